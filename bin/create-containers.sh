@@ -6,8 +6,6 @@ IMAGE=evgenymyasishchev/transactions-fetcher:latest
 
 COMMON_PARAMS="--env-file ${PWD}/env \
               -v ${PWD}/config/fetchers:/go/src/config/fetchers \
-              -v ${PWD}/fetch.sh:/go/src/fetch.sh \
-              -v ${PWD}/sync.sh:/go/src/sync.sh \
               -v ${PWD}/db:/go/src/db \
               ${IMAGE}"
 
@@ -17,13 +15,30 @@ for i in $(docker ps -aq --filter name=transactions-fetcher); do
     docker rm "$i"
 done
 
-docker create --name=transactions-fetcher-fetch \
+docker create --name=transactions-fetcher-run \
               ${COMMON_PARAMS} \
-              ./fetch.sh
+              run
 
-docker create --name=transactions-fetcher-sync \
+docker create --name=transactions-fetcher-daemon \
+              --restart=unless-stopped \
+              -p 127.0.0.1:8080:8080 \
               ${COMMON_PARAMS} \
-              ./sync.sh
+              daemon
+
+# Legacy scripts listing accounts explicitly
+if [ -f "${PWD}/fetch.sh" ]; then
+    docker create --name=transactions-fetcher-fetch \
+                  -v ${PWD}/fetch.sh:/go/src/fetch.sh \
+                  ${COMMON_PARAMS} \
+                  ./fetch.sh
+fi
+
+if [ -f "${PWD}/sync.sh" ]; then
+    docker create --name=transactions-fetcher-sync \
+                  -v ${PWD}/sync.sh:/go/src/sync.sh \
+                  ${COMMON_PARAMS} \
+                  ./sync.sh
+fi
 
 docker create --name=transactions-fetcher-shell \
               ${COMMON_PARAMS} \
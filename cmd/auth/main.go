@@ -4,26 +4,39 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/output"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
 )
 
 var logger = diag.CreateLogger()
 
+type authURLOutput struct {
+	URL string `json:"url"`
+}
+
+type registeredUserOutput struct {
+	Email string `json:"email"`
+}
+
 var cliArgs struct {
 	cmd               string
 	authorizationCode string
+	output            string
 }
 
 func init() {
 	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: auth-url, register-user")
 	flag.StringVar(&cliArgs.authorizationCode, "code", "", "Authorization code obtained by following auth-url instruction")
 
+	flag.StringVar(&cliArgs.output, "output", output.FormatTable, "Output format of results: table or json")
+
 	flag.Parse()
 }
 
@@ -33,7 +46,7 @@ func showHelpAndExit() {
 }
 
 func main() {
-	if cliArgs.cmd == "" {
+	if cliArgs.cmd == "" || output.ValidateFormat(cliArgs.output) != nil {
 		showHelpAndExit()
 	}
 
@@ -53,11 +66,13 @@ func main() {
 
 	switch cliArgs.cmd {
 	case "auth-url":
-		if err := injector(func(oauthClient auth.OAuthClient) {
+		if err := injector(func(oauthClient auth.OAuthClient) error {
 			codeGrantURL := oauthClient.BuildCodeGrantURL()
-			fmt.Println("Paste url below to browser and follow instructions")
-			fmt.Println("Then use exchange-code action")
-			fmt.Println(codeGrantURL)
+			return output.Print(cliArgs.output, authURLOutput{URL: codeGrantURL}, func(w io.Writer) {
+				fmt.Fprintln(w, "Paste url below to browser and follow instructions")
+				fmt.Fprintln(w, "Then use register-user action")
+				fmt.Fprintln(w, codeGrantURL)
+			})
 		}); err != nil {
 			panic(err)
 		}
@@ -66,12 +81,19 @@ func main() {
 			showHelpAndExit()
 		}
 		err := injector(func(authSvc auth.Service) error {
-			return authSvc.RegisterUser(ctx, cliArgs.authorizationCode)
+			email, err := authSvc.RegisterUser(ctx, cliArgs.authorizationCode)
+			if err != nil {
+				return err
+			}
+			logger.Info(ctx, "User registered")
+			return output.Print(cliArgs.output, registeredUserOutput{Email: email}, func(w io.Writer) {
+				fmt.Fprintln(w, "EMAIL")
+				fmt.Fprintln(w, email)
+			})
 		})
 		if err != nil {
 			panic(err)
 		}
-		logger.Info(ctx, "User registered")
 	default:
 		flag.PrintDefaults()
 		os.Exit(1)
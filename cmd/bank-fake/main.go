@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/monoua"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/monoua/monouatest"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/pbanua2x/pbanua2xtest"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+var cliArgs struct {
+	monouaListen    string
+	pbanua2xListen  string
+	data            string
+	monouaRateLimit time.Duration
+}
+
+func init() {
+	flag.StringVar(&cliArgs.monouaListen, "monoua-listen", "localhost:3001", "Address to serve the fake monobank API on")
+	flag.StringVar(&cliArgs.pbanua2xListen, "pbanua2x-listen", "localhost:3002", "Address to serve the fake privat24 merchant API on")
+	flag.StringVar(&cliArgs.data, "data", "", "JSON file with monoua clients and pbanua2x merchants to serve, e.g {\"monoua\":{\"clients\":[]},\"pbanua2x\":{\"merchants\":[]}}")
+	flag.DurationVar(&cliArgs.monouaRateLimit, "monoua-rate-limit", monoua.MinFetchInterval, "Minimal interval between monobank requests of the same token to the same endpoint, 0 to disable")
+
+	flag.Parse()
+}
+
+type fakeData struct {
+	Monoua struct {
+		Clients []monouatest.Client `json:"clients"`
+	} `json:"monoua"`
+	Pbanua2x struct {
+		Merchants []pbanua2xtest.Merchant `json:"merchants"`
+	} `json:"pbanua2x"`
+}
+
+func loadData() (*fakeData, error) {
+	var data fakeData
+	if cliArgs.data == "" {
+		return &data, nil
+	}
+	buffer, err := ioutil.ReadFile(cliArgs.data)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buffer, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func serve(ctx context.Context, name string, listen string, bank http.Handler, done chan<- error) {
+	handler := diag.NewRequestIDMiddleware()(diag.NewLogRequestsMiddleware()(bank))
+	logger.Info(ctx, "Fake %v listening on %v", name, listen)
+	done <- http.ListenAndServe(listen, handler)
+}
+
+func main() {
+	ctx := context.Background()
+
+	data, err := loadData()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load fake banks data")
+		os.Exit(1)
+	}
+
+	done := make(chan error)
+	go serve(ctx, "monoua", cliArgs.monouaListen, monouatest.NewBank(
+		monouatest.WithClients(data.Monoua.Clients...),
+		monouatest.WithRateLimit(cliArgs.monouaRateLimit),
+	), done)
+	go serve(ctx, "pbanua2x", cliArgs.pbanua2xListen, pbanua2xtest.NewBank(
+		pbanua2xtest.WithMerchants(data.Pbanua2x.Merchants...),
+	), done)
+	if err := <-done; err != nil {
+		logger.WithError(err).Error(ctx, "Fake banks failed")
+		os.Exit(1)
+	}
+}
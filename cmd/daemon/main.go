@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/scheduler"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+func newRouter(svc scheduler.Service) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/healthcheck/ping", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("PONG"))
+	})
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(svc.Status()); err != nil {
+			logger.WithError(err).Error(req.Context(), "Failed to write status")
+		}
+	})
+	return diag.NewRequestIDMiddleware()(diag.NewLogRequestsMiddleware()(mux))
+}
+
+func main() {
+	ctx := context.Background()
+
+	appCfg, err := app.LoadConfig()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load app config")
+		os.Exit(1)
+	}
+
+	diag.SetupLoggingSystem(func(setup diag.LoggingSystemSetup) {
+		setup.SetLogLevel(appCfg.Log.Level)
+	})
+
+	injector := app.BootstrapServices(appCfg)
+
+	if err := injector(func(svc scheduler.Service) error {
+		server := &http.Server{Addr: appCfg.Daemon.ListenAddress, Handler: newRouter(svc)}
+		serverErr := make(chan error, 1)
+		go func() {
+			logger.Info(ctx, "Listening on %v", server.Addr)
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				serverErr <- err
+			}
+		}()
+
+		schedulerCtx, stopScheduler := context.WithCancel(ctx)
+		defer stopScheduler()
+		schedulerErr := make(chan error, 1)
+		go func() {
+			schedulerErr <- svc.Run(schedulerCtx)
+		}()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+		var runErr error
+		select {
+		case sig := <-signals:
+			logger.Info(ctx, "Received %v, shutting down", sig)
+			stopScheduler()
+			shutdownTimeout := time.Duration(appCfg.Daemon.ShutdownTimeoutSeconds) * time.Second
+			select {
+			case runErr = <-schedulerErr:
+			case <-time.After(shutdownTimeout):
+				logger.Warn(ctx, "Runs in progress did not complete in %v", shutdownTimeout)
+			}
+		case runErr = <-schedulerErr:
+		case runErr = <-serverErr:
+			stopScheduler()
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.WithError(err).Warn(ctx, "Failed to shutdown http server")
+		}
+		return runErr
+	}); err != nil {
+		logger.WithError(err).Error(ctx, "Daemon failed")
+		os.Exit(1)
+	}
+}
@@ -3,14 +3,16 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"os"
 	"time"
 
-	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/pkg/errors"
 
-	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
-	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/monoua"
-	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/pbanua2x"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/output"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
 
@@ -24,6 +26,10 @@ var cliArgs struct {
 	ledgerAccountID string
 	daysToFetch     int64
 	bank            string
+	from            string
+	to              string
+	dryRun          bool
+	output          string
 }
 
 func showHelpAndExit() {
@@ -34,14 +40,19 @@ func showHelpAndExit() {
 func init() {
 	flag.StringVar(&cliArgs.user, "user", "", "User to fetch transactions for (email)")
 	flag.StringVar(&cliArgs.ledgerAccountID, "acc", "", "Ledger account ID to fetch for")
-	flag.Int64Var(&cliArgs.daysToFetch, "days", 2, "Number of days to fetch transactions for")
-	flag.StringVar(&cliArgs.bank, "bank", "", "Bank code to fetch transactions for")
+	flag.Int64Var(&cliArgs.daysToFetch, "days", 0, "Number of calendar days to fetch transactions for, including the last day of the range. Overrides the account cursor")
+	flag.StringVar(&cliArgs.bank, "bank", "", "Bank code to fetch transactions for. Bank configured for the account is used if not set")
+	flag.StringVar(&cliArgs.from, "from", "", "Fetch transactions starting from given date (YYYY-MM-DD, start of the day in fetch/time-zone) or RFC3339 timestamp. Overrides the account cursor")
+	flag.StringVar(&cliArgs.to, "to", "", "Fetch transactions up to given date (YYYY-MM-DD, the day is included) or RFC3339 timestamp (exclusive). Defaults to now")
+
+	flag.BoolVar(&cliArgs.dryRun, "dry-run", false, "Fetch and print transactions that would be stored as new or skipped as duplicates without writing anything")
+	flag.StringVar(&cliArgs.output, "output", output.FormatTable, "Output format of results: table or json")
 
 	flag.Parse()
 }
 
 func main() {
-	if cliArgs.user == "" || cliArgs.ledgerAccountID == "" || cliArgs.bank == "" {
+	if cliArgs.user == "" || cliArgs.ledgerAccountID == "" || output.ValidateFormat(cliArgs.output) != nil {
 		showHelpAndExit()
 	}
 	ctx := context.Background()
@@ -58,54 +69,69 @@ func main() {
 
 	injector := app.BootstrapServices(appCfg)
 
-	err = injector(func(fetcherConfig banks.FetcherConfig, storage dal.Storage) error {
-		var fetcher banks.Fetcher
-		var err error
-		switch cliArgs.bank {
-		case "pbanua2x":
-			fetcher, err = pbanua2x.NewFetcher(ctx, cliArgs.user, fetcherConfig)
-			if err != nil {
-				return err
+	err = injector(func(fetchSvc fetch.Service, loc *time.Location) error {
+		from, err := fetch.ParseRangeStart(cliArgs.from, loc)
+		if err != nil {
+			return errors.Wrap(err, "Invalid -from value")
+		}
+		to, err := fetch.ParseRangeEnd(cliArgs.to, loc)
+		if err != nil {
+			return errors.Wrap(err, "Invalid -to value")
+		}
+		if from.IsZero() && cliArgs.daysToFetch > 0 {
+			rangeEnd := to
+			if rangeEnd.IsZero() {
+				rangeEnd = time.Now()
 			}
-		case "monoua":
-			fetcher, err = monoua.NewFetcher(ctx, cliArgs.user, fetcherConfig)
+			from = fetch.DaysBack(rangeEnd, int(cliArgs.daysToFetch), loc)
 		}
-		to := time.Now()
-		from := to.Add(time.Duration(-24*cliArgs.daysToFetch) * time.Hour)
-		logger.Info(ctx, "Fetching transactions from %v to %v", from, to)
-		transactions, err := fetcher.Fetch(ctx, &banks.FetchParams{
+
+		params := &fetch.Params{
+			Bank:            cliArgs.bank,
+			UserID:          cliArgs.user,
 			LedgerAccountID: cliArgs.ledgerAccountID,
 			From:            from,
 			To:              to,
-		})
-		if err != nil {
-			return err
 		}
-		for _, trx := range transactions {
-			trxDto, err := trx.ToDTO()
+		if cliArgs.dryRun {
+			report, err := fetchSvc.DryRun(ctx, params)
 			if err != nil {
 				return err
 			}
-			exists, err := storage.PendingTransactionExist(ctx, trxDto.ID)
-			if err != nil {
-				return err
-			}
-			if exists {
-				logger.Debug(ctx, "Ignoring previously fetched transaction: {id=%v; amount=%v}", trxDto.ID, trxDto.Amount)
-				continue
-			} else {
-				logger.Debug(ctx, "Saving transaction: {id=%v; amount=%v}", trxDto.ID, trxDto.Amount)
-				if err := storage.SavePendingTransaction(ctx, trxDto); err != nil {
-					return err
-				}
+			return printDryRun(report)
+		}
+		run, err := fetchSvc.FetchTransactions(ctx, params)
+		if run != nil {
+			if printErr := output.PrintFetchRun(cliArgs.output, run); printErr != nil && err == nil {
+				return printErr
 			}
 		}
-		logger.Info(ctx, "Processed %v transactions", len(transactions))
-		return nil
+		return err
 	})
 
+	if lock.IsLocked(err) {
+		logger.Info(ctx, "Skipping fetch, the account is being fetched by another process: %v", err)
+		return
+	}
 	if err != nil {
 		logger.WithError(err).Error(ctx, "Failed to fetch transactions")
 		os.Exit(1)
 	}
 }
+
+func printDryRun(report *fetch.DryRunReport) error {
+	return output.Print(cliArgs.output, report.Transactions, func(w io.Writer) {
+		fmt.Fprintln(w, "STATUS\tID\tDATE\tTYPE\tAMOUNT\tCOMMENT\tERROR")
+		for _, trx := range report.Transactions {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				trx.Status,
+				trx.ID,
+				trx.Date,
+				trx.TypeID,
+				trx.Amount,
+				trx.Comment,
+				trx.Error,
+			)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// listFlag is a flag that can be set multiple times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var cliArgs struct {
+	cmd       string
+	userID    string
+	accountID string
+	bank      string
+	set       listFlag
+	unset     listFlag
+	skipTest  bool
+}
+
+func init() {
+	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: list, add, update, remove, convert-files")
+	flag.StringVar(&cliArgs.userID, "user", "", "User email. Required for add, update and remove. All users are listed if empty")
+	flag.StringVar(&cliArgs.accountID, "account", "", "Ledger account ID, required for add, update and remove")
+	flag.StringVar(&cliArgs.bank, "bank", "", "Bank of the merchant (pbanua2x or monoua), required for add")
+	flag.Var(&cliArgs.set, "set", "Merchant setting in Key=Value format (e.g ID=123, Password=secret, XToken=token, BankAccount=1234). Can be repeated")
+	flag.Var(&cliArgs.unset, "unset", "Merchant setting to remove, used for update. Can be repeated")
+	flag.BoolVar(&cliArgs.skipTest, "skip-test", false, "Save merchant without doing a test fetch")
+
+	flag.Parse()
+}
+
+func showHelpAndExit() {
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func parseSettings(values []string) (map[string]string, error) {
+	settings := make(map[string]string, len(values))
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Setting should have Key=Value format, got: %v", value)
+		}
+		settings[parts[0]] = parts[1]
+	}
+	return settings, nil
+}
+
+func checkBank(bank string, schemas []banks.MerchantSchema) error {
+	for _, schema := range schemas {
+		if schema.Bank == bank {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown bank: %v", bank)
+}
+
+// testAndSave will test fetch with given merchant settings, secrets are resolved the same way as when fetching
+func testAndSave(
+	ctx context.Context,
+	storage dal.Storage,
+	fetchSvc fetch.Service,
+	merchantOpts []banks.MerchantsFetcherConfigOpt,
+	merchant *dal.FetcherMerchantDTO,
+) error {
+	if !cliArgs.skipTest {
+		fetched, err := fetchSvc.TestFetch(ctx, &fetch.Params{
+			Bank:            merchant.Bank,
+			UserID:          merchant.UserID,
+			LedgerAccountID: merchant.AccountID,
+		}, banks.NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{*merchant}, merchantOpts...))
+		if err != nil {
+			return fmt.Errorf("Test fetch failed, merchant not saved: %v", err)
+		}
+		logger.Info(ctx, "Test fetch succeeded, fetched %v transactions", fetched)
+	}
+	return storage.SaveFetcherMerchant(ctx, merchant)
+}
+
+func main() {
+	if cliArgs.cmd == "" {
+		showHelpAndExit()
+	}
+	ctx := context.Background()
+
+	appCfg, err := app.LoadConfig()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load app config")
+		os.Exit(1)
+	}
+
+	diag.SetupLoggingSystem(func(setup diag.LoggingSystemSetup) {
+		setup.SetLogLevel(appCfg.Log.Level)
+	})
+
+	if appCfg.FetcherConfig.Source != "db" && cliArgs.cmd != "convert-files" {
+		logger.Warn(ctx, "Fetcher config source is %v, merchants stored in db will not be used", appCfg.FetcherConfig.Source)
+	}
+
+	injector := app.BootstrapServices(appCfg)
+
+	switch cliArgs.cmd {
+	case "list":
+		if err := injector(func(storage dal.Storage) error {
+			merchants, err := storage.FindFetcherMerchants(ctx, cliArgs.userID)
+			if err != nil {
+				return err
+			}
+			printMerchants(merchants)
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to list merchants")
+			os.Exit(1)
+		}
+	case "add":
+		if cliArgs.userID == "" || cliArgs.accountID == "" || cliArgs.bank == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(storage dal.Storage, fetchSvc fetch.Service, schemas []banks.MerchantSchema, merchantOpts []banks.MerchantsFetcherConfigOpt) error {
+			if err := checkBank(cliArgs.bank, schemas); err != nil {
+				return err
+			}
+			existing, err := storage.GetFetcherMerchant(ctx, cliArgs.userID, cliArgs.accountID)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				return fmt.Errorf("Merchant already exists: %v, %v", cliArgs.userID, cliArgs.accountID)
+			}
+			settings, err := parseSettings(cliArgs.set)
+			if err != nil {
+				return err
+			}
+			return testAndSave(ctx, storage, fetchSvc, merchantOpts, &dal.FetcherMerchantDTO{
+				UserID:    cliArgs.userID,
+				AccountID: cliArgs.accountID,
+				Bank:      cliArgs.bank,
+				Settings:  settings,
+			})
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to add merchant")
+			os.Exit(1)
+		}
+		logger.Info(ctx, "Merchant added: %v, %v", cliArgs.userID, cliArgs.accountID)
+	case "update":
+		if cliArgs.userID == "" || cliArgs.accountID == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(storage dal.Storage, fetchSvc fetch.Service, schemas []banks.MerchantSchema, merchantOpts []banks.MerchantsFetcherConfigOpt) error {
+			merchant, err := storage.GetFetcherMerchant(ctx, cliArgs.userID, cliArgs.accountID)
+			if err != nil {
+				return err
+			}
+			if merchant == nil {
+				return fmt.Errorf("Merchant not found: %v, %v", cliArgs.userID, cliArgs.accountID)
+			}
+			settings, err := parseSettings(cliArgs.set)
+			if err != nil {
+				return err
+			}
+			for key, value := range settings {
+				merchant.Settings[key] = value
+			}
+			for _, key := range cliArgs.unset {
+				delete(merchant.Settings, key)
+			}
+			if cliArgs.bank != "" {
+				if err := checkBank(cliArgs.bank, schemas); err != nil {
+					return err
+				}
+				merchant.Bank = cliArgs.bank
+			}
+			return testAndSave(ctx, storage, fetchSvc, merchantOpts, merchant)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to update merchant")
+			os.Exit(1)
+		}
+		logger.Info(ctx, "Merchant updated: %v, %v", cliArgs.userID, cliArgs.accountID)
+	case "remove":
+		if cliArgs.userID == "" || cliArgs.accountID == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(storage dal.Storage) error {
+			return storage.DeleteFetcherMerchant(ctx, cliArgs.userID, cliArgs.accountID)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to remove merchant")
+			os.Exit(1)
+		}
+		logger.Info(ctx, "Merchant removed: %v, %v", cliArgs.userID, cliArgs.accountID)
+	case "convert-files":
+		if err := injector(func(schemas []banks.MerchantSchema) error {
+			converter := banks.NewFSFetcherConfig(appCfg.FetcherConfig.ConfigDir).(banks.LegacyConfigConverter)
+			converted, err := converter.ConvertLegacyConfigs(ctx, schemas)
+			if err != nil {
+				return err
+			}
+			logger.Info(ctx, "Converted %v legacy config files", converted)
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to convert config files")
+			os.Exit(1)
+		}
+
+	default:
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+}
+
+func printMerchants(merchants []dal.FetcherMerchantDTO) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tACCOUNT\tBANK\tSETTINGS\tUPDATED")
+	for _, merchant := range merchants {
+		// Only setting names are shown to not leak credentials
+		keys := make([]string, 0, len(merchant.Settings))
+		for key := range merchant.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n",
+			merchant.UserID,
+			merchant.AccountID,
+			merchant.Bank,
+			strings.Join(keys, ", "),
+			merchant.UpdatedAt.Local().Format(time.RFC3339),
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger/ledgertest"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+var cliArgs struct {
+	listen       string
+	data         string
+	idTokens     string
+	withoutBatch bool
+}
+
+func init() {
+	flag.StringVar(&cliArgs.listen, "listen", "localhost:3000", "Address to listen on")
+	flag.StringVar(&cliArgs.data, "data", "", "JSON file with accounts and transactions to serve, same shape as GET /_fake/state")
+	flag.StringVar(&cliArgs.idTokens, "id-tokens", "", "Comma separated ID tokens accepted to start a session, any token is accepted if not set")
+	flag.BoolVar(&cliArgs.withoutBatch, "without-batch", false, "Respond with 404 to batch reports like older ledger versions")
+
+	flag.Parse()
+}
+
+func loadOpts() ([]ledgertest.LedgerOpt, error) {
+	opts := []ledgertest.LedgerOpt{}
+	if cliArgs.idTokens != "" {
+		opts = append(opts, ledgertest.WithIDTokens(strings.Split(cliArgs.idTokens, ",")...))
+	}
+	if cliArgs.withoutBatch {
+		opts = append(opts, ledgertest.WithoutBatchReports())
+	}
+	if cliArgs.data == "" {
+		return opts, nil
+	}
+	buffer, err := ioutil.ReadFile(cliArgs.data)
+	if err != nil {
+		return nil, err
+	}
+	var data ledgertest.State
+	if err := json.Unmarshal(buffer, &data); err != nil {
+		return nil, err
+	}
+	return append(opts,
+		ledgertest.WithAccounts(data.Accounts...),
+		ledgertest.WithTransactions(data.Transactions...),
+	), nil
+}
+
+func main() {
+	ctx := context.Background()
+
+	opts, err := loadOpts()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load fake ledger data")
+		os.Exit(1)
+	}
+	handler := diag.NewRequestIDMiddleware()(diag.NewLogRequestsMiddleware()(ledgertest.NewLedger(opts...)))
+	logger.Info(ctx, "Fake ledger listening on %v", cliArgs.listen)
+	if err := http.ListenAndServe(cliArgs.listen, handler); err != nil {
+		logger.WithError(err).Error(ctx, "Fake ledger failed")
+		os.Exit(1)
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"time"
-
-	"github.com/pkg/errors"
-
-	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/output"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
@@ -21,16 +21,57 @@ import (
 
 var logger = diag.CreateLogger()
 
+type accountOutput struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+	Type     string `json:"type"`
+	Closed   bool   `json:"closed"`
+}
+
+type duplicateOutput struct {
+	TransactionID string `json:"transaction_id"`
+	LedgerID      string `json:"ledger_id"`
+	Fuzzy         bool   `json:"fuzzy"`
+}
+
+type syncReportOutput struct {
+	AccountID    string            `json:"account_id"`
+	Synced       int               `json:"synced"`
+	Failed       int               `json:"failed"`
+	DeadLettered int               `json:"dead_lettered"`
+	Skipped      int               `json:"skipped"`
+	Flagged      int               `json:"flagged"`
+	Duplicates   []duplicateOutput `json:"duplicates"`
+}
+
+type userSyncReportOutput struct {
+	UserID       string             `json:"user_id"`
+	Synced       int                `json:"synced"`
+	Failed       int                `json:"failed"`
+	DeadLettered int                `json:"dead_lettered"`
+	Skipped      int                `json:"skipped"`
+	Flagged      int                `json:"flagged"`
+	Accounts     []syncReportOutput `json:"accounts"`
+	Locked       []string           `json:"locked"`
+	Closed       []string           `json:"closed"`
+}
+
 var cliArgs struct {
 	cmd       string
 	user      string
 	accountID string
+	dryRun    bool
+	output    string
 }
 
 func init() {
 	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: accounts, sync")
 	flag.StringVar(&cliArgs.user, "user", "", "Valid ledger user email")
-	flag.StringVar(&cliArgs.accountID, "account", "", "Valid ledger account, used for sync")
+	flag.StringVar(&cliArgs.accountID, "account", "", "Valid ledger account, used for sync. All accounts of the user with pending transactions are synced if not set")
+
+	flag.BoolVar(&cliArgs.dryRun, "dry-run", false, "Print transactions that would be reported to ledger without reporting them, used for sync")
+	flag.StringVar(&cliArgs.output, "output", output.FormatTable, "Output format of results: table or json")
 
 	flag.Parse()
 }
@@ -42,7 +83,7 @@ func showHelpAndExit() {
 
 func main() {
 	ctx := context.Background()
-	if cliArgs.user == "" || cliArgs.cmd == "" {
+	if cliArgs.user == "" || cliArgs.cmd == "" || output.ValidateFormat(cliArgs.output) != nil {
 		showHelpAndExit()
 	}
 
@@ -60,12 +101,10 @@ func main() {
 
 	switch cliArgs.cmd {
 	case "accounts":
-		if err := injector(func(authSvc auth.Service) error {
-			idToken, err := authSvc.FetchAuthToken(ctx, cliArgs.user)
-			if err != nil {
-				return err
-			}
-			api, err := ledger.NewAPI(ctx, appCfg.Ledger.API, idToken)
+		if err := injector(func(authSvc auth.Service, apiFactory ledger.APIFactory) error {
+			api, err := apiFactory(ctx, appCfg.Ledger.API, cliArgs.user, func(ctx context.Context) (types.IDToken, error) {
+				return authSvc.FetchAuthToken(ctx, cliArgs.user)
+			})
 			if err != nil {
 				return err
 			}
@@ -73,60 +112,39 @@ func main() {
 			if err != nil {
 				return err
 			}
-			for _, acc := range accounts {
-				fmt.Println(acc)
-			}
-			return nil
+			return printAccounts(accounts)
 		}); err != nil {
 			logger.WithError(err).Error(ctx, "Failed to list accounts")
 			os.Exit(1)
 		}
 	case "sync":
-		if cliArgs.accountID == "" {
-			showHelpAndExit()
-		}
-		if err := injector(func(authSvc auth.Service, storage dal.Storage) error {
-			notSyncedTrxs, err := storage.FindNotSyncedTransactions(ctx, cliArgs.accountID)
-			if err != nil {
-				return err
-			}
-			if len(notSyncedTrxs) == 0 {
-				logger.Info(ctx, "No pending transactions to sync")
-				return nil
-			}
-
-			logger.Info(ctx, "Got %v pending transactions to sync", len(notSyncedTrxs))
-
-			idToken, err := authSvc.FetchAuthToken(ctx, cliArgs.user)
-			if err != nil {
-				return err
+		if err := injector(func(syncSvc ledgersync.Service) error {
+			if cliArgs.dryRun {
+				trxs, err := syncSvc.DryRun(ctx, cliArgs.user, cliArgs.accountID)
+				if err != nil {
+					return err
+				}
+				return printDryRun(trxs)
 			}
-			api, err := ledger.NewAPI(ctx, appCfg.Ledger.API, idToken)
-			if err != nil {
+			if cliArgs.accountID == "" {
+				userReport, err := syncSvc.SyncUserTransactions(ctx, cliArgs.user)
+				if userReport != nil {
+					if printErr := printUserSyncReport(userReport); printErr != nil && err == nil {
+						return printErr
+					}
+				}
 				return err
 			}
-
-			for _, trx := range notSyncedTrxs {
-				err := api.ReportPendingTransaction(ctx, ledger.PendingTransactionDTO{
-					ID:        trx.ID,
-					Amount:    trx.Amount,
-					Date:      trx.Date,
-					Comment:   trx.Comment,
-					AccountID: trx.AccountID,
-					TypeID:    trx.TypeID,
-				})
-				if err != nil {
-					return errors.Wrapf(err, "Failed to report pending trx: %v", trx.ID)
-				}
-				syncedAt := time.Now().UTC()
-				trx.SyncedAt = &syncedAt
-				if err := storage.SavePendingTransaction(ctx, &trx); err != nil {
-					return errors.Wrapf(err, "Failed to mark pending transaction '%v' as synced", trx.ID)
+			report, err := syncSvc.SyncTransactions(ctx, cliArgs.user, cliArgs.accountID)
+			if report != nil && !lock.IsLocked(err) {
+				if printErr := printSyncReport(report); printErr != nil && err == nil {
+					return printErr
 				}
 			}
-
-			return nil
-		}); err != nil {
+			return err
+		}); lock.IsLocked(err) {
+			logger.Info(ctx, "Skipping sync, the account is being synced by another process: %v", err)
+		} else if err != nil {
 			logger.WithError(err).Error(ctx, "Failed to sync transactions")
 			os.Exit(1)
 		}
@@ -136,3 +154,128 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func printDryRun(trxs []ledgersync.DryRunTransaction) error {
+	return output.Print(cliArgs.output, trxs, func(w io.Writer) {
+		fmt.Fprintln(w, "ACTION\tID\tACCOUNT\tDATE\tTYPE\tAMOUNT\tCOMMENT\tREASON")
+		for _, trx := range trxs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				trx.Action,
+				trx.ID,
+				trx.AccountID,
+				trx.Date,
+				trx.TypeID,
+				trx.Amount,
+				trx.Comment,
+				trx.Reason,
+			)
+		}
+	})
+}
+
+func printAccounts(accounts []ledger.AccountDTO) error {
+	result := make([]accountOutput, 0, len(accounts))
+	for _, acc := range accounts {
+		result = append(result, accountOutput{
+			ID:       acc.ID,
+			Name:     acc.Name,
+			Currency: acc.Currency,
+			Type:     acc.Type,
+			Closed:   acc.Closed,
+		})
+	}
+	return output.Print(cliArgs.output, result, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tNAME\tCURRENCY\tTYPE\tSTATUS")
+		for _, acc := range accounts {
+			status := "open"
+			if acc.Closed {
+				status = "closed"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", acc.ID, acc.Name, acc.Currency, acc.Type, status)
+		}
+	})
+}
+
+func newSyncReportOutput(report *ledgersync.Report) syncReportOutput {
+	result := syncReportOutput{
+		AccountID:    report.AccountID,
+		Synced:       report.Synced,
+		Failed:       report.Failed,
+		DeadLettered: report.DeadLettered,
+		Skipped:      report.Skipped,
+		Flagged:      report.Flagged,
+		Duplicates:   make([]duplicateOutput, 0, len(report.Duplicates)),
+	}
+	for _, duplicate := range report.Duplicates {
+		result.Duplicates = append(result.Duplicates, duplicateOutput{
+			TransactionID: duplicate.TransactionID,
+			LedgerID:      duplicate.LedgerID,
+			Fuzzy:         duplicate.Fuzzy,
+		})
+	}
+	return result
+}
+
+// writeDuplicatesTable will list duplicates below the report table if there are any
+func writeDuplicatesTable(w io.Writer, duplicates []ledgersync.Duplicate) {
+	if len(duplicates) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "DUPLICATE\tLEDGER ID\tACTION")
+	for _, duplicate := range duplicates {
+		action := "skipped"
+		if duplicate.Fuzzy {
+			action = "flagged"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", duplicate.TransactionID, duplicate.LedgerID, action)
+	}
+}
+
+func printSyncReport(report *ledgersync.Report) error {
+	result := newSyncReportOutput(report)
+	return output.Print(cliArgs.output, result, func(w io.Writer) {
+		fmt.Fprintln(w, "ACCOUNT\tSYNCED\tFAILED\tDEAD LETTERED\tSKIPPED\tFLAGGED")
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n",
+			report.AccountID, report.Synced, report.Failed, report.DeadLettered, report.Skipped, report.Flagged)
+		writeDuplicatesTable(w, report.Duplicates)
+	})
+}
+
+func printUserSyncReport(userReport *ledgersync.UserReport) error {
+	totals := userReport.Totals()
+	result := userSyncReportOutput{
+		UserID:       userReport.UserID,
+		Synced:       totals.Synced,
+		Failed:       totals.Failed,
+		DeadLettered: totals.DeadLettered,
+		Skipped:      totals.Skipped,
+		Flagged:      totals.Flagged,
+		Accounts:     make([]syncReportOutput, 0, len(userReport.Accounts)),
+		Locked:       userReport.Locked,
+		Closed:       userReport.Closed,
+	}
+	for _, report := range userReport.Accounts {
+		result.Accounts = append(result.Accounts, newSyncReportOutput(report))
+	}
+	return output.Print(cliArgs.output, result, func(w io.Writer) {
+		fmt.Fprintln(w, "ACCOUNT\tSTATUS\tSYNCED\tFAILED\tDEAD LETTERED\tSKIPPED\tFLAGGED")
+		for _, report := range userReport.Accounts {
+			status := "ok"
+			if report.Failed > 0 {
+				status = "failed"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				report.AccountID, status, report.Synced, report.Failed, report.DeadLettered, report.Skipped, report.Flagged)
+		}
+		for _, accountID := range userReport.Locked {
+			fmt.Fprintf(w, "%v\t%v\t\t\t\t\t\n", accountID, "locked")
+		}
+		for _, accountID := range userReport.Closed {
+			fmt.Fprintf(w, "%v\t%v\t\t\t\t\t\n", accountID, "closed")
+		}
+		fmt.Fprintf(w, "%v\t\t%v\t%v\t%v\t%v\t%v\n",
+			"TOTAL", totals.Synced, totals.Failed, totals.DeadLettered, totals.Skipped, totals.Flagged)
+		writeDuplicatesTable(w, totals.Duplicates)
+	})
+}
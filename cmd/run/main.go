@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/runner"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+var cliArgs struct {
+	user string
+}
+
+func init() {
+	flag.StringVar(&cliArgs.user, "user", "", "User email to fetch and sync accounts of. All configured users if empty")
+
+	flag.Parse()
+}
+
+func main() {
+	ctx := context.Background()
+
+	appCfg, err := app.LoadConfig()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load app config")
+		os.Exit(1)
+	}
+
+	diag.SetupLoggingSystem(func(setup diag.LoggingSystemSetup) {
+		setup.SetLogLevel(appCfg.Log.Level)
+	})
+
+	injector := app.BootstrapServices(appCfg)
+
+	params := &runner.Params{}
+	if cliArgs.user != "" {
+		params.UserIDs = []string{cliArgs.user}
+	}
+
+	var failed int
+	if err := injector(func(svc runner.Service) error {
+		results, err := svc.Run(ctx, params)
+		if err != nil {
+			return err
+		}
+		printResults(results)
+		for _, result := range results {
+			if result.Failed() {
+				failed++
+			}
+		}
+		return nil
+	}); err != nil {
+		logger.WithError(err).Error(ctx, "Failed to run")
+		os.Exit(1)
+	}
+	if failed > 0 {
+		logger.Error(ctx, "Failed to process %v accounts", failed)
+		os.Exit(1)
+	}
+}
+
+func printResults(results []runner.AccountResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tACCOUNT\tBANK\tFETCHED\tNEW\tDUPLICATE\tFETCH FAILED\tSYNCED\tSYNC FAILED\tDEAD LETTERED\tSTATUS\tERROR")
+	for _, result := range results {
+		var fetched, fresh, duplicate, fetchFailed int
+		if result.Fetch != nil {
+			fetched, fresh, duplicate, fetchFailed = result.Fetch.Fetched, result.Fetch.New, result.Fetch.Duplicate, result.Fetch.Failed
+		}
+		var synced, syncFailed, deadLettered int
+		if result.Sync != nil {
+			synced, syncFailed, deadLettered = result.Sync.Synced, result.Sync.Failed, result.Sync.DeadLettered
+		}
+		status := "ok"
+		if result.Failed() {
+			status = "failed"
+		} else if result.Locked() {
+			status = "locked"
+		}
+		errMsg := ""
+		if result.FetchError != nil {
+			errMsg = result.FetchError.Error()
+		}
+		if result.SyncError != nil {
+			if errMsg != "" {
+				errMsg += "; "
+			}
+			errMsg += result.SyncError.Error()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			result.UserID,
+			result.AccountID,
+			result.Bank,
+			fetched,
+			fresh,
+			duplicate,
+			fetchFailed,
+			synced,
+			syncFailed,
+			deadLettered,
+			status,
+			errMsg,
+		)
+	}
+	w.Flush()
+}
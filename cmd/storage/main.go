@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/output"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
+	"github.com/pkg/errors"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
 
@@ -14,12 +22,48 @@ import (
 
 var logger = diag.CreateLogger()
 
+type deadLetteredTransactionOutput struct {
+	ID            string `json:"id"`
+	AccountID     string `json:"account_id"`
+	Date          string `json:"date"`
+	TypeID        uint8  `json:"type_id"`
+	Amount        string `json:"amount"`
+	Comment       string `json:"comment"`
+	SyncAttempts  int    `json:"sync_attempts"`
+	LastSyncError string `json:"last_sync_error"`
+}
+
+type generatedKeyOutput struct {
+	Key string `json:"key"`
+}
+
+type encryptedValueOutput struct {
+	Value string `json:"value"`
+}
+
+type rotatedSecretsOutput struct {
+	// UsersAndMerchants also counts ledger sessions, the name is kept for compatibility
+	UsersAndMerchants int `json:"users_and_merchants"`
+	FetcherConfigs    int `json:"fetcher_configs"`
+}
+
 var cliArgs struct {
-	cmd string
+	cmd       string
+	limit     int
+	accountID string
+	trxID     string
+	keyID     string
+	output    string
 }
 
 func init() {
-	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: setup")
+	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: setup, runs, dead-letters, requeue, generate-key, encrypt, rotate-key")
+	flag.IntVar(&cliArgs.limit, "limit", 20, "Number of recent fetch runs to show, used for runs")
+	flag.StringVar(&cliArgs.accountID, "account", "", "Ledger account to show dead lettered transactions for, all if empty")
+	flag.StringVar(&cliArgs.trxID, "id", "", "Dead lettered transaction ID, used for requeue")
+	flag.StringVar(&cliArgs.keyID, "key-id", "", "ID of a new master key, used for generate-key")
+
+	flag.StringVar(&cliArgs.output, "output", output.FormatTable, "Output format of results: table or json")
 
 	flag.Parse()
 }
@@ -30,7 +74,7 @@ func showHelpAndExit() {
 }
 
 func main() {
-	if cliArgs.cmd == "" {
+	if cliArgs.cmd == "" || output.ValidateFormat(cliArgs.output) != nil {
 		showHelpAndExit()
 	}
 	ctx := context.Background()
@@ -54,9 +98,151 @@ func main() {
 		}); err != nil {
 			panic(err)
 		}
+	case "runs":
+		if err := injector(func(storage dal.Storage) error {
+			runs, err := storage.FindRecentFetchRuns(ctx, cliArgs.limit)
+			if err != nil {
+				return err
+			}
+			return output.PrintFetchRuns(cliArgs.output, runs)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to list fetch runs")
+			os.Exit(1)
+		}
+	case "dead-letters":
+		if err := injector(func(storage dal.Storage) error {
+			trxs, err := storage.FindDeadLetteredTransactions(ctx, cliArgs.accountID)
+			if err != nil {
+				return err
+			}
+			return printTransactions(trxs)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to list dead lettered transactions")
+			os.Exit(1)
+		}
+	case "requeue":
+		if cliArgs.trxID == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(storage dal.Storage) error {
+			return storage.RequeueDeadLetteredTransaction(ctx, cliArgs.trxID)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to requeue transaction")
+			os.Exit(1)
+		}
+		logger.Info(ctx, "Transaction %v requeued", cliArgs.trxID)
+	case "generate-key":
+		if cliArgs.keyID == "" {
+			showHelpAndExit()
+		}
+		key, err := secrets.GenerateMasterKey(cliArgs.keyID)
+		if err != nil {
+			logger.WithError(err).Error(ctx, "Failed to generate master key")
+			os.Exit(1)
+		}
+		if err := output.Print(cliArgs.output, generatedKeyOutput{Key: key.String()}, func(w io.Writer) {
+			fmt.Fprintln(w, key)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to print master key")
+			os.Exit(1)
+		}
+	case "encrypt":
+		value, err := readValue(os.Stdin, os.Stderr)
+		if err != nil {
+			logger.WithError(err).Error(ctx, "Failed to read value to encrypt")
+			os.Exit(1)
+		}
+		if err := injector(func(cipher secrets.Cipher) error {
+			encrypted, err := cipher.Encrypt(value)
+			if err != nil {
+				return err
+			}
+			if !secrets.IsEncrypted(encrypted) {
+				return errors.New("No master keys configured")
+			}
+			return output.Print(cliArgs.output, encryptedValueOutput{Value: encrypted}, func(w io.Writer) {
+				fmt.Fprintln(w, encrypted)
+			})
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to encrypt value")
+			os.Exit(1)
+		}
+	case "rotate-key":
+		if err := injector(func(storage dal.Storage, fetcherConfig banks.FetcherConfig) error {
+			var result rotatedSecretsOutput
+			rotated, err := storage.RotateSecrets(ctx)
+			if err != nil {
+				return err
+			}
+			result.UsersAndMerchants = rotated
+			logger.Info(ctx, "Rotated secrets of %v users, merchants and ledger sessions", rotated)
+			if rotator, ok := fetcherConfig.(banks.SecretsRotator); ok {
+				rotated, err = rotator.RotateSecrets(ctx)
+				if err != nil {
+					return err
+				}
+				result.FetcherConfigs = rotated
+				logger.Info(ctx, "Rotated secrets of %v fetcher configs", rotated)
+			}
+			return output.Print(cliArgs.output, result, func(w io.Writer) {
+				fmt.Fprintln(w, "USERS AND MERCHANTS\tFETCHER CONFIGS")
+				fmt.Fprintf(w, "%v\t%v\n", result.UsersAndMerchants, result.FetcherConfigs)
+			})
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to rotate secrets")
+			os.Exit(1)
+		}
 
 	default:
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 }
+
+// readValue reads a single line from stdin, so secrets do not end up in shell
+// history or process list. A prompt is shown if stdin is a terminal
+func readValue(stdin *os.File, prompt io.Writer) (string, error) {
+	if info, err := stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(prompt, "Value to encrypt: ")
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	value := strings.TrimRight(line, "\r\n")
+	if value == "" {
+		return "", errors.New("Value to encrypt is empty")
+	}
+	return value, nil
+}
+
+func printTransactions(trxs []dal.PendingTransactionDTO) error {
+	result := make([]deadLetteredTransactionOutput, 0, len(trxs))
+	for _, trx := range trxs {
+		result = append(result, deadLetteredTransactionOutput{
+			ID:            trx.ID,
+			AccountID:     trx.AccountID,
+			Date:          trx.Date,
+			TypeID:        trx.TypeID,
+			Amount:        trx.Amount,
+			Comment:       trx.Comment,
+			SyncAttempts:  trx.SyncAttempts,
+			LastSyncError: trx.LastSyncError,
+		})
+	}
+	return output.Print(cliArgs.output, result, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tACCOUNT\tDATE\tTYPE\tAMOUNT\tCOMMENT\tATTEMPTS\tLAST ERROR")
+		for _, trx := range trxs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				trx.ID,
+				trx.AccountID,
+				trx.Date,
+				trx.TypeID,
+				trx.Amount,
+				trx.Comment,
+				trx.SyncAttempts,
+				trx.LastSyncError,
+			)
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/pending"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+var cliArgs struct {
+	cmd       string
+	user      string
+	id        string
+	accountID string
+	status    string
+	search    string
+	limit     int
+	reason    string
+	amount    string
+	comment   string
+	date      string
+	trxType   string
+}
+
+var transactionTypes = map[string]uint8{
+	"income":  ledger.TransactionTypeIncome,
+	"expense": ledger.TransactionTypeExpense,
+}
+
+func init() {
+	flag.StringVar(&cliArgs.cmd, "cmd", "", "Command to run. Available commands: list, history, ignore, unignore, confirm, edit, add")
+	flag.StringVar(&cliArgs.user, "user", "", "User (email) the transaction belongs to, used for add. Needed to sync it with all accounts of the user")
+	flag.StringVar(&cliArgs.id, "id", "", "Transaction ID, used for history, ignore, unignore, confirm and edit")
+	flag.StringVar(&cliArgs.accountID, "account", "", "Ledger account ID, used for list and add")
+	flag.StringVar(&cliArgs.status, "status", "", "Transaction status to list: not-synced, synced, ignored, dead-lettered. All if empty")
+	flag.StringVar(&cliArgs.search, "search", "", "Text to search in comments, used for list")
+	flag.IntVar(&cliArgs.limit, "limit", 50, "Max number of transactions to list")
+	flag.StringVar(&cliArgs.reason, "reason", "", "Why the transaction is ignored, used for ignore")
+	flag.StringVar(&cliArgs.amount, "amount", "", "Transaction amount, used for edit and add")
+	flag.StringVar(&cliArgs.comment, "comment", "", "Transaction comment, used for edit and add")
+	flag.StringVar(&cliArgs.date, "date", "", "Transaction date (YYYY-MM-DD or RFC3339), used for edit and add. Now if not set for add")
+	flag.StringVar(&cliArgs.trxType, "type", "", "Transaction type: income or expense, used for edit and add")
+
+	flag.Parse()
+}
+
+func showHelpAndExit() {
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func parseTypeID(trxType string) (uint8, error) {
+	typeID, ok := transactionTypes[trxType]
+	if !ok {
+		return 0, fmt.Errorf("Unexpected transaction type: %v", trxType)
+	}
+	return typeID, nil
+}
+
+func main() {
+	if cliArgs.cmd == "" {
+		showHelpAndExit()
+	}
+	ctx := context.Background()
+
+	appCfg, err := app.LoadConfig()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load app config")
+		os.Exit(1)
+	}
+
+	diag.SetupLoggingSystem(func(setup diag.LoggingSystemSetup) {
+		setup.SetLogLevel(appCfg.Log.Level)
+	})
+
+	injector := app.BootstrapServices(appCfg)
+
+	switch cliArgs.cmd {
+	case "list":
+		if err := injector(func(storage dal.Storage) error {
+			trxs, err := storage.FindPendingTransactions(ctx, dal.PendingTransactionsFilter{
+				AccountID: cliArgs.accountID,
+				Status:    cliArgs.status,
+				Comment:   cliArgs.search,
+				Limit:     cliArgs.limit,
+			})
+			if err != nil {
+				return err
+			}
+			printTransactions(trxs)
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to list transactions")
+			os.Exit(1)
+		}
+	case "history":
+		if cliArgs.id == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(storage dal.Storage) error {
+			changes, err := storage.FindTransactionChanges(ctx, cliArgs.id)
+			if err != nil {
+				return err
+			}
+			printChanges(changes)
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to get transaction history")
+			os.Exit(1)
+		}
+	case "ignore":
+		if cliArgs.id == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(svc pending.Service) error {
+			return svc.Ignore(ctx, cliArgs.id, cliArgs.reason)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to ignore transaction")
+			os.Exit(1)
+		}
+	case "unignore":
+		if cliArgs.id == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(svc pending.Service) error {
+			return svc.Unignore(ctx, cliArgs.id)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to unignore transaction")
+			os.Exit(1)
+		}
+	case "confirm":
+		if cliArgs.id == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(svc pending.Service) error {
+			return svc.Confirm(ctx, cliArgs.id)
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to confirm transaction")
+			os.Exit(1)
+		}
+	case "edit":
+		if cliArgs.id == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(svc pending.Service) error {
+			edit := pending.Edit{}
+			if isFlagSet("amount") {
+				edit.Amount = &cliArgs.amount
+			}
+			if isFlagSet("comment") {
+				edit.Comment = &cliArgs.comment
+			}
+			if isFlagSet("date") {
+				edit.Date = &cliArgs.date
+			}
+			if isFlagSet("type") {
+				typeID, err := parseTypeID(cliArgs.trxType)
+				if err != nil {
+					return err
+				}
+				edit.TypeID = &typeID
+			}
+			trx, err := svc.Edit(ctx, cliArgs.id, edit)
+			if err != nil {
+				return err
+			}
+			printTransactions([]dal.PendingTransactionDTO{*trx})
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to edit transaction")
+			os.Exit(1)
+		}
+	case "add":
+		if cliArgs.accountID == "" || cliArgs.amount == "" || cliArgs.trxType == "" {
+			showHelpAndExit()
+		}
+		if err := injector(func(svc pending.Service) error {
+			typeID, err := parseTypeID(cliArgs.trxType)
+			if err != nil {
+				return err
+			}
+			trx, err := svc.AddManual(ctx, pending.ManualTransaction{
+				UserID:    cliArgs.user,
+				AccountID: cliArgs.accountID,
+				Amount:    cliArgs.amount,
+				Comment:   cliArgs.comment,
+				Date:      cliArgs.date,
+				TypeID:    typeID,
+			})
+			if err != nil {
+				return err
+			}
+			printTransactions([]dal.PendingTransactionDTO{*trx})
+			return nil
+		}); err != nil {
+			logger.WithError(err).Error(ctx, "Failed to add transaction")
+			os.Exit(1)
+		}
+	default:
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+}
+
+func printTransactions(trxs []dal.PendingTransactionDTO) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tACCOUNT\tDATE\tTYPE\tAMOUNT\tSTATUS\tCOMMENT")
+	for _, trx := range trxs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			trx.ID,
+			trx.AccountID,
+			trx.Date,
+			trx.TypeID,
+			trx.Amount,
+			trx.Status(),
+			trx.Comment,
+		)
+	}
+	w.Flush()
+}
+
+func printChanges(changes []dal.TransactionChangeDTO) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGED\tACTION\tDETAILS")
+	for _, change := range changes {
+		fmt.Fprintf(w, "%v\t%v\t%v\n",
+			change.ChangedAt.Local().Format(time.RFC3339),
+			change.Action,
+			change.Details,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/configcheck"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/output"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/app"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+var cliArgs struct {
+	user       string
+	skipLedger bool
+	output     string
+}
+
+type issueOutput struct {
+	UserID    string `json:"user_id"`
+	AccountID string `json:"account_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+func init() {
+	flag.StringVar(&cliArgs.user, "user", "", "User email to validate config of. All users are validated if empty")
+	flag.BoolVar(&cliArgs.skipLedger, "skip-ledger", false, "Do not check that configured ledger accounts exist")
+	flag.StringVar(&cliArgs.output, "output", output.FormatTable, "Output format of issues: table or json")
+
+	flag.Parse()
+}
+
+func printIssues(issues []banks.ConfigIssue) error {
+	result := make([]issueOutput, 0, len(issues))
+	for _, issue := range issues {
+		result = append(result, issueOutput{
+			UserID:    issue.UserID,
+			AccountID: issue.AccountID,
+			Message:   issue.Message,
+		})
+	}
+	return output.Print(cliArgs.output, result, func(w io.Writer) {
+		if len(issues) == 0 {
+			return
+		}
+		fmt.Fprintln(w, "USER\tACCOUNT\tMESSAGE")
+		for _, issue := range issues {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", issue.UserID, issue.AccountID, issue.Message)
+		}
+	})
+}
+
+func main() {
+	if output.ValidateFormat(cliArgs.output) != nil {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	ctx := context.Background()
+
+	appCfg, err := app.LoadConfig()
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to load app config")
+		os.Exit(1)
+	}
+
+	diag.SetupLoggingSystem(func(setup diag.LoggingSystemSetup) {
+		setup.SetLogLevel(appCfg.Log.Level)
+	})
+
+	injector := app.BootstrapServices(appCfg)
+
+	params := &configcheck.Params{CheckLedgerAccounts: !cliArgs.skipLedger}
+	if cliArgs.user != "" {
+		params.UserIDs = []string{cliArgs.user}
+	}
+
+	var issuesCount int
+	if err := injector(func(svc configcheck.Service) error {
+		issues, err := svc.Validate(ctx, params)
+		if err != nil {
+			return err
+		}
+		issuesCount = len(issues)
+		return printIssues(issues)
+	}); err != nil {
+		logger.WithError(err).Error(ctx, "Failed to validate config")
+		os.Exit(1)
+	}
+	if issuesCount > 0 {
+		logger.Error(ctx, "Found %v config issues", issuesCount)
+		os.Exit(1)
+	}
+	logger.Info(ctx, "No config issues found")
+}
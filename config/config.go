@@ -19,12 +19,99 @@ type Storage struct {
 
 // FetcherConfig represents settings of a fetcher-config service
 type FetcherConfig struct {
+	// Source is where user fetcher configs are stored: fs (files in ConfigDir) or db
+	Source    string `config:"key=fetcher-config/source"`
 	ConfigDir string `config:"key=fetcher-config/config-dir"`
 }
 
+// Fetch represents transactions fetching settings
+type Fetch struct {
+	// OverlapMinutes is how far back from the account cursor to resume fetching
+	OverlapMinutes int `config:"key=fetch/overlap-minutes"`
+
+	// InitialDays is how many days to fetch for accounts without a cursor
+	InitialDays int `config:"key=fetch/initial-days"`
+
+	// TimeZone is an IANA time zone of users (e.g Europe/Kiev), dates are calendar days of the zone
+	TimeZone string `config:"key=fetch/time-zone"`
+}
+
+// Banks represents settings of bank APIs, e.g to fetch from fake banks in development
+type Banks struct {
+	MonouaAPIURL   string `config:"key=banks/monoua-api-url"`
+	Pbanua2xAPIURL string `config:"key=banks/pbanua2x-api-url"`
+}
+
+// Sync represents settings of reporting transactions to ledger
+type Sync struct {
+	// MaxAttempts is how many times to try reporting a transaction before dead lettering it
+	MaxAttempts int `config:"key=sync/max-attempts"`
+
+	// RetryBackoffMinutes is a delay before the first retry, doubles with each attempt
+	RetryBackoffMinutes int `config:"key=sync/retry-backoff-minutes"`
+
+	// DetectDuplicates will skip or ignore pending transactions that are already in ledger
+	DetectDuplicates bool `config:"key=sync/detect-duplicates"`
+
+	// DuplicateDateToleranceHours is how much dates of fuzzy matched duplicates may differ
+	DuplicateDateToleranceHours int `config:"key=sync/duplicate-date-tolerance-hours"`
+}
+
+// Concurrency represents settings of processing accounts concurrently (run and daemon)
+type Concurrency struct {
+	// Workers is how many accounts are processed at the same time
+	Workers int `config:"key=concurrency/workers"`
+
+	// BankLimit is how many of workers may process accounts of the same bank, not limited if zero
+	BankLimit int `config:"key=concurrency/bank-limit"`
+
+	// AccountTimeoutSeconds limits fetching and syncing of a single account, not limited if zero
+	AccountTimeoutSeconds int `config:"key=concurrency/account-timeout-seconds"`
+}
+
+// Locks represents settings of locks that prevent concurrent runs on the same account
+type Locks struct {
+	// LeaseSeconds is how long a lock of a crashed process is held before it can be taken over
+	LeaseSeconds int `config:"key=locks/lease-seconds"`
+}
+
+// Secrets represents settings of encryption of secrets at rest
+type Secrets struct {
+	// MasterKeys is a comma separated list of <id>:<base64 key>, first key is a primary key
+	MasterKeys string `config:"key=secrets/master-keys"`
+
+	// KeyFile is an optional file with additional master keys, one per line
+	KeyFile string `config:"key=secrets/key-file"`
+}
+
+// Daemon represents settings of a scheduler daemon
+type Daemon struct {
+	// ListenAddress is where healthcheck and status endpoints are served
+	ListenAddress string `config:"key=daemon/listen-address"`
+
+	FetchIntervalMinutes int `config:"key=daemon/fetch-interval-minutes"`
+	SyncIntervalMinutes  int `config:"key=daemon/sync-interval-minutes"`
+
+	// JitterSeconds is a max random delay added to each scheduled run
+	JitterSeconds int `config:"key=daemon/jitter-seconds"`
+
+	// PollIntervalSeconds is how often due runs and config changes are checked
+	PollIntervalSeconds int `config:"key=daemon/poll-interval-seconds"`
+
+	// ShutdownTimeoutSeconds is how long to wait for runs in progress on shutdown
+	ShutdownTimeoutSeconds int `config:"key=daemon/shutdown-timeout-seconds"`
+}
+
 // Ledger ledger config
 type Ledger struct {
 	API string `config:"key=ledger/api"`
+
+	// BatchSize is how many pending transactions to report in a single request
+	BatchSize int `config:"key=ledger/batch-size"`
+
+	// ReportConcurrency is how many pending transactions to report in parallel
+	// if ledger does not support batch reports
+	ReportConcurrency int `config:"key=ledger/report-concurrency"`
 }
 
 // Config is a toplevel config structure
@@ -33,5 +120,12 @@ type Config struct {
 	Google        *Google        `config:"source=local"`
 	Storage       *Storage       `config:"source=local"`
 	FetcherConfig *FetcherConfig `config:"source=local"`
+	Fetch         *Fetch         `config:"source=local"`
+	Banks         *Banks         `config:"source=local"`
+	Sync          *Sync          `config:"source=local"`
+	Concurrency   *Concurrency   `config:"source=local"`
+	Locks         *Locks         `config:"source=local"`
+	Secrets       *Secrets       `config:"source=local"`
+	Daemon        *Daemon        `config:"source=local"`
 	Ledger        *Ledger        `config:"source=local"`
 }
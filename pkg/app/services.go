@@ -2,18 +2,39 @@ package app
 
 import (
 	"database/sql"
+	"fmt"
+	"time"
+
+	// Embedding tz database since it may be missing in the image
+	_ "time/tzdata"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/monoua"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/pbanua2x"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/configcheck"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	coreCfg "github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/config"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/pending"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/runner"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/scheduler"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
 
+	"github.com/pkg/errors"
 	"go.uber.org/dig"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/config"
 )
 
+var logger = diag.CreateLogger()
+
 // Injector is a function that will inject desired services
 // to a target function
 type Injector func(function interface{}) error
@@ -23,11 +44,35 @@ func BootstrapServices(appCfg *config.Config) Injector {
 	c := dig.New()
 
 	c.Provide(func() (*sql.DB, error) {
-		return sql.Open(appCfg.Storage.Driver, appCfg.Storage.DSN)
+		db, err := sql.Open(appCfg.Storage.Driver, appCfg.Storage.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if appCfg.Storage.Driver == "sqlite3" {
+			// Accounts are processed concurrently, sqlite does not support concurrent
+			// writes so all queries go through a single connection
+			db.SetMaxOpenConns(1)
+		}
+		return db, nil
 	})
 
-	c.Provide(func(db *sql.DB) (dal.Storage, error) {
-		return dal.NewSQLStorage(dal.WithSQLDb(db))
+	c.Provide(func() (secrets.Cipher, error) {
+		keys, err := secrets.LoadMasterKeys(appCfg.Secrets.MasterKeys, appCfg.Secrets.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			logger.Warn(nil, "No master keys configured, secrets will be stored unencrypted")
+		}
+		return secrets.NewCipher(keys...)
+	})
+
+	c.Provide(func(db *sql.DB, cipher secrets.Cipher) (dal.Storage, error) {
+		return dal.NewSQLStorage(dal.WithSQLDb(db), dal.WithCipher(cipher))
+	})
+
+	c.Provide(func(storage dal.Storage) lock.Locker {
+		return lock.NewStorageLocker(storage, lock.WithLease(time.Duration(appCfg.Locks.LeaseSeconds)*time.Second))
 	})
 
 	c.Provide(func() auth.OAuthClient {
@@ -44,8 +89,145 @@ func BootstrapServices(appCfg *config.Config) Injector {
 		)
 	})
 
-	c.Provide(func() banks.FetcherConfig {
-		return banks.NewFSFetcherConfig(appCfg.FetcherConfig.ConfigDir)
+	c.Provide(func() banks.SecretResolver {
+		return banks.NewSecretResolver(
+			banks.WithSSMParameterReader(coreCfg.NewSSMParameterReader()),
+		)
+	})
+
+	// Options of db fetcher config, also used to test merchants before storing them
+	c.Provide(func(cipher secrets.Cipher, resolver banks.SecretResolver) []banks.MerchantsFetcherConfigOpt {
+		return []banks.MerchantsFetcherConfigOpt{
+			banks.WithMerchantsCipher(cipher),
+			banks.WithMerchantsSecretResolver(resolver),
+		}
+	})
+
+	c.Provide(func(
+		cipher secrets.Cipher,
+		resolver banks.SecretResolver,
+		storage dal.Storage,
+		merchantOpts []banks.MerchantsFetcherConfigOpt,
+	) (banks.FetcherConfig, error) {
+		if appCfg.FetcherConfig.Source == "db" {
+			return banks.NewDBFetcherConfig(storage, merchantOpts...), nil
+		}
+		if appCfg.FetcherConfig.Source != "fs" {
+			return nil, fmt.Errorf("Unexpected fetcher config source: %v", appCfg.FetcherConfig.Source)
+		}
+		return banks.NewFSFetcherConfig(
+			appCfg.FetcherConfig.ConfigDir,
+			banks.WithCipher(cipher),
+			banks.WithSecretResolver(resolver),
+		), nil
+	})
+
+	c.Provide(func() (*time.Location, error) {
+		loc, err := time.LoadLocation(appCfg.Fetch.TimeZone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to load time zone: %v", appCfg.Fetch.TimeZone)
+		}
+		return loc, nil
+	})
+
+	c.Provide(func(storage dal.Storage, fetcherConfig banks.FetcherConfig, locker lock.Locker, loc *time.Location, authSvc auth.Service, apiFactory ledger.APIFactory) fetch.Service {
+		return fetch.NewService(
+			fetch.WithStorage(storage),
+			fetch.WithLocker(locker),
+			fetch.WithTimeZone(loc),
+			fetch.WithFetcherConfig(fetcherConfig),
+			fetch.WithAuthService(authSvc),
+			fetch.WithLedgerAPI(appCfg.Ledger.API, apiFactory),
+			fetch.WithDryRunLedgerAPI(ledger.NewAPIFactory(ledger.WithReadOnlySessionStorage(storage))),
+			fetch.WithCursorOverlap(time.Duration(appCfg.Fetch.OverlapMinutes)*time.Minute),
+			fetch.WithInitialWindow(time.Duration(appCfg.Fetch.InitialDays)*24*time.Hour),
+			fetch.WithFetcherFactory("pbanua2x", pbanua2x.NewFetcherFactory(pbanua2x.WithAPIURL(appCfg.Banks.Pbanua2xAPIURL))),
+			fetch.WithFetcherFactory("monoua", monoua.NewFetcherFactory(monoua.WithAPIURL(appCfg.Banks.MonouaAPIURL))),
+		)
+	})
+
+	c.Provide(func(storage dal.Storage) ledger.APIFactory {
+		return ledger.NewAPIFactory(
+			ledger.WithSessionStorage(storage),
+			ledger.WithBatchSize(appCfg.Ledger.BatchSize),
+			ledger.WithReportConcurrency(appCfg.Ledger.ReportConcurrency),
+		)
+	})
+
+	c.Provide(func(storage dal.Storage, authSvc auth.Service, locker lock.Locker, apiFactory ledger.APIFactory) ledgersync.Service {
+		opts := []ledgersync.ServiceOpt{
+			ledgersync.WithStorage(storage),
+			ledgersync.WithLocker(locker),
+			ledgersync.WithAuthService(authSvc),
+			ledgersync.WithLedgerAPI(appCfg.Ledger.API, apiFactory),
+			ledgersync.WithDryRunLedgerAPI(ledger.NewAPIFactory(ledger.WithReadOnlySessionStorage(storage))),
+			ledgersync.WithRetries(
+				appCfg.Sync.MaxAttempts,
+				time.Duration(appCfg.Sync.RetryBackoffMinutes)*time.Minute,
+			),
+		}
+		if appCfg.Sync.DetectDuplicates {
+			opts = append(opts, ledgersync.WithDuplicateDetection(
+				time.Duration(appCfg.Sync.DuplicateDateToleranceHours)*time.Hour,
+			))
+		}
+		return ledgersync.NewService(opts...)
+	})
+
+	c.Provide(func() []banks.MerchantSchema {
+		return []banks.MerchantSchema{pbanua2x.MerchantSchema, monoua.MerchantSchema}
+	})
+
+	c.Provide(func(fetcherConfig banks.FetcherConfig, schemas []banks.MerchantSchema, authSvc auth.Service, apiFactory ledger.APIFactory) configcheck.Service {
+		opts := []configcheck.ServiceOpt{
+			configcheck.WithFetcherConfig(fetcherConfig),
+			configcheck.WithAuthService(authSvc),
+			configcheck.WithLedgerAPI(appCfg.Ledger.API, apiFactory),
+		}
+		for _, schema := range schemas {
+			opts = append(opts, configcheck.WithMerchantSchema(schema))
+		}
+		return configcheck.NewService(opts...)
+	})
+
+	c.Provide(func(storage dal.Storage) *runner.RateLimiter {
+		return runner.NewRateLimiter(
+			runner.WithRateLimitStorage(storage),
+			runner.WithBankInterval("pbanua2x", pbanua2x.MinFetchInterval),
+			runner.WithBankInterval("monoua", monoua.MinFetchInterval),
+		)
+	})
+
+	c.Provide(func(fetcherConfig banks.FetcherConfig, fetchSvc fetch.Service, syncSvc ledgersync.Service, rateLimiter *runner.RateLimiter) runner.Service {
+		return runner.NewService(
+			runner.WithFetcherConfig(fetcherConfig),
+			runner.WithFetchService(fetchSvc),
+			runner.WithSyncService(syncSvc),
+			runner.WithRateLimiter(rateLimiter),
+			runner.WithConcurrency(appCfg.Concurrency.Workers, appCfg.Concurrency.BankLimit),
+			runner.WithAccountTimeout(time.Duration(appCfg.Concurrency.AccountTimeoutSeconds)*time.Second),
+		)
+	})
+
+	c.Provide(func(fetcherConfig banks.FetcherConfig, fetchSvc fetch.Service, syncSvc ledgersync.Service, rateLimiter *runner.RateLimiter) scheduler.Service {
+		return scheduler.NewService(
+			scheduler.WithFetcherConfig(fetcherConfig),
+			scheduler.WithFetchService(fetchSvc),
+			scheduler.WithSyncService(syncSvc),
+			scheduler.WithIntervals(
+				time.Duration(appCfg.Daemon.FetchIntervalMinutes)*time.Minute,
+				time.Duration(appCfg.Daemon.SyncIntervalMinutes)*time.Minute,
+			),
+			scheduler.WithJitter(time.Duration(appCfg.Daemon.JitterSeconds)*time.Second),
+			scheduler.WithPollInterval(time.Duration(appCfg.Daemon.PollIntervalSeconds)*time.Second),
+			scheduler.WithConcurrency(appCfg.Concurrency.Workers, appCfg.Concurrency.BankLimit),
+			scheduler.WithAccountTimeout(time.Duration(appCfg.Concurrency.AccountTimeoutSeconds)*time.Second),
+			scheduler.WithRateLimiter(rateLimiter),
+		)
+	})
+
+	c.Provide(func(storage dal.Storage, loc *time.Location) pending.Service {
+		return pending.NewService(pending.WithStorage(storage), pending.WithTimeZone(loc))
 	})
 
 	return func(function interface{}) error {
@@ -16,7 +16,8 @@ var logger = diag.CreateLogger()
 
 // Service is an auth service abstraction
 type Service interface {
-	RegisterUser(ctx context.Context, oauthCode string) error
+	// RegisterUser will exchange the code for tokens and save them. Returns email of the registered user
+	RegisterUser(ctx context.Context, oauthCode string) (string, error)
 	FetchAuthToken(ctx context.Context, email string) (types.IDToken, error)
 }
 
@@ -25,22 +26,25 @@ type service struct {
 	storage     dal.Storage
 }
 
-func (svc *service) RegisterUser(ctx context.Context, oauthCode string) error {
+func (svc *service) RegisterUser(ctx context.Context, oauthCode string) (string, error) {
 	logger.Debug(ctx, "Submitting oauth code and exchange it for token")
 	accessToken, err := svc.oauthClient.PerformAuthCodeExchangeFlow(ctx, oauthCode)
 	if err != nil {
-		return errors.Wrap(err, "Failed to perform oauth code flow")
+		return "", errors.Wrap(err, "Failed to perform oauth code flow")
 	}
 	idTokenDetails, err := accessToken.IDToken.ExtractIDTokenDetails()
 	if err != nil {
-		return errors.Wrap(err, "Failed to extract ID token")
+		return "", errors.Wrap(err, "Failed to extract ID token")
 	}
 	logger.Debug(ctx, "Got token for user %v, saving", idTokenDetails.Email)
-	return svc.storage.SaveAuthToken(ctx, &dal.AuthTokenDTO{
+	if err := svc.storage.SaveAuthToken(ctx, &dal.AuthTokenDTO{
 		Email:        idTokenDetails.Email,
 		IDToken:      accessToken.IDToken,
 		RefreshToken: accessToken.RefreshToken,
-	})
+	}); err != nil {
+		return "", err
+	}
+	return idTokenDetails.Email, nil
 }
 
 func (svc *service) FetchAuthToken(ctx context.Context, email string) (types.IDToken, error) {
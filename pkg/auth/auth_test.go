@@ -50,9 +50,11 @@ func Test_Service_RegisterUser(t *testing.T) {
 					}).
 					Return(nil)
 				svc := NewService(WithStorage(storage), WithOAuthClient(oauthClient))
-				if err := svc.RegisterUser(context.TODO(), code); !assert.NoError(t, err) {
+				registered, err := svc.RegisterUser(context.TODO(), code)
+				if !assert.NoError(t, err) {
 					return
 				}
+				assert.Equal(t, email, registered)
 			}
 		},
 	}
@@ -77,6 +77,21 @@ func (mr *MockStorageMockRecorder) SaveAuthToken(ctx, token interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveAuthToken", reflect.TypeOf((*MockStorage)(nil).SaveAuthToken), ctx, token)
 }
 
+// RotateSecrets mocks base method
+func (m *MockStorage) RotateSecrets(ctx context.Context) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateSecrets", ctx)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateSecrets indicates an expected call of RotateSecrets
+func (mr *MockStorageMockRecorder) RotateSecrets(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateSecrets", reflect.TypeOf((*MockStorage)(nil).RotateSecrets), ctx)
+}
+
 // SavePendingTransaction mocks base method
 func (m *MockStorage) SavePendingTransaction(ctx context.Context, trx *dal.PendingTransactionDTO) error {
 	m.ctrl.T.Helper()
@@ -91,6 +106,49 @@ func (mr *MockStorageMockRecorder) SavePendingTransaction(ctx, trx interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePendingTransaction", reflect.TypeOf((*MockStorage)(nil).SavePendingTransaction), ctx, trx)
 }
 
+// SavePendingTransactions mocks base method
+func (m *MockStorage) SavePendingTransactions(ctx context.Context, trxs []dal.PendingTransactionDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SavePendingTransactions", ctx, trxs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SavePendingTransactions indicates an expected call of SavePendingTransactions
+func (mr *MockStorageMockRecorder) SavePendingTransactions(ctx, trxs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePendingTransactions", reflect.TypeOf((*MockStorage)(nil).SavePendingTransactions), ctx, trxs)
+}
+
+// SaveSyncResults mocks base method
+func (m *MockStorage) SaveSyncResults(ctx context.Context, trxs []dal.PendingTransactionDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveSyncResults", ctx, trxs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveSyncResults indicates an expected call of SaveSyncResults
+func (mr *MockStorageMockRecorder) SaveSyncResults(ctx, trxs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveSyncResults", reflect.TypeOf((*MockStorage)(nil).SaveSyncResults), ctx, trxs)
+}
+
+// InsertNewPendingTransactions mocks base method
+func (m *MockStorage) InsertNewPendingTransactions(ctx context.Context, trxs []dal.PendingTransactionDTO) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "InsertNewPendingTransactions", ctx, trxs)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// InsertNewPendingTransactions indicates an expected call of InsertNewPendingTransactions
+func (mr *MockStorageMockRecorder) InsertNewPendingTransactions(ctx, trxs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "InsertNewPendingTransactions", reflect.TypeOf((*MockStorage)(nil).InsertNewPendingTransactions), ctx, trxs)
+}
+
 // PendingTransactionExist mocks base method
 func (m *MockStorage) PendingTransactionExist(ctx context.Context, id string) (bool, error) {
 	m.ctrl.T.Helper()
@@ -106,6 +164,65 @@ func (mr *MockStorageMockRecorder) PendingTransactionExist(ctx, id interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PendingTransactionExist", reflect.TypeOf((*MockStorage)(nil).PendingTransactionExist), ctx, id)
 }
 
+// GetPendingTransaction mocks base method
+func (m *MockStorage) GetPendingTransaction(ctx context.Context, id string) (*dal.PendingTransactionDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPendingTransaction", ctx, id)
+	ret0, _ := ret[0].(*dal.PendingTransactionDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPendingTransaction indicates an expected call of GetPendingTransaction
+func (mr *MockStorageMockRecorder) GetPendingTransaction(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPendingTransaction", reflect.TypeOf((*MockStorage)(nil).GetPendingTransaction), ctx, id)
+}
+
+// FindPendingTransactions mocks base method
+func (m *MockStorage) FindPendingTransactions(ctx context.Context, filter dal.PendingTransactionsFilter) ([]dal.PendingTransactionDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindPendingTransactions", ctx, filter)
+	ret0, _ := ret[0].([]dal.PendingTransactionDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindPendingTransactions indicates an expected call of FindPendingTransactions
+func (mr *MockStorageMockRecorder) FindPendingTransactions(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindPendingTransactions", reflect.TypeOf((*MockStorage)(nil).FindPendingTransactions), ctx, filter)
+}
+
+// SavePendingTransactionChange mocks base method
+func (m *MockStorage) SavePendingTransactionChange(ctx context.Context, trx *dal.PendingTransactionDTO, change *dal.TransactionChangeDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SavePendingTransactionChange", ctx, trx, change)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SavePendingTransactionChange indicates an expected call of SavePendingTransactionChange
+func (mr *MockStorageMockRecorder) SavePendingTransactionChange(ctx, trx, change interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SavePendingTransactionChange", reflect.TypeOf((*MockStorage)(nil).SavePendingTransactionChange), ctx, trx, change)
+}
+
+// FindTransactionChanges mocks base method
+func (m *MockStorage) FindTransactionChanges(ctx context.Context, transactionID string) ([]dal.TransactionChangeDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindTransactionChanges", ctx, transactionID)
+	ret0, _ := ret[0].([]dal.TransactionChangeDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindTransactionChanges indicates an expected call of FindTransactionChanges
+func (mr *MockStorageMockRecorder) FindTransactionChanges(ctx, transactionID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindTransactionChanges", reflect.TypeOf((*MockStorage)(nil).FindTransactionChanges), ctx, transactionID)
+}
+
 // FindNotSyncedTransactions mocks base method
 func (m *MockStorage) FindNotSyncedTransactions(ctx context.Context, accountID string) ([]dal.PendingTransactionDTO, error) {
 	m.ctrl.T.Helper()
@@ -120,3 +237,250 @@ func (mr *MockStorageMockRecorder) FindNotSyncedTransactions(ctx, accountID inte
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindNotSyncedTransactions", reflect.TypeOf((*MockStorage)(nil).FindNotSyncedTransactions), ctx, accountID)
 }
+
+// FindNotSyncedTransactionsByUser mocks base method
+func (m *MockStorage) FindNotSyncedTransactionsByUser(ctx context.Context, userID string) ([]dal.PendingTransactionDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindNotSyncedTransactionsByUser", ctx, userID)
+	ret0, _ := ret[0].([]dal.PendingTransactionDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindNotSyncedTransactionsByUser indicates an expected call of FindNotSyncedTransactionsByUser
+func (mr *MockStorageMockRecorder) FindNotSyncedTransactionsByUser(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindNotSyncedTransactionsByUser", reflect.TypeOf((*MockStorage)(nil).FindNotSyncedTransactionsByUser), ctx, userID)
+}
+
+// FindDeadLetteredTransactions mocks base method
+func (m *MockStorage) FindDeadLetteredTransactions(ctx context.Context, accountID string) ([]dal.PendingTransactionDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindDeadLetteredTransactions", ctx, accountID)
+	ret0, _ := ret[0].([]dal.PendingTransactionDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindDeadLetteredTransactions indicates an expected call of FindDeadLetteredTransactions
+func (mr *MockStorageMockRecorder) FindDeadLetteredTransactions(ctx, accountID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindDeadLetteredTransactions", reflect.TypeOf((*MockStorage)(nil).FindDeadLetteredTransactions), ctx, accountID)
+}
+
+// RequeueDeadLetteredTransaction mocks base method
+func (m *MockStorage) RequeueDeadLetteredTransaction(ctx context.Context, id string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RequeueDeadLetteredTransaction", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RequeueDeadLetteredTransaction indicates an expected call of RequeueDeadLetteredTransaction
+func (mr *MockStorageMockRecorder) RequeueDeadLetteredTransaction(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RequeueDeadLetteredTransaction", reflect.TypeOf((*MockStorage)(nil).RequeueDeadLetteredTransaction), ctx, id)
+}
+
+// SaveFetchRun mocks base method
+func (m *MockStorage) SaveFetchRun(ctx context.Context, run *dal.FetchRunDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveFetchRun", ctx, run)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveFetchRun indicates an expected call of SaveFetchRun
+func (mr *MockStorageMockRecorder) SaveFetchRun(ctx, run interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFetchRun", reflect.TypeOf((*MockStorage)(nil).SaveFetchRun), ctx, run)
+}
+
+// FindRecentFetchRuns mocks base method
+func (m *MockStorage) FindRecentFetchRuns(ctx context.Context, limit int) ([]dal.FetchRunDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindRecentFetchRuns", ctx, limit)
+	ret0, _ := ret[0].([]dal.FetchRunDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindRecentFetchRuns indicates an expected call of FindRecentFetchRuns
+func (mr *MockStorageMockRecorder) FindRecentFetchRuns(ctx, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindRecentFetchRuns", reflect.TypeOf((*MockStorage)(nil).FindRecentFetchRuns), ctx, limit)
+}
+
+// GetFetchCursor mocks base method
+func (m *MockStorage) GetFetchCursor(ctx context.Context, userID, bank, accountID string) (*dal.FetchCursorDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFetchCursor", ctx, userID, bank, accountID)
+	ret0, _ := ret[0].(*dal.FetchCursorDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFetchCursor indicates an expected call of GetFetchCursor
+func (mr *MockStorageMockRecorder) GetFetchCursor(ctx, userID, bank, accountID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFetchCursor", reflect.TypeOf((*MockStorage)(nil).GetFetchCursor), ctx, userID, bank, accountID)
+}
+
+// SaveFetchCursor mocks base method
+func (m *MockStorage) SaveFetchCursor(ctx context.Context, cursor *dal.FetchCursorDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveFetchCursor", ctx, cursor)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveFetchCursor indicates an expected call of SaveFetchCursor
+func (mr *MockStorageMockRecorder) SaveFetchCursor(ctx, cursor interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFetchCursor", reflect.TypeOf((*MockStorage)(nil).SaveFetchCursor), ctx, cursor)
+}
+
+// SaveFetcherMerchant mocks base method
+func (m *MockStorage) SaveFetcherMerchant(ctx context.Context, merchant *dal.FetcherMerchantDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveFetcherMerchant", ctx, merchant)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveFetcherMerchant indicates an expected call of SaveFetcherMerchant
+func (mr *MockStorageMockRecorder) SaveFetcherMerchant(ctx, merchant interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveFetcherMerchant", reflect.TypeOf((*MockStorage)(nil).SaveFetcherMerchant), ctx, merchant)
+}
+
+// GetFetcherMerchant mocks base method
+func (m *MockStorage) GetFetcherMerchant(ctx context.Context, userID, accountID string) (*dal.FetcherMerchantDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFetcherMerchant", ctx, userID, accountID)
+	ret0, _ := ret[0].(*dal.FetcherMerchantDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFetcherMerchant indicates an expected call of GetFetcherMerchant
+func (mr *MockStorageMockRecorder) GetFetcherMerchant(ctx, userID, accountID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFetcherMerchant", reflect.TypeOf((*MockStorage)(nil).GetFetcherMerchant), ctx, userID, accountID)
+}
+
+// FindFetcherMerchants mocks base method
+func (m *MockStorage) FindFetcherMerchants(ctx context.Context, userID string) ([]dal.FetcherMerchantDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindFetcherMerchants", ctx, userID)
+	ret0, _ := ret[0].([]dal.FetcherMerchantDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindFetcherMerchants indicates an expected call of FindFetcherMerchants
+func (mr *MockStorageMockRecorder) FindFetcherMerchants(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindFetcherMerchants", reflect.TypeOf((*MockStorage)(nil).FindFetcherMerchants), ctx, userID)
+}
+
+// DeleteFetcherMerchant mocks base method
+func (m *MockStorage) DeleteFetcherMerchant(ctx context.Context, userID, accountID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteFetcherMerchant", ctx, userID, accountID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteFetcherMerchant indicates an expected call of DeleteFetcherMerchant
+func (mr *MockStorageMockRecorder) DeleteFetcherMerchant(ctx, userID, accountID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteFetcherMerchant", reflect.TypeOf((*MockStorage)(nil).DeleteFetcherMerchant), ctx, userID, accountID)
+}
+
+// GetLedgerSession mocks base method
+func (m *MockStorage) GetLedgerSession(ctx context.Context, userID string) (*dal.LedgerSessionDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLedgerSession", ctx, userID)
+	ret0, _ := ret[0].(*dal.LedgerSessionDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLedgerSession indicates an expected call of GetLedgerSession
+func (mr *MockStorageMockRecorder) GetLedgerSession(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLedgerSession", reflect.TypeOf((*MockStorage)(nil).GetLedgerSession), ctx, userID)
+}
+
+// SaveLedgerSession mocks base method
+func (m *MockStorage) SaveLedgerSession(ctx context.Context, session *dal.LedgerSessionDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveLedgerSession", ctx, session)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveLedgerSession indicates an expected call of SaveLedgerSession
+func (mr *MockStorageMockRecorder) SaveLedgerSession(ctx, session interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveLedgerSession", reflect.TypeOf((*MockStorage)(nil).SaveLedgerSession), ctx, session)
+}
+
+// AcquireLock mocks base method
+func (m *MockStorage) AcquireLock(ctx context.Context, lock *dal.LockDTO) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AcquireLock", ctx, lock)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AcquireLock indicates an expected call of AcquireLock
+func (mr *MockStorageMockRecorder) AcquireLock(ctx, lock interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AcquireLock", reflect.TypeOf((*MockStorage)(nil).AcquireLock), ctx, lock)
+}
+
+// ExtendLock mocks base method
+func (m *MockStorage) ExtendLock(ctx context.Context, lock *dal.LockDTO) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExtendLock", ctx, lock)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ExtendLock indicates an expected call of ExtendLock
+func (mr *MockStorageMockRecorder) ExtendLock(ctx, lock interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExtendLock", reflect.TypeOf((*MockStorage)(nil).ExtendLock), ctx, lock)
+}
+
+// ReleaseLock mocks base method
+func (m *MockStorage) ReleaseLock(ctx context.Context, key, owner string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseLock", ctx, key, owner)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseLock indicates an expected call of ReleaseLock
+func (mr *MockStorageMockRecorder) ReleaseLock(ctx, key, owner interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseLock", reflect.TypeOf((*MockStorage)(nil).ReleaseLock), ctx, key, owner)
+}
+
+// GetLock mocks base method
+func (m *MockStorage) GetLock(ctx context.Context, key string) (*dal.LockDTO, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLock", ctx, key)
+	ret0, _ := ret[0].(*dal.LockDTO)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLock indicates an expected call of GetLock
+func (mr *MockStorageMockRecorder) GetLock(ctx, key interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLock", reflect.TypeOf((*MockStorage)(nil).GetLock), ctx, key)
+}
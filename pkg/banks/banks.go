@@ -16,14 +16,32 @@ type FetchedTransaction interface {
 	ToDTO() (*dal.PendingTransactionDTO, error)
 }
 
+// CurrencyTransaction is a fetched transaction that knows currency of the bank account.
+// Currency is ISO 4217 code (e.g UAH), empty if it can not be determined
+type CurrencyTransaction interface {
+	FetchedTransaction
+	Currency() string
+}
+
 // FetchParams represents what to fetch from bank
 type FetchParams struct {
+	// From is inclusive and To is exclusive. Both are in the user time zone,
+	// banks that take dates should use calendar days of that zone
 	From            time.Time
 	To              time.Time
 	LedgerAccountID string
 }
 
+// LastInstant returns the last instant included in the range, use it for banks
+// that take inclusive upper bound (e.g a date or unix seconds)
+func (p *FetchParams) LastInstant() time.Time {
+	return p.To.Add(-time.Nanosecond)
+}
+
 // Fetcher can fetch transaction for particular bank accountID
 type Fetcher interface {
 	Fetch(ctx context.Context, params *FetchParams) ([]FetchedTransaction, error)
 }
+
+// FetcherFactory creates a fetcher for a given user
+type FetcherFactory func(ctx context.Context, userID string, cfg FetcherConfig) (Fetcher, error)
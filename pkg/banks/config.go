@@ -1,10 +1,18 @@
 package banks
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
+	"github.com/pkg/errors"
 )
 
 // FetcherConfig is a storage where config of user is stored
@@ -12,8 +20,23 @@ type FetcherConfig interface {
 	GetUserConfig(ctx context.Context, userID string, receiver interface{}) error
 }
 
+// LegacyConfigConverter is implemented by configs that can convert user configs
+// of a legacy format to a format where each account names its bank
+type LegacyConfigConverter interface {
+	ConvertLegacyConfigs(ctx context.Context, schemas []MerchantSchema) (int, error)
+}
+
+// SecretsRotator is implemented by configs that keep encrypted secrets
+// and can re-encrypt them with the primary master key. Only values that are
+// already encrypted are rotated, configs do not tell secrets from other values
+type SecretsRotator interface {
+	RotateSecrets(ctx context.Context) (int, error)
+}
+
 type fsFetcherConfig struct {
-	dir string
+	dir            string
+	cipher         secrets.Cipher
+	secretResolver SecretResolver
 }
 
 func (cfg *fsFetcherConfig) GetUserConfig(ctx context.Context, userID string, receiver interface{}) error {
@@ -22,12 +45,200 @@ func (cfg *fsFetcherConfig) GetUserConfig(ctx context.Context, userID string, re
 	if err != nil {
 		return err
 	}
+	if cfg.cipher == nil && cfg.secretResolver == nil {
+		return json.Unmarshal(buffer, receiver)
+	}
+	raw, err := decodeRawJSON(buffer)
+	if err != nil {
+		return err
+	}
+	resolved, err := walkStrings(raw, func(value string) (string, error) {
+		if cfg.cipher != nil {
+			if value, err = cfg.cipher.Decrypt(value); err != nil {
+				return "", errors.Wrap(err, "Failed to decrypt value")
+			}
+		}
+		if cfg.secretResolver != nil {
+			return cfg.secretResolver.Resolve(ctx, value)
+		}
+		return value, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read config of user %v", userID)
+	}
+	if buffer, err = json.Marshal(resolved); err != nil {
+		return err
+	}
 	return json.Unmarshal(buffer, receiver)
 }
 
+func (cfg *fsFetcherConfig) ListUsers(ctx context.Context) ([]string, error) {
+	files, err := filepath.Glob(path.Join(cfg.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(files))
+	for _, file := range files {
+		users = append(users, strings.TrimSuffix(path.Base(file), ".json"))
+	}
+	return users, nil
+}
+
+func (cfg *fsFetcherConfig) RotateSecrets(ctx context.Context) (int, error) {
+	if cfg.cipher == nil {
+		return 0, errors.New("No cipher configured")
+	}
+	files, err := filepath.Glob(path.Join(cfg.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, file := range files {
+		buffer, err := ioutil.ReadFile(file)
+		if err != nil {
+			return rotated, err
+		}
+		raw, err := decodeRawJSON(buffer)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to parse %v", file)
+		}
+		changed := false
+		result, err := walkStrings(raw, func(value string) (string, error) {
+			if !secrets.IsEncrypted(value) || !cfg.cipher.NeedsRotation(value) {
+				return value, nil
+			}
+			changed = true
+			return cfg.cipher.Rotate(value)
+		})
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate secrets of %v", file)
+		}
+		if !changed {
+			continue
+		}
+		logger.Info(ctx, "Rotating secrets of %v", file)
+		if err := rewriteConfigFile(file, result); err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (cfg *fsFetcherConfig) ConvertLegacyConfigs(ctx context.Context, schemas []MerchantSchema) (int, error) {
+	files, err := filepath.Glob(path.Join(cfg.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	converted := 0
+	for _, file := range files {
+		buffer, err := ioutil.ReadFile(file)
+		if err != nil {
+			return converted, err
+		}
+		raw, err := decodeRawJSON(buffer)
+		if err != nil {
+			return converted, errors.Wrapf(err, "Failed to parse %v", file)
+		}
+		rawMap, ok := raw.(map[string]interface{})
+		if !ok {
+			return converted, fmt.Errorf("Config %v should be an object", file)
+		}
+		result, isLegacy, err := ConvertLegacyUserConfig(rawMap, schemas)
+		if err != nil {
+			return converted, errors.Wrapf(err, "Failed to convert %v", file)
+		}
+		if !isLegacy {
+			continue
+		}
+		logger.Info(ctx, "Converting legacy config %v", file)
+		if err := rewriteConfigFile(file, result); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	return converted, nil
+}
+
+func rewriteConfigFile(file string, value interface{}) error {
+	buffer, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buffer, stat.Mode())
+}
+
+// decodeRawJSON decodes json keeping numbers as is so
+// they survive re-encoding without precision loss
+func decodeRawJSON(buffer []byte) (interface{}, error) {
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(buffer))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// walkStrings returns a copy of a decoded json value with all
+// string values replaced by the result of fn
+func walkStrings(value interface{}, fn func(string) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			mapped, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to process %v", key)
+			}
+			result[key] = mapped
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			mapped, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = mapped
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+// FSFetcherConfigOpt is an option of a file system fetcher config
+type FSFetcherConfigOpt func(cfg *fsFetcherConfig)
+
+// WithCipher sets cipher used to decrypt encrypted values of user configs
+func WithCipher(cipher secrets.Cipher) FSFetcherConfigOpt {
+	return func(cfg *fsFetcherConfig) {
+		cfg.cipher = cipher
+	}
+}
+
+// WithSecretResolver enables resolution of secret references (env:, file:, ssm:) of user configs
+func WithSecretResolver(resolver SecretResolver) FSFetcherConfigOpt {
+	return func(cfg *fsFetcherConfig) {
+		cfg.secretResolver = resolver
+	}
+}
+
 // NewFSFetcherConfig creates an instance of a fetcher config
 // that is reading from local file system
-func NewFSFetcherConfig(configDir string) FetcherConfig {
+func NewFSFetcherConfig(configDir string, opts ...FSFetcherConfigOpt) FetcherConfig {
 	logger.Info(nil, "Initializing fetcher config: %v", configDir)
-	return &fsFetcherConfig{configDir}
+	cfg := &fsFetcherConfig{dir: configDir}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
 }
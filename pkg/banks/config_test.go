@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -89,3 +90,92 @@ func TestFSFetcherConfig_GetUserConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestFSFetcherConfig_EncryptedSecrets(t *testing.T) {
+	type userConfig struct {
+		Merchant string
+		Password string
+		Accounts []struct {
+			ID    string
+			Token string
+		}
+	}
+
+	configDir := ensureTmpDir("bank-config-secrets-test")
+	oldKey, err := secrets.GenerateMasterKey("old")
+	if !assert.NoError(t, err) {
+		return
+	}
+	newKey, err := secrets.GenerateMasterKey("new")
+	if !assert.NoError(t, err) {
+		return
+	}
+	oldCipher, err := secrets.NewCipher(oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rotatedCipher, err := secrets.NewCipher(newKey, oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	userID := faker.Word()
+	merchant := faker.Word()
+	password := faker.Password()
+	token := faker.Password()
+	encryptedPassword, err := oldCipher.Encrypt(password)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encryptedToken, err := oldCipher.Encrypt(token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	raw := map[string]interface{}{
+		"Merchant": merchant,
+		"Password": encryptedPassword,
+		"Accounts": []map[string]interface{}{{"ID": "acc-1", "Token": encryptedToken}},
+	}
+	buffer, err := json.Marshal(raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	configFile := path.Join(configDir, userID+".json")
+	if err := ioutil.WriteFile(configFile, buffer, os.ModePerm); !assert.NoError(t, err) {
+		return
+	}
+
+	assertDecrypted := func(cipher secrets.Cipher) {
+		var got userConfig
+		cfg := NewFSFetcherConfig(configDir, WithCipher(cipher))
+		if err := cfg.GetUserConfig(context.Background(), userID, &got); !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, merchant, got.Merchant)
+		assert.Equal(t, password, got.Password)
+		if assert.Len(t, got.Accounts, 1) {
+			assert.Equal(t, "acc-1", got.Accounts[0].ID)
+			assert.Equal(t, token, got.Accounts[0].Token)
+		}
+	}
+	assertDecrypted(oldCipher)
+
+	cfg := NewFSFetcherConfig(configDir, WithCipher(rotatedCipher))
+	rotated, err := cfg.(SecretsRotator).RotateSecrets(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, rotated)
+
+	newCipher, err := secrets.NewCipher(newKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertDecrypted(newCipher)
+
+	rotated, err = cfg.(SecretsRotator).RotateSecrets(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 0, rotated)
+}
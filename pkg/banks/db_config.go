@@ -0,0 +1,152 @@
+package banks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
+)
+
+// merchantSecrets decrypts encrypted values and resolves secret references
+// of merchant settings the same way fs config does
+type merchantSecrets struct {
+	cipher         secrets.Cipher
+	secretResolver SecretResolver
+}
+
+func (s *merchantSecrets) resolve(ctx context.Context, settings map[string]string) (map[string]string, error) {
+	if s.cipher == nil && s.secretResolver == nil {
+		return settings, nil
+	}
+	resolved := make(map[string]string, len(settings))
+	for key, value := range settings {
+		var err error
+		if s.cipher != nil {
+			if value, err = s.cipher.Decrypt(value); err != nil {
+				return nil, errors.Wrapf(err, "Failed to decrypt %v", key)
+			}
+		}
+		if s.secretResolver != nil {
+			if value, err = s.secretResolver.Resolve(ctx, value); err != nil {
+				return nil, errors.Wrapf(err, "Failed to resolve %v", key)
+			}
+		}
+		resolved[key] = value
+	}
+	return resolved, nil
+}
+
+// MerchantsFetcherConfigOpt is an option of fetcher configs made of merchants (db or in memory)
+type MerchantsFetcherConfigOpt func(s *merchantSecrets)
+
+// WithMerchantsCipher sets cipher used to decrypt encrypted values of merchant settings
+func WithMerchantsCipher(cipher secrets.Cipher) MerchantsFetcherConfigOpt {
+	return func(s *merchantSecrets) {
+		s.cipher = cipher
+	}
+}
+
+// WithMerchantsSecretResolver enables resolution of secret references (env:, file:, ssm:) of merchant settings
+func WithMerchantsSecretResolver(resolver SecretResolver) MerchantsFetcherConfigOpt {
+	return func(s *merchantSecrets) {
+		s.secretResolver = resolver
+	}
+}
+
+func newMerchantSecrets(opts []MerchantsFetcherConfigOpt) merchantSecrets {
+	s := merchantSecrets{}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+type merchantsFetcherConfig struct {
+	merchantSecrets
+	merchants []dal.FetcherMerchantDTO
+}
+
+func (cfg *merchantsFetcherConfig) GetUserConfig(ctx context.Context, userID string, receiver interface{}) error {
+	userCfg := UserConfig{UserID: userID, Accounts: map[string]*AccountConfig{}}
+	for _, merchant := range cfg.merchants {
+		if merchant.UserID == userID {
+			settings, err := cfg.resolve(ctx, merchant.Settings)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to read settings of account %v", merchant.AccountID)
+			}
+			userCfg.Accounts[merchant.AccountID] = &AccountConfig{
+				Bank:     merchant.Bank,
+				Settings: settings,
+			}
+		}
+	}
+	if len(userCfg.Accounts) == 0 {
+		return fmt.Errorf("No merchants configured for user: %v", userID)
+	}
+	buffer, err := json.Marshal(userCfg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buffer, receiver)
+}
+
+func (cfg *merchantsFetcherConfig) ListUsers(ctx context.Context) ([]string, error) {
+	users := []string{}
+	seen := map[string]bool{}
+	for _, merchant := range cfg.merchants {
+		if !seen[merchant.UserID] {
+			seen[merchant.UserID] = true
+			users = append(users, merchant.UserID)
+		}
+	}
+	return users, nil
+}
+
+// NewMerchantsFetcherConfig creates an in memory fetcher config with given merchants.
+// Can be used to test merchant settings before storing them
+func NewMerchantsFetcherConfig(merchants []dal.FetcherMerchantDTO, opts ...MerchantsFetcherConfigOpt) FetcherConfig {
+	return &merchantsFetcherConfig{merchantSecrets: newMerchantSecrets(opts), merchants: merchants}
+}
+
+type dbFetcherConfig struct {
+	merchantSecrets
+	storage dal.Storage
+}
+
+func (cfg *dbFetcherConfig) GetUserConfig(ctx context.Context, userID string, receiver interface{}) error {
+	logger.Debug(ctx, "Reading user merchants: %v", userID)
+	if userID == "" {
+		return fmt.Errorf("No merchants configured for user: %v", userID)
+	}
+	merchants, err := cfg.storage.FindFetcherMerchants(ctx, userID)
+	if err != nil {
+		return err
+	}
+	memCfg := &merchantsFetcherConfig{merchantSecrets: cfg.merchantSecrets, merchants: merchants}
+	return memCfg.GetUserConfig(ctx, userID, receiver)
+}
+
+func (cfg *dbFetcherConfig) ListUsers(ctx context.Context) ([]string, error) {
+	merchants, err := cfg.storage.FindFetcherMerchants(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	for _, merchant := range merchants {
+		if len(users) == 0 || users[len(users)-1] != merchant.UserID {
+			users = append(users, merchant.UserID)
+		}
+	}
+	return users, nil
+}
+
+// NewDBFetcherConfig creates an instance of a fetcher config
+// that is reading merchants from the storage
+func NewDBFetcherConfig(storage dal.Storage, opts ...MerchantsFetcherConfigOpt) FetcherConfig {
+	logger.Info(nil, "Initializing db fetcher config")
+	return &dbFetcherConfig{merchantSecrets: newMerchantSecrets(opts), storage: storage}
+}
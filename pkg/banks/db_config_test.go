@@ -0,0 +1,133 @@
+package banks
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBFetcherConfig_GetUserConfig(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	storage, err := dal.NewSQLStorage(dal.WithSQLDb(db))
+	if !assert.NoError(t, err) {
+		return
+	}
+	if err := storage.Setup(context.TODO()); !assert.NoError(t, err) {
+		return
+	}
+
+	randMerchant := func(userID string) *dal.FetcherMerchantDTO {
+		return &dal.FetcherMerchantDTO{
+			UserID:    userID,
+			AccountID: "acc-" + faker.UUIDHyphenated(),
+			Bank:      "bank-" + faker.Word(),
+			Settings: map[string]string{
+				"ID":          faker.Word(),
+				"Password":    faker.Password(),
+				"BankAccount": faker.CCNumber(),
+			},
+		}
+	}
+
+	userID := faker.Email()
+	want := &UserConfig{UserID: userID, Accounts: map[string]*AccountConfig{}}
+	for i := 0; i < 2; i++ {
+		merchant := randMerchant(userID)
+		if err := storage.SaveFetcherMerchant(context.TODO(), merchant); !assert.NoError(t, err) {
+			return
+		}
+		want.Accounts[merchant.AccountID] = &AccountConfig{Bank: merchant.Bank, Settings: merchant.Settings}
+	}
+	otherMerchant := randMerchant(faker.Email())
+	if err := storage.SaveFetcherMerchant(context.TODO(), otherMerchant); !assert.NoError(t, err) {
+		return
+	}
+
+	cfg := NewDBFetcherConfig(storage)
+
+	t.Run("read merchants of user", func(t *testing.T) {
+		got, err := ReadUserConfig(context.TODO(), cfg, userID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("list users", func(t *testing.T) {
+		got, err := cfg.(UserLister).ListUsers(context.TODO())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.ElementsMatch(t, []string{userID, otherMerchant.UserID}, got)
+	})
+
+	t.Run("fail if user has no merchants", func(t *testing.T) {
+		missingUserID := faker.Email()
+		_, err := ReadUserConfig(context.TODO(), cfg, missingUserID)
+		assert.EqualError(t, err, "No merchants configured for user: "+missingUserID)
+	})
+
+	t.Run("resolve secrets of merchant settings", func(t *testing.T) {
+		key, err := secrets.GenerateMasterKey("key")
+		if !assert.NoError(t, err) {
+			return
+		}
+		cipher, err := secrets.NewCipher(key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		password := faker.Password()
+		encryptedPassword, err := cipher.Encrypt(password)
+		if !assert.NoError(t, err) {
+			return
+		}
+		token := faker.Password()
+		paramPath := "/" + faker.Word() + "/token"
+		merchant := randMerchant(faker.Email())
+		merchant.Settings = map[string]string{
+			"ID":       "env:MERCHANT_ID",
+			"Password": encryptedPassword,
+			"XToken":   "ssm:" + paramPath,
+		}
+		if err := storage.SaveFetcherMerchant(context.TODO(), merchant); !assert.NoError(t, err) {
+			return
+		}
+		merchantID := faker.Word()
+		opts := []MerchantsFetcherConfigOpt{
+			WithMerchantsCipher(cipher),
+			WithMerchantsSecretResolver(NewSecretResolver(
+				WithSSMParameterReader(mockSSMParameterReader{paramPath: token}),
+				WithLookupEnv(func(key string) (string, bool) {
+					return merchantID, key == "MERCHANT_ID"
+				}),
+			)),
+		}
+		want := map[string]string{"ID": merchantID, "Password": password, "XToken": token}
+		for name, cfg := range map[string]FetcherConfig{
+			"db":        NewDBFetcherConfig(storage, opts...),
+			"in memory": NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{*merchant}, opts...),
+		} {
+			got, err := ReadUserConfig(context.TODO(), cfg, merchant.UserID)
+			if !assert.NoError(t, err, name) {
+				return
+			}
+			assert.Equal(t, want, got.Accounts[merchant.AccountID].Settings, name)
+		}
+
+		_, err = ReadUserConfig(context.TODO(), NewDBFetcherConfig(storage, WithMerchantsSecretResolver(NewSecretResolver(
+			WithLookupEnv(func(key string) (string, bool) { return "", false }),
+		))), merchant.UserID)
+		assert.Error(t, err)
+	})
+}
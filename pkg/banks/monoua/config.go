@@ -1,10 +1,25 @@
 package monoua
 
+import (
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+)
+
+const bankName = "monoua"
+
+// MinFetchInterval is a minimal interval between statement requests,
+// monobank API allows one request per 60 seconds
+const MinFetchInterval = 60 * time.Second
+
+// MerchantSchema describes monoua merchant settings
+var MerchantSchema = banks.NewMerchantSchema(bankName, merchantConfig{})
+
 type userConfig struct {
 	UserID string
 
 	// Merchants is a map where key is LedgerAccountID and value is a merchant config
-	// that is configured for reading from that account
+	// of monoua accounts of the user
 	Merchants map[string]*merchantConfig
 }
 
@@ -28,7 +28,7 @@ func (f *monoFetcher) Fetch(ctx context.Context, params *banks.FetchParams) ([]b
 	if !ok {
 		return nil, fmt.Errorf("No monoua merchant configured for account: %v", params.LedgerAccountID)
 	}
-	reqPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, params.From.Unix(), params.To.Unix())
+	reqPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, params.From.Unix(), params.LastInstant().Unix())
 	req := request.Get(f.apiBaseURL + reqPath)
 	req = req.WithHeader("X-Token", merchant.XToken)
 	res := request.Do(ctx, req)
@@ -58,14 +58,50 @@ func (f *monoFetcher) Fetch(ctx context.Context, params *banks.FetchParams) ([]b
 	return trxs, err
 }
 
-// NewFetcher creates an instance of a pbanua2x fetcher
+// FetcherOpt is an option of a monoua fetcher
+type FetcherOpt func(*monoFetcher)
+
+// WithAPIURL will send requests to given monobank API (e.g a fake bank)
+func WithAPIURL(apiBaseURL string) FetcherOpt {
+	return func(f *monoFetcher) {
+		f.apiBaseURL = apiBaseURL
+	}
+}
+
+// NewFetcherFactory returns a factory of fetchers with given options
+func NewFetcherFactory(opts ...FetcherOpt) banks.FetcherFactory {
+	return func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+		return newFetcher(ctx, userID, cfg, opts...)
+	}
+}
+
+// NewFetcher creates an instance of a monoua fetcher
 func NewFetcher(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
-	var userCfg userConfig
-	if err := cfg.GetUserConfig(ctx, userID, &userCfg); err != nil {
+	return newFetcher(ctx, userID, cfg)
+}
+
+func newFetcher(ctx context.Context, userID string, cfg banks.FetcherConfig, opts ...FetcherOpt) (banks.Fetcher, error) {
+	userCfg, err := banks.ReadUserConfig(ctx, cfg, userID)
+	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch user config")
 	}
-	return &monoFetcher{
+	bankCfg := &userConfig{UserID: userCfg.UserID, Merchants: map[string]*merchantConfig{}}
+	for accountID, acc := range userCfg.Accounts {
+		if acc.Bank != bankName {
+			continue
+		}
+		var merchant merchantConfig
+		if err := acc.DecodeSettings(&merchant); err != nil {
+			return nil, request.Permanent(errors.Wrapf(err, "Failed to decode merchant settings of account %v", accountID))
+		}
+		bankCfg.Merchants[accountID] = &merchant
+	}
+	f := &monoFetcher{
 		apiBaseURL: "https://api.monobank.ua",
-		userCfg:    &userCfg,
-	}, nil
+		userCfg:    bankCfg,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f, nil
 }
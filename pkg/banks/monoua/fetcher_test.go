@@ -2,10 +2,11 @@ package monoua
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/url"
-	"reflect"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 
 	"github.com/bxcodec/faker/v3"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,8 +26,11 @@ type mockConfig struct {
 
 func (cfg *mockConfig) GetUserConfig(ctx context.Context, userID string, receiver interface{}) error {
 	if userCfg, ok := cfg.userConfigs[userID]; ok {
-		reflect.ValueOf(receiver).Elem().Set(reflect.ValueOf(userCfg).Elem())
-		return nil
+		buffer, err := json.Marshal(userCfg)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(buffer, receiver)
 	}
 	return errors.New("Config not found, user: " + userID)
 }
@@ -35,8 +40,31 @@ func TestNewFetcher(t *testing.T) {
 		userID string
 	}
 
-	existingConfig := &userConfig{
+	existingAccount := &banks.AccountConfig{
+		Bank:     bankName,
+		Settings: map[string]string{"XToken": "token-" + faker.Word(), "BankAccount": "ba-" + faker.Word()},
+	}
+	existingConfig := &banks.UserConfig{
 		UserID: "uid-" + faker.Word(),
+		Accounts: map[string]*banks.AccountConfig{
+			"acc-1-" + faker.Word(): existingAccount,
+			"acc-2-" + faker.Word(): {Bank: "pbanua2x", Settings: map[string]string{"Other": faker.Word()}},
+		},
+	}
+	var existingAccountID string
+	for accountID, acc := range existingConfig.Accounts {
+		if acc == existingAccount {
+			existingAccountID = accountID
+		}
+	}
+	wantConfig := &userConfig{
+		UserID: existingConfig.UserID,
+		Merchants: map[string]*merchantConfig{
+			existingAccountID: &merchantConfig{
+				XToken:      existingAccount.Settings["XToken"],
+				BankAccount: existingAccount.Settings["BankAccount"],
+			},
+		},
 	}
 
 	fetcherCfg := &mockConfig{
@@ -63,7 +91,7 @@ func TestNewFetcher(t *testing.T) {
 					return
 				}
 				bpfetcher := fetcher.(*monoFetcher)
-				assert.Equal(t, existingConfig, bpfetcher.userCfg)
+				assert.Equal(t, wantConfig, bpfetcher.userCfg)
 			},
 		},
 		{
@@ -145,7 +173,7 @@ func Test_monoFetcher_Fetch(t *testing.T) {
 						wantStatements[i] = &stmt
 					}
 
-					wantPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, fetchParams.From.Unix(), fetchParams.To.Unix())
+					wantPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, fetchParams.From.Unix(), fetchParams.To.Unix()-1)
 					gock.New(apiURL.Scheme + "://" + apiURL.Host).
 						Get(wantPath).
 						Reply(200).
@@ -195,7 +223,7 @@ func Test_monoFetcher_Fetch(t *testing.T) {
 
 					code := rand.Intn(100) + 300
 
-					wantPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, fetchParams.From.Unix(), fetchParams.To.Unix())
+					wantPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, fetchParams.From.Unix(), fetchParams.To.Unix()-1)
 
 					gock.New(apiURL.Scheme + "://" + apiURL.Host).
 						Get(wantPath).
@@ -209,6 +237,34 @@ func Test_monoFetcher_Fetch(t *testing.T) {
 				},
 			}
 		},
+		func() testCase {
+			return testCase{
+				name: "fail with transient error if rate limited and permanent if rejected",
+				run: func(t *testing.T, f banks.Fetcher) {
+					fetchParams := banks.FetchParams{
+						LedgerAccountID: ledgerAccountID,
+						From:            timeVal(time.Parse(faker.BaseDateFormat, faker.Date())),
+						To:              timeVal(time.Parse(faker.BaseDateFormat, faker.Date())),
+					}
+
+					wantPath := fmt.Sprintf("/personal/statement/%v/%v/%v", merchant.BankAccount, fetchParams.From.Unix(), fetchParams.To.Unix()-1)
+
+					gock.New(apiURL.Scheme + "://" + apiURL.Host).
+						Get(wantPath).
+						Reply(http.StatusTooManyRequests).
+						BodyString("Too many requests")
+					gock.New(apiURL.Scheme + "://" + apiURL.Host).
+						Get(wantPath).
+						Reply(http.StatusForbidden).
+						BodyString("Unknown 'X-Token'")
+
+					_, err := f.Fetch(context.Background(), &fetchParams)
+					assert.True(t, request.IsTransient(err), "Expected transient error, got: %v", err)
+					_, err = f.Fetch(context.Background(), &fetchParams)
+					assert.True(t, request.IsPermanent(err), "Expected permanent error, got: %v", err)
+				},
+			}
+		},
 	}
 	for _, tt := range tests {
 		tt := tt()
@@ -27,6 +27,24 @@ type monoTransaction struct {
 	ledgerAccountID string
 }
 
+// ISO 4217 numeric codes of currencies monobank accounts are opened in
+var currencyCodes = map[int32]string{
+	980: "UAH",
+	840: "USD",
+	978: "EUR",
+	826: "GBP",
+	985: "PLN",
+}
+
+// Currency returns the account currency. Statement items only have the operation
+// currency, it matches the account currency if the amount was not converted
+func (stmt *monoTransaction) Currency() string {
+	if stmt.Amount != stmt.OperationAmount {
+		return ""
+	}
+	return currencyCodes[stmt.CurrencyCode]
+}
+
 func (stmt *monoTransaction) ToDTO() (*dal.PendingTransactionDTO, error) {
 	typeID := ledger.TransactionTypeIncome
 	if stmt.Amount < 0 {
@@ -9,6 +9,7 @@ import (
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
 	"github.com/stretchr/testify/assert"
@@ -95,3 +96,20 @@ func Test_monoTransaction_ToDTO(t *testing.T) {
 		})
 	}
 }
+
+func Test_monoTransaction_Currency(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *monoTransaction
+		want string
+	}{
+		{name: "operation currency", tx: &monoTransaction{Amount: -1050, OperationAmount: -1050, CurrencyCode: 840}, want: "USD"},
+		{name: "converted operation", tx: &monoTransaction{Amount: -4200, OperationAmount: -1050, CurrencyCode: 840}, want: ""},
+		{name: "unknown currency", tx: &monoTransaction{Amount: -1050, OperationAmount: -1050, CurrencyCode: 392}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, banks.CurrencyTransaction(tt.tx).Currency())
+		})
+	}
+}
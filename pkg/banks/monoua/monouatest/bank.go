@@ -0,0 +1,386 @@
+// Package monouatest provides a fake monobank personal API serving scripted data
+package monouatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+const (
+	// maxStatementPeriod is the longest period of a single statement request
+	maxStatementPeriod = 31*24*time.Hour + time.Hour
+
+	// maxStatementItems is how many items are returned by a single statement request
+	maxStatementItems = 500
+)
+
+// StatementItem is a transaction of an account, see https://api.monobank.ua/docs/#/definitions/StatementItems
+type StatementItem struct {
+	ID              string `json:"id"`
+	Time            int64  `json:"time"`
+	Description     string `json:"description"`
+	Mcc             int32  `json:"mcc"`
+	OriginalMcc     int32  `json:"originalMcc"`
+	Amount          int64  `json:"amount"`
+	OperationAmount int64  `json:"operationAmount"`
+	CurrencyCode    int32  `json:"currencyCode"`
+	CommissionRate  int64  `json:"commissionRate"`
+	CashbackAmount  int64  `json:"cashbackAmount"`
+	Balance         int64  `json:"balance"`
+	Hold            bool   `json:"hold"`
+}
+
+// Account is an account of a client
+type Account struct {
+	ID           string   `json:"id"`
+	SendID       string   `json:"sendId"`
+	CurrencyCode int32    `json:"currencyCode"`
+	CashbackType string   `json:"cashbackType"`
+	Balance      int64    `json:"balance"`
+	CreditLimit  int64    `json:"creditLimit"`
+	MaskedPan    []string `json:"maskedPan"`
+	Type         string   `json:"type"`
+	IBAN         string   `json:"iban"`
+
+	// Statements are served by the statement endpoint, they are not a part of client info
+	Statements []StatementItem `json:"statements,omitempty"`
+}
+
+// Client is a monobank client authorized by XToken
+type Client struct {
+	XToken     string    `json:"xToken,omitempty"`
+	ClientID   string    `json:"clientId"`
+	Name       string    `json:"name"`
+	WebHookURL string    `json:"webHookUrl"`
+	Accounts   []Account `json:"accounts"`
+}
+
+// WebHookEvent is sent to a webhook of the client when a statement item is added
+type WebHookEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Account       string        `json:"account"`
+		StatementItem StatementItem `json:"statementItem"`
+	} `json:"data"`
+}
+
+// Bank is a fake monobank that keeps data in memory. It implements client-info,
+// statement and webhook endpoints of the personal API, requests are authorized by X-Token header.
+// GET /_fake/state returns clients with statements and POST /_fake/statement-items
+// adds a statement item, so the state can be inspected and changed when running out of process
+type Bank struct {
+	mtx sync.Mutex
+
+	// rateLimit is a minimal interval between requests to the same endpoint with the same token,
+	// too frequent requests are rejected with 429. Not limited if zero
+	rateLimit   time.Duration
+	lastRequest map[string]time.Time
+	nowFn       func() time.Time
+
+	clients []*Client
+}
+
+// BankOpt is an option of the fake bank
+type BankOpt func(*Bank)
+
+// WithClients will init the fake with given clients, their accounts and statements
+func WithClients(clients ...Client) BankOpt {
+	return func(b *Bank) {
+		for _, client := range clients {
+			client := client
+			b.clients = append(b.clients, &client)
+		}
+	}
+}
+
+// WithRateLimit will reject requests to the same endpoint with the same token
+// that are more frequent than interval like monobank does
+func WithRateLimit(interval time.Duration) BankOpt {
+	return func(b *Bank) {
+		b.rateLimit = interval
+	}
+}
+
+// NewBank returns a fake bank with given options
+func NewBank(opts ...BankOpt) *Bank {
+	b := &Bank{
+		lastRequest: map[string]time.Time{},
+		nowFn:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Clients returns a snapshot of clients with their accounts and statements
+func (b *Bank) Clients() []Client {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.snapshot()
+}
+
+func (b *Bank) snapshot() []Client {
+	result := make([]Client, 0, len(b.clients))
+	for _, client := range b.clients {
+		snapshot := *client
+		snapshot.Accounts = make([]Account, 0, len(client.Accounts))
+		for _, account := range client.Accounts {
+			account.Statements = append([]StatementItem{}, account.Statements...)
+			snapshot.Accounts = append(snapshot.Accounts, account)
+		}
+		result = append(result, snapshot)
+	}
+	return result
+}
+
+// AddStatementItem will add the item to the account and send it to the webhook of the client if set
+func (b *Bank) AddStatementItem(accountID string, item StatementItem) error {
+	b.mtx.Lock()
+	client, account := b.findAccount(accountID)
+	if account == nil {
+		b.mtx.Unlock()
+		return errors.Errorf("Unknown account: %v", accountID)
+	}
+	account.Statements = append(account.Statements, item)
+	webHookURL := client.WebHookURL
+	b.mtx.Unlock()
+
+	if webHookURL == "" {
+		return nil
+	}
+	event := WebHookEvent{Type: "StatementItem"}
+	event.Data.Account = accountID
+	event.Data.StatementItem = item
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(webHookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Failed to send statement item to webhook")
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return errors.Errorf("Webhook responded with %v", res.StatusCode)
+	}
+	return nil
+}
+
+func (b *Bank) findAccount(accountID string) (*Client, *Account) {
+	for _, client := range b.clients {
+		for i := range client.Accounts {
+			if client.Accounts[i].ID == accountID {
+				return client, &client.Accounts[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (b *Bank) findClient(xToken string) *Client {
+	for _, client := range b.clients {
+		if client.XToken == xToken {
+			return client
+		}
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, statusCode int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"errorDescription": description})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (b *Bank) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/_fake/state" && req.Method == http.MethodGet:
+		writeJSON(w, b.Clients())
+		return
+	case req.URL.Path == "/_fake/statement-items" && req.Method == http.MethodPost:
+		b.addStatementItem(w, req)
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	client := b.findClient(req.Header.Get("X-Token"))
+	if client == nil {
+		writeError(w, http.StatusForbidden, "Unknown 'X-Token'")
+		return
+	}
+	switch {
+	case req.URL.Path == "/personal/client-info" && req.Method == http.MethodGet:
+		if b.allowRequest(w, client, "client-info") {
+			b.clientInfo(w, client)
+		}
+	case strings.HasPrefix(req.URL.Path, "/personal/statement/") && req.Method == http.MethodGet:
+		if b.allowRequest(w, client, "statement") {
+			b.statement(w, req, client)
+		}
+	case req.URL.Path == "/personal/webhook" && req.Method == http.MethodPost:
+		b.setWebHook(w, req, client)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// allowRequest will respond with 429 and return false if the client
+// requested the endpoint more recently than the rate limit allows
+func (b *Bank) allowRequest(w http.ResponseWriter, client *Client, endpoint string) bool {
+	if b.rateLimit == 0 {
+		return true
+	}
+	key := client.XToken + ":" + endpoint
+	now := b.nowFn()
+	if last, ok := b.lastRequest[key]; ok && now.Sub(last) < b.rateLimit {
+		writeError(w, http.StatusTooManyRequests, "Too many requests")
+		return false
+	}
+	b.lastRequest[key] = now
+	return true
+}
+
+func (b *Bank) clientInfo(w http.ResponseWriter, client *Client) {
+	info := *client
+	info.XToken = ""
+	info.Accounts = make([]Account, 0, len(client.Accounts))
+	for _, account := range client.Accounts {
+		account.Statements = nil
+		info.Accounts = append(info.Accounts, account)
+	}
+	writeJSON(w, info)
+}
+
+// statement serves /personal/statement/{account}/{from}/{to}, to is optional
+// and defaults to now. Account "0" is the first account of the client
+func (b *Bank) statement(w http.ResponseWriter, req *http.Request, client *Client) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/personal/statement/"), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		writeError(w, http.StatusBadRequest, "Invalid statement request")
+		return
+	}
+	from, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid 'from'")
+		return
+	}
+	to := b.nowFn().Unix()
+	if len(parts) == 3 {
+		if to, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid 'to'")
+			return
+		}
+	}
+	if time.Duration(to-from)*time.Second > maxStatementPeriod {
+		writeError(w, http.StatusBadRequest, "Period must be no more than 31 days")
+		return
+	}
+
+	var account *Account
+	for i := range client.Accounts {
+		if client.Accounts[i].ID == parts[0] || (parts[0] == "0" && i == 0) {
+			account = &client.Accounts[i]
+			break
+		}
+	}
+	if account == nil {
+		writeError(w, http.StatusBadRequest, "Unknown account")
+		return
+	}
+
+	items := []StatementItem{}
+	for _, item := range account.Statements {
+		if item.Time >= from && item.Time <= to {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Time > items[j].Time })
+	if len(items) > maxStatementItems {
+		items = items[:maxStatementItems]
+	}
+	writeJSON(w, items)
+}
+
+// setWebHook will check that the webhook responds to GET like monobank does before saving it
+func (b *Bank) setWebHook(w http.ResponseWriter, req *http.Request, client *Client) {
+	var payload struct {
+		WebHookURL string `json:"webHookUrl"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload.WebHookURL != "" {
+		res, err := http.Get(payload.WebHookURL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Failed to check webhook: "+err.Error())
+			return
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			writeError(w, http.StatusBadRequest, "Webhook responded with "+res.Status)
+			return
+		}
+	}
+	logger.Info(req.Context(), "Setting webhook of client %v: %v", client.ClientID, payload.WebHookURL)
+	client.WebHookURL = payload.WebHookURL
+	w.WriteHeader(http.StatusOK)
+}
+
+func (b *Bank) addStatementItem(w http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Account       string        `json:"account"`
+		StatementItem StatementItem `json:"statementItem"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := b.AddStatementItem(payload.Account, payload.StatementItem); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Server is a fake bank listening on a local port
+type Server struct {
+	*Bank
+	URL string
+
+	httpServer *httptest.Server
+}
+
+// Close will stop the server
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// NewServer starts a fake bank with given options on a local port
+func NewServer(opts ...BankOpt) *Server {
+	b := NewBank(opts...)
+	httpServer := httptest.NewServer(b)
+	return &Server{Bank: b, URL: httpServer.URL, httpServer: httpServer}
+}
@@ -0,0 +1,174 @@
+package monouatest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/monoua"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+	"github.com/stretchr/testify/assert"
+)
+
+func randItem(at time.Time) StatementItem {
+	return StatementItem{
+		ID:          "stmt-" + faker.UUIDHyphenated(),
+		Time:        at.Unix(),
+		Description: faker.Sentence(),
+		Amount:      -1050,
+	}
+}
+
+func TestBank(t *testing.T) {
+	from := time.Unix(faker.UnixTime(), 0).UTC().Truncate(24 * time.Hour)
+	account := Account{ID: "acc-" + faker.Word(), CurrencyCode: 980}
+	client := Client{XToken: "xt-" + faker.Word(), ClientID: faker.Word(), Name: faker.Name(), Accounts: []Account{account}}
+	userID := faker.Email()
+	ledgerAccountID := "ledger-acc-" + faker.Word()
+	fetcherCfg := banks.NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{{
+		UserID:    userID,
+		AccountID: ledgerAccountID,
+		Bank:      "monoua",
+		Settings:  map[string]string{"XToken": client.XToken, "BankAccount": account.ID},
+	}})
+	get := func(srv *Server, path string, xToken string) request.ResFactory {
+		return request.Do(context.TODO(), request.Get(srv.URL+path).WithHeader("X-Token", xToken))
+	}
+
+	t.Run("serve statements to the fetcher", func(t *testing.T) {
+		inRange := []StatementItem{randItem(from.Add(time.Hour)), randItem(from.Add(2 * time.Hour))}
+		account := account
+		account.Statements = append(inRange, randItem(from.Add(48*time.Hour)))
+		client := client
+		client.Accounts = []Account{account}
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+
+		fetcher, err := monoua.NewFetcherFactory(monoua.WithAPIURL(srv.URL))(context.TODO(), userID, fetcherCfg)
+		if !assert.NoError(t, err) {
+			return
+		}
+		trxs, err := fetcher.Fetch(context.TODO(), &banks.FetchParams{
+			From:            from,
+			To:              from.Add(24 * time.Hour),
+			LedgerAccountID: ledgerAccountID,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids := []string{}
+		for _, trx := range trxs {
+			dto, err := trx.ToDTO()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, ledgerAccountID, dto.AccountID)
+			ids = append(ids, dto.ID)
+		}
+		assert.Equal(t, []string{inRange[1].ID, inRange[0].ID}, ids)
+	})
+
+	t.Run("reject unknown token", func(t *testing.T) {
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+		var httpErr request.HTTPError
+		_, err := get(srv, "/personal/client-info", "other-"+faker.Word()).ReadAll()
+		if assert.ErrorAs(t, err, &httpErr) {
+			assert.Equal(t, http.StatusForbidden, httpErr.StatusCode)
+		}
+	})
+
+	t.Run("reject too long period", func(t *testing.T) {
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+		var httpErr request.HTTPError
+		path := "/personal/statement/" + account.ID + "/" + formatUnix(from) + "/" + formatUnix(from.Add(32*24*time.Hour))
+		_, err := get(srv, path, client.XToken).ReadAll()
+		if assert.ErrorAs(t, err, &httpErr) {
+			assert.Equal(t, http.StatusBadRequest, httpErr.StatusCode)
+		}
+	})
+
+	t.Run("rate limit requests", func(t *testing.T) {
+		srv := NewServer(WithClients(client), WithRateLimit(time.Minute))
+		defer srv.Close()
+		path := "/personal/statement/" + account.ID + "/" + formatUnix(from) + "/" + formatUnix(from.Add(time.Hour))
+		_, err := get(srv, path, client.XToken).ReadAll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		var httpErr request.HTTPError
+		_, err = get(srv, path, client.XToken).ReadAll()
+		if assert.ErrorAs(t, err, &httpErr) {
+			assert.Equal(t, http.StatusTooManyRequests, httpErr.StatusCode)
+		}
+		_, err = get(srv, "/personal/client-info", client.XToken).ReadAll()
+		assert.NoError(t, err)
+	})
+
+	t.Run("serve client info without token and statements", func(t *testing.T) {
+		account := account
+		account.Statements = []StatementItem{randItem(from)}
+		client := client
+		client.Accounts = []Account{account}
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+		var info Client
+		if !assert.NoError(t, get(srv, "/personal/client-info", client.XToken).DecodeJSON(&info)) {
+			return
+		}
+		assert.Equal(t, "", info.XToken)
+		assert.Equal(t, client.ClientID, info.ClientID)
+		if assert.Len(t, info.Accounts, 1) {
+			assert.Equal(t, account.ID, info.Accounts[0].ID)
+			assert.Nil(t, info.Accounts[0].Statements)
+		}
+	})
+
+	t.Run("send added statement items to webhook", func(t *testing.T) {
+		events := []WebHookEvent{}
+		webHook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				var event WebHookEvent
+				json.NewDecoder(req.Body).Decode(&event)
+				events = append(events, event)
+			}
+		}))
+		defer webHook.Close()
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+
+		body, _ := json.Marshal(map[string]string{"webHookUrl": webHook.URL})
+		req := request.Post(srv.URL+"/personal/webhook", "application/json", bytes.NewReader(body)).WithHeader("X-Token", client.XToken)
+		if _, err := request.Do(context.TODO(), req).ReadAll(); !assert.NoError(t, err) {
+			return
+		}
+		item := randItem(from)
+		if !assert.NoError(t, srv.AddStatementItem(account.ID, item)) {
+			return
+		}
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, account.ID, events[0].Data.Account)
+			assert.Equal(t, item, events[0].Data.StatementItem)
+		}
+		assert.Equal(t, []StatementItem{item}, srv.Clients()[0].Accounts[0].Statements)
+	})
+
+	t.Run("reject statement item of unknown account", func(t *testing.T) {
+		srv := NewServer(WithClients(client))
+		defer srv.Close()
+		assert.Error(t, srv.AddStatementItem("other-"+faker.Word(), randItem(from)))
+	})
+}
+
+func formatUnix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
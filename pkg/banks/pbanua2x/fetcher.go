@@ -21,11 +21,17 @@ import (
 
 var logger = diag.CreateLogger()
 
+const bankName = "pbanua2x"
+
+// MinFetchInterval is a minimal interval between statement requests,
+// merchant API rejects too frequent requests of the same merchant
+const MinFetchInterval = 15 * time.Second
+
 type userConfig struct {
 	UserID string
 
 	// Merchants is a map where key is LedgerAccountID and value is a merchant config
-	// that is configured for reading from that account
+	// of pbanua2x accounts of the user
 	Merchants map[string]*merchantConfig
 }
 
@@ -35,6 +41,9 @@ type merchantConfig struct {
 	BankAccount string
 }
 
+// MerchantSchema describes pbanua2x merchant settings
+var MerchantSchema = banks.NewMerchantSchema(bankName, merchantConfig{})
+
 type pbanua2xFetcher struct {
 	apiURL  string
 	userCfg *userConfig
@@ -56,7 +65,7 @@ func (f *pbanua2xFetcher) Fetch(ctx context.Context, params *banks.FetchParams)
 	data.WriteString(`<test>0</test>`)
 	data.WriteString(`<payment id="">`)
 	data.WriteString(`<prop name="sd" value="` + pbTimeForamt(params.From) + `" />`)
-	data.WriteString(`<prop name="ed" value="` + pbTimeForamt(params.To) + `" />`)
+	data.WriteString(`<prop name="ed" value="` + pbTimeForamt(params.LastInstant()) + `" />`)
 	data.WriteString(`<prop name="card" value="` + merchant.BankAccount + `" />`)
 	data.WriteString(`</payment>`)
 
@@ -94,11 +103,13 @@ func (f *pbanua2xFetcher) Fetch(ctx context.Context, params *banks.FetchParams)
 		return nil, err
 	}
 
+	// Merchant API responds with 200 if the request was rejected (e.g invalid signature or card),
+	// such requests will fail the same way if retried
 	if apiResp.Data.Error != nil {
-		return nil, fmt.Errorf("PB api call failed: %v", apiResp.Data.Error.Message)
+		return nil, request.Permanent(fmt.Errorf("PB api call failed: %v", apiResp.Data.Error.Message))
 	}
 	if apiResp.Data.Info.Statements == nil {
-		return nil, errors.New(apiResp.Data.Info.Value)
+		return nil, request.Permanent(errors.New(apiResp.Data.Info.Value))
 	}
 
 	statements := apiResp.Data.Info.Statements.Values
@@ -115,15 +126,50 @@ func (f *pbanua2xFetcher) Fetch(ctx context.Context, params *banks.FetchParams)
 	return trxs, err
 }
 
+// FetcherOpt is an option of a pbanua2x fetcher
+type FetcherOpt func(*pbanua2xFetcher)
+
+// WithAPIURL will send requests to given merchant API (e.g a fake bank)
+func WithAPIURL(apiURL string) FetcherOpt {
+	return func(f *pbanua2xFetcher) {
+		f.apiURL = apiURL
+	}
+}
+
+// NewFetcherFactory returns a factory of fetchers with given options
+func NewFetcherFactory(opts ...FetcherOpt) banks.FetcherFactory {
+	return func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+		return newFetcher(ctx, userID, cfg, opts...)
+	}
+}
+
 // NewFetcher creates an instance of a pbanua2x fetcher
 func NewFetcher(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
-	var userCfg userConfig
-	if err := cfg.GetUserConfig(ctx, userID, &userCfg); err != nil {
+	return newFetcher(ctx, userID, cfg)
+}
+
+func newFetcher(ctx context.Context, userID string, cfg banks.FetcherConfig, opts ...FetcherOpt) (banks.Fetcher, error) {
+	userCfg, err := banks.ReadUserConfig(ctx, cfg, userID)
+	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch user config")
 	}
-	return &pbanua2xFetcher{
-		// TODO: Parametrize
+	bankCfg := &userConfig{UserID: userCfg.UserID, Merchants: map[string]*merchantConfig{}}
+	for accountID, acc := range userCfg.Accounts {
+		if acc.Bank != bankName {
+			continue
+		}
+		var merchant merchantConfig
+		if err := acc.DecodeSettings(&merchant); err != nil {
+			return nil, request.Permanent(errors.Wrapf(err, "Failed to decode merchant settings of account %v", accountID))
+		}
+		bankCfg.Merchants[accountID] = &merchant
+	}
+	f := &pbanua2xFetcher{
 		apiURL:  "https://api.privatbank.ua/p24api/rest_fiz",
-		userCfg: &userCfg,
-	}, nil
+		userCfg: bankCfg,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f, nil
 }
@@ -5,11 +5,11 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"math/rand"
 	"net/url"
-	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -20,6 +20,7 @@ import (
 
 	"github.com/bxcodec/faker/v3"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,8 +30,11 @@ type mockConfig struct {
 
 func (cfg *mockConfig) GetUserConfig(ctx context.Context, userID string, receiver interface{}) error {
 	if userCfg, ok := cfg.userConfigs[userID]; ok {
-		reflect.ValueOf(receiver).Elem().Set(reflect.ValueOf(userCfg).Elem())
-		return nil
+		buffer, err := json.Marshal(userCfg)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(buffer, receiver)
 	}
 	return errors.New("Config not found, user: " + userID)
 }
@@ -40,8 +44,32 @@ func TestNewFetcher(t *testing.T) {
 		userID string
 	}
 
-	existingConfig := &userConfig{
+	existingAccount := &banks.AccountConfig{
+		Bank:     bankName,
+		Settings: map[string]string{"ID": "id-" + faker.Word(), "Password": "pwd-" + faker.Word(), "BankAccount": "ba-" + faker.Word()},
+	}
+	existingConfig := &banks.UserConfig{
 		UserID: "uid-" + faker.Word(),
+		Accounts: map[string]*banks.AccountConfig{
+			"acc-1-" + faker.Word(): existingAccount,
+			"acc-2-" + faker.Word(): {Bank: "monoua", Settings: map[string]string{"Other": faker.Word()}},
+		},
+	}
+	var existingAccountID string
+	for accountID, acc := range existingConfig.Accounts {
+		if acc == existingAccount {
+			existingAccountID = accountID
+		}
+	}
+	wantConfig := &userConfig{
+		UserID: existingConfig.UserID,
+		Merchants: map[string]*merchantConfig{
+			existingAccountID: &merchantConfig{
+				ID:          existingAccount.Settings["ID"],
+				Password:    existingAccount.Settings["Password"],
+				BankAccount: existingAccount.Settings["BankAccount"],
+			},
+		},
 	}
 
 	fetcherCfg := &mockConfig{
@@ -68,7 +96,7 @@ func TestNewFetcher(t *testing.T) {
 					return
 				}
 				bpfetcher := fetcher.(*pbanua2xFetcher)
-				assert.Equal(t, existingConfig, bpfetcher.userCfg)
+				assert.Equal(t, wantConfig, bpfetcher.userCfg)
 			},
 		},
 		{
@@ -155,7 +183,7 @@ func Test_pbanua2xFetcher_Fetch(t *testing.T) {
 					expectedData.WriteString(`<test>0</test>`)
 					expectedData.WriteString(`<payment id="">`)
 					expectedData.WriteString(`<prop name="sd" value="` + pbTimeForamt(fetchParams.From) + `" />`)
-					expectedData.WriteString(`<prop name="ed" value="` + pbTimeForamt(fetchParams.To) + `" />`)
+					expectedData.WriteString(`<prop name="ed" value="` + pbTimeForamt(fetchParams.To.AddDate(0, 0, -1)) + `" />`)
 					expectedData.WriteString(`<prop name="card" value="` + merchant.BankAccount + `" />`)
 					expectedData.WriteString(`</payment>`)
 
@@ -250,7 +278,7 @@ func Test_pbanua2xFetcher_Fetch(t *testing.T) {
 					expectedData.WriteString(`<test>0</test>`)
 					expectedData.WriteString(`<payment id="">`)
 					expectedData.WriteString(`<prop name="sd" value="` + pbTimeForamt(fetchParams.From) + `" />`)
-					expectedData.WriteString(`<prop name="ed" value="` + pbTimeForamt(fetchParams.To) + `" />`)
+					expectedData.WriteString(`<prop name="ed" value="` + pbTimeForamt(fetchParams.To.AddDate(0, 0, -1)) + `" />`)
 					expectedData.WriteString(`<prop name="card" value="` + merchant.BankAccount + `" />`)
 					expectedData.WriteString(`</payment>`)
 
@@ -291,6 +319,7 @@ func Test_pbanua2xFetcher_Fetch(t *testing.T) {
 						return
 					}
 					assert.EqualError(t, err, errorMessage)
+					assert.True(t, request.IsPermanent(err))
 				},
 			}
 		},
@@ -342,6 +371,7 @@ func Test_pbanua2xFetcher_Fetch(t *testing.T) {
 					}
 
 					assert.EqualError(t, err, "PB api call failed: "+errorMessage)
+					assert.True(t, request.IsPermanent(err))
 				},
 			}
 		},
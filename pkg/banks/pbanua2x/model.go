@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/xml"
+	"strings"
 	"time"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
@@ -79,6 +80,15 @@ func parseAmount(amountStr string) amountSpec {
 	}
 }
 
+// Currency returns the card currency, card amount is in the form "-10.50 UAH"
+func (stmt *apiStatement) Currency() string {
+	fields := strings.Fields(stmt.Cardamount)
+	if len(fields) != 2 {
+		return ""
+	}
+	return fields[1]
+}
+
 func (stmt *apiStatement) ToDTO() (*dal.PendingTransactionDTO, error) {
 	tranTime, err := time.ParseInLocation(
 		"2006-01-02 15:04:05", stmt.Trandate+" "+stmt.Trantime,
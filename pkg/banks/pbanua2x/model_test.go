@@ -99,3 +99,20 @@ func Test_apiStatement_ToDTO(t *testing.T) {
 		})
 	}
 }
+
+func Test_apiStatement_Currency(t *testing.T) {
+	tests := []struct {
+		name       string
+		cardamount string
+		want       string
+	}{
+		{name: "currency of the card amount", cardamount: "-10.50 USD", want: "USD"},
+		{name: "no currency", cardamount: "10.50", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := &apiStatement{Cardamount: tt.cardamount}
+			assert.Equal(t, tt.want, banks.CurrencyTransaction(stmt).Currency())
+		})
+	}
+}
@@ -0,0 +1,293 @@
+// Package pbanua2xtest provides a fake privat24 merchant API serving scripted data
+package pbanua2xtest
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// APIPath is a path of the merchant API on the fake server
+const APIPath = "/p24api/rest_fiz"
+
+// Statement is a card transaction as returned by the merchant API
+type Statement struct {
+	Card        string `xml:"card,attr" json:"card"`
+	Appcode     string `xml:"appcode,attr" json:"appcode"`
+	Trandate    string `xml:"trandate,attr" json:"trandate"`
+	Trantime    string `xml:"trantime,attr" json:"trantime"`
+	Amount      string `xml:"amount,attr" json:"amount"`
+	Cardamount  string `xml:"cardamount,attr" json:"cardamount"`
+	Rest        string `xml:"rest,attr" json:"rest"`
+	Terminal    string `xml:"terminal,attr" json:"terminal"`
+	Description string `xml:"description,attr" json:"description"`
+}
+
+// Merchant is a merchant registered for a card. Requests are signed with the Password
+type Merchant struct {
+	ID         string      `json:"id"`
+	Password   string      `json:"password"`
+	Card       string      `json:"card"`
+	Statements []Statement `json:"statements"`
+}
+
+type apiRequest struct {
+	XMLName  xml.Name    `xml:"request"`
+	Merchant apiMerchant `xml:"merchant"`
+	Data     struct {
+		// Raw is signed as is
+		Raw     string `xml:",innerxml"`
+		Oper    string `xml:"oper"`
+		Payment struct {
+			Props []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"prop"`
+		} `xml:"payment"`
+	} `xml:"data"`
+}
+
+type apiMerchant struct {
+	ID        string `xml:"id"`
+	Signature string `xml:"signature"`
+}
+
+type apiError struct {
+	Message string `xml:"message,attr"`
+}
+
+type apiStatements struct {
+	Status     string      `xml:"status,attr"`
+	Credit     string      `xml:"credit,attr"`
+	Debet      string      `xml:"debet,attr"`
+	Statements []Statement `xml:"statement"`
+}
+
+type apiInfo struct {
+	Value      string         `xml:",chardata"`
+	Statements *apiStatements `xml:"statements,omitempty"`
+}
+
+type apiResponse struct {
+	XMLName  xml.Name     `xml:"response"`
+	Version  string       `xml:"version,attr"`
+	Merchant *apiMerchant `xml:"merchant,omitempty"`
+	Data     struct {
+		Oper  string    `xml:"oper,omitempty"`
+		Error *apiError `xml:"error,omitempty"`
+		Info  *apiInfo  `xml:"info,omitempty"`
+	} `xml:"data"`
+}
+
+// Bank is a fake privat24 merchant API that keeps data in memory. It serves
+// statements (cmt operation) of merchants verifying signatures of requests.
+// GET /_fake/state returns merchants with statements and POST /_fake/statements
+// adds a statement, so the state can be inspected and changed when running out of process
+type Bank struct {
+	mtx       sync.Mutex
+	merchants []*Merchant
+}
+
+// BankOpt is an option of the fake bank
+type BankOpt func(*Bank)
+
+// WithMerchants will init the fake with given merchants and their statements
+func WithMerchants(merchants ...Merchant) BankOpt {
+	return func(b *Bank) {
+		for _, merchant := range merchants {
+			merchant := merchant
+			b.merchants = append(b.merchants, &merchant)
+		}
+	}
+}
+
+// NewBank returns a fake bank with given options
+func NewBank(opts ...BankOpt) *Bank {
+	b := &Bank{}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Merchants returns a snapshot of merchants with their statements
+func (b *Bank) Merchants() []Merchant {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	result := make([]Merchant, 0, len(b.merchants))
+	for _, merchant := range b.merchants {
+		snapshot := *merchant
+		snapshot.Statements = append([]Statement{}, merchant.Statements...)
+		result = append(result, snapshot)
+	}
+	return result
+}
+
+// AddStatement will add the statement to a merchant of the statement card.
+// Returns false if there is no merchant of the card
+func (b *Bank) AddStatement(stmt Statement) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, merchant := range b.merchants {
+		if merchant.Card == stmt.Card {
+			merchant.Statements = append(merchant.Statements, stmt)
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns a signature of request data signed with merchant password
+func Sign(data string, password string) string {
+	md5hash := md5.Sum([]byte(data + password))
+	signature := sha1.Sum([]byte(hex.EncodeToString(md5hash[:])))
+	return hex.EncodeToString(signature[:])
+}
+
+func writeXML(w http.ResponseWriter, res *apiResponse) {
+	res.Version = "1.0"
+	body, err := xml.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, message string) {
+	res := &apiResponse{}
+	res.Data.Error = &apiError{Message: message}
+	writeXML(w, res)
+}
+
+func (b *Bank) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/_fake/state" && req.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.Merchants())
+	case req.URL.Path == "/_fake/statements" && req.Method == http.MethodPost:
+		var stmt Statement
+		if err := json.NewDecoder(req.Body).Decode(&stmt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !b.AddStatement(stmt) {
+			http.Error(w, "No merchant of card "+stmt.Card, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case req.URL.Path == APIPath && req.Method == http.MethodPost:
+		b.serveAPI(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveAPI responds with errors in the response body and 200 status like the merchant API does
+func (b *Bank) serveAPI(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var apiReq apiRequest
+	if err := xml.Unmarshal(body, &apiReq); err != nil {
+		writeError(w, "invalid request: "+err.Error())
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var merchant *Merchant
+	for _, m := range b.merchants {
+		if m.ID == apiReq.Merchant.ID {
+			merchant = m
+			break
+		}
+	}
+	if merchant == nil {
+		writeError(w, "invalid merchant id")
+		return
+	}
+	if Sign(apiReq.Data.Raw, merchant.Password) != apiReq.Merchant.Signature {
+		logger.Info(req.Context(), "Rejecting request of merchant %v with invalid signature", merchant.ID)
+		writeError(w, "invalid signature")
+		return
+	}
+	if apiReq.Data.Oper != "cmt" {
+		writeError(w, "unsupported operation: "+apiReq.Data.Oper)
+		return
+	}
+
+	props := map[string]string{}
+	for _, prop := range apiReq.Data.Payment.Props {
+		props[prop.Name] = prop.Value
+	}
+	res := &apiResponse{}
+	res.Merchant = &apiMerchant{ID: merchant.ID, Signature: apiReq.Merchant.Signature}
+	res.Data.Oper = "cmt"
+	res.Data.Info = &apiInfo{}
+	if props["card"] != merchant.Card {
+		res.Data.Info.Value = "card not found"
+		writeXML(w, res)
+		return
+	}
+	from, err := time.Parse("2.1.2006", props["sd"])
+	if err != nil {
+		res.Data.Info.Value = "invalid date sd"
+		writeXML(w, res)
+		return
+	}
+	to, err := time.Parse("2.1.2006", props["ed"])
+	if err != nil {
+		res.Data.Info.Value = "invalid date ed"
+		writeXML(w, res)
+		return
+	}
+
+	statements := []Statement{}
+	for _, stmt := range merchant.Statements {
+		date, err := time.Parse("2006-01-02", stmt.Trandate)
+		if err != nil || date.Before(from) || date.After(to) {
+			continue
+		}
+		statements = append(statements, stmt)
+	}
+	res.Data.Info.Statements = &apiStatements{Status: "excellent", Statements: statements}
+	writeXML(w, res)
+}
+
+// Server is a fake bank listening on a local port
+type Server struct {
+	*Bank
+
+	// URL is the merchant API url of the fake
+	URL string
+
+	httpServer *httptest.Server
+}
+
+// Close will stop the server
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// NewServer starts a fake bank with given options on a local port
+func NewServer(opts ...BankOpt) *Server {
+	b := NewBank(opts...)
+	httpServer := httptest.NewServer(b)
+	return &Server{Bank: b, URL: httpServer.URL + APIPath, httpServer: httpServer}
+}
@@ -0,0 +1,109 @@
+package pbanua2xtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks/pbanua2x"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/stretchr/testify/assert"
+)
+
+func randStatement(card string, date time.Time) Statement {
+	return Statement{
+		Card:        card,
+		Appcode:     faker.UUIDDigit(),
+		Trandate:    date.Format("2006-01-02"),
+		Trantime:    date.Format("15:04:05"),
+		Amount:      "-10.50 UAH",
+		Cardamount:  "-10.50 UAH",
+		Rest:        "100.00 UAH",
+		Terminal:    faker.Word(),
+		Description: faker.Sentence(),
+	}
+}
+
+func TestBank(t *testing.T) {
+	from := time.Unix(faker.UnixTime(), 0).UTC().Truncate(24 * time.Hour)
+	merchant := Merchant{ID: "mid-" + faker.Word(), Password: "pwd-" + faker.Word(), Card: faker.CCNumber()}
+	userID := faker.Email()
+	ledgerAccountID := "ledger-acc-" + faker.Word()
+	newFetcher := func(t *testing.T, srv *Server, settings map[string]string) banks.Fetcher {
+		fetcherCfg := banks.NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{{
+			UserID:    userID,
+			AccountID: ledgerAccountID,
+			Bank:      "pbanua2x",
+			Settings:  settings,
+		}})
+		fetcher, err := pbanua2x.NewFetcherFactory(pbanua2x.WithAPIURL(srv.URL))(context.TODO(), userID, fetcherCfg)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return fetcher
+	}
+	fetchParams := &banks.FetchParams{From: from, To: from.Add(24 * time.Hour), LedgerAccountID: ledgerAccountID}
+
+	t.Run("serve statements to the fetcher", func(t *testing.T) {
+		inRange := randStatement(merchant.Card, from.Add(time.Hour))
+		merchant := merchant
+		merchant.Statements = []Statement{inRange, randStatement(merchant.Card, from.Add(48*time.Hour))}
+		srv := NewServer(WithMerchants(merchant))
+		defer srv.Close()
+
+		fetcher := newFetcher(t, srv, map[string]string{"ID": merchant.ID, "Password": merchant.Password, "BankAccount": merchant.Card})
+		trxs, err := fetcher.Fetch(context.TODO(), fetchParams)
+		if !assert.NoError(t, err) || !assert.Len(t, trxs, 1) {
+			return
+		}
+		dto, err := trxs[0].ToDTO()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, ledgerAccountID, dto.AccountID)
+		assert.Equal(t, "10.50", dto.Amount)
+		assert.Contains(t, dto.Comment, inRange.Description)
+	})
+
+	t.Run("serve added statements", func(t *testing.T) {
+		srv := NewServer(WithMerchants(merchant))
+		defer srv.Close()
+		stmt := randStatement(merchant.Card, from)
+		assert.True(t, srv.AddStatement(stmt))
+		assert.False(t, srv.AddStatement(randStatement("other-"+faker.Word(), from)))
+
+		fetcher := newFetcher(t, srv, map[string]string{"ID": merchant.ID, "Password": merchant.Password, "BankAccount": merchant.Card})
+		trxs, err := fetcher.Fetch(context.TODO(), fetchParams)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, trxs, 1)
+		assert.Equal(t, []Statement{stmt}, srv.Merchants()[0].Statements)
+	})
+
+	t.Run("reject invalid signature", func(t *testing.T) {
+		srv := NewServer(WithMerchants(merchant))
+		defer srv.Close()
+		fetcher := newFetcher(t, srv, map[string]string{"ID": merchant.ID, "Password": "other-" + faker.Word(), "BankAccount": merchant.Card})
+		_, err := fetcher.Fetch(context.TODO(), fetchParams)
+		assert.EqualError(t, err, "PB api call failed: invalid signature")
+	})
+
+	t.Run("reject unknown merchant", func(t *testing.T) {
+		srv := NewServer(WithMerchants(merchant))
+		defer srv.Close()
+		fetcher := newFetcher(t, srv, map[string]string{"ID": "other-" + faker.Word(), "Password": merchant.Password, "BankAccount": merchant.Card})
+		_, err := fetcher.Fetch(context.TODO(), fetchParams)
+		assert.EqualError(t, err, "PB api call failed: invalid merchant id")
+	})
+
+	t.Run("respond with info on unknown card", func(t *testing.T) {
+		srv := NewServer(WithMerchants(merchant))
+		defer srv.Close()
+		fetcher := newFetcher(t, srv, map[string]string{"ID": merchant.ID, "Password": merchant.Password, "BankAccount": "other-" + faker.Word()})
+		_, err := fetcher.Fetch(context.TODO(), fetchParams)
+		assert.EqualError(t, err, "card not found")
+	})
+}
@@ -0,0 +1,222 @@
+package banks
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MerchantSchema describes settings of a bank merchant config
+type MerchantSchema struct {
+	Bank   string
+	Fields []string
+}
+
+// NewMerchantSchema creates a schema of a bank merchant from a merchant config struct.
+// All exported fields of the struct are required
+func NewMerchantSchema(bank string, merchantConfig interface{}) MerchantSchema {
+	t := reflect.TypeOf(merchantConfig)
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields = append(fields, t.Field(i).Name)
+		}
+	}
+	return MerchantSchema{Bank: bank, Fields: fields}
+}
+
+// ConfigIssue is a problem found in a user fetcher config
+type ConfigIssue struct {
+	UserID string
+
+	// AccountID is a ledger account of the merchant, empty for user level issues
+	AccountID string
+	Message   string
+}
+
+func (i ConfigIssue) String() string {
+	if i.AccountID == "" {
+		return fmt.Sprintf("%v: %v", i.UserID, i.Message)
+	}
+	return fmt.Sprintf("%v, %v: %v", i.UserID, i.AccountID, i.Message)
+}
+
+// UserLister is implemented by configs that can list users they have configs for
+type UserLister interface {
+	ListUsers(ctx context.Context) ([]string, error)
+}
+
+var userConfigKeys = []string{"UserID", "Accounts"}
+
+var accountConfigKeys = []string{"Bank", "Settings"}
+
+func isLegacyUserConfig(raw map[string]interface{}) bool {
+	_, hasAccounts := raw["Accounts"]
+	_, hasMerchants := raw["Merchants"]
+	return hasMerchants && !hasAccounts
+}
+
+// ValidateUserConfig checks raw user config against merchant schemas of banks
+func ValidateUserConfig(userID string, raw map[string]interface{}, schemas []MerchantSchema) []ConfigIssue {
+	issues := []ConfigIssue{}
+	addIssue := func(accountID string, format string, args ...interface{}) {
+		issues = append(issues, ConfigIssue{UserID: userID, AccountID: accountID, Message: fmt.Sprintf(format, args...)})
+	}
+	if isLegacyUserConfig(raw) {
+		addIssue("", "legacy config format, convert it with: fetcher-config -cmd convert-files")
+		return issues
+	}
+	for _, key := range sortedKeys(raw) {
+		if !containsString(userConfigKeys, key) {
+			addIssue("", "unknown key %v%v", key, suggestKey(key, userConfigKeys))
+		}
+	}
+	if cfgUserID, ok := raw["UserID"]; !ok {
+		addIssue("", "missing UserID")
+	} else if cfgUserID != userID {
+		addIssue("", "UserID %v does not match config user", cfgUserID)
+	}
+	accounts, ok := raw["Accounts"].(map[string]interface{})
+	if !ok || len(accounts) == 0 {
+		addIssue("", "no accounts configured")
+		return issues
+	}
+	bankNames := make([]string, len(schemas))
+	for i, schema := range schemas {
+		bankNames[i] = schema.Bank
+	}
+	for _, accountID := range sortedKeys(accounts) {
+		account, ok := accounts[accountID].(map[string]interface{})
+		if !ok {
+			addIssue(accountID, "account config should be an object")
+			continue
+		}
+		for _, key := range sortedKeys(account) {
+			if !containsString(accountConfigKeys, key) {
+				addIssue(accountID, "unknown key %v%v", key, suggestKey(key, accountConfigKeys))
+			}
+		}
+		bank, _ := account["Bank"].(string)
+		schema := findSchema(bank, schemas)
+		if schema == nil {
+			addIssue(accountID, "unknown bank %q, expected one of: %v", bank, strings.Join(bankNames, ", "))
+			continue
+		}
+		settings, ok := account["Settings"].(map[string]interface{})
+		if !ok {
+			addIssue(accountID, "missing %v Settings", bank)
+			continue
+		}
+		for _, field := range schema.Fields {
+			value, ok := settings[field]
+			if !ok {
+				addIssue(accountID, "missing %v field %v", schema.Bank, field)
+				continue
+			}
+			if str, ok := value.(string); !ok || str == "" {
+				addIssue(accountID, "%v should be a non empty string", field)
+			}
+		}
+		for _, key := range sortedKeys(settings) {
+			if !containsString(schema.Fields, key) {
+				addIssue(accountID, "unknown %v key %v%v", schema.Bank, key, suggestKey(key, schema.Fields))
+			}
+		}
+	}
+	return issues
+}
+
+// ConvertLegacyUserConfig converts raw user config of a legacy format, where merchants
+// were stored under Merchants key, to a format where each account names its bank.
+// Bank of each merchant is detected by schemas. Returns false if config is not legacy
+func ConvertLegacyUserConfig(raw map[string]interface{}, schemas []MerchantSchema) (map[string]interface{}, bool, error) {
+	if !isLegacyUserConfig(raw) {
+		return raw, false, nil
+	}
+	merchants, ok := raw["Merchants"].(map[string]interface{})
+	if !ok {
+		return nil, false, errors.New("Merchants should be an object")
+	}
+	accounts := make(map[string]interface{}, len(merchants))
+	for accountID, merchant := range merchants {
+		settings, ok := merchant.(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("Merchant of account %v should be an object", accountID)
+		}
+		schema := detectSchema(settings, schemas)
+		if schema == nil {
+			return nil, false, fmt.Errorf("Unable to detect bank of account %v", accountID)
+		}
+		accounts[accountID] = map[string]interface{}{
+			"Bank":     schema.Bank,
+			"Settings": settings,
+		}
+	}
+	converted := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		if key != "Merchants" {
+			converted[key] = value
+		}
+	}
+	converted["Accounts"] = accounts
+	return converted, true, nil
+}
+
+func findSchema(bank string, schemas []MerchantSchema) *MerchantSchema {
+	for i, schema := range schemas {
+		if schema.Bank == bank {
+			return &schemas[i]
+		}
+	}
+	return nil
+}
+
+// detectSchema returns a schema that has most of the settings keys (case insensitive)
+func detectSchema(settings map[string]interface{}, schemas []MerchantSchema) *MerchantSchema {
+	var best *MerchantSchema
+	bestScore := 0
+	for i, schema := range schemas {
+		score := 0
+		for key := range settings {
+			if suggestKey(key, schema.Fields) != "" || containsString(schema.Fields, key) {
+				score++
+			}
+		}
+		if score > bestScore {
+			best = &schemas[i]
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func suggestKey(key string, known []string) string {
+	for _, candidate := range known {
+		if candidate != key && strings.EqualFold(candidate, key) {
+			return ", did you mean " + candidate + "?"
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
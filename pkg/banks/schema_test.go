@@ -0,0 +1,185 @@
+package banks
+
+import (
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMerchantSchema(t *testing.T) {
+	type merchantConfig struct {
+		ID       string
+		Password string
+		internal string
+	}
+	schema := NewMerchantSchema("bank1", merchantConfig{})
+	assert.Equal(t, MerchantSchema{Bank: "bank1", Fields: []string{"ID", "Password"}}, schema)
+}
+
+func TestValidateUserConfig(t *testing.T) {
+	schemas := []MerchantSchema{
+		{Bank: "bank1", Fields: []string{"ID", "Password", "BankAccount"}},
+		{Bank: "bank2", Fields: []string{"XToken", "BankAccount"}},
+	}
+	type testCase struct {
+		name   string
+		userID string
+		raw    map[string]interface{}
+		want   []ConfigIssue
+	}
+	tests := []func() testCase{
+		func() testCase {
+			userID := faker.Email()
+			return testCase{
+				name:   "no issues for valid config",
+				userID: userID,
+				raw: map[string]interface{}{
+					"UserID": userID,
+					"Accounts": map[string]interface{}{
+						"acc-1": map[string]interface{}{
+							"Bank":     "bank1",
+							"Settings": map[string]interface{}{"ID": "1", "Password": "pwd", "BankAccount": "123"},
+						},
+						"acc-2": map[string]interface{}{
+							"Bank":     "bank2",
+							"Settings": map[string]interface{}{"XToken": "token", "BankAccount": "321"},
+						},
+					},
+				},
+				want: []ConfigIssue{},
+			}
+		},
+		func() testCase {
+			userID := faker.Email()
+			return testCase{
+				name:   "legacy config",
+				userID: userID,
+				raw: map[string]interface{}{
+					"UserID":    userID,
+					"Merchants": map[string]interface{}{},
+				},
+				want: []ConfigIssue{
+					{UserID: userID, Message: "legacy config format, convert it with: fetcher-config -cmd convert-files"},
+				},
+			}
+		},
+		func() testCase {
+			userID := faker.Email()
+			otherUserID := faker.Email()
+			return testCase{
+				name:   "user level issues",
+				userID: userID,
+				raw: map[string]interface{}{
+					"UserID":   otherUserID,
+					"Account":  map[string]interface{}{},
+					"accounts": map[string]interface{}{},
+				},
+				want: []ConfigIssue{
+					{UserID: userID, Message: "unknown key Account"},
+					{UserID: userID, Message: "unknown key accounts, did you mean Accounts?"},
+					{UserID: userID, Message: "UserID " + otherUserID + " does not match config user"},
+					{UserID: userID, Message: "no accounts configured"},
+				},
+			}
+		},
+		func() testCase {
+			userID := faker.Email()
+			return testCase{
+				name:   "account level issues",
+				userID: userID,
+				raw: map[string]interface{}{
+					"Accounts": map[string]interface{}{
+						"acc-1": map[string]interface{}{
+							"Bank":     "bank2",
+							"Settings": map[string]interface{}{"Xtoken": "token", "Comment": "card"},
+						},
+						"acc-2": map[string]interface{}{
+							"Bank":     "bank1",
+							"Settings": map[string]interface{}{"ID": "1", "Password": "", "BankAccount": 123},
+						},
+						"acc-3": "not an object",
+						"acc-4": map[string]interface{}{"Bank": "bank3", "Settings": map[string]interface{}{}},
+						"acc-5": map[string]interface{}{"bank": "bank1"},
+						"acc-6": map[string]interface{}{"Bank": "bank1"},
+					},
+				},
+				want: []ConfigIssue{
+					{UserID: userID, Message: "missing UserID"},
+					{UserID: userID, AccountID: "acc-1", Message: "missing bank2 field XToken"},
+					{UserID: userID, AccountID: "acc-1", Message: "missing bank2 field BankAccount"},
+					{UserID: userID, AccountID: "acc-1", Message: "unknown bank2 key Comment"},
+					{UserID: userID, AccountID: "acc-1", Message: "unknown bank2 key Xtoken, did you mean XToken?"},
+					{UserID: userID, AccountID: "acc-2", Message: "Password should be a non empty string"},
+					{UserID: userID, AccountID: "acc-2", Message: "BankAccount should be a non empty string"},
+					{UserID: userID, AccountID: "acc-3", Message: "account config should be an object"},
+					{UserID: userID, AccountID: "acc-4", Message: `unknown bank "bank3", expected one of: bank1, bank2`},
+					{UserID: userID, AccountID: "acc-5", Message: "unknown key bank, did you mean Bank?"},
+					{UserID: userID, AccountID: "acc-5", Message: `unknown bank "", expected one of: bank1, bank2`},
+					{UserID: userID, AccountID: "acc-6", Message: "missing bank1 Settings"},
+				},
+			}
+		},
+	}
+	for _, tt := range tests {
+		tt := tt()
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidateUserConfig(tt.userID, tt.raw, schemas)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestConvertLegacyUserConfig(t *testing.T) {
+	schemas := []MerchantSchema{
+		{Bank: "bank1", Fields: []string{"ID", "Password", "BankAccount"}},
+		{Bank: "bank2", Fields: []string{"XToken", "BankAccount"}},
+	}
+	userID := faker.Email()
+
+	t.Run("convert legacy config", func(t *testing.T) {
+		bank1Settings := map[string]interface{}{"ID": "1", "Password": "pwd", "BankAccount": "123"}
+		bank2Settings := map[string]interface{}{"Xtoken": "token", "BankAccount": "321"}
+		got, converted, err := ConvertLegacyUserConfig(map[string]interface{}{
+			"UserID": userID,
+			"Merchants": map[string]interface{}{
+				"acc-1": bank1Settings,
+				"acc-2": bank2Settings,
+			},
+		}, schemas)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, converted)
+		assert.Equal(t, map[string]interface{}{
+			"UserID": userID,
+			"Accounts": map[string]interface{}{
+				"acc-1": map[string]interface{}{"Bank": "bank1", "Settings": bank1Settings},
+				"acc-2": map[string]interface{}{"Bank": "bank2", "Settings": bank2Settings},
+			},
+		}, got)
+		assert.Equal(t, []ConfigIssue{
+			{UserID: userID, AccountID: "acc-2", Message: "missing bank2 field XToken"},
+			{UserID: userID, AccountID: "acc-2", Message: "unknown bank2 key Xtoken, did you mean XToken?"},
+		}, ValidateUserConfig(userID, got, schemas))
+	})
+
+	t.Run("keep unified config", func(t *testing.T) {
+		raw := map[string]interface{}{"UserID": userID, "Accounts": map[string]interface{}{}}
+		got, converted, err := ConvertLegacyUserConfig(raw, schemas)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, converted)
+		assert.Equal(t, raw, got)
+	})
+
+	t.Run("fail if bank can not be detected", func(t *testing.T) {
+		_, _, err := ConvertLegacyUserConfig(map[string]interface{}{
+			"Merchants": map[string]interface{}{
+				"acc-1": map[string]interface{}{"Other": "value"},
+			},
+		}, schemas)
+		assert.EqualError(t, err, "Unable to detect bank of account acc-1")
+	})
+}
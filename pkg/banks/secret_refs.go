@@ -0,0 +1,88 @@
+package banks
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	envRefPrefix  = "env:"
+	fileRefPrefix = "file:"
+	ssmRefPrefix  = "ssm:"
+)
+
+// SecretResolver resolves references to secrets kept outside of the fetcher config.
+// Supported references are env:<VAR>, file:<path> and ssm:<parameter path>.
+// Values that are not references are returned as is
+type SecretResolver interface {
+	Resolve(ctx context.Context, value string) (string, error)
+}
+
+type secretResolver struct {
+	lookupEnv func(key string) (string, bool)
+	ssm       config.SSMParameterReader
+}
+
+func (r *secretResolver) Resolve(ctx context.Context, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, envRefPrefix):
+		name := strings.TrimPrefix(value, envRefPrefix)
+		resolved, ok := r.lookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Environment variable %v is not set", name)
+		}
+		return resolved, nil
+	case strings.HasPrefix(value, fileRefPrefix):
+		filePath := strings.TrimPrefix(value, fileRefPrefix)
+		buffer, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to read secret file %v", filePath)
+		}
+		// Secret files are usually written with a trailing new line
+		return strings.TrimRight(string(buffer), "\r\n"), nil
+	case strings.HasPrefix(value, ssmRefPrefix):
+		if r.ssm == nil {
+			return "", fmt.Errorf("SSM is not configured, can not resolve %v", value)
+		}
+		paramPath := strings.TrimPrefix(value, ssmRefPrefix)
+		resolved, err := r.ssm.GetParameter(ctx, paramPath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to get SSM parameter %v", paramPath)
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
+
+// SecretResolverOpt is an option of a secret resolver
+type SecretResolverOpt func(r *secretResolver)
+
+// WithSSMParameterReader enables resolution of ssm: references
+func WithSSMParameterReader(reader config.SSMParameterReader) SecretResolverOpt {
+	return func(r *secretResolver) {
+		r.ssm = reader
+	}
+}
+
+// WithLookupEnv overrides lookup of environment variables
+func WithLookupEnv(lookupEnv func(key string) (string, bool)) SecretResolverOpt {
+	return func(r *secretResolver) {
+		r.lookupEnv = lookupEnv
+	}
+}
+
+// NewSecretResolver creates a resolver of secret references
+func NewSecretResolver(opts ...SecretResolverOpt) SecretResolver {
+	r := &secretResolver{lookupEnv: os.LookupEnv}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
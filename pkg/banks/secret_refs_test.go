@@ -0,0 +1,165 @@
+package banks
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSSMParameterReader map[string]string
+
+func (m mockSSMParameterReader) GetParameter(ctx context.Context, path string) (string, error) {
+	value, ok := m[path]
+	if !ok {
+		return "", errors.New("SSM parameter not found: " + path)
+	}
+	return value, nil
+}
+
+func TestSecretResolver_Resolve(t *testing.T) {
+	type testCase struct {
+		name     string
+		resolver SecretResolver
+		value    string
+		assert   func(t *testing.T, got string, err error)
+	}
+	secretsDir := ensureTmpDir("secret-refs-test")
+	tests := []func() testCase{
+		func() testCase {
+			value := faker.Password()
+			return testCase{
+				name:     "return literal values as is",
+				resolver: NewSecretResolver(),
+				value:    value,
+				assert: func(t *testing.T, got string, err error) {
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, value, got)
+				},
+			}
+		},
+		func() testCase {
+			name := "SECRET_" + faker.Word()
+			value := faker.Password()
+			return testCase{
+				name: "resolve env reference",
+				resolver: NewSecretResolver(WithLookupEnv(func(key string) (string, bool) {
+					return value, key == name
+				})),
+				value: "env:" + name,
+				assert: func(t *testing.T, got string, err error) {
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, value, got)
+				},
+			}
+		},
+		func() testCase {
+			name := "SECRET_" + faker.Word()
+			return testCase{
+				name: "fail if env variable is missing",
+				resolver: NewSecretResolver(WithLookupEnv(func(key string) (string, bool) {
+					return "", false
+				})),
+				value: "env:" + name,
+				assert: func(t *testing.T, got string, err error) {
+					assert.EqualError(t, err, "Environment variable "+name+" is not set")
+				},
+			}
+		},
+		func() testCase {
+			value := faker.Password()
+			secretFile := path.Join(secretsDir, faker.Word())
+			if err := ioutil.WriteFile(secretFile, []byte(value+"\n"), os.ModePerm); err != nil {
+				panic(err)
+			}
+			return testCase{
+				name:     "resolve file reference",
+				resolver: NewSecretResolver(),
+				value:    "file:" + secretFile,
+				assert: func(t *testing.T, got string, err error) {
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, value, got)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name:     "fail if file is missing",
+				resolver: NewSecretResolver(),
+				value:    "file:" + path.Join(secretsDir, "missing-"+faker.Word()),
+				assert: func(t *testing.T, got string, err error) {
+					assert.Error(t, err)
+				},
+			}
+		},
+		func() testCase {
+			paramPath := "/" + faker.Word() + "/" + faker.Word()
+			value := faker.Password()
+			return testCase{
+				name:     "resolve ssm reference",
+				resolver: NewSecretResolver(WithSSMParameterReader(mockSSMParameterReader{paramPath: value})),
+				value:    "ssm:" + paramPath,
+				assert: func(t *testing.T, got string, err error) {
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, value, got)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name:     "fail if ssm is not configured",
+				resolver: NewSecretResolver(),
+				value:    "ssm:/" + faker.Word(),
+				assert: func(t *testing.T, got string, err error) {
+					assert.Error(t, err)
+				},
+			}
+		},
+	}
+	for _, tt := range tests {
+		tt := tt()
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.resolver.Resolve(context.TODO(), tt.value)
+			tt.assert(t, got, err)
+		})
+	}
+}
+
+func TestFSFetcherConfig_SecretReferences(t *testing.T) {
+	type userConfig struct {
+		Merchant string
+		Password string
+		Limit    int64
+	}
+	configDir := ensureTmpDir("bank-config-refs-test")
+	userID := faker.Word()
+	merchant := faker.Word()
+	password := faker.Password()
+	paramPath := "/" + faker.Word() + "/password"
+	buffer := []byte(`{"Merchant": "` + merchant + `", "Password": "ssm:` + paramPath + `", "Limit": 9007199254740993}`)
+	if err := ioutil.WriteFile(path.Join(configDir, userID+".json"), buffer, os.ModePerm); !assert.NoError(t, err) {
+		return
+	}
+
+	cfg := NewFSFetcherConfig(configDir, WithSecretResolver(
+		NewSecretResolver(WithSSMParameterReader(mockSSMParameterReader{paramPath: password})),
+	))
+	var got userConfig
+	if err := cfg.GetUserConfig(context.TODO(), userID, &got); !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, userConfig{Merchant: merchant, Password: password, Limit: 9007199254740993}, got)
+}
@@ -0,0 +1,63 @@
+package banks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// UserConfig is a fetcher config of a user
+type UserConfig struct {
+	UserID string
+
+	// Accounts is a map where key is LedgerAccountID and value is a bank
+	// merchant config that is used to fetch transactions of that account
+	Accounts map[string]*AccountConfig
+}
+
+// AccountConfig names the bank of a ledger account and carries bank specific merchant settings
+type AccountConfig struct {
+	Bank     string
+	Settings map[string]string
+}
+
+// DecodeSettings will decode merchant settings into a bank specific receiver
+func (acc *AccountConfig) DecodeSettings(receiver interface{}) error {
+	buffer, err := json.Marshal(acc.Settings)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buffer, receiver)
+}
+
+// legacyUserConfig is a config format where all merchants of a user were
+// stored under Merchants key without a bank
+type legacyUserConfig struct {
+	UserConfig
+	Merchants json.RawMessage
+}
+
+// ReadUserConfig will read a user config from the fetcher config
+func ReadUserConfig(ctx context.Context, cfg FetcherConfig, userID string) (*UserConfig, error) {
+	var userCfg legacyUserConfig
+	if err := cfg.GetUserConfig(ctx, userID, &userCfg); err != nil {
+		return nil, err
+	}
+	if userCfg.Accounts == nil && userCfg.Merchants != nil {
+		return nil, fmt.Errorf("Config of user %v has a legacy format, please convert it with: fetcher-config -cmd convert-files", userID)
+	}
+	return &userCfg.UserConfig, nil
+}
+
+// GetAccountBank returns a bank configured for a given ledger account of the user
+func GetAccountBank(ctx context.Context, cfg FetcherConfig, userID string, accountID string) (string, error) {
+	userCfg, err := ReadUserConfig(ctx, cfg, userID)
+	if err != nil {
+		return "", err
+	}
+	acc, ok := userCfg.Accounts[accountID]
+	if !ok || acc.Bank == "" {
+		return "", fmt.Errorf("No bank configured for account: %v", accountID)
+	}
+	return acc.Bank, nil
+}
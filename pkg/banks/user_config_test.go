@@ -0,0 +1,82 @@
+package banks
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUserConfig(t *testing.T) {
+	configDir := ensureTmpDir("user-config-test")
+	schemas := []MerchantSchema{
+		{Bank: "bank1", Fields: []string{"ID", "Password"}},
+		{Bank: "bank2", Fields: []string{"XToken"}},
+	}
+	legacyUserID := faker.Word()
+	legacyConfig := `{"UserID": "` + legacyUserID + `", "Merchants": {"acc-1": {"ID": "1", "Password": "pwd"}, "acc-2": {"XToken": "token"}}}`
+	if err := ioutil.WriteFile(path.Join(configDir, legacyUserID+".json"), []byte(legacyConfig), os.ModePerm); !assert.NoError(t, err) {
+		return
+	}
+	cfg := NewFSFetcherConfig(configDir)
+
+	t.Run("fail for legacy config", func(t *testing.T) {
+		_, err := ReadUserConfig(context.TODO(), cfg, legacyUserID)
+		assert.EqualError(t, err, "Config of user "+legacyUserID+" has a legacy format, please convert it with: fetcher-config -cmd convert-files")
+	})
+
+	t.Run("convert legacy configs", func(t *testing.T) {
+		converted, err := cfg.(LegacyConfigConverter).ConvertLegacyConfigs(context.TODO(), schemas)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, converted)
+		got, err := ReadUserConfig(context.TODO(), cfg, legacyUserID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, &UserConfig{
+			UserID: legacyUserID,
+			Accounts: map[string]*AccountConfig{
+				"acc-1": {Bank: "bank1", Settings: map[string]string{"ID": "1", "Password": "pwd"}},
+				"acc-2": {Bank: "bank2", Settings: map[string]string{"XToken": "token"}},
+			},
+		}, got)
+
+		converted, err = cfg.(LegacyConfigConverter).ConvertLegacyConfigs(context.TODO(), schemas)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 0, converted)
+	})
+}
+
+func TestGetAccountBank(t *testing.T) {
+	userID := faker.Email()
+	merchant := dal.FetcherMerchantDTO{
+		UserID:    userID,
+		AccountID: "acc-" + faker.Word(),
+		Bank:      "bank-" + faker.Word(),
+		Settings:  map[string]string{"XToken": faker.Word()},
+	}
+	cfg := NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{merchant})
+
+	t.Run("get bank of configured account", func(t *testing.T) {
+		bank, err := GetAccountBank(context.TODO(), cfg, userID, merchant.AccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, merchant.Bank, bank)
+	})
+
+	t.Run("fail if account is not configured", func(t *testing.T) {
+		accountID := "acc-" + faker.UUIDHyphenated()
+		_, err := GetAccountBank(context.TODO(), cfg, userID, accountID)
+		assert.EqualError(t, err, "No bank configured for account: "+accountID)
+	})
+}
@@ -0,0 +1,159 @@
+package configcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// Params represents what to validate
+type Params struct {
+	// UserIDs to validate configs of, all users are validated if empty
+	UserIDs []string
+
+	// CheckLedgerAccounts will check that configured ledger accounts exist.
+	// Requires user to be authenticated with ledger
+	CheckLedgerAccounts bool
+}
+
+// Service validates user fetcher configs
+type Service interface {
+	// Validate will return issues found in user configs
+	Validate(ctx context.Context, params *Params) ([]banks.ConfigIssue, error)
+}
+
+type service struct {
+	fetcherConfig banks.FetcherConfig
+	schemas       []banks.MerchantSchema
+	authSvc       auth.Service
+	apiFactory    ledger.APIFactory
+	ledgerURL     string
+}
+
+func (svc *service) Validate(ctx context.Context, params *Params) ([]banks.ConfigIssue, error) {
+	userIDs := params.UserIDs
+	if len(userIDs) == 0 {
+		lister, ok := svc.fetcherConfig.(banks.UserLister)
+		if !ok {
+			return nil, errors.New("Fetcher config can not list users, please provide users to validate")
+		}
+		var err error
+		if userIDs, err = lister.ListUsers(ctx); err != nil {
+			return nil, err
+		}
+	}
+	issues := []banks.ConfigIssue{}
+	for _, userID := range userIDs {
+		logger.Info(ctx, "Validating config of user: %v", userID)
+		var raw map[string]interface{}
+		if err := svc.fetcherConfig.GetUserConfig(ctx, userID, &raw); err != nil {
+			issues = append(issues, banks.ConfigIssue{
+				UserID:  userID,
+				Message: fmt.Sprintf("failed to read config: %v", err),
+			})
+			continue
+		}
+		issues = append(issues, banks.ValidateUserConfig(userID, raw, svc.schemas)...)
+		if params.CheckLedgerAccounts {
+			issues = append(issues, svc.checkLedgerAccounts(ctx, userID, raw)...)
+		}
+	}
+	return issues, nil
+}
+
+func (svc *service) checkLedgerAccounts(ctx context.Context, userID string, raw map[string]interface{}) []banks.ConfigIssue {
+	configuredAccounts, ok := raw["Accounts"].(map[string]interface{})
+	if !ok || len(configuredAccounts) == 0 {
+		return nil
+	}
+	accounts, err := svc.listAccounts(ctx, userID)
+	if err != nil {
+		return []banks.ConfigIssue{{
+			UserID:  userID,
+			Message: fmt.Sprintf("failed to list ledger accounts: %v", err),
+		}}
+	}
+	accountIDs := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		accountIDs[account.ID] = true
+	}
+	configuredAccountIDs := make([]string, 0, len(configuredAccounts))
+	for accountID := range configuredAccounts {
+		configuredAccountIDs = append(configuredAccountIDs, accountID)
+	}
+	sort.Strings(configuredAccountIDs)
+	issues := []banks.ConfigIssue{}
+	for _, accountID := range configuredAccountIDs {
+		if !accountIDs[accountID] {
+			issues = append(issues, banks.ConfigIssue{
+				UserID:    userID,
+				AccountID: accountID,
+				Message:   "ledger account not found",
+			})
+		}
+	}
+	return issues
+}
+
+func (svc *service) listAccounts(ctx context.Context, userID string) ([]ledger.AccountDTO, error) {
+	api, err := svc.apiFactory(ctx, svc.ledgerURL, userID, func(ctx context.Context) (types.IDToken, error) {
+		return svc.authSvc.FetchAuthToken(ctx, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return api.ListAccounts(ctx)
+}
+
+// ServiceOpt is an option for config check service
+type ServiceOpt func(*service)
+
+// WithFetcherConfig will init the service with fetcher config to validate
+func WithFetcherConfig(cfg banks.FetcherConfig) ServiceOpt {
+	return func(svc *service) {
+		svc.fetcherConfig = cfg
+	}
+}
+
+// WithMerchantSchema will register a merchant schema of a bank
+func WithMerchantSchema(schema banks.MerchantSchema) ServiceOpt {
+	return func(svc *service) {
+		svc.schemas = append(svc.schemas, schema)
+	}
+}
+
+// WithAuthService will init the service with auth service
+func WithAuthService(authSvc auth.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.authSvc = authSvc
+	}
+}
+
+// WithLedgerAPI will init the service with ledger API factory and url
+func WithLedgerAPI(ledgerURL string, apiFactory ledger.APIFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.ledgerURL = ledgerURL
+		svc.apiFactory = apiFactory
+	}
+}
+
+// NewService returns an instance of a config check service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		apiFactory: ledger.NewAPI,
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
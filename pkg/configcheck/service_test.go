@@ -0,0 +1,168 @@
+package configcheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthService struct {
+	tokens map[string]types.IDToken
+}
+
+func (svc *mockAuthService) RegisterUser(ctx context.Context, oauthCode string) (string, error) {
+	return "", errors.New("Not supported")
+}
+
+func (svc *mockAuthService) FetchAuthToken(ctx context.Context, email string) (types.IDToken, error) {
+	token, ok := svc.tokens[email]
+	if !ok {
+		return "", errors.New("User not registered: " + email)
+	}
+	return token, nil
+}
+
+type mockAPI struct {
+	accounts []ledger.AccountDTO
+}
+
+func (a *mockAPI) ListAccounts(ctx context.Context) ([]ledger.AccountDTO, error) {
+	return a.accounts, nil
+}
+
+func (a *mockAPI) ListTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.TransactionDTO, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (a *mockAPI) ListPendingTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.PendingTransactionDTO, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (a *mockAPI) ReportPendingTransaction(ctx context.Context, trx ledger.PendingTransactionDTO) error {
+	return errors.New("Not supported")
+}
+
+func (a *mockAPI) ReportPendingTransactions(ctx context.Context, trxs []ledger.PendingTransactionDTO) []ledger.ReportResult {
+	return nil
+}
+
+func ensureTmpDir(name string) string {
+	var tmpDir = path.Join("..", "..", "tmp", name)
+	os.RemoveAll(tmpDir)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		panic(err)
+	}
+	return tmpDir
+}
+
+func Test_service_Validate(t *testing.T) {
+	configDir := ensureTmpDir("configcheck-test")
+	writeConfig := func(userID string, value interface{}) {
+		buffer, err := json.Marshal(value)
+		if err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(path.Join(configDir, userID+".json"), buffer, os.ModePerm); err != nil {
+			panic(err)
+		}
+	}
+
+	validUser := faker.Email()
+	writeConfig(validUser, map[string]interface{}{
+		"UserID": validUser,
+		"Accounts": map[string]interface{}{
+			"acc-1": map[string]interface{}{"Bank": "bank1", "Settings": map[string]string{"XToken": "token", "BankAccount": "123"}},
+			"acc-2": map[string]interface{}{"Bank": "bank1", "Settings": map[string]string{"XToken": "token", "BankAccount": "321"}},
+		},
+	})
+	invalidUser := faker.Email()
+	writeConfig(invalidUser, map[string]interface{}{
+		"UserID": invalidUser,
+		"Accounts": map[string]interface{}{
+			"acc-3": map[string]interface{}{"Bank": "bank1", "Settings": map[string]string{"XToken": "token"}},
+		},
+	})
+	unauthorizedUser := faker.Email()
+	writeConfig(unauthorizedUser, map[string]interface{}{
+		"UserID": unauthorizedUser,
+		"Accounts": map[string]interface{}{
+			"acc-4": map[string]interface{}{"Bank": "bank1", "Settings": map[string]string{"XToken": "token", "BankAccount": "123"}},
+		},
+	})
+
+	validToken := types.IDToken("token-" + faker.Word())
+	invalidToken := types.IDToken("token-" + faker.Word())
+	apis := map[types.IDToken]ledger.API{
+		validToken:   &mockAPI{accounts: []ledger.AccountDTO{{ID: "acc-1"}}},
+		invalidToken: &mockAPI{accounts: []ledger.AccountDTO{{ID: "acc-3"}}},
+	}
+	svc := NewService(
+		WithFetcherConfig(banks.NewFSFetcherConfig(configDir)),
+		WithMerchantSchema(banks.MerchantSchema{Bank: "bank1", Fields: []string{"XToken", "BankAccount"}}),
+		WithAuthService(&mockAuthService{tokens: map[string]types.IDToken{
+			validUser:   validToken,
+			invalidUser: invalidToken,
+		}}),
+		WithLedgerAPI("http://ledger", func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			idToken, err := tokens(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return apis[idToken], nil
+		}),
+	)
+
+	t.Run("validate given users", func(t *testing.T) {
+		issues, err := svc.Validate(context.TODO(), &Params{UserIDs: []string{validUser, invalidUser}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []banks.ConfigIssue{
+			{UserID: invalidUser, AccountID: "acc-3", Message: "missing bank1 field BankAccount"},
+		}, issues)
+	})
+
+	t.Run("validate all users", func(t *testing.T) {
+		issues, err := svc.Validate(context.TODO(), &Params{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, issues, 1)
+	})
+
+	t.Run("report missing user config", func(t *testing.T) {
+		missingUser := faker.Email()
+		issues, err := svc.Validate(context.TODO(), &Params{UserIDs: []string{missingUser}})
+		if !assert.NoError(t, err) || !assert.Len(t, issues, 1) {
+			return
+		}
+		assert.Equal(t, missingUser, issues[0].UserID)
+		assert.Contains(t, issues[0].Message, "failed to read config")
+	})
+
+	t.Run("check ledger accounts", func(t *testing.T) {
+		issues, err := svc.Validate(context.TODO(), &Params{
+			UserIDs:             []string{validUser, invalidUser, unauthorizedUser},
+			CheckLedgerAccounts: true,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []banks.ConfigIssue{
+			{UserID: validUser, AccountID: "acc-2", Message: "ledger account not found"},
+			{UserID: invalidUser, AccountID: "acc-3", Message: "missing bank1 field BankAccount"},
+			{UserID: unauthorizedUser, Message: "failed to list ledger accounts: User not registered: " + unauthorizedUser},
+		}, issues)
+	})
+}
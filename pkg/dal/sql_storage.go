@@ -3,11 +3,16 @@ package dal
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+
 	// This has to be here to let go mods work work
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,6 +26,9 @@ func defaultNowFn() time.Time {
 type sqlStorage struct {
 	db    *sql.DB
 	nowFn nowFn
+
+	// cipher is optional, secrets are stored as is if not set
+	cipher secrets.Cipher
 }
 
 func (s *sqlStorage) Setup(ctx context.Context) error {
@@ -41,8 +49,107 @@ CREATE TABLE IF NOT EXISTS transactions(
 	created_at timestamp NOT NULL,
 	synced_at timestamp NULL
 );
+CREATE TABLE IF NOT EXISTS fetch_runs(
+	id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	bank nvarchar(50) NOT NULL,
+	user_id nvarchar(255) NOT NULL,
+	account_id nvarchar(255) NOT NULL,
+	from_time timestamp NOT NULL,
+	to_time timestamp NOT NULL,
+	fetched_count integer NOT NULL,
+	new_count integer NOT NULL,
+	duplicate_count integer NOT NULL,
+	failed_count integer NOT NULL,
+	started_at timestamp NOT NULL,
+	duration_ms integer NOT NULL,
+	error text NOT NULL
+);
+CREATE TABLE IF NOT EXISTS fetch_cursors(
+	user_id nvarchar(255) NOT NULL,
+	bank nvarchar(50) NOT NULL,
+	account_id nvarchar(255) NOT NULL,
+	fetched_to timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	PRIMARY KEY(user_id, bank, account_id)
+);
+CREATE TABLE IF NOT EXISTS transaction_changes(
+	id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+	transaction_id nvarchar(50) NOT NULL,
+	action nvarchar(50) NOT NULL,
+	details text NOT NULL,
+	changed_at timestamp NOT NULL
+);
+CREATE TABLE IF NOT EXISTS fetcher_merchants(
+	user_id nvarchar(255) NOT NULL,
+	account_id nvarchar(255) NOT NULL,
+	bank nvarchar(50) NOT NULL,
+	settings text NOT NULL,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL,
+	PRIMARY KEY(user_id, account_id)
+);
+CREATE TABLE IF NOT EXISTS ledger_sessions(
+	user_id nvarchar(255) NOT NULL PRIMARY KEY,
+	session text NOT NULL,
+	csrf_token text NOT NULL,
+	created_at timestamp NOT NULL
+);
+CREATE TABLE IF NOT EXISTS locks(
+	key nvarchar(255) NOT NULL PRIMARY KEY,
+	owner nvarchar(255) NOT NULL,
+	acquired_at timestamp NOT NULL,
+	expires_at timestamp NOT NULL
+);
 `)
-	return errors.Wrap(err, "Failed to setup storage")
+	if err != nil {
+		return errors.Wrap(err, "Failed to setup storage")
+	}
+	for _, migration := range columnMigrations {
+		if err := s.addColumnIfMissing(ctx, migration.table, migration.column, migration.definition); err != nil {
+			return errors.Wrap(err, "Failed to setup storage")
+		}
+	}
+	return nil
+}
+
+// columnMigrations are columns that were added to existing tables,
+// they are added by setup if missing
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"transactions", "sync_attempts", "integer NOT NULL DEFAULT 0"},
+	{"transactions", "last_sync_error", "text NOT NULL DEFAULT ''"},
+	{"transactions", "last_sync_attempt_at", "timestamp NULL"},
+	{"transactions", "next_sync_at", "timestamp NULL"},
+	{"transactions", "dead_lettered_at", "timestamp NULL"},
+	{"transactions", "ignored_at", "timestamp NULL"},
+	{"transactions", "user_id", "nvarchar(255) NOT NULL DEFAULT ''"},
+	{"fetch_runs", "error_category", "nvarchar(20) NOT NULL DEFAULT ''"},
+}
+
+func (s *sqlStorage) addColumnIfMissing(ctx context.Context, table, column, definition string) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT name FROM pragma_table_info($1)", table)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get %v columns", table)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return errors.Wrapf(err, "Failed to scan %v column", table)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrapf(err, "Failed to get %v columns", table)
+	}
+	logger.Info(ctx, "Adding column %v.%v", table, column)
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", table, column, definition))
+	return errors.Wrapf(err, "Failed to add column %v.%v", table, column)
 }
 
 // TODO: Add context (for others as well)
@@ -63,32 +170,273 @@ func (s *sqlStorage) GetAuthTokenByEmail(ctx context.Context, email string) (*Au
 		return nil, fmt.Errorf("Unknown user: %v", email)
 	}
 
+	var idToken, refreshToken string
 	result := &AuthTokenDTO{}
 	if err := res.Scan(
 		&result.Email,
-		&result.IDToken,
-		&result.RefreshToken,
+		&idToken,
+		&refreshToken,
 	); err != nil {
 		return nil, err
 	}
+	if idToken, err = s.decrypt(idToken); err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt id token")
+	}
+	if result.RefreshToken, err = s.decrypt(refreshToken); err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt refresh token")
+	}
+	result.IDToken = types.IDToken(idToken)
 	return result, nil
 }
 
 func (s *sqlStorage) SaveAuthToken(ctx context.Context, token *AuthTokenDTO) error {
+	idToken, err := s.encrypt(token.IDToken.Value())
+	if err != nil {
+		return errors.Wrap(err, "Failed to encrypt id token")
+	}
+	refreshToken, err := s.encrypt(token.RefreshToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encrypt refresh token")
+	}
 	if _, err := s.db.Exec(`
 	INSERT INTO users(email, id_token, refresh_token)
 	VALUES($1, $2, $3)
 	ON CONFLICT(email) DO UPDATE 
 	SET id_token=$2, refresh_token=$3
 	`,
-		token.Email, token.IDToken, token.RefreshToken); err != nil {
+		token.Email, idToken, refreshToken); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (s *sqlStorage) RotateSecrets(ctx context.Context) (int, error) {
+	if s.cipher == nil {
+		return 0, errors.New("No cipher configured")
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT email, id_token, refresh_token FROM users`)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to query users")
+	}
+	type userSecrets struct {
+		email        string
+		idToken      string
+		refreshToken string
+	}
+	users := []userSecrets{}
+	for rows.Next() {
+		var user userSecrets
+		if err := rows.Scan(&user.email, &user.idToken, &user.refreshToken); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "Failed to scan user")
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "Failed to query users")
+	}
+
+	rotated := 0
+	for _, user := range users {
+		if !s.cipher.NeedsRotation(user.idToken) && !s.cipher.NeedsRotation(user.refreshToken) {
+			continue
+		}
+		idToken, err := s.cipher.Rotate(user.idToken)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate id token of user %v", user.email)
+		}
+		refreshToken, err := s.cipher.Rotate(user.refreshToken)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate refresh token of user %v", user.email)
+		}
+		if _, err := s.db.ExecContext(ctx, `
+		UPDATE users SET id_token=$1, refresh_token=$2 WHERE email=$3
+		`, idToken, refreshToken, user.email); err != nil {
+			return rotated, errors.Wrapf(err, "Failed to save secrets of user %v", user.email)
+		}
+		rotated++
+	}
+
+	merchantsRotated, err := s.rotateMerchantSecrets(ctx)
+	rotated += merchantsRotated
+	if err != nil {
+		return rotated, err
+	}
+
+	sessionsRotated, err := s.rotateLedgerSessionSecrets(ctx)
+	return rotated + sessionsRotated, err
+}
+
+func (s *sqlStorage) rotateMerchantSecrets(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, account_id, settings FROM fetcher_merchants`)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to query merchants")
+	}
+	type merchantSecrets struct {
+		userID    string
+		accountID string
+		settings  string
+	}
+	merchants := []merchantSecrets{}
+	for rows.Next() {
+		var merchant merchantSecrets
+		if err := rows.Scan(&merchant.userID, &merchant.accountID, &merchant.settings); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "Failed to scan merchant")
+		}
+		merchants = append(merchants, merchant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "Failed to query merchants")
+	}
+
+	rotated := 0
+	for _, merchant := range merchants {
+		if !s.cipher.NeedsRotation(merchant.settings) {
+			continue
+		}
+		settings, err := s.cipher.Rotate(merchant.settings)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate settings of merchant %v, %v", merchant.userID, merchant.accountID)
+		}
+		if _, err := s.db.ExecContext(ctx, `
+		UPDATE fetcher_merchants SET settings=$1 WHERE user_id=$2 AND account_id=$3
+		`, settings, merchant.userID, merchant.accountID); err != nil {
+			return rotated, errors.Wrapf(err, "Failed to save settings of merchant %v, %v", merchant.userID, merchant.accountID)
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (s *sqlStorage) rotateLedgerSessionSecrets(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, session, csrf_token FROM ledger_sessions`)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to query ledger sessions")
+	}
+	type sessionSecrets struct {
+		userID    string
+		session   string
+		csrfToken string
+	}
+	sessions := []sessionSecrets{}
+	for rows.Next() {
+		var session sessionSecrets
+		if err := rows.Scan(&session.userID, &session.session, &session.csrfToken); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "Failed to scan ledger session")
+		}
+		sessions = append(sessions, session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "Failed to query ledger sessions")
+	}
+
+	rotated := 0
+	for _, session := range sessions {
+		if !s.cipher.NeedsRotation(session.session) && !s.cipher.NeedsRotation(session.csrfToken) {
+			continue
+		}
+		encryptedSession, err := s.cipher.Rotate(session.session)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate ledger session of user %v", session.userID)
+		}
+		csrfToken, err := s.cipher.Rotate(session.csrfToken)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to rotate ledger CSRF token of user %v", session.userID)
+		}
+
+		// Sessions started meanwhile are encrypted with the primary key already
+		res, err := s.db.ExecContext(ctx, `
+		UPDATE ledger_sessions SET session=$1, csrf_token=$2
+		WHERE user_id=$3 AND session=$4 AND csrf_token=$5
+		`, encryptedSession, csrfToken, session.userID, session.session, session.csrfToken)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to save ledger session of user %v", session.userID)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Failed to save ledger session of user %v", session.userID)
+		}
+		if affected > 0 {
+			rotated++
+		}
+	}
+	return rotated, nil
+}
+
+func (s *sqlStorage) encrypt(value string) (string, error) {
+	if s.cipher == nil {
+		return value, nil
+	}
+	return s.cipher.Encrypt(value)
+}
+
+func (s *sqlStorage) decrypt(value string) (string, error) {
+	if s.cipher == nil {
+		return value, nil
+	}
+	return s.cipher.Decrypt(value)
+}
+
+// execer is implemented by both sql.DB and sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
 func (s *sqlStorage) SavePendingTransaction(ctx context.Context, trx *PendingTransactionDTO) error {
-	if _, err := s.db.ExecContext(ctx, `
+	return s.savePendingTransaction(ctx, s.db, trx)
+}
+
+func (s *sqlStorage) SavePendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	for i := range trxs {
+		if err := s.savePendingTransaction(ctx, tx, &trxs[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Failed to commit transaction")
+	}
+	return nil
+}
+
+func (s *sqlStorage) SaveSyncResults(ctx context.Context, trxs []PendingTransactionDTO) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	for _, trx := range trxs {
+		if _, err := tx.ExecContext(ctx, `
+		UPDATE transactions
+		SET synced_at=$1, sync_attempts=$2, last_sync_error=$3, last_sync_attempt_at=$4,
+			next_sync_at=$5, dead_lettered_at=$6
+		WHERE id=$7 AND ignored_at IS NULL
+		`, trx.SyncedAt, trx.SyncAttempts, trx.LastSyncError,
+			trx.LastSyncAttemptAt, trx.NextSyncAt, trx.DeadLetteredAt, trx.ID); err != nil {
+			return errors.Wrapf(err, "Failed to save sync results of transaction: %v", trx.ID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Failed to commit transaction")
+	}
+	return nil
+}
+
+func (s *sqlStorage) savePendingTransaction(ctx context.Context, db execer, trx *PendingTransactionDTO) error {
+	if _, err := db.ExecContext(ctx, `
 	INSERT INTO transactions(
 		id,
 		amount,
@@ -97,19 +445,167 @@ func (s *sqlStorage) SavePendingTransaction(ctx context.Context, trx *PendingTra
 		account_id,
 		type_id,
 		created_at,
-		synced_at
+		synced_at,
+		sync_attempts,
+		last_sync_error,
+		last_sync_attempt_at,
+		next_sync_at,
+		dead_lettered_at,
+		ignored_at,
+		user_id
 	)
-	VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	ON CONFLICT(id) DO UPDATE 
-	SET amount=$2, date=$3, comment=$4, account_id=$5, type_id=$6, synced_at=$8
+	SET amount=$2, date=$3, comment=$4, account_id=$5, type_id=$6, synced_at=$8,
+		sync_attempts=$9, last_sync_error=$10, last_sync_attempt_at=$11, next_sync_at=$12, dead_lettered_at=$13,
+		ignored_at=$14, user_id=$15
 	`,
 		trx.ID, trx.Amount, trx.Date, trx.Comment,
-		trx.AccountID, trx.TypeID, s.nowFn().UTC(), trx.SyncedAt); err != nil {
+		trx.AccountID, trx.TypeID, s.nowFn().UTC(), trx.SyncedAt,
+		trx.SyncAttempts, trx.LastSyncError, trx.LastSyncAttemptAt, trx.NextSyncAt, trx.DeadLetteredAt,
+		trx.IgnoredAt, trx.UserID); err != nil {
 		return errors.Wrapf(err, "Failed to save transaction: %v, %v (%v)", trx.Amount, trx.Date, trx.Comment)
 	}
 	return nil
 }
 
+// savePendingTransactionChange will update changeable fields of a not synced transaction
+// or insert it if it does not exist yet
+func (s *sqlStorage) savePendingTransactionChange(ctx context.Context, tx *sql.Tx, trx *PendingTransactionDTO) error {
+	res, err := tx.ExecContext(ctx, `
+	UPDATE transactions
+	SET amount=$1, date=$2, comment=$3, type_id=$4, ignored_at=$5
+	WHERE id=$6 AND synced_at IS NULL
+	`, trx.Amount, trx.Date, trx.Comment, trx.TypeID, trx.IgnoredAt, trx.ID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save transaction: %v", trx.ID)
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get number of updated transactions")
+	}
+	if updated > 0 {
+		return nil
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM transactions WHERE id=$1)`, trx.ID).Scan(&exists); err != nil {
+		return errors.Wrapf(err, "Failed to check if transaction exists: %v", trx.ID)
+	}
+	if exists {
+		return &TransactionSyncedError{ID: trx.ID}
+	}
+	return s.savePendingTransaction(ctx, tx, trx)
+}
+
+func (s *sqlStorage) SavePendingTransactionChange(ctx context.Context, trx *PendingTransactionDTO, change *TransactionChangeDTO) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if err := s.savePendingTransactionChange(ctx, tx, trx); err != nil {
+		return err
+	}
+
+	change.TransactionID = trx.ID
+	change.ChangedAt = s.nowFn().UTC()
+	res, err := tx.ExecContext(ctx, `
+	INSERT INTO transaction_changes(transaction_id, action, details, changed_at)
+	VALUES($1, $2, $3, $4)
+	`, change.TransactionID, change.Action, change.Details, change.ChangedAt)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record transaction change: %v", trx.ID)
+	}
+	if change.ID, err = res.LastInsertId(); err != nil {
+		return errors.Wrap(err, "Failed to get transaction change id")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "Failed to commit transaction")
+	}
+	return nil
+}
+
+func (s *sqlStorage) FindTransactionChanges(ctx context.Context, transactionID string) ([]TransactionChangeDTO, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, transaction_id, action, details, changed_at
+	FROM transaction_changes
+	WHERE transaction_id=$1
+	ORDER BY id
+	`, transactionID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query transaction changes")
+	}
+	defer rows.Close()
+
+	changes := []TransactionChangeDTO{}
+	for rows.Next() {
+		change := TransactionChangeDTO{}
+		if err := rows.Scan(
+			&change.ID,
+			&change.TransactionID,
+			&change.Action,
+			&change.Details,
+			&change.ChangedAt,
+		); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan transaction change")
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqlStorage) InsertNewPendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+	INSERT INTO transactions(
+		id,
+		amount,
+		date,
+		comment,
+		account_id,
+		type_id,
+		created_at,
+		user_id
+	)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT(id) DO NOTHING
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to prepare insert statement")
+	}
+	defer stmt.Close()
+
+	createdAt := s.nowFn().UTC()
+	insertedIDs := []string{}
+	for _, trx := range trxs {
+		res, err := stmt.ExecContext(ctx,
+			trx.ID, trx.Amount, trx.Date, trx.Comment,
+			trx.AccountID, trx.TypeID, createdAt, trx.UserID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to insert transaction: %v, %v (%v)", trx.Amount, trx.Date, trx.Comment)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to insert transaction: %v, %v (%v)", trx.Amount, trx.Date, trx.Comment)
+		}
+		if affected > 0 {
+			insertedIDs = append(insertedIDs, trx.ID)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "Failed to commit transaction")
+	}
+	return insertedIDs, nil
+}
+
 func (s *sqlStorage) PendingTransactionExist(ctx context.Context, id string) (bool, error) {
 	rows := s.db.QueryRowContext(ctx, `
 	SELECT COUNT(1) FROM transactions
@@ -122,18 +618,14 @@ func (s *sqlStorage) PendingTransactionExist(ctx context.Context, id string) (bo
 	return count > 0, nil
 }
 
-func (s *sqlStorage) FindNotSyncedTransactions(ctx context.Context, accountID string) ([]PendingTransactionDTO, error) {
-	rows, err := s.db.QueryContext(ctx, `
+const selectTransactionsSQL = `
 	SELECT 
-		id, amount, date, comment, account_id, type_id, created_at, synced_at
-	FROM transactions 
-	WHERE account_id=$1 and synced_at IS NULL
-	`, accountID)
-
-	if err != nil {
-		return nil, errors.Wrap(err, "Failed to query not synced transactions")
-	}
+		id, amount, date, comment, account_id, type_id, created_at, synced_at,
+		sync_attempts, last_sync_error, last_sync_attempt_at, next_sync_at, dead_lettered_at,
+		ignored_at, user_id
+	FROM transactions`
 
+func scanTransactions(rows *sql.Rows) ([]PendingTransactionDTO, error) {
 	defer rows.Close()
 
 	trxs := []PendingTransactionDTO{}
@@ -148,13 +640,469 @@ func (s *sqlStorage) FindNotSyncedTransactions(ctx context.Context, accountID st
 			&trx.TypeID,
 			&trx.CreatedAt,
 			&trx.SyncedAt,
+			&trx.SyncAttempts,
+			&trx.LastSyncError,
+			&trx.LastSyncAttemptAt,
+			&trx.NextSyncAt,
+			&trx.DeadLetteredAt,
+			&trx.IgnoredAt,
+			&trx.UserID,
 		); err != nil {
 			return nil, errors.Wrap(err, "Failed to scan trx")
 		}
 		trxs = append(trxs, *trx)
 	}
 
-	return trxs, nil
+	return trxs, rows.Err()
+}
+
+func (s *sqlStorage) FindNotSyncedTransactions(ctx context.Context, accountID string) ([]PendingTransactionDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectTransactionsSQL+`
+	WHERE account_id=$1 AND synced_at IS NULL AND dead_lettered_at IS NULL AND ignored_at IS NULL
+		AND (next_sync_at IS NULL OR next_sync_at <= $2)
+	`, accountID, s.nowFn().UTC())
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query not synced transactions")
+	}
+
+	return scanTransactions(rows)
+}
+
+func (s *sqlStorage) FindNotSyncedTransactionsByUser(ctx context.Context, userID string) ([]PendingTransactionDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectTransactionsSQL+`
+	WHERE (user_id=$1 OR (user_id='' AND account_id IN (SELECT account_id FROM fetch_cursors WHERE user_id=$1)))
+		AND synced_at IS NULL AND dead_lettered_at IS NULL AND ignored_at IS NULL
+		AND (next_sync_at IS NULL OR next_sync_at <= $2)
+	ORDER BY account_id
+	`, userID, s.nowFn().UTC())
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query not synced transactions of user")
+	}
+
+	return scanTransactions(rows)
+}
+
+func (s *sqlStorage) GetPendingTransaction(ctx context.Context, id string) (*PendingTransactionDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectTransactionsSQL+`
+	WHERE id=$1
+	`, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query transaction")
+	}
+	trxs, err := scanTransactions(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(trxs) == 0 {
+		return nil, nil
+	}
+	return &trxs[0], nil
+}
+
+func (s *sqlStorage) FindPendingTransactions(ctx context.Context, filter PendingTransactionsFilter) ([]PendingTransactionDTO, error) {
+	conditions := []string{"1=1"}
+	args := []interface{}{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.AccountID != "" {
+		addCondition("account_id=$%v", filter.AccountID)
+	}
+	if filter.Comment != "" {
+		addCondition("comment LIKE '%%' || $%v || '%%'", filter.Comment)
+	}
+	switch filter.Status {
+	case "":
+	case TransactionStatusNotSynced:
+		conditions = append(conditions, "synced_at IS NULL AND ignored_at IS NULL AND dead_lettered_at IS NULL")
+	case TransactionStatusSynced:
+		conditions = append(conditions, "synced_at IS NOT NULL")
+	case TransactionStatusIgnored:
+		conditions = append(conditions, "synced_at IS NULL AND ignored_at IS NOT NULL")
+	case TransactionStatusDeadLettered:
+		conditions = append(conditions, "synced_at IS NULL AND ignored_at IS NULL AND dead_lettered_at IS NOT NULL")
+	default:
+		return nil, fmt.Errorf("Unknown transaction status: %v", filter.Status)
+	}
+	query := selectTransactionsSQL + `
+	WHERE ` + strings.Join(conditions, " AND ") + `
+	ORDER BY created_at DESC, date DESC`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%v", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query transactions")
+	}
+	return scanTransactions(rows)
+}
+
+func (s *sqlStorage) FindDeadLetteredTransactions(ctx context.Context, accountID string) ([]PendingTransactionDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectTransactionsSQL+`
+	WHERE dead_lettered_at IS NOT NULL AND ignored_at IS NULL AND ($1 = '' OR account_id=$1)
+	ORDER BY dead_lettered_at
+	`, accountID)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query dead lettered transactions")
+	}
+
+	return scanTransactions(rows)
+}
+
+func (s *sqlStorage) RequeueDeadLetteredTransaction(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `
+	UPDATE transactions
+	SET sync_attempts=0, next_sync_at=NULL, dead_lettered_at=NULL
+	WHERE id=$1 AND dead_lettered_at IS NOT NULL
+	`, id)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to requeue transaction: %v", id)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to requeue transaction: %v", id)
+	}
+	if affected == 0 {
+		return fmt.Errorf("No dead lettered transaction: %v", id)
+	}
+	return nil
+}
+
+func (s *sqlStorage) SaveFetchRun(ctx context.Context, run *FetchRunDTO) error {
+	res, err := s.db.ExecContext(ctx, `
+	INSERT INTO fetch_runs(
+		bank,
+		user_id,
+		account_id,
+		from_time,
+		to_time,
+		fetched_count,
+		new_count,
+		duplicate_count,
+		failed_count,
+		started_at,
+		duration_ms,
+		error,
+		error_category
+	)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`,
+		run.Bank, run.UserID, run.AccountID, run.From.UTC(), run.To.UTC(),
+		run.Fetched, run.New, run.Duplicate, run.Failed,
+		run.StartedAt.UTC(), run.Duration.Milliseconds(), run.Error, run.ErrorCategory)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save fetch run: %v, %v (%v)", run.Bank, run.AccountID, run.StartedAt)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get fetch run id")
+	}
+	run.ID = id
+	return nil
+}
+
+func (s *sqlStorage) FindRecentFetchRuns(ctx context.Context, limit int) ([]FetchRunDTO, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT
+		id, bank, user_id, account_id, from_time, to_time,
+		fetched_count, new_count, duplicate_count, failed_count,
+		started_at, duration_ms, error, error_category
+	FROM fetch_runs
+	ORDER BY started_at DESC, id DESC
+	LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query fetch runs")
+	}
+
+	defer rows.Close()
+
+	runs := []FetchRunDTO{}
+	for rows.Next() {
+		run := FetchRunDTO{}
+		var durationMs int64
+		if err := rows.Scan(
+			&run.ID,
+			&run.Bank,
+			&run.UserID,
+			&run.AccountID,
+			&run.From,
+			&run.To,
+			&run.Fetched,
+			&run.New,
+			&run.Duplicate,
+			&run.Failed,
+			&run.StartedAt,
+			&durationMs,
+			&run.Error,
+			&run.ErrorCategory,
+		); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan fetch run")
+		}
+		run.Duration = time.Duration(durationMs) * time.Millisecond
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *sqlStorage) GetFetchCursor(ctx context.Context, userID, bank, accountID string) (*FetchCursorDTO, error) {
+	row := s.db.QueryRowContext(ctx, `
+	SELECT
+		user_id, bank, account_id, fetched_to, updated_at
+	FROM fetch_cursors
+	WHERE user_id=$1 AND bank=$2 AND account_id=$3
+	`, userID, bank, accountID)
+	cursor := &FetchCursorDTO{}
+	if err := row.Scan(
+		&cursor.UserID,
+		&cursor.Bank,
+		&cursor.AccountID,
+		&cursor.FetchedTo,
+		&cursor.UpdatedAt,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Failed to get fetch cursor")
+	}
+	return cursor, nil
+}
+
+func (s *sqlStorage) SaveFetchCursor(ctx context.Context, cursor *FetchCursorDTO) error {
+	cursor.UpdatedAt = s.nowFn().UTC()
+	if _, err := s.db.ExecContext(ctx, `
+	INSERT INTO fetch_cursors(user_id, bank, account_id, fetched_to, updated_at)
+	VALUES($1, $2, $3, $4, $5)
+	ON CONFLICT(user_id, bank, account_id) DO UPDATE
+	SET fetched_to=$4, updated_at=$5
+	`,
+		cursor.UserID, cursor.Bank, cursor.AccountID, cursor.FetchedTo.UTC(), cursor.UpdatedAt); err != nil {
+		return errors.Wrapf(err, "Failed to save fetch cursor: %v, %v", cursor.Bank, cursor.AccountID)
+	}
+	return nil
+}
+
+func (s *sqlStorage) SaveFetcherMerchant(ctx context.Context, merchant *FetcherMerchantDTO) error {
+	buffer, err := json.Marshal(merchant.Settings)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal merchant settings")
+	}
+	settings, err := s.encrypt(string(buffer))
+	if err != nil {
+		return errors.Wrap(err, "Failed to encrypt merchant settings")
+	}
+	now := s.nowFn().UTC()
+	if merchant.CreatedAt.IsZero() {
+		merchant.CreatedAt = now
+	}
+	merchant.UpdatedAt = now
+	if _, err := s.db.ExecContext(ctx, `
+	INSERT INTO fetcher_merchants(user_id, account_id, bank, settings, created_at, updated_at)
+	VALUES($1, $2, $3, $4, $5, $6)
+	ON CONFLICT(user_id, account_id) DO UPDATE
+	SET bank=$3, settings=$4, updated_at=$6
+	`,
+		merchant.UserID, merchant.AccountID, merchant.Bank, settings, merchant.CreatedAt.UTC(), merchant.UpdatedAt); err != nil {
+		return errors.Wrapf(err, "Failed to save merchant: %v, %v", merchant.UserID, merchant.AccountID)
+	}
+	return nil
+}
+
+func (s *sqlStorage) scanFetcherMerchants(rows *sql.Rows) ([]FetcherMerchantDTO, error) {
+	defer rows.Close()
+	result := []FetcherMerchantDTO{}
+	for rows.Next() {
+		var merchant FetcherMerchantDTO
+		var settings string
+		if err := rows.Scan(
+			&merchant.UserID,
+			&merchant.AccountID,
+			&merchant.Bank,
+			&settings,
+			&merchant.CreatedAt,
+			&merchant.UpdatedAt,
+		); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan merchant")
+		}
+		decrypted, err := s.decrypt(settings)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decrypt settings of merchant %v, %v", merchant.UserID, merchant.AccountID)
+		}
+		if err := json.Unmarshal([]byte(decrypted), &merchant.Settings); err != nil {
+			return nil, errors.Wrapf(err, "Failed to unmarshal settings of merchant %v, %v", merchant.UserID, merchant.AccountID)
+		}
+		result = append(result, merchant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to query merchants")
+	}
+	return result, nil
+}
+
+const selectFetcherMerchantsSQL = `
+	SELECT
+		user_id, account_id, bank, settings, created_at, updated_at
+	FROM fetcher_merchants`
+
+func (s *sqlStorage) GetFetcherMerchant(ctx context.Context, userID, accountID string) (*FetcherMerchantDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectFetcherMerchantsSQL+`
+	WHERE user_id=$1 AND account_id=$2
+	`, userID, accountID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query merchant")
+	}
+	merchants, err := s.scanFetcherMerchants(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(merchants) == 0 {
+		return nil, nil
+	}
+	return &merchants[0], nil
+}
+
+func (s *sqlStorage) FindFetcherMerchants(ctx context.Context, userID string) ([]FetcherMerchantDTO, error) {
+	rows, err := s.db.QueryContext(ctx, selectFetcherMerchantsSQL+`
+	WHERE $1 = '' OR user_id=$1
+	ORDER BY user_id, account_id
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query merchants")
+	}
+	return s.scanFetcherMerchants(rows)
+}
+
+func (s *sqlStorage) DeleteFetcherMerchant(ctx context.Context, userID, accountID string) error {
+	res, err := s.db.ExecContext(ctx, `
+	DELETE FROM fetcher_merchants WHERE user_id=$1 AND account_id=$2
+	`, userID, accountID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete merchant: %v, %v", userID, accountID)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete merchant: %v, %v", userID, accountID)
+	}
+	if affected == 0 {
+		return fmt.Errorf("Merchant not found: %v, %v", userID, accountID)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetLedgerSession(ctx context.Context, userID string) (*LedgerSessionDTO, error) {
+	row := s.db.QueryRowContext(ctx, `
+	SELECT
+		user_id, session, csrf_token, created_at
+	FROM ledger_sessions
+	WHERE user_id=$1
+	`, userID)
+	var session, csrfToken string
+	result := &LedgerSessionDTO{}
+	if err := row.Scan(
+		&result.UserID,
+		&session,
+		&csrfToken,
+		&result.CreatedAt,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to get ledger session of user %v", userID)
+	}
+	var err error
+	if result.Session, err = s.decrypt(session); err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt ledger session")
+	}
+	if result.CSRFToken, err = s.decrypt(csrfToken); err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt ledger CSRF token")
+	}
+	return result, nil
+}
+
+func (s *sqlStorage) SaveLedgerSession(ctx context.Context, session *LedgerSessionDTO) error {
+	encryptedSession, err := s.encrypt(session.Session)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encrypt ledger session")
+	}
+	csrfToken, err := s.encrypt(session.CSRFToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encrypt ledger CSRF token")
+	}
+	session.CreatedAt = s.nowFn().UTC()
+	if _, err := s.db.ExecContext(ctx, `
+	INSERT INTO ledger_sessions(user_id, session, csrf_token, created_at)
+	VALUES($1, $2, $3, $4)
+	ON CONFLICT(user_id) DO UPDATE
+	SET session=$2, csrf_token=$3, created_at=$4
+	`,
+		session.UserID, encryptedSession, csrfToken, session.CreatedAt); err != nil {
+		return errors.Wrapf(err, "Failed to save ledger session of user %v", session.UserID)
+	}
+	return nil
+}
+
+func (s *sqlStorage) AcquireLock(ctx context.Context, lock *LockDTO) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+	INSERT INTO locks(key, owner, acquired_at, expires_at)
+	VALUES($1, $2, $3, $4)
+	ON CONFLICT(key) DO UPDATE
+	SET owner=$2, acquired_at=$3, expires_at=$4
+	WHERE locks.expires_at < $3
+	`, lock.Key, lock.Owner, lock.AcquiredAt.UTC(), lock.ExpiresAt.UTC())
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to acquire lock: %v", lock.Key)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to acquire lock: %v", lock.Key)
+	}
+	return affected > 0, nil
+}
+
+func (s *sqlStorage) ExtendLock(ctx context.Context, lock *LockDTO) error {
+	res, err := s.db.ExecContext(ctx, `
+	UPDATE locks SET expires_at=$1 WHERE key=$2 AND owner=$3
+	`, lock.ExpiresAt.UTC(), lock.Key, lock.Owner)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to extend lock: %v", lock.Key)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to extend lock: %v", lock.Key)
+	}
+	if affected == 0 {
+		return fmt.Errorf("Lock %v is not held by %v", lock.Key, lock.Owner)
+	}
+	return nil
+}
+
+func (s *sqlStorage) ReleaseLock(ctx context.Context, key, owner string) error {
+	if _, err := s.db.ExecContext(ctx, `
+	DELETE FROM locks WHERE key=$1 AND owner=$2
+	`, key, owner); err != nil {
+		return errors.Wrapf(err, "Failed to release lock: %v", key)
+	}
+	return nil
+}
+
+func (s *sqlStorage) GetLock(ctx context.Context, key string) (*LockDTO, error) {
+	lock := &LockDTO{}
+	if err := s.db.QueryRowContext(ctx, `
+	SELECT key, owner, acquired_at, expires_at FROM locks WHERE key=$1
+	`, key).Scan(&lock.Key, &lock.Owner, &lock.AcquiredAt, &lock.ExpiresAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to get lock: %v", key)
+	}
+	return lock, nil
 }
 
 // SQLStorageOpt is an option of SQL storage
@@ -167,6 +1115,20 @@ func WithSQLDb(db *sql.DB) SQLStorageOpt {
 	}
 }
 
+// WithCipher will set a cipher to encrypt secrets with
+func WithCipher(cipher secrets.Cipher) SQLStorageOpt {
+	return func(s *sqlStorage) {
+		s.cipher = cipher
+	}
+}
+
+// WithNowFn will set a function that returns current time, used for tests
+func WithNowFn(fn func() time.Time) SQLStorageOpt {
+	return func(s *sqlStorage) {
+		s.nowFn = fn
+	}
+}
+
 // NewSQLStorage returns an instance of a local storage
 func NewSQLStorage(opts ...SQLStorageOpt) (Storage, error) {
 	storage := &sqlStorage{
@@ -3,12 +3,15 @@ package dal
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/secrets"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
@@ -34,6 +37,12 @@ func withAccount(accountID string) trxOpt {
 	}
 }
 
+func withUser(userID string) trxOpt {
+	return func(dto *PendingTransactionDTO) {
+		dto.UserID = userID
+	}
+}
+
 func withCreatedAt(createdAt time.Time) trxOpt {
 	return func(dto *PendingTransactionDTO) {
 		dto.CreatedAt = createdAt
@@ -46,6 +55,30 @@ func withSyncedAt(syncedAt time.Time) trxOpt {
 	}
 }
 
+func withNextSyncAt(nextSyncAt time.Time) trxOpt {
+	return func(dto *PendingTransactionDTO) {
+		dto.NextSyncAt = &nextSyncAt
+	}
+}
+
+func withDeadLetteredAt(deadLetteredAt time.Time) trxOpt {
+	return func(dto *PendingTransactionDTO) {
+		dto.DeadLetteredAt = &deadLetteredAt
+	}
+}
+
+func withIgnoredAt(ignoredAt time.Time) trxOpt {
+	return func(dto *PendingTransactionDTO) {
+		dto.IgnoredAt = &ignoredAt
+	}
+}
+
+func withComment(comment string) trxOpt {
+	return func(dto *PendingTransactionDTO) {
+		dto.Comment = comment
+	}
+}
+
 func randTrx(opts ...trxOpt) *PendingTransactionDTO {
 	dto := &PendingTransactionDTO{
 		ID:        gofakeit.UUID(),
@@ -66,6 +99,9 @@ func setupMemoryDB(t *testing.T) (*sql.DB, error) {
 	if !assert.NoError(t, err) {
 		return nil, err
 	}
+
+	// Each connection gets it's own memory db, so keeping just one
+	db.SetMaxOpenConns(1)
 	s := Storage(&sqlStorage{db: db})
 	if err := s.Setup(context.TODO()); !assert.NoError(t, err) {
 		return nil, err
@@ -323,6 +359,82 @@ func Test_sqlStorage_SavePendingTransaction(t *testing.T) {
 	}
 }
 
+func Test_sqlStorage_SavePendingTransactions(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	accountID := "acc-" + faker.Word()
+	existing := randTrx(withAccount(accountID), withCreatedAt(now))
+	if err := s.SavePendingTransaction(context.TODO(), existing); !assert.NoError(t, err) {
+		return
+	}
+	synced := *existing
+	synced.SyncedAt = &now
+	failed := *randTrx(withAccount(accountID), withCreatedAt(now), withNextSyncAt(now.Add(time.Hour)))
+	failed.SyncAttempts = 1
+	failed.LastSyncError = faker.Sentence()
+	if err := s.SavePendingTransactions(context.TODO(), []PendingTransactionDTO{synced, failed}); !assert.NoError(t, err) {
+		return
+	}
+	got, err := s.FindPendingTransactions(context.TODO(), PendingTransactionsFilter{AccountID: accountID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, []PendingTransactionDTO{synced, failed}, got)
+}
+
+func Test_sqlStorage_SaveSyncResults(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	accountID := "acc-" + faker.Word()
+	edited := randTrx(withAccount(accountID), withCreatedAt(now))
+	ignored := randTrx(withAccount(accountID), withCreatedAt(now))
+	if err := s.SavePendingTransactions(context.TODO(), []PendingTransactionDTO{*edited, *ignored}); !assert.NoError(t, err) {
+		return
+	}
+
+	// Sync results are recorded on copies read before the changes below
+	synced := *edited
+	synced.SyncedAt = &now
+	failed := *ignored
+	failed.SyncAttempts = 1
+	failed.LastSyncError = faker.Sentence()
+	failed.LastSyncAttemptAt = &now
+
+	edited.Comment = "edited " + faker.Sentence()
+	ignored.IgnoredAt = &now
+	if err := s.SavePendingTransactions(context.TODO(), []PendingTransactionDTO{*edited, *ignored}); !assert.NoError(t, err) {
+		return
+	}
+	if err := s.SaveSyncResults(context.TODO(), []PendingTransactionDTO{synced, failed}); !assert.NoError(t, err) {
+		return
+	}
+
+	got, err := s.GetPendingTransaction(context.TODO(), edited.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	edited.SyncedAt = &now
+	assert.Equal(t, edited, got)
+
+	got, err = s.GetPendingTransaction(context.TODO(), ignored.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ignored, got)
+}
+
 func Test_sqlStorage_FindNotSyncedTransactions(t *testing.T) {
 	type args struct {
 		accountID string
@@ -366,6 +478,31 @@ func Test_sqlStorage_FindNotSyncedTransactions(t *testing.T) {
 				}
 			}
 		},
+		func() (string, fields, tcFn) {
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			return "skip dead lettered and not due transactions", fields{now: now}, func(t *testing.T, s Storage) *testCase {
+				accountID := "acc-" + faker.Word()
+				dueTrxs := []PendingTransactionDTO{
+					*randTrx(withCreatedAt(now), withAccount(accountID)),
+					*randTrx(withCreatedAt(now), withAccount(accountID), withNextSyncAt(now)),
+					*randTrx(withCreatedAt(now), withAccount(accountID), withNextSyncAt(now.Add(-time.Minute))),
+				}
+				allTrxs := append(dueTrxs,
+					*randTrx(withCreatedAt(now), withAccount(accountID), withNextSyncAt(now.Add(time.Minute))),
+					*randTrx(withCreatedAt(now), withAccount(accountID), withDeadLetteredAt(now.Add(-time.Hour))),
+					*randTrx(withCreatedAt(now), withAccount(accountID), withIgnoredAt(now.Add(-time.Hour))),
+				)
+				for _, trx := range allTrxs {
+					if err := s.SavePendingTransaction(context.TODO(), &trx); !assert.NoError(t, err) {
+						return nil
+					}
+				}
+				return &testCase{
+					args: args{accountID: accountID},
+					want: dueTrxs,
+				}
+			}
+		},
 	}
 	for _, tt := range tests {
 		name, fields, tt := tt()
@@ -448,3 +585,936 @@ func Test_sqlStorage_PendingTransactionExist(t *testing.T) {
 		})
 	}
 }
+
+func randFetchRun(startedAt time.Time) *FetchRunDTO {
+	return &FetchRunDTO{
+		Bank:      "bank-" + faker.Word(),
+		UserID:    faker.Email(),
+		AccountID: "acc-" + faker.Word(),
+		From:      time.Unix(faker.UnixTime(), 0).UTC(),
+		To:        time.Unix(faker.UnixTime(), 0).UTC(),
+		Fetched:   rand.Intn(100),
+		New:       rand.Intn(100),
+		Duplicate: rand.Intn(100),
+		Failed:    rand.Intn(100),
+		StartedAt: startedAt,
+		Duration:  time.Duration(rand.Intn(10000)) * time.Millisecond,
+		Error:     faker.Sentence(),
+
+		ErrorCategory: "permanent",
+	}
+}
+
+func Test_sqlStorage_FetchRuns(t *testing.T) {
+	type testCase struct {
+		limit int
+		want  []FetchRunDTO
+	}
+	type tcFn func(*testing.T, Storage) *testCase
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "get recent runs newest first", func(t *testing.T, s Storage) *testCase {
+				startedAt := time.Unix(faker.UnixTime(), 0).UTC()
+				runs := []*FetchRunDTO{
+					randFetchRun(startedAt.Add(-2 * time.Hour)),
+					randFetchRun(startedAt),
+					randFetchRun(startedAt.Add(-1 * time.Hour)),
+				}
+				for _, run := range runs {
+					if err := s.SaveFetchRun(context.TODO(), run); !assert.NoError(t, err) {
+						return nil
+					}
+					if !assert.NotZero(t, run.ID) {
+						return nil
+					}
+				}
+				return &testCase{
+					limit: 2,
+					want:  []FetchRunDTO{*runs[1], *runs[2]},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "empty if no runs", func(t *testing.T, s Storage) *testCase {
+				return &testCase{
+					limit: 10,
+					want:  []FetchRunDTO{},
+				}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, err := setupMemoryDB(t)
+			if err != nil {
+				return
+			}
+			defer db.Close()
+			s := Storage(&sqlStorage{db: db, nowFn: defaultNowFn})
+			tt := tt(t, s)
+			if tt == nil {
+				return
+			}
+			got, err := s.FindRecentFetchRuns(context.TODO(), tt.limit)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_sqlStorage_FetchCursor(t *testing.T) {
+	randCursor := func() *FetchCursorDTO {
+		return &FetchCursorDTO{
+			UserID:    faker.Email(),
+			Bank:      "bank-" + faker.Word(),
+			AccountID: "acc-" + faker.Word(),
+			FetchedTo: time.Unix(faker.UnixTime(), 0).UTC(),
+		}
+	}
+	type testCase struct {
+		query *FetchCursorDTO
+		want  *FetchCursorDTO
+	}
+	type tcFn func(*testing.T, Storage, time.Time) *testCase
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "get saved cursor", func(t *testing.T, s Storage, now time.Time) *testCase {
+				cursor := randCursor()
+				if err := s.SaveFetchCursor(context.TODO(), cursor); !assert.NoError(t, err) {
+					return nil
+				}
+				want := *cursor
+				want.UpdatedAt = now
+				return &testCase{query: cursor, want: &want}
+			}
+		},
+		func() (string, tcFn) {
+			return "update existing cursor", func(t *testing.T, s Storage, now time.Time) *testCase {
+				cursor := randCursor()
+				if err := s.SaveFetchCursor(context.TODO(), cursor); !assert.NoError(t, err) {
+					return nil
+				}
+				updated := *cursor
+				updated.FetchedTo = cursor.FetchedTo.Add(time.Duration(rand.Intn(100)+1) * time.Hour)
+				if err := s.SaveFetchCursor(context.TODO(), &updated); !assert.NoError(t, err) {
+					return nil
+				}
+				return &testCase{query: cursor, want: &updated}
+			}
+		},
+		func() (string, tcFn) {
+			return "nil for not existing cursor", func(t *testing.T, s Storage, now time.Time) *testCase {
+				return &testCase{query: randCursor(), want: nil}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, err := setupMemoryDB(t)
+			if err != nil {
+				return
+			}
+			defer db.Close()
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+			tt := tt(t, s, now)
+			if tt == nil {
+				return
+			}
+			got, err := s.GetFetchCursor(context.TODO(), tt.query.UserID, tt.query.Bank, tt.query.AccountID)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_sqlStorage_LedgerSession(t *testing.T) {
+	randSession := func() *LedgerSessionDTO {
+		return &LedgerSessionDTO{
+			UserID:    faker.Email(),
+			Session:   "sess-" + faker.Word(),
+			CSRFToken: "csrf-" + faker.Word(),
+		}
+	}
+	type testCase struct {
+		userID string
+		want   *LedgerSessionDTO
+	}
+	type tcFn func(*testing.T, Storage, time.Time) *testCase
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "get saved session", func(t *testing.T, s Storage, now time.Time) *testCase {
+				session := randSession()
+				if err := s.SaveLedgerSession(context.TODO(), session); !assert.NoError(t, err) {
+					return nil
+				}
+				want := *session
+				want.CreatedAt = now
+				return &testCase{userID: session.UserID, want: &want}
+			}
+		},
+		func() (string, tcFn) {
+			return "replace existing session", func(t *testing.T, s Storage, now time.Time) *testCase {
+				session := randSession()
+				if err := s.SaveLedgerSession(context.TODO(), session); !assert.NoError(t, err) {
+					return nil
+				}
+				updated := randSession()
+				updated.UserID = session.UserID
+				if err := s.SaveLedgerSession(context.TODO(), updated); !assert.NoError(t, err) {
+					return nil
+				}
+				return &testCase{userID: session.UserID, want: updated}
+			}
+		},
+		func() (string, tcFn) {
+			return "nil for not existing session", func(t *testing.T, s Storage, now time.Time) *testCase {
+				return &testCase{userID: faker.Email(), want: nil}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, err := setupMemoryDB(t)
+			if err != nil {
+				return
+			}
+			defer db.Close()
+			key, err := secrets.GenerateMasterKey("key-" + faker.Word())
+			if !assert.NoError(t, err) {
+				return
+			}
+			cipher, err := secrets.NewCipher(key)
+			if !assert.NoError(t, err) {
+				return
+			}
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			s := Storage(&sqlStorage{db: db, cipher: cipher, nowFn: func() time.Time { return now }})
+			tt := tt(t, s, now)
+			if tt == nil {
+				return
+			}
+			got, err := s.GetLedgerSession(context.TODO(), tt.userID)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+			if tt.want == nil {
+				return
+			}
+			var storedSession string
+			row := db.QueryRow(`SELECT session FROM ledger_sessions WHERE user_id=$1`, tt.userID)
+			if err := row.Scan(&storedSession); !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, secrets.IsEncrypted(storedSession))
+		})
+	}
+}
+
+func Test_sqlStorage_Setup_MigrateTransactions(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`
+	CREATE TABLE transactions(
+		id nvarchar(50) NOT NULL PRIMARY KEY,
+		amount nvarchar(255) NOT NULL,
+		date nvarchar(255) NOT NULL,
+		comment text NOT NULL,
+		account_id nvarchar(255) NOT NULL,
+		type_id integer(8) NOT NULL,
+		created_at timestamp NOT NULL,
+		synced_at timestamp NULL
+	);
+	`); !assert.NoError(t, err) {
+		return
+	}
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	trx := randTrx(withCreatedAt(now))
+	if _, err := db.Exec(`
+	INSERT INTO transactions(id, amount, date, comment, account_id, type_id, created_at)
+	VALUES($1, $2, $3, $4, $5, $6, $7)
+	`, trx.ID, trx.Amount, trx.Date, trx.Comment, trx.AccountID, trx.TypeID, trx.CreatedAt); !assert.NoError(t, err) {
+		return
+	}
+
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+	if err := s.Setup(context.TODO()); !assert.NoError(t, err) {
+		return
+	}
+	if err := s.Setup(context.TODO()); !assert.NoError(t, err) {
+		return
+	}
+	got, err := s.FindNotSyncedTransactions(context.TODO(), trx.AccountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []PendingTransactionDTO{*trx}, got)
+}
+
+func Test_sqlStorage_DeadLetteredTransactions(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	accountID := "acc-" + faker.Word()
+	deadLettered := []PendingTransactionDTO{
+		*randTrx(withCreatedAt(now), withAccount(accountID), withDeadLetteredAt(now.Add(-2*time.Hour))),
+		*randTrx(withCreatedAt(now), withAccount(accountID), withDeadLetteredAt(now.Add(-time.Hour))),
+	}
+	otherAccount := *randTrx(withCreatedAt(now), withDeadLetteredAt(now))
+	for _, trx := range append(deadLettered, otherAccount, *randTrx(withCreatedAt(now), withAccount(accountID))) {
+		if err := s.SavePendingTransaction(context.TODO(), &trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	got, err := s.FindDeadLetteredTransactions(context.TODO(), accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, deadLettered, got)
+
+	got, err = s.FindDeadLetteredTransactions(context.TODO(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, got, 3)
+
+	if err := s.RequeueDeadLetteredTransaction(context.TODO(), deadLettered[0].ID); !assert.NoError(t, err) {
+		return
+	}
+	got, err = s.FindNotSyncedTransactions(context.TODO(), accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids := []string{}
+	for _, trx := range got {
+		ids = append(ids, trx.ID)
+	}
+	assert.Contains(t, ids, deadLettered[0].ID)
+
+	notDeadLetteredID := "trx-" + faker.Word()
+	assert.EqualError(t,
+		s.RequeueDeadLetteredTransaction(context.TODO(), notDeadLetteredID),
+		"No dead lettered transaction: "+notDeadLetteredID,
+	)
+}
+
+func Test_sqlStorage_FindNotSyncedTransactionsByUser(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	userID := faker.Email()
+	account1 := "acc-1-" + faker.Word()
+	account2 := "acc-2-" + faker.Word()
+	legacyAccount := "acc-3-" + faker.Word()
+	if err := s.SaveFetchCursor(context.TODO(), &FetchCursorDTO{
+		UserID:    userID,
+		Bank:      "bank-" + faker.Word(),
+		AccountID: legacyAccount,
+		FetchedTo: now,
+	}); !assert.NoError(t, err) {
+		return
+	}
+	dueTrxs := []PendingTransactionDTO{
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account1)),
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account2)),
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account1)),
+		*randTrx(withCreatedAt(now), withAccount(legacyAccount)),
+	}
+	allTrxs := append(dueTrxs,
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account1), withSyncedAt(now)),
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account2), withNextSyncAt(now.Add(time.Minute))),
+		*randTrx(withCreatedAt(now), withUser(userID), withAccount(account2), withIgnoredAt(now)),
+		*randTrx(withCreatedAt(now), withUser(faker.Email()), withAccount(account1)),
+		*randTrx(withCreatedAt(now), withAccount("acc-"+faker.Word())),
+	)
+	for _, trx := range allTrxs {
+		if err := s.SavePendingTransaction(context.TODO(), &trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	got, err := s.FindNotSyncedTransactionsByUser(context.TODO(), userID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, dueTrxs, got)
+	for i := 1; i < len(got); i++ {
+		assert.LessOrEqual(t, got[i-1].AccountID, got[i].AccountID)
+	}
+}
+
+func Test_sqlStorage_InsertNewPendingTransactions(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	accountID := "acc-" + faker.Word()
+	synced := randTrx(withAccount(accountID), withCreatedAt(now), withSyncedAt(now.Add(-time.Hour)))
+	if err := s.SavePendingTransaction(context.TODO(), synced); !assert.NoError(t, err) {
+		return
+	}
+	newTrxs := []PendingTransactionDTO{
+		*randTrx(withAccount(accountID), withCreatedAt(now)),
+		*randTrx(withAccount(accountID), withCreatedAt(now)),
+	}
+	changedSynced := *randTrx(withAccount(accountID))
+	changedSynced.ID = synced.ID
+
+	got, err := s.InsertNewPendingTransactions(context.TODO(), []PendingTransactionDTO{
+		newTrxs[0], changedSynced, newTrxs[1], newTrxs[0],
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{newTrxs[0].ID, newTrxs[1].ID}, got)
+
+	notSynced, err := s.FindNotSyncedTransactions(context.TODO(), accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.ElementsMatch(t, newTrxs, notSynced)
+
+	row := db.QueryRow(`SELECT amount, comment, synced_at FROM transactions WHERE id=$1`, synced.ID)
+	var gotAmount, gotComment string
+	var gotSyncedAt time.Time
+	if err := row.Scan(&gotAmount, &gotComment, &gotSyncedAt); !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, synced.Amount, gotAmount)
+	assert.Equal(t, synced.Comment, gotComment)
+	assert.Equal(t, *synced.SyncedAt, gotSyncedAt)
+
+	got, err = s.InsertNewPendingTransactions(context.TODO(), []PendingTransactionDTO{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, got)
+}
+
+func Test_sqlStorage_FindPendingTransactions(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	accountID := "acc-" + faker.Word()
+	notSynced := randTrx(withCreatedAt(now), withAccount(accountID), withComment("Coffee "+faker.Word()))
+	synced := randTrx(withCreatedAt(now), withAccount(accountID), withSyncedAt(now))
+	ignored := randTrx(withCreatedAt(now), withAccount(accountID), withIgnoredAt(now))
+	deadLettered := randTrx(withCreatedAt(now), withAccount(accountID), withDeadLetteredAt(now))
+	otherAccount := randTrx(withCreatedAt(now), withComment("Coffee "+faker.Word()))
+	for _, trx := range []*PendingTransactionDTO{notSynced, synced, ignored, deadLettered, otherAccount} {
+		if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter PendingTransactionsFilter
+		want   []PendingTransactionDTO
+	}{
+		{"by account", PendingTransactionsFilter{AccountID: accountID}, []PendingTransactionDTO{*notSynced, *synced, *ignored, *deadLettered}},
+		{"not synced", PendingTransactionsFilter{AccountID: accountID, Status: TransactionStatusNotSynced}, []PendingTransactionDTO{*notSynced}},
+		{"synced", PendingTransactionsFilter{Status: TransactionStatusSynced}, []PendingTransactionDTO{*synced}},
+		{"ignored", PendingTransactionsFilter{Status: TransactionStatusIgnored}, []PendingTransactionDTO{*ignored}},
+		{"dead lettered", PendingTransactionsFilter{Status: TransactionStatusDeadLettered}, []PendingTransactionDTO{*deadLettered}},
+		{"by comment", PendingTransactionsFilter{Comment: "Coffee"}, []PendingTransactionDTO{*notSynced, *otherAccount}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.FindPendingTransactions(context.TODO(), tt.filter)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.ElementsMatch(t, tt.want, got)
+			for _, trx := range got {
+				if len(tt.filter.Status) > 0 {
+					assert.Equal(t, tt.filter.Status, trx.Status())
+				}
+			}
+		})
+	}
+
+	got, err := s.FindPendingTransactions(context.TODO(), PendingTransactionsFilter{Limit: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, got, 2)
+
+	_, err = s.FindPendingTransactions(context.TODO(), PendingTransactionsFilter{Status: "unknown"})
+	assert.EqualError(t, err, "Unknown transaction status: unknown")
+}
+
+func Test_sqlStorage_SavePendingTransactionChange(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	s := Storage(&sqlStorage{db: db, nowFn: func() time.Time { return now }})
+
+	trx := randTrx(withCreatedAt(now))
+	changes := []TransactionChangeDTO{
+		{Action: "add", Details: faker.Sentence()},
+		{Action: "ignore", Details: faker.Sentence()},
+	}
+	if err := s.SavePendingTransactionChange(context.TODO(), trx, &changes[0]); !assert.NoError(t, err) {
+		return
+	}
+	trx.IgnoredAt = &now
+	if err := s.SavePendingTransactionChange(context.TODO(), trx, &changes[1]); !assert.NoError(t, err) {
+		return
+	}
+	for i := range changes {
+		assert.NotZero(t, changes[i].ID)
+		assert.Equal(t, trx.ID, changes[i].TransactionID)
+		assert.Equal(t, now, changes[i].ChangedAt)
+	}
+
+	got, err := s.GetPendingTransaction(context.TODO(), trx.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, trx, got)
+
+	gotChanges, err := s.FindTransactionChanges(context.TODO(), trx.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, changes, gotChanges)
+
+	notExisting, err := s.GetPendingTransaction(context.TODO(), "trx-"+faker.Word())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, notExisting)
+
+	t.Run("keep sync state", func(t *testing.T) {
+		trx := randTrx(withCreatedAt(now))
+		if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+		failed := *trx
+		failed.SyncAttempts = 2
+		failed.LastSyncError = faker.Sentence()
+		if err := s.SaveSyncResults(context.TODO(), []PendingTransactionDTO{failed}); !assert.NoError(t, err) {
+			return
+		}
+		trx.Comment = faker.Sentence()
+		if err := s.SavePendingTransactionChange(context.TODO(), trx, &TransactionChangeDTO{Action: "edit"}); !assert.NoError(t, err) {
+			return
+		}
+		got, err := s.GetPendingTransaction(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		failed.Comment = trx.Comment
+		assert.Equal(t, &failed, got)
+	})
+
+	t.Run("fail to change synced transaction", func(t *testing.T) {
+		trx := randTrx(withCreatedAt(now))
+		if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+		synced := *trx
+		synced.SyncedAt = &now
+		if err := s.SaveSyncResults(context.TODO(), []PendingTransactionDTO{synced}); !assert.NoError(t, err) {
+			return
+		}
+		edited := *trx
+		edited.Comment = faker.Sentence()
+		err := s.SavePendingTransactionChange(context.TODO(), &edited, &TransactionChangeDTO{Action: "edit"})
+		var syncedErr *TransactionSyncedError
+		if !assert.True(t, errors.As(err, &syncedErr)) {
+			return
+		}
+		assert.EqualError(t, err, "Transaction "+trx.ID+" is already synced")
+		got, err := s.GetPendingTransaction(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, &synced, got)
+		changes, err := s.FindTransactionChanges(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, changes)
+	})
+}
+
+func Test_sqlStorage_AuthTokenEncryption(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	oldKey, err := secrets.GenerateMasterKey("old-" + faker.Word())
+	if !assert.NoError(t, err) {
+		return
+	}
+	newKey, err := secrets.GenerateMasterKey("new-" + faker.Word())
+	if !assert.NoError(t, err) {
+		return
+	}
+	oldCipher, err := secrets.NewCipher(oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rotatedCipher, err := secrets.NewCipher(newKey, oldKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	readStoredSecrets := func(email string) (string, string) {
+		var idToken, refreshToken string
+		row := db.QueryRow(`SELECT id_token, refresh_token FROM users WHERE email=$1`, email)
+		if err := row.Scan(&idToken, &refreshToken); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return idToken, refreshToken
+	}
+
+	plainToken := randomAccessToken()
+	if err := Storage(&sqlStorage{db: db}).SaveAuthToken(context.TODO(), plainToken); !assert.NoError(t, err) {
+		return
+	}
+
+	token := randomAccessToken()
+	s := Storage(&sqlStorage{db: db, cipher: oldCipher})
+	if err := s.SaveAuthToken(context.TODO(), token); !assert.NoError(t, err) {
+		return
+	}
+	storedIDToken, storedRefreshToken := readStoredSecrets(token.Email)
+	assert.True(t, secrets.IsEncrypted(storedIDToken))
+	assert.True(t, secrets.IsEncrypted(storedRefreshToken))
+	assert.NotContains(t, storedRefreshToken, token.RefreshToken)
+
+	got, err := s.GetAuthTokenByEmail(context.TODO(), token.Email)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, token, got)
+
+	got, err = s.GetAuthTokenByEmail(context.TODO(), plainToken.Email)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, plainToken, got)
+
+	session := &LedgerSessionDTO{
+		UserID:    token.Email,
+		Session:   "sess-" + faker.Word(),
+		CSRFToken: "csrf-" + faker.Word(),
+	}
+	if err := Storage(&sqlStorage{db: db, cipher: oldCipher, nowFn: time.Now}).SaveLedgerSession(context.TODO(), session); !assert.NoError(t, err) {
+		return
+	}
+
+	s = Storage(&sqlStorage{db: db, cipher: rotatedCipher})
+	rotated, err := s.RotateSecrets(context.TODO())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3, rotated)
+
+	for _, want := range []*AuthTokenDTO{token, plainToken} {
+		storedIDToken, storedRefreshToken := readStoredSecrets(want.Email)
+		assert.False(t, rotatedCipher.NeedsRotation(storedIDToken))
+		assert.False(t, rotatedCipher.NeedsRotation(storedRefreshToken))
+
+		newCipher, err := secrets.NewCipher(newKey)
+		if !assert.NoError(t, err) {
+			return
+		}
+		got, err = Storage(&sqlStorage{db: db, cipher: newCipher}).GetAuthTokenByEmail(context.TODO(), want.Email)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want, got)
+	}
+
+	var storedSession, storedCSRFToken string
+	row := db.QueryRow(`SELECT session, csrf_token FROM ledger_sessions WHERE user_id=$1`, session.UserID)
+	if err := row.Scan(&storedSession, &storedCSRFToken); !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, rotatedCipher.NeedsRotation(storedSession))
+	assert.False(t, rotatedCipher.NeedsRotation(storedCSRFToken))
+	newCipher, err := secrets.NewCipher(newKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	gotSession, err := Storage(&sqlStorage{db: db, cipher: newCipher}).GetLedgerSession(context.TODO(), session.UserID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, session.Session, gotSession.Session)
+	assert.Equal(t, session.CSRFToken, gotSession.CSRFToken)
+
+	rotated, err = s.RotateSecrets(context.TODO())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 0, rotated)
+}
+
+func Test_sqlStorage_FetcherMerchants(t *testing.T) {
+	randMerchant := func(userID string) *FetcherMerchantDTO {
+		return &FetcherMerchantDTO{
+			UserID:    userID,
+			AccountID: "acc-" + faker.UUIDHyphenated(),
+			Bank:      "bank-" + faker.Word(),
+			Settings: map[string]string{
+				"ID":       faker.Word(),
+				"Password": faker.Password(),
+			},
+		}
+	}
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	key, err := secrets.GenerateMasterKey("key-" + faker.Word())
+	if !assert.NoError(t, err) {
+		return
+	}
+	cipher, err := secrets.NewCipher(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := Storage(&sqlStorage{db: db, cipher: cipher, nowFn: func() time.Time { return now }})
+
+	user1 := faker.Email()
+	user2 := faker.Email()
+	user1Merchants := []*FetcherMerchantDTO{randMerchant(user1), randMerchant(user1)}
+	user2Merchant := randMerchant(user2)
+	for _, merchant := range append(user1Merchants, user2Merchant) {
+		if err := s.SaveFetcherMerchant(context.TODO(), merchant); !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, now, merchant.CreatedAt)
+		assert.Equal(t, now, merchant.UpdatedAt)
+	}
+
+	t.Run("get saved merchant", func(t *testing.T) {
+		got, err := s.GetFetcherMerchant(context.TODO(), user2, user2Merchant.AccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, user2Merchant, got)
+	})
+
+	t.Run("store settings encrypted", func(t *testing.T) {
+		var settings string
+		row := db.QueryRow(`SELECT settings FROM fetcher_merchants WHERE account_id=$1`, user2Merchant.AccountID)
+		if !assert.NoError(t, row.Scan(&settings)) {
+			return
+		}
+		assert.True(t, secrets.IsEncrypted(settings))
+		assert.NotContains(t, settings, user2Merchant.Settings["Password"])
+	})
+
+	t.Run("nil for not existing merchant", func(t *testing.T) {
+		got, err := s.GetFetcherMerchant(context.TODO(), user1, "acc-"+faker.Word())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Nil(t, got)
+	})
+
+	t.Run("find merchants of user", func(t *testing.T) {
+		got, err := s.FindFetcherMerchants(context.TODO(), user1)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.ElementsMatch(t, []FetcherMerchantDTO{*user1Merchants[0], *user1Merchants[1]}, got)
+	})
+
+	t.Run("find all merchants", func(t *testing.T) {
+		got, err := s.FindFetcherMerchants(context.TODO(), "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, got, 3)
+	})
+
+	t.Run("update existing merchant", func(t *testing.T) {
+		updatedAt := now.Add(time.Hour)
+		s := Storage(&sqlStorage{db: db, cipher: cipher, nowFn: func() time.Time { return updatedAt }})
+		updated := *user1Merchants[0]
+		updated.CreatedAt = time.Time{}
+		updated.Bank = "bank-" + faker.Word()
+		updated.Settings = map[string]string{"XToken": faker.Password()}
+		if err := s.SaveFetcherMerchant(context.TODO(), &updated); !assert.NoError(t, err) {
+			return
+		}
+		got, err := s.GetFetcherMerchant(context.TODO(), updated.UserID, updated.AccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, now, got.CreatedAt)
+		assert.Equal(t, updatedAt, got.UpdatedAt)
+		assert.Equal(t, updated.Bank, got.Bank)
+		assert.Equal(t, updated.Settings, got.Settings)
+	})
+
+	t.Run("delete merchant", func(t *testing.T) {
+		if err := s.DeleteFetcherMerchant(context.TODO(), user1, user1Merchants[1].AccountID); !assert.NoError(t, err) {
+			return
+		}
+		got, err := s.GetFetcherMerchant(context.TODO(), user1, user1Merchants[1].AccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Nil(t, got)
+		err = s.DeleteFetcherMerchant(context.TODO(), user1, user1Merchants[1].AccountID)
+		assert.EqualError(t, err, "Merchant not found: "+user1+", "+user1Merchants[1].AccountID)
+	})
+}
+
+func Test_sqlStorage_Locks(t *testing.T) {
+	db, err := setupMemoryDB(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	s := Storage(&sqlStorage{db: db, nowFn: defaultNowFn})
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+
+	randLock := func(key string, acquiredAt time.Time) *LockDTO {
+		return &LockDTO{
+			Key:        key,
+			Owner:      "owner-" + faker.UUIDHyphenated(),
+			AcquiredAt: acquiredAt,
+			ExpiresAt:  acquiredAt.Add(time.Minute),
+		}
+	}
+
+	t.Run("acquire free lock", func(t *testing.T) {
+		lock := randLock("key-"+faker.UUIDHyphenated(), now)
+		acquired, err := s.AcquireLock(context.TODO(), lock)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, acquired)
+		got, err := s.GetLock(context.TODO(), lock.Key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, lock, got)
+	})
+
+	t.Run("not acquire held lock", func(t *testing.T) {
+		key := "key-" + faker.UUIDHyphenated()
+		lock := randLock(key, now)
+		if _, err := s.AcquireLock(context.TODO(), lock); !assert.NoError(t, err) {
+			return
+		}
+		acquired, err := s.AcquireLock(context.TODO(), randLock(key, now.Add(30*time.Second)))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, acquired)
+		got, err := s.GetLock(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, lock, got)
+	})
+
+	t.Run("take over expired lock", func(t *testing.T) {
+		key := "key-" + faker.UUIDHyphenated()
+		if _, err := s.AcquireLock(context.TODO(), randLock(key, now)); !assert.NoError(t, err) {
+			return
+		}
+		lock := randLock(key, now.Add(2*time.Minute))
+		acquired, err := s.AcquireLock(context.TODO(), lock)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, acquired)
+		got, err := s.GetLock(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, lock, got)
+	})
+
+	t.Run("extend lock", func(t *testing.T) {
+		lock := randLock("key-"+faker.UUIDHyphenated(), now)
+		if _, err := s.AcquireLock(context.TODO(), lock); !assert.NoError(t, err) {
+			return
+		}
+		lock.ExpiresAt = lock.ExpiresAt.Add(time.Hour)
+		if err := s.ExtendLock(context.TODO(), lock); !assert.NoError(t, err) {
+			return
+		}
+		got, err := s.GetLock(context.TODO(), lock.Key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, lock.ExpiresAt, got.ExpiresAt)
+
+		other := *lock
+		other.Owner = "owner-" + faker.UUIDHyphenated()
+		assert.EqualError(t, s.ExtendLock(context.TODO(), &other), fmt.Sprintf("Lock %v is not held by %v", lock.Key, other.Owner))
+	})
+
+	t.Run("release lock of owner", func(t *testing.T) {
+		lock := randLock("key-"+faker.UUIDHyphenated(), now)
+		if _, err := s.AcquireLock(context.TODO(), lock); !assert.NoError(t, err) {
+			return
+		}
+		if err := s.ReleaseLock(context.TODO(), lock.Key, "owner-"+faker.Word()); !assert.NoError(t, err) {
+			return
+		}
+		got, err := s.GetLock(context.TODO(), lock.Key)
+		if !assert.NoError(t, err) || !assert.NotNil(t, got) {
+			return
+		}
+		if err := s.ReleaseLock(context.TODO(), lock.Key, lock.Owner); !assert.NoError(t, err) {
+			return
+		}
+		got, err = s.GetLock(context.TODO(), lock.Key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Nil(t, got)
+	})
+}
@@ -2,6 +2,7 @@ package dal
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
@@ -27,8 +28,140 @@ type PendingTransactionDTO struct {
 	AccountID string
 	TypeID    uint8
 
+	// UserID is empty for transactions stored before users were recorded
+	UserID string
+
 	CreatedAt time.Time
 	SyncedAt  *time.Time
+
+	// SyncAttempts is a number of failed attempts to report the transaction to ledger
+	SyncAttempts      int
+	LastSyncError     string
+	LastSyncAttemptAt *time.Time
+
+	// NextSyncAt is set when a failed transaction should not be synced before given time
+	NextSyncAt *time.Time
+
+	// DeadLetteredAt is set when a transaction failed too many times and is not synced anymore
+	DeadLetteredAt *time.Time
+
+	// IgnoredAt is set when a transaction was manually excluded from sync
+	IgnoredAt *time.Time
+}
+
+// TransactionSyncedError is returned if a synced transaction is changed
+type TransactionSyncedError struct {
+	ID string
+}
+
+func (e *TransactionSyncedError) Error() string {
+	return fmt.Sprintf("Transaction %v is already synced", e.ID)
+}
+
+// Pending transaction statuses
+const (
+	TransactionStatusNotSynced    = "not-synced"
+	TransactionStatusSynced       = "synced"
+	TransactionStatusIgnored      = "ignored"
+	TransactionStatusDeadLettered = "dead-lettered"
+)
+
+// Status returns a status of the transaction
+func (trx *PendingTransactionDTO) Status() string {
+	switch {
+	case trx.SyncedAt != nil:
+		return TransactionStatusSynced
+	case trx.IgnoredAt != nil:
+		return TransactionStatusIgnored
+	case trx.DeadLetteredAt != nil:
+		return TransactionStatusDeadLettered
+	default:
+		return TransactionStatusNotSynced
+	}
+}
+
+// PendingTransactionsFilter defines what pending transactions to find.
+// Empty values are not used for filtering
+type PendingTransactionsFilter struct {
+	AccountID string
+
+	// Status is one of TransactionStatus values
+	Status string
+
+	// Comment is a substring to search in the transaction comment
+	Comment string
+
+	Limit int
+}
+
+// TransactionChangeDTO is a DTO to store manual changes of pending transactions
+type TransactionChangeDTO struct {
+	ID            int64
+	TransactionID string
+	Action        string
+	Details       string
+	ChangedAt     time.Time
+}
+
+// FetchRunDTO is a DTO to store fetch run history
+type FetchRunDTO struct {
+	ID        int64
+	Bank      string
+	UserID    string
+	AccountID string
+	From      time.Time
+	To        time.Time
+
+	Fetched   int
+	New       int
+	Duplicate int
+	Failed    int
+
+	StartedAt time.Time
+	Duration  time.Duration
+	Error     string
+
+	// ErrorCategory is transient or permanent (see request.ErrorCategory), empty if the run did not fail
+	ErrorCategory string
+}
+
+// FetchCursorDTO is a DTO to store the point in time up to which
+// transactions of a given account were successfully fetched
+type FetchCursorDTO struct {
+	UserID    string
+	Bank      string
+	AccountID string
+	FetchedTo time.Time
+	UpdatedAt time.Time
+}
+
+// FetcherMerchantDTO is a DTO to store bank merchant settings
+// used to fetch transactions of a given ledger account
+type FetcherMerchantDTO struct {
+	UserID    string
+	AccountID string
+	Bank      string
+
+	// Settings are bank specific merchant fields (e.g ID, Password, XToken, BankAccount)
+	Settings  map[string]string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// LedgerSessionDTO is a DTO to keep a ledger session of a user between runs
+type LedgerSessionDTO struct {
+	UserID    string
+	Session   string
+	CSRFToken string
+	CreatedAt time.Time
+}
+
+// LockDTO is a DTO to store a lease of a lock held by a process
+type LockDTO struct {
+	Key        string
+	Owner      string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
 }
 
 // Storage is a persistance layer
@@ -37,8 +170,79 @@ type Storage interface {
 	GetAuthTokenByEmail(ctx context.Context, email string) (*AuthTokenDTO, error)
 	SaveAuthToken(ctx context.Context, token *AuthTokenDTO) error
 
+	// RotateSecrets will encrypt stored secrets with a primary master key.
+	// Returns number of users, fetcher merchants and ledger sessions whose secrets were reencrypted
+	RotateSecrets(ctx context.Context) (int, error)
+
 	SavePendingTransaction(ctx context.Context, trx *PendingTransactionDTO) error
+
+	// SavePendingTransactions will save given transactions in a single db transaction
+	SavePendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) error
+
+	// SaveSyncResults will save sync state of given transactions in a single db transaction.
+	// Other columns are left untouched, so changes made while syncing are not overwritten,
+	// and transactions ignored meanwhile are skipped
+	SaveSyncResults(ctx context.Context, trxs []PendingTransactionDTO) error
+
+	// InsertNewPendingTransactions will insert given transactions in a single db transaction.
+	// Existing transactions are left untouched. Returns IDs of inserted transactions
+	InsertNewPendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) ([]string, error)
 	PendingTransactionExist(ctx context.Context, id string) (bool, error)
 
+	// GetPendingTransaction returns nil if there is no such transaction
+	GetPendingTransaction(ctx context.Context, id string) (*PendingTransactionDTO, error)
+	FindPendingTransactions(ctx context.Context, filter PendingTransactionsFilter) ([]PendingTransactionDTO, error)
+
+	// SavePendingTransactionChange will save manually changeable fields of the transaction (amount, date,
+	// comment, type and ignored state) and record the change in a single db transaction. New transactions
+	// are inserted. Sync state is never overwritten, TransactionSyncedError is returned
+	// if the transaction was synced meanwhile
+	SavePendingTransactionChange(ctx context.Context, trx *PendingTransactionDTO, change *TransactionChangeDTO) error
+	FindTransactionChanges(ctx context.Context, transactionID string) ([]TransactionChangeDTO, error)
+
+	// FindNotSyncedTransactions returns transactions that are due to sync,
+	// dead lettered and ignored transactions are not included
 	FindNotSyncedTransactions(ctx context.Context, accountID string) ([]PendingTransactionDTO, error)
+
+	// FindNotSyncedTransactionsByUser returns transactions of all accounts of the user that are due to sync
+	// ordered by account. Transactions stored without a user are matched by accounts the user fetched
+	FindNotSyncedTransactionsByUser(ctx context.Context, userID string) ([]PendingTransactionDTO, error)
+
+	// FindDeadLetteredTransactions returns dead lettered transactions of given account or all if accountID is empty
+	FindDeadLetteredTransactions(ctx context.Context, accountID string) ([]PendingTransactionDTO, error)
+	RequeueDeadLetteredTransaction(ctx context.Context, id string) error
+
+	SaveFetchRun(ctx context.Context, run *FetchRunDTO) error
+	FindRecentFetchRuns(ctx context.Context, limit int) ([]FetchRunDTO, error)
+
+	// GetFetchCursor returns nil if no cursor has been saved yet
+	GetFetchCursor(ctx context.Context, userID, bank, accountID string) (*FetchCursorDTO, error)
+	SaveFetchCursor(ctx context.Context, cursor *FetchCursorDTO) error
+
+	// SaveFetcherMerchant will insert or replace merchant of a given user and account
+	SaveFetcherMerchant(ctx context.Context, merchant *FetcherMerchantDTO) error
+
+	// GetFetcherMerchant returns nil if there is no such merchant
+	GetFetcherMerchant(ctx context.Context, userID, accountID string) (*FetcherMerchantDTO, error)
+
+	// FindFetcherMerchants returns merchants of a given user or all if userID is empty
+	FindFetcherMerchants(ctx context.Context, userID string) ([]FetcherMerchantDTO, error)
+	DeleteFetcherMerchant(ctx context.Context, userID, accountID string) error
+
+	// GetLedgerSession returns nil if no session has been saved yet
+	GetLedgerSession(ctx context.Context, userID string) (*LedgerSessionDTO, error)
+
+	// SaveLedgerSession will insert or replace a ledger session of the user
+	SaveLedgerSession(ctx context.Context, session *LedgerSessionDTO) error
+
+	// AcquireLock will take the lock if it is free or a lease of a previous owner has expired.
+	// Returns false if the lock is held by other owner
+	AcquireLock(ctx context.Context, lock *LockDTO) (bool, error)
+
+	// ExtendLock will prolong the lease, returns an error if the lock is not held by the owner anymore
+	ExtendLock(ctx context.Context, lock *LockDTO) error
+	ReleaseLock(ctx context.Context, key, owner string) error
+
+	// GetLock returns nil if the lock is not held
+	GetLock(ctx context.Context, key string) (*LockDTO, error)
 }
@@ -0,0 +1,50 @@
+package fetch
+
+import (
+	"fmt"
+	"time"
+)
+
+const dateFormat = "2006-01-02"
+
+// StartOfDay returns midnight of the calendar day of t in a given time zone
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+func parseBound(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+	t, err := time.ParseInLocation(dateFormat, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unexpected date format: %v", value)
+	}
+	if endOfDay {
+		// AddDate keeps wall clock so DST transitions do not shift the boundary
+		return t.AddDate(0, 0, 1), nil
+	}
+	return t, nil
+}
+
+// ParseRangeStart parses a date (YYYY-MM-DD) as a start of the day in a given
+// time zone or an RFC3339 timestamp. Zero time is returned for empty value
+func ParseRangeStart(value string, loc *time.Location) (time.Time, error) {
+	return parseBound(value, loc, false)
+}
+
+// ParseRangeEnd parses a date (YYYY-MM-DD) as an end of the day in a given time zone,
+// so the day is included into the range, or an RFC3339 timestamp. Zero time is returned for empty value
+func ParseRangeEnd(value string, loc *time.Location) (time.Time, error) {
+	return parseBound(value, loc, true)
+}
+
+// DaysBack returns a start of the range of given number of calendar days
+// that ends at the given time (exclusive), the last day is included
+func DaysBack(to time.Time, days int, loc *time.Location) time.Time {
+	return StartOfDay(to.Add(-time.Nanosecond), loc).AddDate(0, 0, -(days - 1))
+}
@@ -0,0 +1,113 @@
+package fetch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRangeBounds(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kiev")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name      string
+		value     string
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "date as calendar day of the zone",
+			value:     "2021-01-31",
+			wantStart: time.Date(2021, 1, 31, 0, 0, 0, 0, kyiv),
+			wantEnd:   time.Date(2021, 2, 1, 0, 0, 0, 0, kyiv),
+		},
+		{
+			name:      "day of DST transition",
+			value:     "2021-03-28",
+			wantStart: time.Date(2021, 3, 28, 0, 0, 0, 0, kyiv),
+			wantEnd:   time.Date(2021, 3, 29, 0, 0, 0, 0, kyiv),
+		},
+		{
+			name:      "RFC3339 timestamp as is",
+			value:     "2021-01-31T10:20:30Z",
+			wantStart: time.Date(2021, 1, 31, 10, 20, 30, 0, time.UTC).In(kyiv),
+			wantEnd:   time.Date(2021, 1, 31, 10, 20, 30, 0, time.UTC).In(kyiv),
+		},
+		{
+			name: "zero time for empty value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, err := ParseRangeStart(tt.value, kyiv)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantStart, start)
+			end, err := ParseRangeEnd(tt.value, kyiv)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantEnd, end)
+		})
+	}
+
+	t.Run("fail on unexpected format", func(t *testing.T) {
+		_, err := ParseRangeStart("31.01.2021", kyiv)
+		assert.EqualError(t, err, "Unexpected date format: 31.01.2021")
+	})
+
+	t.Run("DST day is 23 hours long", func(t *testing.T) {
+		start, _ := ParseRangeStart("2021-03-28", kyiv)
+		end, _ := ParseRangeEnd("2021-03-28", kyiv)
+		assert.Equal(t, 23*time.Hour, end.Sub(start))
+	})
+}
+
+func TestDaysBack(t *testing.T) {
+	kyiv, err := time.LoadLocation("Europe/Kiev")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name string
+		to   time.Time
+		days int
+		want time.Time
+	}{
+		{
+			name: "include the day of now",
+			to:   time.Date(2021, 2, 10, 15, 30, 0, 0, kyiv),
+			days: 1,
+			want: time.Date(2021, 2, 10, 0, 0, 0, 0, kyiv),
+		},
+		{
+			name: "full month ending at exclusive midnight",
+			to:   time.Date(2021, 2, 1, 0, 0, 0, 0, kyiv),
+			days: 31,
+			want: time.Date(2021, 1, 1, 0, 0, 0, 0, kyiv),
+		},
+		{
+			name: "across DST transition",
+			to:   time.Date(2021, 3, 30, 12, 0, 0, 0, kyiv),
+			days: 3,
+			want: time.Date(2021, 3, 28, 0, 0, 0, 0, kyiv),
+		},
+		{
+			name: "calendar day of the zone",
+			to:   time.Date(2021, 2, 10, 23, 30, 0, 0, time.UTC),
+			days: 1,
+			want: time.Date(2021, 2, 11, 0, 0, 0, 0, kyiv),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DaysBack(tt.to, tt.days, kyiv))
+		})
+	}
+}
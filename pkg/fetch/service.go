@@ -0,0 +1,515 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+)
+
+var logger = diag.CreateLogger()
+
+// Params represents what to fetch and for whom
+type Params struct {
+	UserID          string
+	LedgerAccountID string
+
+	// Bank is optional. If not set then the bank configured for the account is used
+	Bank string
+
+	// From is optional. If not set then fetching will resume from the
+	// account cursor (minus overlap), or start initial window back if there is no cursor
+	From time.Time
+
+	// To is optional and exclusive, now is used if not set or in the future
+	To time.Time
+}
+
+// Statuses of transactions fetched in a dry run
+const (
+	DryRunStatusNew       = "new"
+	DryRunStatusDuplicate = "duplicate"
+	DryRunStatusFailed    = "failed"
+)
+
+// DryRunTransaction is a fetched transaction and what the fetch would do with it
+type DryRunTransaction struct {
+	Status    string `json:"status"`
+	ID        string `json:"id"`
+	Amount    string `json:"amount"`
+	Date      string `json:"date"`
+	Comment   string `json:"comment"`
+	AccountID string `json:"account_id"`
+	TypeID    uint8  `json:"type_id"`
+
+	// Error is set for transactions that failed to map
+	Error string `json:"error,omitempty"`
+}
+
+// DryRunReport represents results of a dry run
+type DryRunReport struct {
+	Run          *dal.FetchRunDTO
+	Transactions []DryRunTransaction
+}
+
+// Service fetches bank transactions and stores them as pending transactions
+type Service interface {
+	// FetchTransactions will fetch transactions and record the run details.
+	// The run is returned even if the fetch failed, errors that will repeat if the fetch
+	// is retried are permanent (see request.IsPermanent). Nothing is fetched into a closed
+	// ledger account, it may be reopened so the error is not permanent.
+	// If the account is being fetched by another process then lock.LockedError is returned without a run
+	FetchTransactions(ctx context.Context, params *Params) (*dal.FetchRunDTO, error)
+
+	// TestFetch will fetch transactions using given fetcher config without storing anything.
+	// Initial window is fetched if range is not set. Returns number of fetched transactions.
+	// Used to validate bank credentials
+	TestFetch(ctx context.Context, params *Params, cfg banks.FetcherConfig) (int, error)
+
+	// DryRun will fetch transactions the same way as FetchTransactions and report which
+	// of them would be stored as new or skipped as duplicates. Nothing is written to the storage,
+	// ledger sessions started to check the account are not saved
+	DryRun(ctx context.Context, params *Params) (*DryRunReport, error)
+}
+
+type service struct {
+	storage          dal.Storage
+	fetcherConfig    banks.FetcherConfig
+	fetcherFactories map[string]banks.FetcherFactory
+	nowFn            func() time.Time
+	locker           lock.Locker
+	location         *time.Location
+
+	// Ledger accounts are checked before fetching if the ledger API is set
+	ledgerURL  string
+	authSvc    auth.Service
+	apiFactory ledger.APIFactory
+
+	// dryRunAPIFactory is used to check ledger accounts in dry runs, must not write to the storage
+	dryRunAPIFactory ledger.APIFactory
+
+	cursorOverlap time.Duration
+	initialWindow time.Duration
+}
+
+func (svc *service) FetchTransactions(ctx context.Context, params *Params) (*dal.FetchRunDTO, error) {
+	if svc.locker != nil {
+		held, err := svc.locker.Acquire(ctx, lock.Key(params.UserID, params.LedgerAccountID, lock.OperationFetch))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := held.Release(ctx); err != nil {
+				logger.WithError(err).Error(ctx, "Failed to release fetch lock")
+			}
+		}()
+	}
+
+	startedAt := svc.nowFn()
+	run := &dal.FetchRunDTO{
+		Bank:      params.Bank,
+		UserID:    params.UserID,
+		AccountID: params.LedgerAccountID,
+		From:      params.From,
+		To:        params.To,
+		StartedAt: startedAt,
+	}
+	err := svc.fetch(ctx, params, run)
+	run.Duration = svc.nowFn().Sub(startedAt)
+	if err != nil {
+		run.Error = err.Error()
+		run.ErrorCategory = string(request.CategoryOf(err))
+	}
+	if saveErr := svc.storage.SaveFetchRun(ctx, run); saveErr != nil {
+		if err == nil {
+			return run, errors.Wrap(saveErr, "Failed to record fetch run")
+		}
+		logger.WithError(saveErr).Error(ctx, "Failed to record fetch run")
+	}
+	return run, err
+}
+
+// fetchFromBank will resolve the bank and the range of the run and fetch transactions
+func (svc *service) fetchFromBank(
+	ctx context.Context,
+	params *Params,
+	run *dal.FetchRunDTO,
+	apiFactory ledger.APIFactory,
+) ([]banks.FetchedTransaction, *dal.FetchCursorDTO, error) {
+	if run.Bank == "" {
+		bank, err := banks.GetAccountBank(ctx, svc.fetcherConfig, params.UserID, params.LedgerAccountID)
+		if err != nil {
+			return nil, nil, err
+		}
+		run.Bank = bank
+	}
+	factory, ok := svc.fetcherFactories[run.Bank]
+	if !ok {
+		return nil, nil, request.Permanent(fmt.Errorf("Unknown bank: %v", run.Bank))
+	}
+	account, err := svc.checkLedgerAccount(ctx, apiFactory, params.UserID, params.LedgerAccountID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Refusing to fetch transactions")
+	}
+	fetcher, err := factory(ctx, params.UserID, svc.fetcherConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	cursor, err := svc.storage.GetFetchCursor(ctx, params.UserID, run.Bank, params.LedgerAccountID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := svc.resolveRange(run, cursor); err != nil {
+		return nil, nil, err
+	}
+	fetchParams := svc.fetchParams(params.LedgerAccountID, run)
+	logger.Info(ctx, "Fetching transactions from %v to %v", fetchParams.From, fetchParams.To)
+	transactions, err := fetcher.Fetch(ctx, fetchParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	run.Fetched = len(transactions)
+	if account != nil {
+		warnCurrencyMismatch(ctx, account, transactions)
+	}
+	return transactions, cursor, nil
+}
+
+// checkLedgerAccount returns the ledger account to fetch into. The check is advisory,
+// only a closed account fails it. Nil is returned if the ledger API is not configured,
+// ledger can not be reached or the account is not found
+func (svc *service) checkLedgerAccount(
+	ctx context.Context,
+	apiFactory ledger.APIFactory,
+	userID string,
+	accountID string,
+) (*ledger.AccountDTO, error) {
+	if svc.apiFactory == nil {
+		return nil, nil
+	}
+	api, err := apiFactory(ctx, svc.ledgerURL, userID, func(ctx context.Context) (types.IDToken, error) {
+		return svc.authSvc.FetchAuthToken(ctx, userID)
+	})
+	if err != nil {
+		logger.WithError(err).Warn(ctx, "Failed to open ledger session, fetching without checking account %v", accountID)
+		return nil, nil
+	}
+	accounts, err := api.ListAccounts(ctx)
+	if err != nil {
+		logger.WithError(err).Warn(ctx, "Failed to list ledger accounts, fetching without checking account %v", accountID)
+		return nil, nil
+	}
+	account, err := ledger.FindOpenAccount(accounts, accountID)
+	if ledger.IsAccountClosed(err) {
+		return nil, err
+	}
+	if err != nil {
+		logger.WithError(err).Warn(ctx, "Fetching anyway, transactions will not be synced until the account is found")
+		return nil, nil
+	}
+	return account, nil
+}
+
+// warnCurrencyMismatch will warn once if the bank reports transactions
+// in a currency other than the ledger account currency
+func warnCurrencyMismatch(ctx context.Context, account *ledger.AccountDTO, transactions []banks.FetchedTransaction) {
+	if account.Currency == "" {
+		return
+	}
+	for _, trx := range transactions {
+		currencyTrx, ok := trx.(banks.CurrencyTransaction)
+		if !ok {
+			continue
+		}
+		currency := currencyTrx.Currency()
+		if currency != "" && !strings.EqualFold(currency, account.Currency) {
+			logger.Warn(ctx, "Bank account currency %v differs from ledger account %v currency %v",
+				currency, account.ID, account.Currency)
+			return
+		}
+	}
+}
+
+func (svc *service) fetch(ctx context.Context, params *Params, run *dal.FetchRunDTO) error {
+	transactions, cursor, err := svc.fetchFromBank(ctx, params, run, svc.apiFactory)
+	if err != nil {
+		return err
+	}
+	trxDtos := make([]dal.PendingTransactionDTO, 0, len(transactions))
+	for _, trx := range transactions {
+		trxDto, err := trx.ToDTO()
+		if err != nil {
+			logger.WithError(err).Error(ctx, "Failed to map fetched transaction")
+			run.Failed++
+			continue
+		}
+		trxDto.UserID = params.UserID
+		trxDtos = append(trxDtos, *trxDto)
+	}
+	insertedIDs, err := svc.storage.InsertNewPendingTransactions(ctx, trxDtos)
+	if err != nil {
+		run.Failed += len(trxDtos)
+		return err
+	}
+	run.New = len(insertedIDs)
+	run.Duplicate = len(trxDtos) - run.New
+	logger.Debug(ctx, "Inserted new transactions: %v", insertedIDs)
+	logger.Info(ctx, "Processed %v transactions: new=%v, duplicate=%v, failed=%v",
+		run.Fetched, run.New, run.Duplicate, run.Failed)
+	if run.Failed > 0 {
+		return fmt.Errorf("Failed to process %v of %v transactions", run.Failed, run.Fetched)
+	}
+	return svc.advanceCursor(ctx, cursor, run)
+}
+
+func (svc *service) TestFetch(ctx context.Context, params *Params, cfg banks.FetcherConfig) (int, error) {
+	factory, ok := svc.fetcherFactories[params.Bank]
+	if !ok {
+		return 0, fmt.Errorf("Unknown bank: %v", params.Bank)
+	}
+	fetcher, err := factory(ctx, params.UserID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	run := &dal.FetchRunDTO{From: params.From, To: params.To, StartedAt: svc.nowFn()}
+	if err := svc.resolveRange(run, nil); err != nil {
+		return 0, err
+	}
+	fetchParams := svc.fetchParams(params.LedgerAccountID, run)
+	logger.Info(ctx, "Test fetching transactions from %v to %v", fetchParams.From, fetchParams.To)
+	transactions, err := fetcher.Fetch(ctx, fetchParams)
+	if err != nil {
+		return 0, err
+	}
+	for _, trx := range transactions {
+		if _, err := trx.ToDTO(); err != nil {
+			return 0, errors.Wrap(err, "Failed to map fetched transaction")
+		}
+	}
+	return len(transactions), nil
+}
+
+func (svc *service) DryRun(ctx context.Context, params *Params) (*DryRunReport, error) {
+	startedAt := svc.nowFn()
+	run := &dal.FetchRunDTO{
+		Bank:      params.Bank,
+		UserID:    params.UserID,
+		AccountID: params.LedgerAccountID,
+		From:      params.From,
+		To:        params.To,
+		StartedAt: startedAt,
+	}
+	report := &DryRunReport{Run: run, Transactions: []DryRunTransaction{}}
+	err := svc.dryRun(ctx, params, report)
+	run.Duration = svc.nowFn().Sub(startedAt)
+	if err != nil {
+		run.Error = err.Error()
+		run.ErrorCategory = string(request.CategoryOf(err))
+	}
+	return report, err
+}
+
+func (svc *service) dryRun(ctx context.Context, params *Params, report *DryRunReport) error {
+	run := report.Run
+	transactions, _, err := svc.fetchFromBank(ctx, params, run, svc.dryRunAPIFactory)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, trx := range transactions {
+		trxDto, err := trx.ToDTO()
+		if err != nil {
+			run.Failed++
+			report.Transactions = append(report.Transactions, DryRunTransaction{
+				Status: DryRunStatusFailed,
+				Error:  err.Error(),
+			})
+			continue
+		}
+		exist := seen[trxDto.ID]
+		if !exist {
+			if exist, err = svc.storage.PendingTransactionExist(ctx, trxDto.ID); err != nil {
+				return err
+			}
+		}
+		seen[trxDto.ID] = true
+		status := DryRunStatusNew
+		if exist {
+			status = DryRunStatusDuplicate
+			run.Duplicate++
+		} else {
+			run.New++
+		}
+		report.Transactions = append(report.Transactions, DryRunTransaction{
+			Status:    status,
+			ID:        trxDto.ID,
+			Amount:    trxDto.Amount,
+			Date:      trxDto.Date,
+			Comment:   trxDto.Comment,
+			AccountID: trxDto.AccountID,
+			TypeID:    trxDto.TypeID,
+		})
+	}
+	logger.Info(ctx, "Dry run of %v transactions: new=%v, duplicate=%v, failed=%v",
+		run.Fetched, run.New, run.Duplicate, run.Failed)
+	return nil
+}
+
+// fetchParams returns bank fetch params with the range in the user time zone
+func (svc *service) fetchParams(accountID string, run *dal.FetchRunDTO) *banks.FetchParams {
+	return &banks.FetchParams{
+		LedgerAccountID: accountID,
+		From:            run.From.In(svc.location),
+		To:              run.To.In(svc.location),
+	}
+}
+
+// resolveRange fails if the range is empty (e.g it starts in the future or after its end),
+// such a range is not sent to the bank and does not move the cursor
+func (svc *service) resolveRange(run *dal.FetchRunDTO, cursor *dal.FetchCursorDTO) error {
+	// The range may end in the future (e.g today is requested), moving
+	// the cursor there would skip transactions made till then
+	if run.To.IsZero() || run.To.After(run.StartedAt) {
+		run.To = run.StartedAt
+	}
+	if run.From.IsZero() {
+		if cursor != nil {
+			run.From = cursor.FetchedTo.Add(-svc.cursorOverlap)
+		} else {
+			run.From = run.To.Add(-svc.initialWindow)
+		}
+	}
+	if !run.From.Before(run.To) {
+		return fmt.Errorf("Empty fetch range: from %v is not before to %v", run.From, run.To)
+	}
+	return nil
+}
+
+func (svc *service) advanceCursor(ctx context.Context, cursor *dal.FetchCursorDTO, run *dal.FetchRunDTO) error {
+	if cursor != nil {
+		if !run.To.After(cursor.FetchedTo) {
+			logger.Debug(ctx, "Keeping fetch cursor at %v", cursor.FetchedTo)
+			return nil
+		}
+		if run.From.After(cursor.FetchedTo) {
+			// Moving the cursor would skip transactions between the cursor and the range start
+			logger.Warn(ctx, "Keeping fetch cursor at %v, fetched range starts after it", cursor.FetchedTo)
+			return nil
+		}
+	}
+	logger.Debug(ctx, "Moving fetch cursor to %v", run.To)
+	if err := svc.storage.SaveFetchCursor(ctx, &dal.FetchCursorDTO{
+		UserID:    run.UserID,
+		Bank:      run.Bank,
+		AccountID: run.AccountID,
+		FetchedTo: run.To,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to advance fetch cursor")
+	}
+	return nil
+}
+
+// ServiceOpt is an option for fetch service
+type ServiceOpt func(*service)
+
+// WithStorage will init the service with storage
+func WithStorage(storage dal.Storage) ServiceOpt {
+	return func(svc *service) {
+		svc.storage = storage
+	}
+}
+
+// WithFetcherConfig will init the service with fetcher config
+func WithFetcherConfig(cfg banks.FetcherConfig) ServiceOpt {
+	return func(svc *service) {
+		svc.fetcherConfig = cfg
+	}
+}
+
+// WithFetcherFactory will register a fetcher factory for a given bank
+func WithFetcherFactory(bank string, factory banks.FetcherFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.fetcherFactories[bank] = factory
+	}
+}
+
+// WithCursorOverlap will set how far back from the cursor to start fetching.
+// Overlap allows picking up transactions that are reported by bank with a delay
+func WithCursorOverlap(overlap time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.cursorOverlap = overlap
+	}
+}
+
+// WithInitialWindow will set how far back to fetch if account has no cursor
+func WithInitialWindow(window time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.initialWindow = window
+	}
+}
+
+// WithLocker will prevent fetching the same account by concurrent processes
+func WithLocker(locker lock.Locker) ServiceOpt {
+	return func(svc *service) {
+		svc.locker = locker
+	}
+}
+
+// WithTimeZone will set a user time zone. Banks that take dates use calendar days of the zone
+func WithTimeZone(loc *time.Location) ServiceOpt {
+	return func(svc *service) {
+		svc.location = loc
+	}
+}
+
+// WithAuthService will init the service with auth service used to call ledger API
+func WithAuthService(authSvc auth.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.authSvc = authSvc
+	}
+}
+
+// WithLedgerAPI will check ledger account before fetching into it
+func WithLedgerAPI(ledgerURL string, apiFactory ledger.APIFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.ledgerURL = ledgerURL
+		svc.apiFactory = apiFactory
+	}
+}
+
+// WithDryRunLedgerAPI will check ledger account in dry runs with given API factory.
+// The factory must not write to the storage (see ledger.WithReadOnlySessionStorage).
+// Dry runs start a new ledger session each run if not set
+func WithDryRunLedgerAPI(apiFactory ledger.APIFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.dryRunAPIFactory = apiFactory
+	}
+}
+
+// NewService returns an instance of a fetch service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		dryRunAPIFactory: ledger.NewAPI,
+		fetcherFactories: map[string]banks.FetcherFactory{},
+		nowFn:            time.Now,
+		location:         time.Local,
+		cursorOverlap:    time.Hour,
+		initialWindow:    48 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
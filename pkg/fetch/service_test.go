@@ -0,0 +1,965 @@
+package fetch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger/ledgertest"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTransaction struct {
+	dto *dal.PendingTransactionDTO
+	err error
+}
+
+func (trx *mockTransaction) ToDTO() (*dal.PendingTransactionDTO, error) {
+	return trx.dto, trx.err
+}
+
+type mockCurrencyTransaction struct {
+	mockTransaction
+	currency string
+}
+
+func (trx *mockCurrencyTransaction) Currency() string {
+	return trx.currency
+}
+
+type mockAuthService struct {
+	token types.IDToken
+}
+
+func (svc *mockAuthService) RegisterUser(ctx context.Context, oauthCode string) (string, error) {
+	return "", errors.New("Not supported")
+}
+
+func (svc *mockAuthService) FetchAuthToken(ctx context.Context, email string) (types.IDToken, error) {
+	return svc.token, nil
+}
+
+type mockAPI struct {
+	accounts    []ledger.AccountDTO
+	accountsErr error
+}
+
+func (a *mockAPI) ListAccounts(ctx context.Context) ([]ledger.AccountDTO, error) {
+	return a.accounts, a.accountsErr
+}
+
+func (a *mockAPI) ListTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.TransactionDTO, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (a *mockAPI) ListPendingTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.PendingTransactionDTO, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (a *mockAPI) ReportPendingTransaction(ctx context.Context, trx ledger.PendingTransactionDTO) error {
+	return errors.New("Not supported")
+}
+
+func (a *mockAPI) ReportPendingTransactions(ctx context.Context, trxs []ledger.PendingTransactionDTO) []ledger.ReportResult {
+	return nil
+}
+
+type mockFetcher struct {
+	params       *banks.FetchParams
+	transactions []banks.FetchedTransaction
+	err          error
+}
+
+func (f *mockFetcher) Fetch(ctx context.Context, params *banks.FetchParams) ([]banks.FetchedTransaction, error) {
+	f.params = params
+	return f.transactions, f.err
+}
+
+func randTrx(accountID string) *mockTransaction {
+	return &mockTransaction{dto: &dal.PendingTransactionDTO{
+		ID:        gofakeit.UUID(),
+		Amount:    faker.Word(),
+		Date:      faker.Word(),
+		Comment:   faker.Word(),
+		AccountID: accountID,
+		TypeID:    1,
+	}}
+}
+
+// dumpStorage returns rows of all storage tables, so tests can check that nothing was written
+func dumpStorage(t *testing.T, db *sql.DB) map[string][]string {
+	tables := []string{}
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	for rows.Next() {
+		var table string
+		if !assert.NoError(t, rows.Scan(&table)) {
+			break
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	dump := map[string][]string{}
+	for _, table := range tables {
+		dump[table] = []string{}
+		rows, err := db.Query("SELECT * FROM " + table)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		columns, err := rows.Columns()
+		if !assert.NoError(t, err) {
+			rows.Close()
+			return nil
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if !assert.NoError(t, rows.Scan(dest...)) {
+				break
+			}
+			dump[table] = append(dump[table], fmt.Sprint(values...))
+		}
+		rows.Close()
+	}
+	return dump
+}
+
+func setupStorage(t *testing.T) (*sql.DB, dal.Storage) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	db.SetMaxOpenConns(1)
+	storage, err := dal.NewSQLStorage(dal.WithSQLDb(db))
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	if err := storage.Setup(context.TODO()); !assert.NoError(t, err) {
+		return nil, nil
+	}
+	return db, storage
+}
+
+func Test_service_FetchTransactions(t *testing.T) {
+	type testCase struct {
+		params  *Params
+		fetcher *mockFetcher
+		assert  func(t *testing.T, run *dal.FetchRunDTO, err error)
+	}
+	type tcFn func(*testing.T, dal.Storage) *testCase
+
+	randParams := func() *Params {
+		from := time.Unix(faker.UnixTime(), 0).UTC()
+		return &Params{
+			Bank:            "bank-" + faker.Word(),
+			UserID:          faker.Email(),
+			LedgerAccountID: "acc-" + faker.Word(),
+			From:            from,
+			To:              from.Add(time.Duration(rand.Intn(48)+1) * time.Hour),
+		}
+	}
+
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "store new and skip duplicate transactions", func(t *testing.T, s dal.Storage) *testCase {
+				params := randParams()
+				existing := randTrx(params.LedgerAccountID)
+				if err := s.SavePendingTransaction(context.TODO(), existing.dto); !assert.NoError(t, err) {
+					return nil
+				}
+				fresh := []*mockTransaction{randTrx(params.LedgerAccountID), randTrx(params.LedgerAccountID)}
+				fetcher := &mockFetcher{
+					transactions: []banks.FetchedTransaction{fresh[0], existing, fresh[1]},
+				}
+				return &testCase{
+					params:  params,
+					fetcher: fetcher,
+					assert: func(t *testing.T, run *dal.FetchRunDTO, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Equal(t, &banks.FetchParams{
+							LedgerAccountID: params.LedgerAccountID,
+							From:            params.From,
+							To:              params.To,
+						}, fetcher.params)
+						assert.Equal(t, 3, run.Fetched)
+						assert.Equal(t, 2, run.New)
+						assert.Equal(t, 1, run.Duplicate)
+						assert.Equal(t, 0, run.Failed)
+						for _, trx := range fresh {
+							stored, err := s.GetPendingTransaction(context.TODO(), trx.dto.ID)
+							if !assert.NoError(t, err) || !assert.NotNil(t, stored) {
+								return
+							}
+							assert.Equal(t, params.UserID, stored.UserID)
+						}
+						runs, err := s.FindRecentFetchRuns(context.TODO(), 10)
+						if !assert.NoError(t, err) {
+							return
+						}
+						if !assert.Len(t, runs, 1) {
+							return
+						}
+						assert.Equal(t, run.ID, runs[0].ID)
+						assert.Equal(t, params.Bank, runs[0].Bank)
+						assert.Equal(t, params.UserID, runs[0].UserID)
+						assert.Equal(t, 2, runs[0].New)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "count failed transactions", func(t *testing.T, s dal.Storage) *testCase {
+				params := randParams()
+				mapErr := errors.New(faker.Sentence())
+				fetcher := &mockFetcher{
+					transactions: []banks.FetchedTransaction{
+						randTrx(params.LedgerAccountID),
+						&mockTransaction{err: mapErr},
+					},
+				}
+				return &testCase{
+					params:  params,
+					fetcher: fetcher,
+					assert: func(t *testing.T, run *dal.FetchRunDTO, err error) {
+						if !assert.EqualError(t, err, "Failed to process 1 of 2 transactions") {
+							return
+						}
+						assert.Equal(t, 1, run.New)
+						assert.Equal(t, 1, run.Failed)
+						assert.Equal(t, err.Error(), run.Error)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "record failed fetch", func(t *testing.T, s dal.Storage) *testCase {
+				params := randParams()
+				fetchErr := errors.New(faker.Sentence())
+				return &testCase{
+					params:  params,
+					fetcher: &mockFetcher{err: fetchErr},
+					assert: func(t *testing.T, run *dal.FetchRunDTO, err error) {
+						if !assert.Equal(t, fetchErr, err) {
+							return
+						}
+						runs, err := s.FindRecentFetchRuns(context.TODO(), 10)
+						if !assert.NoError(t, err) {
+							return
+						}
+						if !assert.Len(t, runs, 1) {
+							return
+						}
+						assert.Equal(t, fetchErr.Error(), runs[0].Error)
+						assert.Equal(t, string(request.ErrorCategoryTransient), runs[0].ErrorCategory)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "record permanent failure", func(t *testing.T, s dal.Storage) *testCase {
+				params := randParams()
+				fetchErr := request.Permanent(errors.New(faker.Sentence()))
+				return &testCase{
+					params:  params,
+					fetcher: &mockFetcher{err: fetchErr},
+					assert: func(t *testing.T, run *dal.FetchRunDTO, err error) {
+						if !assert.True(t, request.IsPermanent(err)) {
+							return
+						}
+						runs, err := s.FindRecentFetchRuns(context.TODO(), 10)
+						if !assert.NoError(t, err) || !assert.Len(t, runs, 1) {
+							return
+						}
+						assert.Equal(t, string(request.ErrorCategoryPermanent), runs[0].ErrorCategory)
+					},
+				}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, storage := setupStorage(t)
+			if db == nil {
+				return
+			}
+			defer db.Close()
+			tt := tt(t, storage)
+			if tt == nil {
+				return
+			}
+			svc := NewService(
+				WithStorage(storage),
+				WithTimeZone(time.UTC),
+				WithFetcherFactory(tt.params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+					return tt.fetcher, nil
+				}),
+			)
+			run, err := svc.FetchTransactions(context.TODO(), tt.params)
+			tt.assert(t, run, err)
+		})
+	}
+}
+
+func Test_service_FetchTransactions_UnknownBank(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	bank := "bank-" + faker.Word()
+	svc := NewService(WithStorage(storage))
+	run, err := svc.FetchTransactions(context.TODO(), &Params{Bank: bank})
+	if !assert.EqualError(t, err, "Unknown bank: "+bank) {
+		return
+	}
+	assert.Equal(t, err.Error(), run.Error)
+	assert.Equal(t, string(request.ErrorCategoryPermanent), run.ErrorCategory)
+}
+
+func Test_service_FetchTransactions_AccountBank(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	merchant := dal.FetcherMerchantDTO{
+		UserID:    faker.Email(),
+		AccountID: "acc-" + faker.Word(),
+		Bank:      "bank-" + faker.Word(),
+		Settings:  map[string]string{"XToken": faker.Word()},
+	}
+	fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx(merchant.AccountID)}}
+	svc := NewService(
+		WithStorage(storage),
+		WithFetcherConfig(banks.NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{merchant})),
+		WithFetcherFactory(merchant.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			return fetcher, nil
+		}),
+	)
+
+	t.Run("use bank configured for the account", func(t *testing.T) {
+		run, err := svc.FetchTransactions(context.TODO(), &Params{
+			UserID:          merchant.UserID,
+			LedgerAccountID: merchant.AccountID,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, merchant.Bank, run.Bank)
+		assert.Equal(t, 1, run.New)
+		cursor, err := storage.GetFetchCursor(context.TODO(), merchant.UserID, merchant.Bank, merchant.AccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NotNil(t, cursor)
+	})
+
+	t.Run("fail if account is not configured", func(t *testing.T) {
+		accountID := "acc-" + faker.UUIDHyphenated()
+		run, err := svc.FetchTransactions(context.TODO(), &Params{
+			UserID:          merchant.UserID,
+			LedgerAccountID: accountID,
+		})
+		assert.EqualError(t, err, "No bank configured for account: "+accountID)
+		assert.Equal(t, err.Error(), run.Error)
+	})
+}
+
+func Test_service_FetchTransactions_LedgerAccount(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+	bank := "bank-" + faker.Word()
+	newServiceWithAPI := func(fetcher *mockFetcher, api *mockAPI) Service {
+		apiFactory := func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			return api, nil
+		}
+		return NewService(
+			WithStorage(storage),
+			WithFetcherFactory(bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+				return fetcher, nil
+			}),
+			WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+			WithLedgerAPI(faker.URL(), apiFactory),
+			WithDryRunLedgerAPI(apiFactory),
+		)
+	}
+	newService := func(fetcher *mockFetcher, accounts ...ledger.AccountDTO) Service {
+		return newServiceWithAPI(fetcher, &mockAPI{accounts: accounts})
+	}
+
+	t.Run("fetch into open account with other currency", func(t *testing.T) {
+		account := ledger.AccountDTO{ID: "acc-" + faker.UUIDHyphenated(), Currency: "UAH"}
+		trx := &mockCurrencyTransaction{mockTransaction: *randTrx(account.ID), currency: "USD"}
+		fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{trx}}
+		run, err := newService(fetcher, account).FetchTransactions(context.TODO(), &Params{
+			UserID:          userID,
+			LedgerAccountID: account.ID,
+			Bank:            bank,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, run.New)
+	})
+
+	t.Run("refuse to fetch into closed account", func(t *testing.T) {
+		account := ledger.AccountDTO{ID: "acc-" + faker.UUIDHyphenated(), Closed: true}
+		fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx(account.ID)}}
+		run, err := newService(fetcher, account).FetchTransactions(context.TODO(), &Params{
+			UserID:          userID,
+			LedgerAccountID: account.ID,
+			Bank:            bank,
+		})
+		if !assert.EqualError(t, err, "Refusing to fetch transactions: Ledger account "+account.ID+" is closed") {
+			return
+		}
+		assert.Nil(t, fetcher.params)
+		assert.Equal(t, 0, run.Fetched)
+		assert.False(t, request.IsPermanent(err), "closed account should not suspend the fetch")
+		assert.Equal(t, string(request.ErrorCategoryTransient), run.ErrorCategory)
+	})
+
+	t.Run("fetch into missing account", func(t *testing.T) {
+		accountID := "acc-" + faker.UUIDHyphenated()
+		fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx(accountID)}}
+		report, err := newService(fetcher, ledger.AccountDTO{ID: "other-" + faker.UUIDHyphenated()}).DryRun(context.TODO(), &Params{
+			UserID:          userID,
+			LedgerAccountID: accountID,
+			Bank:            bank,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NotNil(t, fetcher.params)
+		assert.Len(t, report.Transactions, 1)
+	})
+
+	t.Run("fetch if ledger can not be reached", func(t *testing.T) {
+		accountID := "acc-" + faker.UUIDHyphenated()
+		fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx(accountID)}}
+		api := &mockAPI{accountsErr: errors.New(faker.Sentence())}
+		run, err := newServiceWithAPI(fetcher, api).FetchTransactions(context.TODO(), &Params{
+			UserID:          userID,
+			LedgerAccountID: accountID,
+			Bank:            bank,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, run.New)
+	})
+}
+
+func Test_service_FetchTransactions_Locked(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	bank := "bank-" + faker.Word()
+	params := &Params{Bank: bank, UserID: faker.Email(), LedgerAccountID: "acc-" + faker.Word()}
+	locker := lock.NewStorageLocker(storage)
+	held, err := locker.Acquire(context.TODO(), lock.Key(params.UserID, params.LedgerAccountID, lock.OperationFetch))
+	if !assert.NoError(t, err) {
+		return
+	}
+	fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx(params.LedgerAccountID)}}
+	svc := NewService(
+		WithStorage(storage),
+		WithLocker(locker),
+		WithFetcherFactory(bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			return fetcher, nil
+		}),
+	)
+
+	run, err := svc.FetchTransactions(context.TODO(), params)
+	assert.True(t, lock.IsLocked(err))
+	assert.Nil(t, run)
+	assert.Nil(t, fetcher.params)
+	runs, err := storage.FindRecentFetchRuns(context.TODO(), 10)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, runs)
+
+	if !assert.NoError(t, held.Release(context.TODO())) {
+		return
+	}
+	run, err = svc.FetchTransactions(context.TODO(), params)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, run.New)
+}
+
+func Test_service_FetchTransactions_Cursor(t *testing.T) {
+	type testCase struct {
+		params     *Params
+		fetcher    *mockFetcher
+		wantFrom   time.Time
+		wantTo     time.Time
+		wantCursor time.Time
+	}
+	type tcFn func(*testing.T, dal.Storage, time.Time) *testCase
+
+	overlap := time.Duration(rand.Intn(60)+1) * time.Minute
+	initialWindow := time.Duration(rand.Intn(10)+1) * 24 * time.Hour
+
+	randParams := func() *Params {
+		return &Params{
+			Bank:            "bank-" + faker.Word(),
+			UserID:          faker.Email(),
+			LedgerAccountID: "acc-" + faker.Word(),
+		}
+	}
+	saveCursor := func(t *testing.T, s dal.Storage, params *Params, fetchedTo time.Time) bool {
+		return assert.NoError(t, s.SaveFetchCursor(context.TODO(), &dal.FetchCursorDTO{
+			UserID:    params.UserID,
+			Bank:      params.Bank,
+			AccountID: params.LedgerAccountID,
+			FetchedTo: fetchedTo,
+		}))
+	}
+
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "fetch initial window if no cursor", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				return &testCase{
+					params:     randParams(),
+					fetcher:    &mockFetcher{},
+					wantFrom:   now.Add(-initialWindow),
+					wantTo:     now,
+					wantCursor: now,
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "resume from cursor with overlap", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				params := randParams()
+				fetchedTo := now.Add(-time.Duration(rand.Intn(100)+1) * time.Hour)
+				if !saveCursor(t, s, params, fetchedTo) {
+					return nil
+				}
+				return &testCase{
+					params:     params,
+					fetcher:    &mockFetcher{},
+					wantFrom:   fetchedTo.Add(-overlap),
+					wantTo:     now,
+					wantCursor: now,
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "keep cursor for backfill", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				params := randParams()
+				fetchedTo := now.Add(-time.Hour)
+				if !saveCursor(t, s, params, fetchedTo) {
+					return nil
+				}
+				params.From = now.Add(-30 * 24 * time.Hour)
+				params.To = now.Add(-20 * 24 * time.Hour)
+				return &testCase{
+					params:     params,
+					fetcher:    &mockFetcher{},
+					wantFrom:   params.From,
+					wantTo:     params.To,
+					wantCursor: fetchedTo,
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "keep cursor if range starts after it", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				params := randParams()
+				fetchedTo := now.Add(-30 * 24 * time.Hour)
+				if !saveCursor(t, s, params, fetchedTo) {
+					return nil
+				}
+				params.From = now.Add(-24 * time.Hour)
+				return &testCase{
+					params:     params,
+					fetcher:    &mockFetcher{},
+					wantFrom:   params.From,
+					wantTo:     now,
+					wantCursor: fetchedTo,
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "do not fetch beyond now", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				params := randParams()
+				params.From = now.Add(-24 * time.Hour)
+				params.To = now.Add(24 * time.Hour)
+				return &testCase{
+					params:     params,
+					fetcher:    &mockFetcher{},
+					wantFrom:   params.From,
+					wantTo:     now,
+					wantCursor: now,
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "keep cursor if fetch failed", func(t *testing.T, s dal.Storage, now time.Time) *testCase {
+				params := randParams()
+				fetchedTo := now.Add(-time.Hour)
+				if !saveCursor(t, s, params, fetchedTo) {
+					return nil
+				}
+				return &testCase{
+					params:     params,
+					fetcher:    &mockFetcher{err: errors.New(faker.Sentence())},
+					wantFrom:   fetchedTo.Add(-overlap),
+					wantTo:     now,
+					wantCursor: fetchedTo,
+				}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, storage := setupStorage(t)
+			if db == nil {
+				return
+			}
+			defer db.Close()
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			tt := tt(t, storage, now)
+			if tt == nil {
+				return
+			}
+			svc := NewService(
+				WithStorage(storage),
+				WithTimeZone(time.UTC),
+				WithCursorOverlap(overlap),
+				WithInitialWindow(initialWindow),
+				WithFetcherFactory(tt.params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+					return tt.fetcher, nil
+				}),
+			)
+			svc.(*service).nowFn = func() time.Time { return now }
+			run, _ := svc.FetchTransactions(context.TODO(), tt.params)
+			if !assert.NotNil(t, tt.fetcher.params) {
+				return
+			}
+			assert.Equal(t, tt.wantFrom, tt.fetcher.params.From)
+			assert.Equal(t, tt.wantTo, tt.fetcher.params.To)
+			assert.Equal(t, tt.wantFrom, run.From)
+			assert.Equal(t, tt.wantTo, run.To)
+			cursor, err := storage.GetFetchCursor(context.TODO(), tt.params.UserID, tt.params.Bank, tt.params.LedgerAccountID)
+			if !assert.NoError(t, err) || !assert.NotNil(t, cursor) {
+				return
+			}
+			assert.Equal(t, tt.wantCursor, cursor.FetchedTo)
+		})
+	}
+}
+
+func Test_service_FetchTransactions_EmptyRange(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	bank := "bank-" + faker.Word()
+	userID := faker.Email()
+	fetcher := &mockFetcher{transactions: []banks.FetchedTransaction{randTrx("acc-" + faker.Word())}}
+	svc := NewService(
+		WithStorage(storage),
+		WithFetcherFactory(bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			return fetcher, nil
+		}),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	tests := []struct {
+		name      string
+		from      time.Time
+		to        time.Time
+		fetchedTo time.Time
+	}{
+		{name: "range ends before it starts", from: now.Add(-24 * time.Hour), to: now.Add(-48 * time.Hour)},
+		{name: "range starts in the future", from: now.Add(time.Hour)},
+		{name: "cursor is after range end", to: now.Add(-48 * time.Hour), fetchedTo: now.Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetcher.params = nil
+			accountID := "acc-" + faker.UUIDHyphenated()
+			if !tt.fetchedTo.IsZero() {
+				if !assert.NoError(t, storage.SaveFetchCursor(context.TODO(), &dal.FetchCursorDTO{
+					UserID:    userID,
+					Bank:      bank,
+					AccountID: accountID,
+					FetchedTo: tt.fetchedTo,
+				})) {
+					return
+				}
+			}
+			run, err := svc.FetchTransactions(context.TODO(), &Params{
+				UserID:          userID,
+				LedgerAccountID: accountID,
+				Bank:            bank,
+				From:            tt.from,
+				To:              tt.to,
+			})
+			if !assert.Error(t, err) {
+				return
+			}
+			assert.Contains(t, err.Error(), "Empty fetch range")
+			assert.Equal(t, err.Error(), run.Error)
+			assert.Nil(t, fetcher.params)
+			cursor, err := storage.GetFetchCursor(context.TODO(), userID, bank, accountID)
+			if !assert.NoError(t, err) {
+				return
+			}
+			if tt.fetchedTo.IsZero() {
+				assert.Nil(t, cursor)
+			} else if assert.NotNil(t, cursor) {
+				assert.True(t, tt.fetchedTo.Equal(cursor.FetchedTo))
+			}
+		})
+	}
+}
+
+func Test_service_FetchTransactions_TimeZone(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	params := &Params{
+		Bank:            "bank-" + faker.Word(),
+		UserID:          faker.Email(),
+		LedgerAccountID: "acc-" + faker.Word(),
+		From:            time.Unix(faker.UnixTime(), 0).UTC(),
+	}
+	params.To = params.From.Add(48 * time.Hour)
+	fetcher := &mockFetcher{}
+	svc := NewService(
+		WithStorage(storage),
+		WithTimeZone(loc),
+		WithFetcherFactory(params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			return fetcher, nil
+		}),
+	)
+	if _, err := svc.FetchTransactions(context.TODO(), params); !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, loc, fetcher.params.From.Location())
+	assert.Equal(t, loc, fetcher.params.To.Location())
+	assert.True(t, params.From.Equal(fetcher.params.From))
+	assert.True(t, params.To.Equal(fetcher.params.To))
+}
+
+func Test_service_TestFetch(t *testing.T) {
+	db, storage := setupStorage(t)
+	if storage == nil {
+		return
+	}
+	defer db.Close()
+
+	params := &Params{
+		Bank:            "bank-" + faker.Word(),
+		UserID:          faker.Email(),
+		LedgerAccountID: "acc-" + faker.Word(),
+	}
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	initialWindow := time.Duration(rand.Intn(48)+1) * time.Hour
+	testCfg := banks.NewMerchantsFetcherConfig(nil)
+	fetcher := &mockFetcher{
+		transactions: []banks.FetchedTransaction{randTrx(params.LedgerAccountID), randTrx(params.LedgerAccountID)},
+	}
+	var gotCfg banks.FetcherConfig
+	svc := NewService(
+		WithStorage(storage),
+		WithTimeZone(time.UTC),
+		WithInitialWindow(initialWindow),
+		WithFetcherFactory(params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			gotCfg = cfg
+			return fetcher, nil
+		}),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	t.Run("fetch with given config without storing", func(t *testing.T) {
+		fetched, err := svc.TestFetch(context.TODO(), params, testCfg)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 2, fetched)
+		assert.Same(t, testCfg, gotCfg)
+		assert.Equal(t, &banks.FetchParams{
+			LedgerAccountID: params.LedgerAccountID,
+			From:            now.Add(-initialWindow),
+			To:              now,
+		}, fetcher.params)
+		trxs, err := storage.FindPendingTransactions(context.TODO(), dal.PendingTransactionsFilter{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, trxs)
+		runs, err := storage.FindRecentFetchRuns(context.TODO(), 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, runs)
+	})
+
+	t.Run("fail if fetch failed", func(t *testing.T) {
+		fetcher.err = errors.New(faker.Sentence())
+		_, err := svc.TestFetch(context.TODO(), params, testCfg)
+		assert.Equal(t, fetcher.err, err)
+	})
+}
+
+func Test_service_DryRun(t *testing.T) {
+	db, storage := setupStorage(t)
+	if storage == nil {
+		return
+	}
+	defer db.Close()
+
+	params := &Params{
+		Bank:            "bank-" + faker.Word(),
+		UserID:          faker.Email(),
+		LedgerAccountID: "acc-" + faker.Word(),
+	}
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	cursor := &dal.FetchCursorDTO{
+		UserID:    params.UserID,
+		Bank:      params.Bank,
+		AccountID: params.LedgerAccountID,
+		FetchedTo: now.Add(-time.Duration(rand.Intn(48)+1) * time.Hour),
+	}
+	if !assert.NoError(t, storage.SaveFetchCursor(context.TODO(), cursor)) {
+		return
+	}
+	existingTrx := randTrx(params.LedgerAccountID)
+	if !assert.NoError(t, storage.SavePendingTransaction(context.TODO(), existingTrx.dto)) {
+		return
+	}
+	newTrx := randTrx(params.LedgerAccountID)
+	failedTrx := &mockTransaction{err: errors.New(faker.Sentence())}
+	fetcher := &mockFetcher{
+		transactions: []banks.FetchedTransaction{existingTrx, newTrx, newTrx, failedTrx},
+	}
+	svc := NewService(
+		WithStorage(storage),
+		WithTimeZone(time.UTC),
+		WithFetcherFactory(params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+			return fetcher, nil
+		}),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	t.Run("report what would be stored without writing", func(t *testing.T) {
+		before := dumpStorage(t, db)
+		report, err := svc.DryRun(context.TODO(), params)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, cursor.FetchedTo.Add(-time.Hour), fetcher.params.From)
+		assert.Equal(t, now, fetcher.params.To)
+		assert.Equal(t, 4, report.Run.Fetched)
+		assert.Equal(t, 1, report.Run.New)
+		assert.Equal(t, 2, report.Run.Duplicate)
+		assert.Equal(t, 1, report.Run.Failed)
+		if !assert.Len(t, report.Transactions, 4) {
+			return
+		}
+		assert.Equal(t, DryRunTransaction{
+			Status:    DryRunStatusDuplicate,
+			ID:        existingTrx.dto.ID,
+			Amount:    existingTrx.dto.Amount,
+			Date:      existingTrx.dto.Date,
+			Comment:   existingTrx.dto.Comment,
+			AccountID: existingTrx.dto.AccountID,
+			TypeID:    existingTrx.dto.TypeID,
+		}, report.Transactions[0])
+		assert.Equal(t, DryRunStatusNew, report.Transactions[1].Status)
+		assert.Equal(t, newTrx.dto.ID, report.Transactions[1].ID)
+		assert.Equal(t, DryRunStatusDuplicate, report.Transactions[2].Status)
+		assert.Equal(t, DryRunTransaction{
+			Status: DryRunStatusFailed,
+			Error:  failedTrx.err.Error(),
+		}, report.Transactions[3])
+
+		exist, err := storage.PendingTransactionExist(context.TODO(), newTrx.dto.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, exist)
+		runs, err := storage.FindRecentFetchRuns(context.TODO(), 10)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, runs)
+		gotCursor, err := storage.GetFetchCursor(context.TODO(), params.UserID, params.Bank, params.LedgerAccountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, cursor.FetchedTo.Equal(gotCursor.FetchedTo))
+		assert.Equal(t, before, dumpStorage(t, db))
+	})
+
+	t.Run("not save ledger session", func(t *testing.T) {
+		fakeLedger := ledgertest.NewLedger(ledgertest.WithAccounts(ledger.AccountDTO{ID: params.LedgerAccountID}))
+		server := httptest.NewServer(fakeLedger)
+		defer server.Close()
+		svc := NewService(
+			WithStorage(storage),
+			WithTimeZone(time.UTC),
+			WithFetcherFactory(params.Bank, func(ctx context.Context, userID string, cfg banks.FetcherConfig) (banks.Fetcher, error) {
+				return fetcher, nil
+			}),
+			WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+			WithLedgerAPI(server.URL, ledger.NewAPIFactory(ledger.WithSessionStorage(storage))),
+			WithDryRunLedgerAPI(ledger.NewAPIFactory(ledger.WithReadOnlySessionStorage(storage))),
+		)
+		before := dumpStorage(t, db)
+		_, err := svc.DryRun(context.TODO(), params)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, fakeLedger.State().Logins)
+		assert.Equal(t, before, dumpStorage(t, db))
+		assert.Empty(t, before["ledger_sessions"])
+	})
+
+	t.Run("fail if fetch failed", func(t *testing.T) {
+		fetcher.err = errors.New(faker.Sentence())
+		report, err := svc.DryRun(context.TODO(), params)
+		assert.Equal(t, fetcher.err, err)
+		assert.Equal(t, fetcher.err.Error(), report.Run.Error)
+	})
+}
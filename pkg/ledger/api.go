@@ -4,36 +4,195 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
 
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
 
 	"github.com/pkg/errors"
 )
 
+var logger = diag.CreateLogger()
+
 const (
 	csrfTokenName     = "form_authenticity_token"
 	csrfHeaderName    = "X-CSRF-Token"
 	sessionCookieName = "_ledger_session_v1"
 )
 
+// InvalidAuthenticityTokenMessage is a message of ledger responses to requests with a rejected CSRF token
+const InvalidAuthenticityTokenMessage = "Invalid authenticity token"
+
+// csrfRejectionMarkers are parts of 422 response bodies that tell a rejected CSRF token
+// from invalid data: the message and the name of the exception Rails raises
+// (ActionController::InvalidAuthenticityToken), matched case insensitively
+var csrfRejectionMarkers = []string{InvalidAuthenticityTokenMessage, "InvalidAuthenticityToken", "CSRF"}
+
+// ReportResult is a result of reporting a single pending transaction
+type ReportResult struct {
+	ID string
+
+	// Err is set if the transaction was not reported. Transactions rejected by ledger
+	// have permanent errors (see request.IsPermanent) and should not be reported again as is.
+	// Failures of the whole batch are transient since they are not caused by the transaction
+	Err error
+}
+
 // API is an interface to communicate with ledger
 type API interface {
 	ListAccounts(ctx context.Context) ([]AccountDTO, error)
+
+	// ListTransactions returns transactions of the account dated within [from, to]
+	ListTransactions(ctx context.Context, accountID string, from, to time.Time) ([]TransactionDTO, error)
+
+	// ListPendingTransactions returns pending transactions of the account dated within [from, to]
+	// that were reported to ledger and not yet approved
+	ListPendingTransactions(ctx context.Context, accountID string, from, to time.Time) ([]PendingTransactionDTO, error)
+
 	ReportPendingTransaction(ctx context.Context, trx PendingTransactionDTO) error
+
+	// ReportPendingTransactions will report transactions in batches if ledger supports it,
+	// or one by one with bounded concurrency otherwise. Results are in the order of transactions
+	ReportPendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) []ReportResult
+}
+
+// TokenSource returns an ID token of the user to start a ledger session with
+type TokenSource func(ctx context.Context) (types.IDToken, error)
+
+// SessionStorage keeps ledger sessions between runs
+type SessionStorage interface {
+	// GetLedgerSession returns nil if no session has been saved yet
+	GetLedgerSession(ctx context.Context, userID string) (*dal.LedgerSessionDTO, error)
+	SaveLedgerSession(ctx context.Context, session *dal.LedgerSessionDTO) error
 }
 
 type api struct {
-	baseURL   string
-	session   string
-	csrfToken string
+	baseURL string
+	userID  string
+	tokens  TokenSource
+
+	// sessions is optional, a new session is started on each run if not set
+	sessions SessionStorage
+
+	// readOnlySessions is set if started sessions should not be saved to sessions
+	readOnlySessions bool
+
+	sessionMtx sync.Mutex
+	session    string
+	csrfToken  string
+
+	batchSize   int
+	concurrency int
+
+	mtx              sync.Mutex
+	batchUnsupported bool
+}
+
+func (a *api) currentSession() (string, string) {
+	a.sessionMtx.Lock()
+	defer a.sessionMtx.Unlock()
+	return a.session, a.csrfToken
+}
+
+// do will send the request with current session. If ledger rejects the session or CSRF token
+// then a new session is started and the request is sent again.
+// newReq is called for each attempt so the request body can be read again
+func (a *api) do(ctx context.Context, newReq func() request.ReqFactory) request.ResFactory {
+	send := func(session, csrfToken string) request.ResFactory {
+		return request.Do(ctx, newReq().
+			WithHeader("Cookie", sessionCookieName+"="+session).
+			WithHeader(csrfHeaderName, csrfToken))
+	}
+	session, csrfToken := a.currentSession()
+	res := send(session, csrfToken)
+	if _, err := res(); !isSessionRejected(err) || a.tokens == nil {
+		return res
+	}
+	logger.Info(ctx, "Ledger rejected the session, starting a new one")
+	if err := a.restartSession(ctx, session); err != nil {
+		return func() (*http.Response, error) {
+			return nil, err
+		}
+	}
+	return send(a.currentSession())
+}
+
+// isSessionRejected returns true if ledger rejected the session (401) or the CSRF token.
+// Ledger responds with 422 to invalid data too, a new session would not help then
+func isSessionRejected(err error) bool {
+	var httpErr request.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusUnprocessableEntity:
+		return isCSRFTokenRejected(httpErr.Message)
+	default:
+		return false
+	}
+}
+
+// isCSRFTokenRejected returns true if a body of a 422 response tells that ledger rejected the CSRF token.
+// Ledger responds with the same status to invalid data, so the body is the only hint
+func isCSRFTokenRejected(body string) bool {
+	body = strings.ToLower(body)
+	for _, marker := range csrfRejectionMarkers {
+		if strings.Contains(body, strings.ToLower(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// restartSession will start a new session unless it has already been
+// restarted by a concurrent request that got rejectedSession as well
+func (a *api) restartSession(ctx context.Context, rejectedSession string) error {
+	a.sessionMtx.Lock()
+	defer a.sessionMtx.Unlock()
+	if a.session != rejectedSession {
+		return nil
+	}
+	return a.startSession(ctx)
+}
+
+// startSession will login with a fresh ID token and cache the session if session storage is set and writable.
+// Must be called with sessionMtx held or before the api is shared
+func (a *api) startSession(ctx context.Context) error {
+	idToken, err := a.tokens(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get ID token to start ledger session")
+	}
+	session, csrfToken, err := login(ctx, a.baseURL, idToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to start ledger session")
+	}
+	a.session = session
+	a.csrfToken = csrfToken
+	if a.sessions != nil && !a.readOnlySessions {
+		if err := a.sessions.SaveLedgerSession(ctx, &dal.LedgerSessionDTO{
+			UserID:    a.userID,
+			Session:   session,
+			CSRFToken: csrfToken,
+		}); err != nil {
+			logger.WithError(err).Warn(ctx, "Failed to save ledger session, a new one will be started next run")
+		}
+	}
+	return nil
 }
 
 func (a *api) ListAccounts(ctx context.Context) ([]AccountDTO, error) {
-	req := request.Get(a.baseURL+"/accounts").
-		WithHeader("Cookie", sessionCookieName+"="+a.session)
-	res := request.Do(ctx, req)
+	res := a.do(ctx, func() request.ReqFactory {
+		return request.Get(a.baseURL + "/accounts")
+	})
 	var accounts []AccountDTO
 	if err := res.DecodeJSON(&accounts); err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch accounts")
@@ -41,29 +200,254 @@ func (a *api) ListAccounts(ctx context.Context) ([]AccountDTO, error) {
 	return accounts, nil
 }
 
+func dateRangeQuery(from, to time.Time) url.Values {
+	return url.Values{
+		"from": []string{from.Format(time.RFC3339)},
+		"to":   []string{to.Format(time.RFC3339)},
+	}
+}
+
+func (a *api) ListTransactions(ctx context.Context, accountID string, from, to time.Time) ([]TransactionDTO, error) {
+	query := dateRangeQuery(from, to)
+	res := a.do(ctx, func() request.ReqFactory {
+		return request.Get(a.baseURL + "/accounts/" + url.PathEscape(accountID) + "/transactions?" + query.Encode())
+	})
+	var trxs []TransactionDTO
+	if err := res.DecodeJSON(&trxs); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch transactions of account %v", accountID)
+	}
+	return trxs, nil
+}
+
+func (a *api) ListPendingTransactions(ctx context.Context, accountID string, from, to time.Time) ([]PendingTransactionDTO, error) {
+	query := dateRangeQuery(from, to)
+	query.Set("account_id", accountID)
+	res := a.do(ctx, func() request.ReqFactory {
+		return request.Get(a.baseURL + "/pending-transactions?" + query.Encode())
+	})
+	var trxs []PendingTransactionDTO
+	if err := res.DecodeJSON(&trxs); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch pending transactions of account %v", accountID)
+	}
+	return trxs, nil
+}
+
 func (a *api) ReportPendingTransaction(ctx context.Context, trx PendingTransactionDTO) error {
 	body, err := json.Marshal(trx)
 	if err != nil {
 		return err
 	}
-	req := request.Post(a.baseURL+"/pending-transactions", "application/json", bytes.NewReader(body)).
-		WithHeader("Cookie", sessionCookieName+"="+a.session).
-		WithHeader(csrfHeaderName, a.csrfToken)
-	res := request.Do(ctx, req)
+	res := a.do(ctx, func() request.ReqFactory {
+		return request.Post(a.baseURL+"/pending-transactions", "application/json", bytes.NewReader(body))
+	})
 	_, err = res()
 	return err
 }
 
-// APIFactory is a function that creates ledger API instance for given idToken
-type APIFactory func(ctx context.Context, baseURL string, idToken types.IDToken) (API, error)
+type batchReportRequest struct {
+	Transactions []PendingTransactionDTO `json:"transactions"`
+}
+
+type batchReportResponse struct {
+	Results []struct {
+		ID    string `json:"id"`
+		Error string `json:"error"`
+	} `json:"results"`
+}
 
-// NewAPI returns an instance of a new API initialized with given token
-func NewAPI(ctx context.Context, baseURL string, idToken types.IDToken) (API, error) {
+func (a *api) ReportPendingTransactions(ctx context.Context, trxs []PendingTransactionDTO) []ReportResult {
+	results := make([]ReportResult, len(trxs))
+	for i, trx := range trxs {
+		results[i].ID = trx.ID
+	}
+	reported := 0
+	for reported < len(trxs) && a.batchSize > 1 && a.batchSupported() {
+		end := reported + a.batchSize
+		if end > len(trxs) {
+			end = len(trxs)
+		}
+		err := a.reportBatch(ctx, trxs[reported:end], results[reported:end])
+		if isNotSupported(err) {
+			logger.Info(ctx, "Ledger does not support batch reports, reporting transactions one by one")
+			a.mtx.Lock()
+			a.batchUnsupported = true
+			a.mtx.Unlock()
+			break
+		}
+		if isBatchRejected(err) {
+			// A single bad transaction or a too large batch may get the whole batch rejected,
+			// transactions are reported one by one so only rejected ones fail
+			logger.WithError(err).Warn(ctx, "Ledger rejected batch report, reporting %v transactions one by one", end-reported)
+			a.reportConcurrently(ctx, trxs[reported:end], results[reported:end])
+		} else if err != nil {
+			for i := reported; i < end; i++ {
+				results[i].Err = request.Transient(err)
+			}
+		}
+		reported = end
+	}
+	a.reportConcurrently(ctx, trxs[reported:], results[reported:])
+	return results
+}
+
+func (a *api) batchSupported() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return !a.batchUnsupported
+}
+
+func isNotSupported(err error) bool {
+	var httpErr request.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusNotFound || httpErr.StatusCode == http.StatusMethodNotAllowed
+}
+
+// isBatchRejected returns true if ledger rejected the batch request with a 4xx
+// response that will repeat if the same batch is sent again
+func isBatchRejected(err error) bool {
+	var httpErr request.HTTPError
+	return errors.As(err, &httpErr) && httpErr.Category() == request.ErrorCategoryPermanent
+}
+
+func (a *api) reportBatch(ctx context.Context, trxs []PendingTransactionDTO, results []ReportResult) error {
+	body, err := json.Marshal(batchReportRequest{Transactions: trxs})
+	if err != nil {
+		return err
+	}
+	res := a.do(ctx, func() request.ReqFactory {
+		return request.Post(a.baseURL+"/pending-transactions/batch", "application/json", bytes.NewReader(body))
+	})
+	var batchRes batchReportResponse
+	if err := res.DecodeJSON(&batchRes); err != nil {
+		return err
+	}
+	errorsByID := make(map[string]string, len(batchRes.Results))
+	for _, result := range batchRes.Results {
+		errorsByID[result.ID] = result.Error
+	}
+	for i := range results {
+		errMsg, ok := errorsByID[results[i].ID]
+		if !ok {
+			results[i].Err = errors.Errorf("Ledger did not report a result of pending transaction %v", results[i].ID)
+		} else if errMsg != "" {
+			results[i].Err = request.Permanent(errors.Errorf("Ledger rejected pending transaction %v: %v", results[i].ID, errMsg))
+		}
+	}
+	return nil
+}
+
+func (a *api) reportConcurrently(ctx context.Context, trxs []PendingTransactionDTO, results []ReportResult) {
+	concurrency := a.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range trxs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i].Err = a.ReportPendingTransaction(ctx, trxs[i])
+		}(i)
+	}
+	wg.Wait()
+}
+
+// APIOpt is an option of ledger API
+type APIOpt func(*api)
+
+// WithBatchSize will set how many transactions to report in a single request.
+// Batches are not used if size is less than 2
+func WithBatchSize(size int) APIOpt {
+	return func(a *api) {
+		a.batchSize = size
+	}
+}
+
+// WithReportConcurrency will set how many transactions to report in parallel
+// if ledger does not support batch reports
+func WithReportConcurrency(concurrency int) APIOpt {
+	return func(a *api) {
+		a.concurrency = concurrency
+	}
+}
+
+// WithSessionStorage will reuse sessions saved in a storage instead of starting
+// a new session each run. Started sessions are saved to the storage
+func WithSessionStorage(sessions SessionStorage) APIOpt {
+	return func(a *api) {
+		a.sessions = sessions
+		a.readOnlySessions = false
+	}
+}
+
+// WithReadOnlySessionStorage will reuse sessions saved in a storage like WithSessionStorage,
+// but started sessions are not saved. Useful for runs that must not change the storage (e.g dry runs)
+func WithReadOnlySessionStorage(sessions SessionStorage) APIOpt {
+	return func(a *api) {
+		a.sessions = sessions
+		a.readOnlySessions = true
+	}
+}
+
+// APIFactory is a function that creates ledger API instance of the user.
+// tokens are used to start a new session if there is no saved one or ledger rejects it
+type APIFactory func(ctx context.Context, baseURL string, userID string, tokens TokenSource) (API, error)
+
+// NewAPIFactory returns a factory of API instances with given options
+func NewAPIFactory(opts ...APIOpt) APIFactory {
+	return func(ctx context.Context, baseURL string, userID string, tokens TokenSource) (API, error) {
+		return newAPI(ctx, baseURL, userID, tokens, opts...)
+	}
+}
+
+// NewAPI returns an instance of a new API with a session started with a token from tokens
+func NewAPI(ctx context.Context, baseURL string, userID string, tokens TokenSource) (API, error) {
+	return newAPI(ctx, baseURL, userID, tokens)
+}
+
+func newAPI(ctx context.Context, baseURL string, userID string, tokens TokenSource, opts ...APIOpt) (API, error) {
+	a := &api{
+		baseURL:     baseURL,
+		userID:      userID,
+		tokens:      tokens,
+		batchSize:   50,
+		concurrency: 4,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.sessions != nil {
+		saved, err := a.sessions.GetLedgerSession(ctx, userID)
+		if err != nil {
+			logger.WithError(err).Warn(ctx, "Failed to get saved ledger session, starting a new one")
+		} else if saved != nil {
+			logger.Debug(ctx, "Using saved ledger session of user %v", userID)
+			a.session = saved.Session
+			a.csrfToken = saved.CSRFToken
+			return a, nil
+		}
+	}
+	if err := a.startSession(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// login will start a new ledger session with given ID token.
+// Fails if ledger did not respond with a session cookie or a CSRF token
+func login(ctx context.Context, baseURL string, idToken types.IDToken) (string, string, error) {
 	startSessionPayload, err := json.Marshal(map[string]string{
 		"google_id_token": idToken.Value(),
 	})
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
 	req := request.Post(
 		baseURL+"/api/sessions",
@@ -73,26 +457,25 @@ func NewAPI(ctx context.Context, baseURL string, idToken types.IDToken) (API, er
 	var sessionData map[string]string
 	res := request.Do(ctx, req)
 	if err := res.DecodeJSON(&sessionData); err != nil {
-		return nil, err
+		return "", "", err
 	}
 	resVal, err := res()
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	cookies := resVal.Cookies()
 	var session string
-	for _, cookie := range cookies {
+	for _, cookie := range resVal.Cookies() {
 		if cookie.Name == sessionCookieName {
 			session = cookie.Value
 			break
 		}
 	}
-
-	// TODO: Fail if no session
-
-	return &api{
-		baseURL:   baseURL,
-		csrfToken: sessionData[csrfTokenName],
-		session:   session,
-	}, nil
+	if session == "" {
+		return "", "", request.Permanent(errors.Errorf("Ledger did not respond with %v cookie", sessionCookieName))
+	}
+	csrfToken := sessionData[csrfTokenName]
+	if csrfToken == "" {
+		return "", "", request.Permanent(errors.Errorf("Ledger did not respond with %v", csrfTokenName))
+	}
+	return session, csrfToken, nil
 }
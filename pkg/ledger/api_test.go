@@ -4,10 +4,14 @@ import (
 	"context"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
 	tst "github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/internal/testing"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
 	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/h2non/gock.v1"
 )
@@ -32,9 +36,9 @@ func Test_API_ListAccounts(t *testing.T) {
 		func() (string, func(*testing.T) *testCase) {
 			return "get accounts", func(t *testing.T) *testCase {
 				want := []AccountDTO{
-					AccountDTO{ID: "acc-1-" + faker.Word(), Name: "Acc 1 " + faker.Word()},
-					AccountDTO{ID: "acc-2-" + faker.Word(), Name: "Acc 2 " + faker.Word()},
-					AccountDTO{ID: "acc-3-" + faker.Word(), Name: "Acc 3 " + faker.Word()},
+					AccountDTO{ID: "acc-1-" + faker.Word(), Name: "Acc 1 " + faker.Word(), Currency: "UAH", Type: "card"},
+					AccountDTO{ID: "acc-2-" + faker.Word(), Name: "Acc 2 " + faker.Word(), Currency: "USD", Type: "cash"},
+					AccountDTO{ID: "acc-3-" + faker.Word(), Name: "Acc 3 " + faker.Word(), Currency: "EUR", Type: "deposit", Closed: true},
 				}
 				body, ok := tst.JSONMarshalToReader(t, want)
 				if !ok {
@@ -164,45 +168,440 @@ func Test_API_ReportPendingTransaction(t *testing.T) {
 	}
 }
 
+func Test_API_ReportPendingTransactions(t *testing.T) {
+	defer gock.Clean()
+	randTrxs := func(count int) []PendingTransactionDTO {
+		trxs := make([]PendingTransactionDTO, 0, count)
+		for i := 0; i < count; i++ {
+			trxs = append(trxs, PendingTransactionDTO{
+				ID:        "trx-" + faker.UUIDHyphenated(),
+				Amount:    faker.Word(),
+				Date:      faker.Word(),
+				Comment:   faker.Word(),
+				AccountID: faker.Word(),
+				TypeID:    uint8(rand.Intn(20)),
+			})
+		}
+		return trxs
+	}
+	newAPI := func(batchSize int) *api {
+		return &api{
+			baseURL:     "https://my-ledger." + faker.Word() + ".com",
+			session:     "sess-" + faker.Word(),
+			csrfToken:   "csrf-token-" + faker.Word(),
+			batchSize:   batchSize,
+			concurrency: 2,
+		}
+	}
+	headers := func(a *api) map[string]string {
+		return map[string]string{
+			"Cookie":       sessionCookieName + "=" + a.session,
+			csrfHeaderName: a.csrfToken,
+		}
+	}
+
+	t.Run("report in batches", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI(2)
+		trxs := randTrxs(3)
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			MatchHeaders(headers(a)).
+			JSON(map[string]interface{}{"transactions": trxs[0:2]}).
+			Reply(200).
+			JSON(map[string]interface{}{"results": []map[string]string{
+				{"id": trxs[0].ID},
+				{"id": trxs[1].ID, "error": "Invalid amount"},
+			}})
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			MatchHeaders(headers(a)).
+			JSON(map[string]interface{}{"transactions": trxs[2:]}).
+			Reply(200).
+			JSON(map[string]interface{}{"results": []map[string]string{}})
+
+		results := a.ReportPendingTransactions(context.TODO(), trxs)
+		if !assert.Len(t, results, 3) {
+			return
+		}
+		assert.Equal(t, ReportResult{ID: trxs[0].ID}, results[0])
+		assert.Equal(t, trxs[1].ID, results[1].ID)
+		assert.EqualError(t, results[1].Err, "Ledger rejected pending transaction "+trxs[1].ID+": Invalid amount")
+		assert.True(t, request.IsPermanent(results[1].Err))
+		assert.EqualError(t, results[2].Err, "Ledger did not report a result of pending transaction "+trxs[2].ID)
+		assert.True(t, request.IsTransient(results[2].Err))
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("fail all transactions of a failed batch", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI(10)
+		trxs := randTrxs(2)
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			Reply(500)
+
+		results := a.ReportPendingTransactions(context.TODO(), trxs)
+		if !assert.Len(t, results, 2) {
+			return
+		}
+		for i, result := range results {
+			assert.Equal(t, trxs[i].ID, result.ID)
+			assert.Error(t, result.Err)
+			assert.True(t, request.IsTransient(result.Err))
+		}
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("report one by one if batch is rejected", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI(10)
+		trxs := randTrxs(2)
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			Reply(400)
+		gock.New(a.baseURL).
+			Post("/pending-transactions").
+			JSON(trxs[0]).
+			Reply(200)
+		gock.New(a.baseURL).
+			Post("/pending-transactions").
+			JSON(trxs[1]).
+			Reply(400)
+
+		results := a.ReportPendingTransactions(context.TODO(), trxs)
+		if !assert.Len(t, results, 2) {
+			return
+		}
+		assert.Equal(t, ReportResult{ID: trxs[0].ID}, results[0])
+		assert.Equal(t, trxs[1].ID, results[1].ID)
+		assert.True(t, request.IsPermanent(results[1].Err))
+		assert.True(t, gock.IsDone())
+
+		// Batches are still used for next reports
+		nextTrx := randTrxs(1)
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			Reply(200).
+			JSON(map[string]interface{}{"results": []map[string]string{{"id": nextTrx[0].ID}}})
+		results = a.ReportPendingTransactions(context.TODO(), nextTrx)
+		assert.Equal(t, []ReportResult{{ID: nextTrx[0].ID}}, results)
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("report one by one if batches are not supported", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI(10)
+		trxs := randTrxs(3)
+		gock.New(a.baseURL).
+			Post("/pending-transactions/batch").
+			Reply(404)
+		for _, trx := range trxs[0:2] {
+			gock.New(a.baseURL).
+				Post("/pending-transactions").
+				MatchHeaders(headers(a)).
+				JSON(trx).
+				Reply(200)
+		}
+		gock.New(a.baseURL).
+			Post("/pending-transactions").
+			JSON(trxs[2]).
+			Reply(422)
+
+		results := a.ReportPendingTransactions(context.TODO(), trxs)
+		if !assert.Len(t, results, 3) {
+			return
+		}
+		assert.Equal(t, ReportResult{ID: trxs[0].ID}, results[0])
+		assert.Equal(t, ReportResult{ID: trxs[1].ID}, results[1])
+		assert.Equal(t, trxs[2].ID, results[2].ID)
+		assert.Error(t, results[2].Err)
+		assert.True(t, gock.IsDone())
+
+		nextTrx := randTrxs(1)
+		gock.New(a.baseURL).
+			Post("/pending-transactions").
+			JSON(nextTrx[0]).
+			Reply(200)
+		results = a.ReportPendingTransactions(context.TODO(), nextTrx)
+		assert.Equal(t, []ReportResult{{ID: nextTrx[0].ID}}, results)
+		assert.True(t, gock.IsDone())
+	})
+}
+
+func Test_API_ListTransactions(t *testing.T) {
+	newAPI := func() *api {
+		return &api{
+			baseURL:   "https://my-ledger." + faker.Word() + ".com",
+			session:   "sess-" + faker.Word(),
+			csrfToken: "csrf-token-" + faker.Word(),
+		}
+	}
+	from := time.Unix(faker.UnixTime(), 0).UTC()
+	to := from.Add(48 * time.Hour)
+	accountID := "acc-" + faker.Word()
+
+	t.Run("list transactions", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI()
+		want := []TransactionDTO{
+			{ID: "trx-1-" + faker.Word(), Amount: "10.5", Date: from.Format(time.RFC3339), Comment: faker.Word(), AccountID: accountID, TypeID: 2},
+			{ID: "trx-2-" + faker.Word(), Amount: "100", Date: to.Format(time.RFC3339), Comment: faker.Word(), AccountID: accountID, TypeID: 1},
+		}
+		gock.New(a.baseURL).
+			Get("/accounts/" + accountID + "/transactions").
+			MatchParams(map[string]string{
+				"from": from.Format(time.RFC3339),
+				"to":   to.Format(time.RFC3339),
+			}).
+			MatchHeaders(map[string]string{
+				"Cookie": sessionCookieName + "=" + a.session,
+			}).
+			Reply(200).
+			JSON(want)
+		got, err := a.ListTransactions(context.TODO(), accountID, from, to)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want, got)
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("list pending transactions", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI()
+		want := []PendingTransactionDTO{
+			{ID: "trx-" + faker.Word(), Amount: "10.5", Date: from.Format(time.RFC3339), Comment: faker.Word(), AccountID: accountID, TypeID: 2},
+		}
+		gock.New(a.baseURL).
+			Get("/pending-transactions").
+			MatchParams(map[string]string{
+				"account_id": accountID,
+				"from":       from.Format(time.RFC3339),
+				"to":         to.Format(time.RFC3339),
+			}).
+			Reply(200).
+			JSON(want)
+		got, err := a.ListPendingTransactions(context.TODO(), accountID, from, to)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, want, got)
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("fail to list transactions", func(t *testing.T) {
+		defer gock.Clean()
+		a := newAPI()
+		gock.New(a.baseURL).
+			Get("/accounts/" + accountID + "/transactions").
+			Reply(500)
+		_, err := a.ListTransactions(context.TODO(), accountID, from, to)
+		assert.Error(t, err)
+	})
+}
+
+type mockSessionStorage struct {
+	sessions map[string]*dal.LedgerSessionDTO
+	saved    []dal.LedgerSessionDTO
+}
+
+func (m *mockSessionStorage) GetLedgerSession(ctx context.Context, userID string) (*dal.LedgerSessionDTO, error) {
+	return m.sessions[userID], nil
+}
+
+func (m *mockSessionStorage) SaveLedgerSession(ctx context.Context, session *dal.LedgerSessionDTO) error {
+	m.saved = append(m.saved, *session)
+	return nil
+}
+
+func staticTokens(idToken types.IDToken) TokenSource {
+	return func(ctx context.Context) (types.IDToken, error) {
+		return idToken, nil
+	}
+}
+
+func mockLogin(baseURL string, idToken types.IDToken, session string, csrf string) {
+	gock.New(baseURL).
+		Post("/api/sessions").
+		JSON(map[string]string{
+			"google_id_token": idToken.Value(),
+		}).
+		Reply(200).
+		AddHeader("Set-Cookie", sessionCookieName+"="+session).
+		JSON(map[string]string{
+			csrfTokenName: csrf,
+		})
+}
+
 func TestNewAPI(t *testing.T) {
 	defer gock.Clean()
 	type args struct {
 		baseURL string
+		userID  string
 		idToken types.IDToken
+		opts    []APIOpt
 	}
 	type testCase struct {
-		args  args
-		want  API
-		after func()
+		args   args
+		assert func(t *testing.T, got API, err error)
 	}
 	type tcFn func(*testing.T) testCase
+	randArgs := func(opts ...APIOpt) args {
+		return args{
+			baseURL: "https://my-ledger." + faker.Word() + ".com",
+			userID:  faker.Email(),
+			idToken: types.IDToken("id-token-" + faker.Word()),
+			opts:    opts,
+		}
+	}
 	tests := []func() (string, tcFn){
 		func() (string, tcFn) {
 			return "start session and return new api", func(t *testing.T) testCase {
-				args := args{
-					baseURL: "https://my-ledger." + faker.Word() + ".com",
-					idToken: types.IDToken("id-token-" + faker.Word()),
-				}
+				args := randArgs()
 				session := "sess-" + faker.Word()
 				csrf := "csrf-" + faker.Word()
+				mockLogin(args.baseURL, args.idToken, session, csrf)
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						a := got.(*api)
+						assert.Equal(t, args.baseURL, a.baseURL)
+						assert.Equal(t, args.userID, a.userID)
+						assert.Equal(t, session, a.session)
+						assert.Equal(t, csrf, a.csrfToken)
+						assert.Equal(t, 50, a.batchSize)
+						assert.Equal(t, 4, a.concurrency)
+						assert.True(t, gock.IsDone())
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "fail if no session cookie", func(t *testing.T) testCase {
+				args := randArgs()
 				gock.New(args.baseURL).
 					Post("/api/sessions").
-					JSON(map[string]string{
-						"google_id_token": args.idToken.Value(),
-					}).
 					Reply(200).
-					AddHeader("Set-Cookie", sessionCookieName+"="+session).
 					JSON(map[string]string{
-						csrfTokenName: csrf,
+						csrfTokenName: "csrf-" + faker.Word(),
 					})
 				return testCase{
 					args: args,
-					want: API(&api{
-						baseURL:   args.baseURL,
-						csrfToken: csrf,
-						session:   session,
-					}),
-					after: func() {
+					assert: func(t *testing.T, got API, err error) {
+						assert.EqualError(t, err, "Failed to start ledger session: Ledger did not respond with "+sessionCookieName+" cookie")
+						assert.True(t, request.IsPermanent(err))
+						assert.Nil(t, got)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "fail if no csrf token", func(t *testing.T) testCase {
+				args := randArgs()
+				gock.New(args.baseURL).
+					Post("/api/sessions").
+					Reply(200).
+					AddHeader("Set-Cookie", sessionCookieName+"=sess-"+faker.Word()).
+					JSON(map[string]string{})
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						assert.EqualError(t, err, "Failed to start ledger session: Ledger did not respond with "+csrfTokenName)
+						assert.Nil(t, got)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "use saved session", func(t *testing.T) testCase {
+				storage := &mockSessionStorage{sessions: map[string]*dal.LedgerSessionDTO{}}
+				args := randArgs(WithSessionStorage(storage))
+				saved := &dal.LedgerSessionDTO{
+					UserID:    args.userID,
+					Session:   "sess-" + faker.Word(),
+					CSRFToken: "csrf-" + faker.Word(),
+				}
+				storage.sessions[args.userID] = saved
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						a := got.(*api)
+						assert.Equal(t, saved.Session, a.session)
+						assert.Equal(t, saved.CSRFToken, a.csrfToken)
+						assert.Empty(t, storage.saved)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "save started session", func(t *testing.T) testCase {
+				storage := &mockSessionStorage{sessions: map[string]*dal.LedgerSessionDTO{}}
+				args := randArgs(WithSessionStorage(storage))
+				session := "sess-" + faker.Word()
+				csrf := "csrf-" + faker.Word()
+				mockLogin(args.baseURL, args.idToken, session, csrf)
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Equal(t, []dal.LedgerSessionDTO{{
+							UserID:    args.userID,
+							Session:   session,
+							CSRFToken: csrf,
+						}}, storage.saved)
+						assert.True(t, gock.IsDone())
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "use saved session of read only storage", func(t *testing.T) testCase {
+				storage := &mockSessionStorage{sessions: map[string]*dal.LedgerSessionDTO{}}
+				args := randArgs(WithReadOnlySessionStorage(storage))
+				saved := &dal.LedgerSessionDTO{
+					UserID:    args.userID,
+					Session:   "sess-" + faker.Word(),
+					CSRFToken: "csrf-" + faker.Word(),
+				}
+				storage.sessions[args.userID] = saved
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						a := got.(*api)
+						assert.Equal(t, saved.Session, a.session)
+						assert.Equal(t, saved.CSRFToken, a.csrfToken)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "not save started session to read only storage", func(t *testing.T) testCase {
+				storage := &mockSessionStorage{sessions: map[string]*dal.LedgerSessionDTO{}}
+				args := randArgs(WithReadOnlySessionStorage(storage))
+				session := "sess-" + faker.Word()
+				csrf := "csrf-" + faker.Word()
+				mockLogin(args.baseURL, args.idToken, session, csrf)
+				return testCase{
+					args: args,
+					assert: func(t *testing.T, got API, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						a := got.(*api)
+						assert.Equal(t, session, a.session)
+						assert.Empty(t, storage.saved)
 						assert.True(t, gock.IsDone())
 					},
 				}
@@ -212,13 +611,152 @@ func TestNewAPI(t *testing.T) {
 	for _, tt := range tests {
 		name, tt := tt()
 		t.Run(name, func(t *testing.T) {
+			defer gock.Clean()
 			tt := tt(t)
-			got, err := APIFactory(NewAPI)(context.TODO(), tt.args.baseURL, tt.args.idToken)
+			got, err := NewAPIFactory(tt.args.opts...)(
+				context.TODO(), tt.args.baseURL, tt.args.userID, staticTokens(tt.args.idToken),
+			)
+			tt.assert(t, got, err)
+		})
+	}
+}
+
+// railsInvalidAuthenticityTokenBody is a body of Rails response to a JSON request with a rejected CSRF token
+const railsInvalidAuthenticityTokenBody = `{"status":422,"error":"Unprocessable Entity",` +
+	`"exception":"#\u003cActionController::InvalidAuthenticityToken: ActionController::InvalidAuthenticityToken\u003e",` +
+	`"traces":{"Application Trace":[],"Framework Trace":[{"id":0,"trace":"actionpack (5.2.3) ` +
+	`lib/action_controller/metal/request_forgery_protection.rb:211:in 'handle_unverified_request'"}]}}`
+
+func Test_isCSRFTokenRejected(t *testing.T) {
+	for name, tt := range map[string]struct {
+		body string
+		want bool
+	}{
+		"fake ledger message": {body: InvalidAuthenticityTokenMessage, want: true},
+		"rails exception":     {body: railsInvalidAuthenticityTokenBody, want: true},
+		"csrf error":          {body: `{"error":"Can't verify CSRF token authenticity."}`, want: true},
+		"invalid data":        {body: `{"amount":["is not a number"]}`, want: false},
+		"rails invalid record": {
+			body: `{"status":422,"error":"Unprocessable Entity",` +
+				`"exception":"#\u003cActiveRecord::RecordInvalid: Validation failed: Amount is not a number\u003e"}`,
+			want: false,
+		},
+		"empty": {body: "", want: false},
+	} {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isCSRFTokenRejected(tt.body))
+		})
+	}
+}
+
+func Test_API_RestartRejectedSession(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{name: "restart session on 401", status: 401},
+		{name: "restart session on rejected CSRF token", status: 422, body: InvalidAuthenticityTokenMessage},
+		{name: "restart session on rails CSRF token error", status: 422, body: railsInvalidAuthenticityTokenBody},
+	} {
+		status, body := tt.status, tt.body
+		t.Run(tt.name, func(t *testing.T) {
+			defer gock.Clean()
+			storage := &mockSessionStorage{}
+			idToken := types.IDToken("id-token-" + faker.Word())
+			a := &api{
+				baseURL:   "https://my-ledger." + faker.Word() + ".com",
+				userID:    faker.Email(),
+				tokens:    staticTokens(idToken),
+				sessions:  storage,
+				session:   "expired-sess-" + faker.Word(),
+				csrfToken: "expired-csrf-" + faker.Word(),
+			}
+			trx := PendingTransactionDTO{ID: faker.Word(), Amount: faker.Word(), AccountID: faker.Word()}
+			gock.New(a.baseURL).
+				Post("/pending-transactions").
+				MatchHeaders(map[string]string{
+					"Cookie": sessionCookieName + "=" + a.session,
+				}).
+				Reply(status).
+				BodyString(body)
+			session := "sess-" + faker.Word()
+			csrf := "csrf-" + faker.Word()
+			mockLogin(a.baseURL, idToken, session, csrf)
+			gock.New(a.baseURL).
+				Post("/pending-transactions").
+				MatchHeaders(map[string]string{
+					"Cookie":       sessionCookieName + "=" + session,
+					csrfHeaderName: csrf,
+				}).
+				JSON(trx).
+				Reply(200)
+
+			err := a.ReportPendingTransaction(context.TODO(), trx)
 			if !assert.NoError(t, err) {
 				return
 			}
-			assert.Equal(t, tt.want, got)
-			tt.after()
+			assert.True(t, gock.IsDone())
+			assert.Equal(t, []dal.LedgerSessionDTO{{
+				UserID:    a.userID,
+				Session:   session,
+				CSRFToken: csrf,
+			}}, storage.saved)
 		})
 	}
+
+	t.Run("do not restart session on invalid data", func(t *testing.T) {
+		defer gock.Clean()
+		a := &api{
+			baseURL: "https://my-ledger." + faker.Word() + ".com",
+			tokens: func(ctx context.Context) (types.IDToken, error) {
+				return "", errors.New("Should not be called")
+			},
+			session:   "sess-" + faker.Word(),
+			csrfToken: "csrf-" + faker.Word(),
+		}
+		trx := PendingTransactionDTO{ID: faker.Word(), Amount: faker.Word(), AccountID: faker.Word()}
+		gock.New(a.baseURL).
+			Post("/pending-transactions").
+			Reply(422).
+			JSON(map[string]interface{}{"amount": []string{"is not a number"}})
+
+		err := a.ReportPendingTransaction(context.TODO(), trx)
+		var httpErr request.HTTPError
+		if assert.True(t, errors.As(err, &httpErr)) {
+			assert.Equal(t, 422, httpErr.StatusCode)
+		}
+		assert.True(t, request.IsPermanent(err))
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("fail if rejected again", func(t *testing.T) {
+		defer gock.Clean()
+		idToken := types.IDToken("id-token-" + faker.Word())
+		a := &api{
+			baseURL: "https://my-ledger." + faker.Word() + ".com",
+			tokens:  staticTokens(idToken),
+			session: "expired-sess-" + faker.Word(),
+		}
+		gock.New(a.baseURL).Get("/accounts").Reply(401)
+		mockLogin(a.baseURL, idToken, "sess-"+faker.Word(), "csrf-"+faker.Word())
+		gock.New(a.baseURL).Get("/accounts").Reply(401)
+
+		_, err := a.ListAccounts(context.TODO())
+		var httpErr request.HTTPError
+		if assert.True(t, errors.As(err, &httpErr)) {
+			assert.Equal(t, 401, httpErr.StatusCode)
+		}
+		assert.True(t, gock.IsDone())
+	})
+
+	t.Run("do not restart a session restarted by a concurrent request", func(t *testing.T) {
+		a := &api{session: "sess-" + faker.Word(), tokens: func(ctx context.Context) (types.IDToken, error) {
+			return "", errors.New("Should not be called")
+		}}
+		restarted := a.session
+		a.session = "new-sess-" + faker.Word()
+		assert.NoError(t, a.restartSession(context.TODO(), restarted))
+	})
 }
@@ -0,0 +1,413 @@
+// Package ledgertest provides a fake ledger to test ledger API clients
+// and run fetcher end to end without a real ledger instance
+package ledgertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+	uuid "github.com/satori/go.uuid"
+)
+
+var logger = diag.CreateLogger()
+
+// Names of a session cookie and a CSRF token used by ledger
+const (
+	SessionCookieName = "_ledger_session_v1"
+	CSRFTokenName     = "form_authenticity_token"
+	CSRFHeaderName    = "X-CSRF-Token"
+)
+
+// Failure will make the fake respond with StatusCode to Times requests
+// matching Method and Path instead of handling them. Fails once if Times is not set
+type Failure struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Times      int
+}
+
+type session struct {
+	idToken   string
+	csrfToken string
+}
+
+// State is a snapshot of the fake ledger data
+type State struct {
+	Accounts            []ledger.AccountDTO            `json:"accounts"`
+	Transactions        []ledger.TransactionDTO        `json:"transactions"`
+	PendingTransactions []ledger.PendingTransactionDTO `json:"pending_transactions"`
+
+	// Logins is a number of sessions started
+	Logins int `json:"logins"`
+}
+
+// Ledger is a fake ledger that keeps data in memory. It implements endpoints
+// used by ledger API with session cookie and CSRF token checks:
+// unknown or expired sessions are rejected with 401, wrong CSRF tokens with 422.
+// GET /_fake/state returns the data and POST /_fake/expire-sessions rejects started sessions,
+// so the state can be inspected and changed when running out of process
+type Ledger struct {
+	mtx sync.Mutex
+
+	// idTokens are accepted to start a session, any token is accepted if empty
+	idTokens map[string]bool
+
+	batchUnsupported bool
+
+	accounts            []ledger.AccountDTO
+	transactions        []ledger.TransactionDTO
+	pendingTransactions []ledger.PendingTransactionDTO
+	sessions            map[string]session
+	logins              int
+	failures            []*Failure
+}
+
+// LedgerOpt is an option of the fake ledger
+type LedgerOpt func(*Ledger)
+
+// WithIDTokens will accept only given ID tokens to start a session
+func WithIDTokens(idTokens ...string) LedgerOpt {
+	return func(l *Ledger) {
+		for _, idToken := range idTokens {
+			l.idTokens[idToken] = true
+		}
+	}
+}
+
+// WithAccounts will init the fake with given accounts
+func WithAccounts(accounts ...ledger.AccountDTO) LedgerOpt {
+	return func(l *Ledger) {
+		l.accounts = append(l.accounts, accounts...)
+	}
+}
+
+// WithTransactions will init the fake with given transactions
+func WithTransactions(trxs ...ledger.TransactionDTO) LedgerOpt {
+	return func(l *Ledger) {
+		l.transactions = append(l.transactions, trxs...)
+	}
+}
+
+// WithoutBatchReports will respond with 404 to batch reports like older ledger versions
+func WithoutBatchReports() LedgerOpt {
+	return func(l *Ledger) {
+		l.batchUnsupported = true
+	}
+}
+
+// NewLedger returns a fake ledger with given options
+func NewLedger(opts ...LedgerOpt) *Ledger {
+	l := &Ledger{
+		idTokens: map[string]bool{},
+		sessions: map[string]session{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Fail will make the fake respond with a failure to matching requests
+func (l *Ledger) Fail(failure Failure) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.failures = append(l.failures, &failure)
+}
+
+// ExpireSessions will reject all sessions started so far
+func (l *Ledger) ExpireSessions() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sessions = map[string]session{}
+}
+
+// RotateCSRFTokens will reject CSRF tokens issued so far, sessions remain valid
+func (l *Ledger) RotateCSRFTokens() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for id, sess := range l.sessions {
+		sess.csrfToken = uuid.NewV4().String()
+		l.sessions[id] = sess
+	}
+}
+
+// State returns a snapshot of the fake data
+func (l *Ledger) State() State {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.state()
+}
+
+func (l *Ledger) state() State {
+	return State{
+		Accounts:            append([]ledger.AccountDTO{}, l.accounts...),
+		Transactions:        append([]ledger.TransactionDTO{}, l.transactions...),
+		PendingTransactions: append([]ledger.PendingTransactionDTO{}, l.pendingTransactions...),
+		Logins:              l.logins,
+	}
+}
+
+// PendingTransactions returns transactions reported so far ordered by ID
+func (l *Ledger) PendingTransactions() []ledger.PendingTransactionDTO {
+	trxs := l.State().PendingTransactions
+	sort.Slice(trxs, func(i, j int) bool { return trxs[i].ID < trxs[j].ID })
+	return trxs
+}
+
+func (l *Ledger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if failure := l.takeFailure(req); failure != nil {
+		logger.Info(req.Context(), "Failing %v %v with %v", req.Method, req.URL.Path, failure.StatusCode)
+		http.Error(w, http.StatusText(failure.StatusCode), failure.StatusCode)
+		return
+	}
+	switch {
+	case req.URL.Path == "/api/sessions" && req.Method == http.MethodPost:
+		l.startSession(w, req)
+	case req.URL.Path == "/_fake/state" && req.Method == http.MethodGet:
+		writeJSON(w, l.state())
+	case req.URL.Path == "/_fake/expire-sessions" && req.Method == http.MethodPost:
+		l.sessions = map[string]session{}
+		w.WriteHeader(http.StatusNoContent)
+	case req.URL.Path == "/accounts" && req.Method == http.MethodGet:
+		if l.authenticate(w, req, false) {
+			writeJSON(w, l.accounts)
+		}
+	case strings.HasPrefix(req.URL.Path, "/accounts/") && strings.HasSuffix(req.URL.Path, "/transactions") &&
+		req.Method == http.MethodGet:
+		if l.authenticate(w, req, false) {
+			accountID := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/accounts/"), "/transactions")
+			l.listTransactions(w, req, accountID)
+		}
+	case req.URL.Path == "/pending-transactions" && req.Method == http.MethodGet:
+		if l.authenticate(w, req, false) {
+			l.listPendingTransactions(w, req)
+		}
+	case req.URL.Path == "/pending-transactions" && req.Method == http.MethodPost:
+		if l.authenticate(w, req, true) {
+			l.reportPendingTransaction(w, req)
+		}
+	case req.URL.Path == "/pending-transactions/batch" && req.Method == http.MethodPost && !l.batchUnsupported:
+		if l.authenticate(w, req, true) {
+			l.reportPendingTransactions(w, req)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (l *Ledger) takeFailure(req *http.Request) *Failure {
+	for i, failure := range l.failures {
+		if failure.Method != req.Method || failure.Path != req.URL.Path {
+			continue
+		}
+		failure.Times--
+		if failure.Times <= 0 {
+			l.failures = append(l.failures[:i], l.failures[i+1:]...)
+		}
+		return failure
+	}
+	return nil
+}
+
+func (l *Ledger) startSession(w http.ResponseWriter, req *http.Request) {
+	var payload map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idToken := payload["google_id_token"]
+	if idToken == "" || (len(l.idTokens) > 0 && !l.idTokens[idToken]) {
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+	sessionID := uuid.NewV4().String()
+	sess := session{idToken: idToken, csrfToken: uuid.NewV4().String()}
+	l.sessions[sessionID] = sess
+	l.logins++
+	http.SetCookie(w, &http.Cookie{Name: SessionCookieName, Value: sessionID, Path: "/", HttpOnly: true})
+	writeJSON(w, map[string]string{CSRFTokenName: sess.csrfToken})
+}
+
+// authenticate will respond with an error and return false if the request has
+// no valid session. CSRF token is checked for requests that change data
+func (l *Ledger) authenticate(w http.ResponseWriter, req *http.Request, checkCSRF bool) bool {
+	cookie, err := req.Cookie(SessionCookieName)
+	if err != nil {
+		http.Error(w, "No session", http.StatusUnauthorized)
+		return false
+	}
+	sess, ok := l.sessions[cookie.Value]
+	if !ok {
+		http.Error(w, "Unknown session", http.StatusUnauthorized)
+		return false
+	}
+	if checkCSRF && req.Header.Get(CSRFHeaderName) != sess.csrfToken {
+		http.Error(w, ledger.InvalidAuthenticityTokenMessage, http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+// parseDateRange returns a function that checks if the date is within from and to query params.
+// Empty params do not limit the range
+func parseDateRange(req *http.Request) (func(date string) bool, error) {
+	parse := func(param string) (time.Time, error) {
+		value := req.URL.Query().Get(param)
+		if value == "" {
+			return time.Time{}, nil
+		}
+		return parseDate(value)
+	}
+	from, err := parse("from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := parse("to")
+	if err != nil {
+		return nil, err
+	}
+	return func(date string) bool {
+		parsed, err := parseDate(date)
+		if err != nil {
+			return false
+		}
+		return (from.IsZero() || !parsed.Before(from)) && (to.IsZero() || !parsed.After(to))
+	}, nil
+}
+
+func parseDate(date string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, date)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", date)
+}
+
+func (l *Ledger) listTransactions(w http.ResponseWriter, req *http.Request, accountID string) {
+	inRange, err := parseDateRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := []ledger.TransactionDTO{}
+	for _, trx := range l.transactions {
+		if trx.AccountID == accountID && inRange(trx.Date) {
+			result = append(result, trx)
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (l *Ledger) listPendingTransactions(w http.ResponseWriter, req *http.Request) {
+	inRange, err := parseDateRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	accountID := req.URL.Query().Get("account_id")
+	result := []ledger.PendingTransactionDTO{}
+	for _, trx := range l.pendingTransactions {
+		if (accountID == "" || trx.AccountID == accountID) && inRange(trx.Date) {
+			result = append(result, trx)
+		}
+	}
+	writeJSON(w, result)
+}
+
+// addPendingTransaction returns an error message if the transaction is rejected.
+// Reporting the same transaction again replaces it
+func (l *Ledger) addPendingTransaction(trx ledger.PendingTransactionDTO) string {
+	if trx.ID == "" {
+		return "id is required"
+	}
+	if !l.accountExists(trx.AccountID) {
+		return "Unknown account: " + trx.AccountID
+	}
+	for i := range l.pendingTransactions {
+		if l.pendingTransactions[i].ID == trx.ID {
+			l.pendingTransactions[i] = trx
+			return ""
+		}
+	}
+	l.pendingTransactions = append(l.pendingTransactions, trx)
+	return ""
+}
+
+func (l *Ledger) accountExists(accountID string) bool {
+	for _, account := range l.accounts {
+		if account.ID == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Ledger) reportPendingTransaction(w http.ResponseWriter, req *http.Request) {
+	var trx ledger.PendingTransactionDTO
+	if err := json.NewDecoder(req.Body).Decode(&trx); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errMsg := l.addPendingTransaction(trx); errMsg != "" {
+		http.Error(w, errMsg, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, trx)
+}
+
+type batchResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+func (l *Ledger) reportPendingTransactions(w http.ResponseWriter, req *http.Request) {
+	var payload struct {
+		Transactions []ledger.PendingTransactionDTO `json:"transactions"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results := make([]batchResult, 0, len(payload.Transactions))
+	for _, trx := range payload.Transactions {
+		results = append(results, batchResult{ID: trx.ID, Error: l.addPendingTransaction(trx)})
+	}
+	writeJSON(w, map[string]interface{}{"results": results})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Server is a fake ledger listening on a local port
+type Server struct {
+	*Ledger
+	URL string
+
+	httpServer *httptest.Server
+}
+
+// Close will stop the server
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// NewServer starts a fake ledger with given options on a local port
+func NewServer(opts ...LedgerOpt) *Server {
+	l := NewLedger(opts...)
+	httpServer := httptest.NewServer(l)
+	return &Server{Ledger: l, URL: httpServer.URL, httpServer: httpServer}
+}
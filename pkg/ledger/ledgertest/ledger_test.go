@@ -0,0 +1,153 @@
+package ledgertest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func tokens(idToken string) ledger.TokenSource {
+	return func(ctx context.Context) (types.IDToken, error) {
+		return types.IDToken(idToken), nil
+	}
+}
+
+func randTrx(accountID string) ledger.PendingTransactionDTO {
+	return ledger.PendingTransactionDTO{
+		ID:        "trx-" + faker.UUIDHyphenated(),
+		Amount:    "10.5",
+		Date:      time.Unix(faker.UnixTime(), 0).UTC().Format(time.RFC3339),
+		Comment:   faker.Sentence(),
+		AccountID: accountID,
+		TypeID:    ledger.TransactionTypeExpense,
+	}
+}
+
+func TestLedger(t *testing.T) {
+	account := ledger.AccountDTO{ID: "acc-" + faker.Word(), Name: faker.Word()}
+	idToken := "idt-" + faker.Word()
+	newServer := func(opts ...LedgerOpt) *Server {
+		return NewServer(append([]LedgerOpt{WithIDTokens(idToken), WithAccounts(account)}, opts...)...)
+	}
+	newAPI := func(t *testing.T, srv *Server) ledger.API {
+		api, err := ledger.NewAPI(context.TODO(), srv.URL, faker.Email(), tokens(idToken))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return api
+	}
+
+	t.Run("reject unknown id token", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		_, err := ledger.NewAPI(context.TODO(), srv.URL, faker.Email(), tokens("other-"+faker.Word()))
+		assert.Error(t, err)
+		assert.Equal(t, 0, srv.State().Logins)
+	})
+
+	t.Run("list accounts", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		accounts, err := newAPI(t, srv).ListAccounts(context.TODO())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []ledger.AccountDTO{account}, accounts)
+	})
+
+	t.Run("report pending transactions in batches", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		trxs := []ledger.PendingTransactionDTO{randTrx(account.ID), randTrx(account.ID), randTrx("unknown-" + faker.Word())}
+		results := newAPI(t, srv).ReportPendingTransactions(context.TODO(), trxs)
+		if !assert.Len(t, results, 3) {
+			return
+		}
+		assert.NoError(t, results[0].Err)
+		assert.NoError(t, results[1].Err)
+		assert.Error(t, results[2].Err)
+		assert.ElementsMatch(t, trxs[0:2], srv.PendingTransactions())
+	})
+
+	t.Run("report pending transactions one by one without batch support", func(t *testing.T) {
+		srv := newServer(WithoutBatchReports())
+		defer srv.Close()
+		trxs := []ledger.PendingTransactionDTO{randTrx(account.ID), randTrx(account.ID)}
+		results := newAPI(t, srv).ReportPendingTransactions(context.TODO(), trxs)
+		for _, result := range results {
+			assert.NoError(t, result.Err)
+		}
+		assert.ElementsMatch(t, trxs, srv.PendingTransactions())
+	})
+
+	t.Run("restart expired session", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		api := newAPI(t, srv)
+		srv.ExpireSessions()
+		trx := randTrx(account.ID)
+		if !assert.NoError(t, api.ReportPendingTransaction(context.TODO(), trx)) {
+			return
+		}
+		assert.Equal(t, []ledger.PendingTransactionDTO{trx}, srv.PendingTransactions())
+		assert.Equal(t, 2, srv.State().Logins)
+	})
+
+	t.Run("restart session on rotated csrf token", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		api := newAPI(t, srv)
+		srv.RotateCSRFTokens()
+		if !assert.NoError(t, api.ReportPendingTransaction(context.TODO(), randTrx(account.ID))) {
+			return
+		}
+		assert.Equal(t, 2, srv.State().Logins)
+	})
+
+	t.Run("fail injected requests", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		api := newAPI(t, srv)
+		srv.Fail(Failure{Method: http.MethodGet, Path: "/accounts", StatusCode: http.StatusServiceUnavailable, Times: 2})
+		for i := 0; i < 2; i++ {
+			_, err := api.ListAccounts(context.TODO())
+			assert.Error(t, err)
+		}
+		_, err := api.ListAccounts(context.TODO())
+		assert.NoError(t, err)
+	})
+
+	t.Run("list transactions within date range", func(t *testing.T) {
+		date := time.Unix(faker.UnixTime(), 0).UTC()
+		inRange := ledger.TransactionDTO{ID: faker.Word(), AccountID: account.ID, Date: date.Format(time.RFC3339)}
+		srv := newServer(WithTransactions(
+			inRange,
+			ledger.TransactionDTO{ID: faker.Word(), AccountID: account.ID, Date: date.Add(-48 * time.Hour).Format(time.RFC3339)},
+			ledger.TransactionDTO{ID: faker.Word(), AccountID: "other-" + faker.Word(), Date: date.Format(time.RFC3339)},
+		))
+		defer srv.Close()
+		api := newAPI(t, srv)
+		trxs, err := api.ListTransactions(context.TODO(), account.ID, date.Add(-time.Hour), date.Add(time.Hour))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []ledger.TransactionDTO{inRange}, trxs)
+
+		pendingTrx := randTrx(account.ID)
+		pendingTrx.Date = date.Format(time.RFC3339)
+		if !assert.NoError(t, api.ReportPendingTransaction(context.TODO(), pendingTrx)) {
+			return
+		}
+		pendingTrxs, err := api.ListPendingTransactions(context.TODO(), account.ID, date.Add(-time.Hour), date.Add(time.Hour))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []ledger.PendingTransactionDTO{pendingTrx}, pendingTrxs)
+	})
+}
@@ -1,5 +1,11 @@
 package ledger
 
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
 const (
 	// TransactionTypeIncome is a type of income transactions
 	TransactionTypeIncome uint8 = 1
@@ -12,6 +18,68 @@ const (
 type AccountDTO struct {
 	ID   string `json:"aggregate_id"`
 	Name string `json:"name"`
+
+	// Currency is ISO 4217 code of the account currency (e.g UAH)
+	Currency string `json:"currency_code"`
+
+	// Type is a kind of the account (e.g cash, card or deposit)
+	Type string `json:"type"`
+
+	// Closed accounts do not accept new transactions
+	Closed bool `json:"is_closed"`
+}
+
+// AccountNotOpenError is returned if transactions should not be reported
+// into the account since it is closed or missing in ledger
+type AccountNotOpenError struct {
+	AccountID string
+
+	// Missing is set if there is no such account, otherwise it is closed
+	Missing bool
+}
+
+func (e *AccountNotOpenError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("Ledger account %v not found", e.AccountID)
+	}
+	return fmt.Sprintf("Ledger account %v is closed", e.AccountID)
+}
+
+// IsAccountNotOpen returns true if the error is caused by a closed or missing ledger account
+func IsAccountNotOpen(err error) bool {
+	var notOpenErr *AccountNotOpenError
+	return errors.As(err, &notOpenErr)
+}
+
+// IsAccountClosed returns true if the error is caused by a ledger account that exists and is closed
+func IsAccountClosed(err error) bool {
+	var notOpenErr *AccountNotOpenError
+	return errors.As(err, &notOpenErr) && !notOpenErr.Missing
+}
+
+// FindOpenAccount returns an account with given ID. Fails with AccountNotOpenError if there
+// is no such account or it is closed, transactions should not be reported into such accounts
+func FindOpenAccount(accounts []AccountDTO, accountID string) (*AccountDTO, error) {
+	for i := range accounts {
+		if accounts[i].ID != accountID {
+			continue
+		}
+		if accounts[i].Closed {
+			return nil, &AccountNotOpenError{AccountID: accountID}
+		}
+		return &accounts[i], nil
+	}
+	return nil, &AccountNotOpenError{AccountID: accountID, Missing: true}
+}
+
+// TransactionDTO is a transaction recorded in ledger
+type TransactionDTO struct {
+	ID        string `json:"transaction_id"`
+	Amount    string `json:"amount"`
+	Date      string `json:"date"`
+	Comment   string `json:"comment"`
+	AccountID string `json:"account_id"`
+	TypeID    uint8  `json:"type_id"`
 }
 
 // PendingTransactionDTO is a ledger pending transaction
@@ -0,0 +1,42 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOpenAccount(t *testing.T) {
+	open := AccountDTO{ID: "acc-1-" + faker.Word(), Name: faker.Word(), Currency: "UAH"}
+	closed := AccountDTO{ID: "acc-2-" + faker.Word(), Name: faker.Word(), Closed: true}
+	accounts := []AccountDTO{open, closed}
+	tests := []struct {
+		name      string
+		accountID string
+		want      *AccountDTO
+		wantErr   string
+		closed    bool
+	}{
+		{name: "find open account", accountID: open.ID, want: &open},
+		{name: "fail if account is closed", accountID: closed.ID, wantErr: "Ledger account " + closed.ID + " is closed", closed: true},
+		{name: "fail if account is missing", accountID: "acc-3-" + faker.Word(), wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindOpenAccount(accounts, tt.accountID)
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+					assert.True(t, IsAccountNotOpen(errors.Wrap(err, "wrapped")))
+					assert.Equal(t, tt.closed, IsAccountClosed(errors.Wrap(err, "wrapped")))
+				}
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package ledgersync
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/pending"
+)
+
+// Duplicate is a pending transaction that was found in ledger
+type Duplicate struct {
+	TransactionID string
+
+	// LedgerID is an ID of a matching ledger transaction or pending transaction
+	LedgerID string
+
+	// Fuzzy is set if matched by amount, date and comment rather than by ID.
+	// Fuzzy duplicates are left not synced until confirmed or ignored manually,
+	// duplicates matched by ID are marked as synced
+	Fuzzy bool
+}
+
+// ledgerEntry is a transaction or a pending transaction present in ledger
+type ledgerEntry struct {
+	id      string
+	amount  float64
+	date    time.Time
+	comment string
+	typeID  uint8
+	matched bool
+}
+
+type duplicateFinder struct {
+	dateTolerance time.Duration
+	entries       []*ledgerEntry
+	entriesByID   map[string]*ledgerEntry
+}
+
+func newDuplicateFinder(
+	dateTolerance time.Duration,
+	trxs []ledger.TransactionDTO,
+	pendingTrxs []ledger.PendingTransactionDTO,
+) *duplicateFinder {
+	finder := &duplicateFinder{
+		dateTolerance: dateTolerance,
+		entries:       make([]*ledgerEntry, 0, len(trxs)+len(pendingTrxs)),
+		entriesByID:   make(map[string]*ledgerEntry, len(trxs)+len(pendingTrxs)),
+	}
+	add := func(id, amount, date, comment string, typeID uint8) {
+		entry := &ledgerEntry{id: id, comment: normalizeComment(comment), typeID: typeID}
+		entry.amount, _ = parseAmount(amount)
+		entry.date, _ = parseDate(date)
+		finder.entries = append(finder.entries, entry)
+		finder.entriesByID[id] = entry
+	}
+	for _, trx := range trxs {
+		add(trx.ID, trx.Amount, trx.Date, trx.Comment, trx.TypeID)
+	}
+	for _, trx := range pendingTrxs {
+		add(trx.ID, trx.Amount, trx.Date, trx.Comment, trx.TypeID)
+	}
+	return finder
+}
+
+// find returns nil if the transaction is not in ledger. Each ledger entry
+// matches a single transaction, so two similar transactions of the same day
+// are not both treated as duplicates of a single ledger entry
+func (f *duplicateFinder) find(trx *dal.PendingTransactionDTO) *Duplicate {
+	if entry, ok := f.entriesByID[trx.ID]; ok {
+		entry.matched = true
+		return &Duplicate{TransactionID: trx.ID, LedgerID: entry.id}
+	}
+	amount, err := parseAmount(trx.Amount)
+	if err != nil {
+		return nil
+	}
+	date, err := parseDate(trx.Date)
+	if err != nil {
+		return nil
+	}
+	comment := normalizeComment(trx.Comment)
+	for _, entry := range f.entries {
+		if entry.matched ||
+			entry.typeID != trx.TypeID ||
+			entry.date.IsZero() ||
+			math.Abs(entry.amount-amount) >= 0.005 ||
+			absDuration(entry.date.Sub(date)) > f.dateTolerance ||
+			!commentsMatch(entry.comment, comment) {
+			continue
+		}
+		entry.matched = true
+		return &Duplicate{TransactionID: trx.ID, LedgerID: entry.id, Fuzzy: true}
+	}
+	return nil
+}
+
+// dateRange returns a range of dates of transactions extended by the tolerance.
+// ok is false if none of the dates can be parsed
+func dateRange(trxs []dal.PendingTransactionDTO, tolerance time.Duration) (from time.Time, to time.Time, ok bool) {
+	for _, trx := range trxs {
+		date, err := parseDate(trx.Date)
+		if err != nil {
+			continue
+		}
+		if !ok || date.Before(from) {
+			from = date
+		}
+		if !ok || date.After(to) {
+			to = date
+		}
+		ok = true
+	}
+	return from.Add(-tolerance), to.Add(tolerance), ok
+}
+
+// findDuplicates will look for transactions that are already in ledger and return the rest.
+// Duplicates matched by ID are marked as synced and returned as done. Fuzzy duplicates are
+// flagged and neither returned nor changed, unless the transaction was confirmed manually.
+// Nothing is written to the storage, so it is used by dry runs as well.
+// Duplicates are not searched for if ledger transactions can not be fetched
+func (svc *service) findDuplicates(
+	ctx context.Context,
+	api ledger.API,
+	trxs []dal.PendingTransactionDTO,
+	report *Report,
+) (toReport []dal.PendingTransactionDTO, done []dal.PendingTransactionDTO, err error) {
+	from, to, ok := dateRange(trxs, svc.duplicateDateTolerance)
+	if !ok {
+		logger.Warn(ctx, "Failed to parse dates of pending transactions, not looking for duplicates")
+		return trxs, nil, nil
+	}
+	ledgerTrxs, err := api.ListTransactions(ctx, report.AccountID, from, to)
+	if err != nil {
+		logger.WithError(err).Warn(ctx, "Failed to fetch ledger transactions, not looking for duplicates")
+		return trxs, nil, nil
+	}
+	ledgerPendingTrxs, err := api.ListPendingTransactions(ctx, report.AccountID, from, to)
+	if err != nil {
+		logger.WithError(err).Warn(ctx, "Failed to fetch ledger pending transactions, not looking for duplicates")
+		return trxs, nil, nil
+	}
+
+	finder := newDuplicateFinder(svc.duplicateDateTolerance, ledgerTrxs, ledgerPendingTrxs)
+	now := svc.nowFn().UTC()
+	toReport = make([]dal.PendingTransactionDTO, 0, len(trxs))
+	for _, trx := range trxs {
+		duplicate := finder.find(&trx)
+		if duplicate == nil {
+			toReport = append(toReport, trx)
+			continue
+		}
+		if duplicate.Fuzzy {
+			confirmed, err := svc.isConfirmed(ctx, trx.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if confirmed {
+				logger.Info(ctx, "Pending trx %v looks like ledger trx %v but was confirmed, syncing", trx.ID, duplicate.LedgerID)
+				toReport = append(toReport, trx)
+				continue
+			}
+		}
+		report.Duplicates = append(report.Duplicates, *duplicate)
+		if !duplicate.Fuzzy {
+			logger.Info(ctx, "Pending trx %v is already in ledger, marking as synced", trx.ID)
+			trx.SyncedAt = &now
+			trx.NextSyncAt = nil
+			done = append(done, trx)
+			report.Skipped++
+			continue
+		}
+		logger.Warn(ctx, "Pending trx %v is a possible duplicate of ledger trx %v, not syncing until confirmed", trx.ID, duplicate.LedgerID)
+		report.Flagged++
+	}
+	return toReport, done, nil
+}
+
+// isConfirmed returns true if the transaction was confirmed to be synced even if it looks like a duplicate
+func (svc *service) isConfirmed(ctx context.Context, trxID string) (bool, error) {
+	changes, err := svc.storage.FindTransactionChanges(ctx, trxID)
+	if err != nil {
+		return false, err
+	}
+	for _, change := range changes {
+		if change.Action == pending.ActionConfirm {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseAmount(amount string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(amount), 64)
+}
+
+// parseDate accepts RFC3339 timestamps and plain dates as entered manually in ledger
+func parseDate(date string) (time.Time, error) {
+	parsed, err := time.Parse(time.RFC3339, date)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", date)
+}
+
+func normalizeComment(comment string) string {
+	return strings.ToLower(strings.Join(strings.Fields(comment), " "))
+}
+
+// commentsMatch allows a shortened comment since manually entered transactions
+// often have one. Empty comments do not match, amount and date alone are too weak
+func commentsMatch(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.Contains(a, b) || strings.Contains(b, a)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
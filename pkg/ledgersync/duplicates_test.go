@@ -0,0 +1,146 @@
+package ledgersync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_duplicateFinder_find(t *testing.T) {
+	date := time.Unix(faker.UnixTime(), 0).UTC()
+	pendingTrx := func() *dal.PendingTransactionDTO {
+		return &dal.PendingTransactionDTO{
+			ID:      "trx-" + faker.Word(),
+			Amount:  "123.45",
+			Date:    date.Format(time.RFC3339),
+			Comment: "Supermarket Silpo  Kyiv",
+			TypeID:  ledger.TransactionTypeExpense,
+		}
+	}
+	ledgerTrx := func(trx *dal.PendingTransactionDTO) ledger.TransactionDTO {
+		return ledger.TransactionDTO{
+			ID:      "ledger-trx-" + faker.Word(),
+			Amount:  trx.Amount,
+			Date:    trx.Date,
+			Comment: trx.Comment,
+			TypeID:  trx.TypeID,
+		}
+	}
+	type testCase struct {
+		trx         *dal.PendingTransactionDTO
+		trxs        []ledger.TransactionDTO
+		pendingTrxs []ledger.PendingTransactionDTO
+		want        func(trx *dal.PendingTransactionDTO) *Duplicate
+	}
+	tests := map[string]func() testCase{
+		"match transaction by id": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.ID = trx.ID
+			existing.Amount = "1"
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}, want: func(trx *dal.PendingTransactionDTO) *Duplicate {
+				return &Duplicate{TransactionID: trx.ID, LedgerID: trx.ID}
+			}}
+		},
+		"match pending transaction by id": func() testCase {
+			trx := pendingTrx()
+			return testCase{trx: trx, pendingTrxs: []ledger.PendingTransactionDTO{{ID: trx.ID}}, want: func(trx *dal.PendingTransactionDTO) *Duplicate {
+				return &Duplicate{TransactionID: trx.ID, LedgerID: trx.ID}
+			}}
+		},
+		"match fuzzily": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Amount = "123.450"
+			existing.Date = date.Add(20 * time.Hour).Format(time.RFC3339)
+			existing.Comment = "silpo"
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}, want: func(trx *dal.PendingTransactionDTO) *Duplicate {
+				return &Duplicate{TransactionID: trx.ID, LedgerID: existing.ID, Fuzzy: true}
+			}}
+		},
+		"match fuzzily with plain date": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Date = date.Format("2006-01-02")
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}, want: func(trx *dal.PendingTransactionDTO) *Duplicate {
+				return &Duplicate{TransactionID: trx.ID, LedgerID: existing.ID, Fuzzy: true}
+			}}
+		},
+		"not match empty comment": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Comment = ""
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+		"not match if own comment is empty": func() testCase {
+			trx := pendingTrx()
+			trx.Comment = ""
+			existing := ledgerTrx(trx)
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+		"not match different amount": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Amount = "123.46"
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+		"not match different type": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.TypeID = ledger.TransactionTypeIncome
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+		"not match distant date": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Date = date.Add(-25 * time.Hour).Format(time.RFC3339)
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+		"not match different comment": func() testCase {
+			trx := pendingTrx()
+			existing := ledgerTrx(trx)
+			existing.Comment = "Taxi"
+			return testCase{trx: trx, trxs: []ledger.TransactionDTO{existing}}
+		},
+	}
+	for name, tt := range tests {
+		tt := tt()
+		t.Run(name, func(t *testing.T) {
+			finder := newDuplicateFinder(24*time.Hour, tt.trxs, tt.pendingTrxs)
+			var want *Duplicate
+			if tt.want != nil {
+				want = tt.want(tt.trx)
+			}
+			assert.Equal(t, want, finder.find(tt.trx))
+		})
+	}
+
+	t.Run("match each ledger entry once", func(t *testing.T) {
+		trx1 := pendingTrx()
+		trx2 := pendingTrx()
+		existing := ledgerTrx(trx1)
+		finder := newDuplicateFinder(24*time.Hour, []ledger.TransactionDTO{existing}, nil)
+		assert.Equal(t, &Duplicate{TransactionID: trx1.ID, LedgerID: existing.ID, Fuzzy: true}, finder.find(trx1))
+		assert.Nil(t, finder.find(trx2))
+	})
+}
+
+func Test_dateRange(t *testing.T) {
+	date := time.Unix(faker.UnixTime(), 0).UTC()
+	from, to, ok := dateRange([]dal.PendingTransactionDTO{
+		{Date: date.Add(time.Hour).Format(time.RFC3339)},
+		{Date: faker.Word()},
+		{Date: date.Format(time.RFC3339)},
+		{Date: date.Add(5 * time.Hour).Format(time.RFC3339)},
+	}, time.Hour)
+	assert.True(t, ok)
+	assert.True(t, date.Add(-time.Hour).Equal(from), from)
+	assert.True(t, date.Add(6*time.Hour).Equal(to), to)
+
+	_, _, ok = dateRange([]dal.PendingTransactionDTO{{Date: faker.Word()}}, time.Hour)
+	assert.False(t, ok)
+}
@@ -0,0 +1,497 @@
+package ledgersync
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/auth"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+)
+
+var logger = diag.CreateLogger()
+
+// maxRetryBackoff is an upper limit of a delay between sync attempts
+const maxRetryBackoff = 24 * time.Hour
+
+// Report represents results of syncing an account
+type Report struct {
+	AccountID    string
+	Synced       int
+	Failed       int
+	DeadLettered int
+
+	// Skipped are transactions found in ledger by ID, they are marked as synced
+	Skipped int
+
+	// Flagged are possible duplicates of ledger transactions, they are not synced until confirmed
+	Flagged int
+
+	Duplicates []Duplicate
+}
+
+// UserReport represents results of syncing all accounts of a user
+type UserReport struct {
+	UserID   string
+	Accounts []*Report
+
+	// Locked are accounts that were skipped because they are being synced by another process
+	Locked []string
+
+	// Closed are accounts that were skipped because they are closed or missing in ledger,
+	// their transactions are left not synced
+	Closed []string
+}
+
+// Totals returns results of all accounts summed up
+func (r *UserReport) Totals() Report {
+	totals := Report{}
+	for _, report := range r.Accounts {
+		totals.Synced += report.Synced
+		totals.Failed += report.Failed
+		totals.DeadLettered += report.DeadLettered
+		totals.Skipped += report.Skipped
+		totals.Flagged += report.Flagged
+		totals.Duplicates = append(totals.Duplicates, report.Duplicates...)
+	}
+	return totals
+}
+
+// Actions sync would take with transactions in a dry run
+const (
+	DryRunActionReport = "report"
+	DryRunActionSkip   = "skip"
+	DryRunActionFlag   = "flag"
+	DryRunActionRefuse = "refuse"
+)
+
+// DryRunTransaction is a pending transaction and what the sync would do with it
+type DryRunTransaction struct {
+	Action    string `json:"action"`
+	ID        string `json:"id"`
+	Amount    string `json:"amount"`
+	Date      string `json:"date"`
+	Comment   string `json:"comment"`
+	AccountID string `json:"account_id"`
+	TypeID    uint8  `json:"type_id"`
+
+	// Reason is set for transactions that would not be reported
+	Reason string `json:"reason,omitempty"`
+}
+
+// Service reports pending transactions to ledger
+type Service interface {
+	// SyncTransactions will report not synced transactions of the account.
+	// Nothing is reported if the ledger account is closed or missing.
+	// Transactions that failed transiently are scheduled for a retry and those rejected
+	// by ledger are dead lettered right away, failures do not stop the sync.
+	// If the account is being synced by another process then lock.LockedError is returned
+	SyncTransactions(ctx context.Context, userID string, accountID string) (*Report, error)
+
+	// SyncUserTransactions will report not synced transactions of all accounts of the user
+	// using a single ledger session. Accounts that are being synced by another process
+	// and accounts that are closed or missing in ledger are skipped
+	SyncUserTransactions(ctx context.Context, userID string) (*UserReport, error)
+
+	// DryRun returns transactions that would be synced by SyncTransactions, or by
+	// SyncUserTransactions if accountID is empty, with an action the sync would take.
+	// Ledger accounts and duplicates are checked the same way as when syncing.
+	// Nothing is reported and nothing is written to the storage, ledger sessions started
+	// to check accounts are not saved
+	DryRun(ctx context.Context, userID string, accountID string) ([]DryRunTransaction, error)
+}
+
+type service struct {
+	storage    dal.Storage
+	authSvc    auth.Service
+	apiFactory ledger.APIFactory
+	ledgerURL  string
+
+	// dryRunAPIFactory is used to open ledger sessions in dry runs, must not write to the storage
+	dryRunAPIFactory ledger.APIFactory
+
+	maxAttempts  int
+	retryBackoff time.Duration
+	nowFn        func() time.Time
+	locker       lock.Locker
+
+	detectDuplicates       bool
+	duplicateDateTolerance time.Duration
+}
+
+// session opens a ledger session on first use, so it is not opened
+// if there is nothing to sync and is shared by all synced accounts
+type session struct {
+	svc        *service
+	apiFactory ledger.APIFactory
+	userID     string
+	api        ledger.API
+	accounts   []ledger.AccountDTO
+}
+
+func (sess *session) get(ctx context.Context) (ledger.API, error) {
+	if sess.api != nil {
+		return sess.api, nil
+	}
+	api, err := sess.apiFactory(ctx, sess.svc.ledgerURL, sess.userID, func(ctx context.Context) (types.IDToken, error) {
+		return sess.svc.authSvc.FetchAuthToken(ctx, sess.userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sess.api = api
+	return api, nil
+}
+
+// openAccount returns the ledger account if it is open, accounts are fetched once per session
+func (sess *session) openAccount(ctx context.Context, accountID string) (*ledger.AccountDTO, error) {
+	if sess.accounts == nil {
+		accounts, err := sess.api.ListAccounts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sess.accounts = accounts
+	}
+	return ledger.FindOpenAccount(sess.accounts, accountID)
+}
+
+func (svc *service) SyncTransactions(ctx context.Context, userID string, accountID string) (*Report, error) {
+	report := &Report{AccountID: accountID}
+	pending, err := svc.syncAccount(ctx, &session{svc: svc, apiFactory: svc.apiFactory, userID: userID}, report)
+	if err != nil {
+		return report, err
+	}
+	if report.Failed > 0 {
+		return report, fmt.Errorf("Failed to sync %v of %v transactions", report.Failed, pending)
+	}
+	return report, nil
+}
+
+func (svc *service) SyncUserTransactions(ctx context.Context, userID string) (*UserReport, error) {
+	userReport := &UserReport{UserID: userID, Accounts: []*Report{}, Locked: []string{}, Closed: []string{}}
+	notSyncedTrxs, err := svc.storage.FindNotSyncedTransactionsByUser(ctx, userID)
+	if err != nil {
+		return userReport, err
+	}
+	accountIDs := []string{}
+	for _, trx := range notSyncedTrxs {
+		if len(accountIDs) == 0 || accountIDs[len(accountIDs)-1] != trx.AccountID {
+			accountIDs = append(accountIDs, trx.AccountID)
+		}
+	}
+	if len(accountIDs) == 0 {
+		logger.Info(ctx, "No pending transactions to sync")
+		return userReport, nil
+	}
+	logger.Info(ctx, "Got %v pending transactions of %v accounts to sync", len(notSyncedTrxs), len(accountIDs))
+
+	sess := &session{svc: svc, apiFactory: svc.apiFactory, userID: userID}
+	totalPending := 0
+	for _, accountID := range accountIDs {
+		report := &Report{AccountID: accountID}
+		pending, err := svc.syncAccount(ctx, sess, report)
+		if lock.IsLocked(err) {
+			logger.Info(ctx, "Skipping account %v, it is being synced by another process", accountID)
+			userReport.Locked = append(userReport.Locked, accountID)
+			continue
+		}
+		if ledger.IsAccountNotOpen(err) {
+			logger.WithError(err).Warn(ctx, "Skipping account %v, it is not open in ledger", accountID)
+			userReport.Closed = append(userReport.Closed, accountID)
+			continue
+		}
+		userReport.Accounts = append(userReport.Accounts, report)
+		if err != nil {
+			return userReport, errors.Wrapf(err, "Failed to sync account %v", accountID)
+		}
+		totalPending += pending
+	}
+	if totals := userReport.Totals(); totals.Failed > 0 {
+		return userReport, fmt.Errorf("Failed to sync %v of %v transactions", totals.Failed, totalPending)
+	}
+	return userReport, nil
+}
+
+// syncAccount will report not synced transactions of the account. Failed transactions
+// are counted in the report, an error is returned only if the sync can not proceed.
+// Returns number of transactions that were due to sync
+func (svc *service) syncAccount(ctx context.Context, sess *session, report *Report) (int, error) {
+	if svc.locker != nil {
+		held, err := svc.locker.Acquire(ctx, lock.Key(sess.userID, report.AccountID, lock.OperationSync))
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			if err := held.Release(ctx); err != nil {
+				logger.WithError(err).Error(ctx, "Failed to release sync lock")
+			}
+		}()
+	}
+
+	notSyncedTrxs, err := svc.storage.FindNotSyncedTransactions(ctx, report.AccountID)
+	if err != nil {
+		return 0, err
+	}
+	if len(notSyncedTrxs) == 0 {
+		logger.Info(ctx, "No pending transactions to sync")
+		return 0, nil
+	}
+
+	logger.Info(ctx, "Got %v pending transactions of account %v to sync", len(notSyncedTrxs), report.AccountID)
+
+	api, err := sess.get(ctx)
+	if err != nil {
+		return len(notSyncedTrxs), err
+	}
+	if _, err := sess.openAccount(ctx, report.AccountID); err != nil {
+		return len(notSyncedTrxs), errors.Wrap(err, "Refusing to report pending transactions")
+	}
+
+	toReport := notSyncedTrxs
+	var done []dal.PendingTransactionDTO
+	if svc.detectDuplicates {
+		if toReport, done, err = svc.findDuplicates(ctx, api, notSyncedTrxs, report); err != nil {
+			return len(notSyncedTrxs), errors.Wrap(err, "Failed to record duplicates of ledger transactions")
+		}
+	}
+
+	ledgerTrxs := make([]ledger.PendingTransactionDTO, 0, len(toReport))
+	for i := range toReport {
+		ledgerTrxs = append(ledgerTrxs, toLedgerDTO(&toReport[i]))
+	}
+	results := api.ReportPendingTransactions(ctx, ledgerTrxs)
+	syncedAt := svc.nowFn().UTC()
+	for i, result := range results {
+		trx := &toReport[i]
+		if result.Err != nil {
+			svc.recordFailure(ctx, trx, result.Err, report)
+			continue
+		}
+		trx.SyncedAt = &syncedAt
+		trx.NextSyncAt = nil
+		report.Synced++
+	}
+	if err := svc.storage.SaveSyncResults(ctx, append(done, toReport...)); err != nil {
+		return len(notSyncedTrxs), errors.Wrap(err, "Failed to record sync results of pending transactions")
+	}
+
+	logger.Info(ctx, "Synced %v transactions: failed=%v, deadLettered=%v, skipped=%v, flagged=%v",
+		report.Synced, report.Failed, report.DeadLettered, report.Skipped, report.Flagged)
+	return len(notSyncedTrxs), nil
+}
+
+func (svc *service) DryRun(ctx context.Context, userID string, accountID string) ([]DryRunTransaction, error) {
+	var notSyncedTrxs []dal.PendingTransactionDTO
+	var err error
+	if accountID == "" {
+		notSyncedTrxs, err = svc.storage.FindNotSyncedTransactionsByUser(ctx, userID)
+	} else {
+		notSyncedTrxs, err = svc.storage.FindNotSyncedTransactions(ctx, accountID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info(ctx, "Dry run: %v pending transactions would be synced", len(notSyncedTrxs))
+	result := make([]DryRunTransaction, 0, len(notSyncedTrxs))
+	sess := &session{svc: svc, apiFactory: svc.dryRunAPIFactory, userID: userID}
+
+	// Transactions are ordered by account
+	for start := 0; start < len(notSyncedTrxs); {
+		end := start + 1
+		for end < len(notSyncedTrxs) && notSyncedTrxs[end].AccountID == notSyncedTrxs[start].AccountID {
+			end++
+		}
+		accountTrxs, err := svc.dryRunAccount(ctx, sess, notSyncedTrxs[start:end])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to check account %v", notSyncedTrxs[start].AccountID)
+		}
+		result = append(result, accountTrxs...)
+		start = end
+	}
+	return result, nil
+}
+
+// dryRunAccount will check the ledger account and look for duplicates
+// of transactions of the account without changing anything
+func (svc *service) dryRunAccount(ctx context.Context, sess *session, trxs []dal.PendingTransactionDTO) ([]DryRunTransaction, error) {
+	accountID := trxs[0].AccountID
+	result := make([]DryRunTransaction, 0, len(trxs))
+	api, err := sess.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sess.openAccount(ctx, accountID); err != nil {
+		if !ledger.IsAccountNotOpen(err) {
+			return nil, err
+		}
+		for i := range trxs {
+			result = append(result, newDryRunTransaction(&trxs[i], DryRunActionRefuse, err.Error()))
+		}
+		return result, nil
+	}
+
+	duplicates := map[string]Duplicate{}
+	if svc.detectDuplicates {
+		report := &Report{AccountID: accountID}
+		if _, _, err := svc.findDuplicates(ctx, api, trxs, report); err != nil {
+			return nil, err
+		}
+		for _, duplicate := range report.Duplicates {
+			duplicates[duplicate.TransactionID] = duplicate
+		}
+	}
+	for i := range trxs {
+		duplicate, ok := duplicates[trxs[i].ID]
+		switch {
+		case !ok:
+			result = append(result, newDryRunTransaction(&trxs[i], DryRunActionReport, ""))
+		case duplicate.Fuzzy:
+			result = append(result, newDryRunTransaction(&trxs[i], DryRunActionFlag,
+				"Possible duplicate of ledger transaction "+duplicate.LedgerID))
+		default:
+			result = append(result, newDryRunTransaction(&trxs[i], DryRunActionSkip, "Already in ledger"))
+		}
+	}
+	return result, nil
+}
+
+func newDryRunTransaction(trx *dal.PendingTransactionDTO, action string, reason string) DryRunTransaction {
+	return DryRunTransaction{
+		Action:    action,
+		ID:        trx.ID,
+		Amount:    trx.Amount,
+		Date:      trx.Date,
+		Comment:   trx.Comment,
+		AccountID: trx.AccountID,
+		TypeID:    trx.TypeID,
+		Reason:    reason,
+	}
+}
+
+func toLedgerDTO(trx *dal.PendingTransactionDTO) ledger.PendingTransactionDTO {
+	return ledger.PendingTransactionDTO{
+		ID:        trx.ID,
+		Amount:    trx.Amount,
+		Date:      trx.Date,
+		Comment:   trx.Comment,
+		AccountID: trx.AccountID,
+		TypeID:    trx.TypeID,
+	}
+}
+
+func (svc *service) recordFailure(ctx context.Context, trx *dal.PendingTransactionDTO, reportErr error, report *Report) {
+	now := svc.nowFn().UTC()
+	trx.SyncAttempts++
+	trx.LastSyncError = reportErr.Error()
+	trx.LastSyncAttemptAt = &now
+	report.Failed++
+	if request.IsPermanent(reportErr) {
+		logger.WithError(reportErr).Error(ctx, "Ledger rejected pending trx %v, it will not be retried", trx.ID)
+		trx.NextSyncAt = nil
+		trx.DeadLetteredAt = &now
+		report.DeadLettered++
+	} else if trx.SyncAttempts >= svc.maxAttempts {
+		logger.WithError(reportErr).Error(ctx, "Failed to report pending trx %v, giving up after %v attempts", trx.ID, trx.SyncAttempts)
+		trx.NextSyncAt = nil
+		trx.DeadLetteredAt = &now
+		report.DeadLettered++
+	} else {
+		nextSyncAt := now.Add(svc.backoff(trx.SyncAttempts))
+		logger.WithError(reportErr).Warn(ctx, "Failed to report pending trx %v, will retry after %v", trx.ID, nextSyncAt)
+		trx.NextSyncAt = &nextSyncAt
+	}
+}
+
+func (svc *service) backoff(attempts int) time.Duration {
+	backoff := svc.retryBackoff
+	for i := 1; i < attempts && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// ServiceOpt is an option for sync service
+type ServiceOpt func(*service)
+
+// WithStorage will init the service with storage
+func WithStorage(storage dal.Storage) ServiceOpt {
+	return func(svc *service) {
+		svc.storage = storage
+	}
+}
+
+// WithAuthService will init the service with auth service
+func WithAuthService(authSvc auth.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.authSvc = authSvc
+	}
+}
+
+// WithLedgerAPI will init the service with ledger API factory and url
+func WithLedgerAPI(ledgerURL string, apiFactory ledger.APIFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.ledgerURL = ledgerURL
+		svc.apiFactory = apiFactory
+	}
+}
+
+// WithDryRunLedgerAPI will open ledger sessions in dry runs with given API factory.
+// The factory must not write to the storage (see ledger.WithReadOnlySessionStorage).
+// Dry runs start a new ledger session each run if not set
+func WithDryRunLedgerAPI(apiFactory ledger.APIFactory) ServiceOpt {
+	return func(svc *service) {
+		svc.dryRunAPIFactory = apiFactory
+	}
+}
+
+// WithRetries will set how many times to attempt reporting a transaction before
+// dead lettering it and a delay before the first retry. The delay doubles with each attempt
+func WithRetries(maxAttempts int, backoff time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.maxAttempts = maxAttempts
+		svc.retryBackoff = backoff
+	}
+}
+
+// WithLocker will prevent syncing the same account by concurrent processes
+func WithLocker(locker lock.Locker) ServiceOpt {
+	return func(svc *service) {
+		svc.locker = locker
+	}
+}
+
+// WithDuplicateDetection will look for pending transactions that are already in ledger
+// before reporting them. Transactions are matched by ID or by amount, comment and a date
+// that differs by no more than dateTolerance
+func WithDuplicateDetection(dateTolerance time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.detectDuplicates = true
+		svc.duplicateDateTolerance = dateTolerance
+	}
+}
+
+// NewService returns an instance of a sync service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		apiFactory:       ledger.NewAPI,
+		dryRunAPIFactory: ledger.NewAPI,
+		maxAttempts:      5,
+		retryBackoff:     10 * time.Minute,
+		nowFn:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
@@ -0,0 +1,835 @@
+package ledgersync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger/ledgertest"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/pending"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/types"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthService struct {
+	token types.IDToken
+}
+
+func (svc *mockAuthService) RegisterUser(ctx context.Context, oauthCode string) (string, error) {
+	return "", errors.New("Not supported")
+}
+
+func (svc *mockAuthService) FetchAuthToken(ctx context.Context, email string) (types.IDToken, error) {
+	return svc.token, nil
+}
+
+type mockAPI struct {
+	reported []ledger.PendingTransactionDTO
+	failures map[string]error
+	batches  int
+
+	accounts     []ledger.AccountDTO
+	accountLists int
+
+	ledgerTrxs        []ledger.TransactionDTO
+	ledgerPendingTrxs []ledger.PendingTransactionDTO
+}
+
+func (a *mockAPI) ListAccounts(ctx context.Context) ([]ledger.AccountDTO, error) {
+	a.accountLists++
+	return a.accounts, nil
+}
+
+func openAccounts(accountIDs ...string) []ledger.AccountDTO {
+	accounts := make([]ledger.AccountDTO, 0, len(accountIDs))
+	for _, accountID := range accountIDs {
+		accounts = append(accounts, ledger.AccountDTO{ID: accountID, Name: faker.Word(), Currency: "UAH"})
+	}
+	return accounts
+}
+
+func (a *mockAPI) ListTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.TransactionDTO, error) {
+	return a.ledgerTrxs, nil
+}
+
+func (a *mockAPI) ListPendingTransactions(ctx context.Context, accountID string, from, to time.Time) ([]ledger.PendingTransactionDTO, error) {
+	return a.ledgerPendingTrxs, nil
+}
+
+func (a *mockAPI) ReportPendingTransaction(ctx context.Context, trx ledger.PendingTransactionDTO) error {
+	if err, ok := a.failures[trx.ID]; ok {
+		return err
+	}
+	a.reported = append(a.reported, trx)
+	return nil
+}
+
+func (a *mockAPI) ReportPendingTransactions(ctx context.Context, trxs []ledger.PendingTransactionDTO) []ledger.ReportResult {
+	a.batches++
+	results := make([]ledger.ReportResult, 0, len(trxs))
+	for _, trx := range trxs {
+		results = append(results, ledger.ReportResult{ID: trx.ID, Err: a.ReportPendingTransaction(ctx, trx)})
+	}
+	return results
+}
+
+// dumpStorage returns rows of all storage tables, so tests can check that nothing was written
+func dumpStorage(t *testing.T, db *sql.DB) map[string][]string {
+	tables := []string{}
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table'")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	for rows.Next() {
+		var table string
+		if !assert.NoError(t, rows.Scan(&table)) {
+			break
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	dump := map[string][]string{}
+	for _, table := range tables {
+		dump[table] = []string{}
+		rows, err := db.Query("SELECT * FROM " + table)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		columns, err := rows.Columns()
+		if !assert.NoError(t, err) {
+			rows.Close()
+			return nil
+		}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			if !assert.NoError(t, rows.Scan(dest...)) {
+				break
+			}
+			dump[table] = append(dump[table], fmt.Sprint(values...))
+		}
+		rows.Close()
+	}
+	return dump
+}
+
+func setupStorage(t *testing.T, now time.Time) (*sql.DB, dal.Storage) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	db.SetMaxOpenConns(1)
+	storage, err := dal.NewSQLStorage(dal.WithSQLDb(db), dal.WithNowFn(func() time.Time { return now }))
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	if err := storage.Setup(context.TODO()); !assert.NoError(t, err) {
+		return nil, nil
+	}
+	return db, storage
+}
+
+func randTrx(accountID string) *dal.PendingTransactionDTO {
+	return &dal.PendingTransactionDTO{
+		ID:        gofakeit.UUID(),
+		Amount:    faker.Word(),
+		Date:      faker.Word(),
+		Comment:   faker.Word(),
+		AccountID: accountID,
+		TypeID:    ledger.TransactionTypeExpense,
+	}
+}
+
+func Test_service_SyncTransactions(t *testing.T) {
+	type testCase struct {
+		accountID string
+		api       *mockAPI
+		assert    func(t *testing.T, report *Report, err error)
+	}
+	type tcFn func(*testing.T, *sql.DB, dal.Storage, time.Time) *testCase
+
+	const maxAttempts = 3
+	const backoff = 10 * time.Minute
+
+	saveTrxs := func(t *testing.T, s dal.Storage, trxs ...*dal.PendingTransactionDTO) bool {
+		for _, trx := range trxs {
+			if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+				return false
+			}
+		}
+		return true
+	}
+	findTrx := func(t *testing.T, s dal.Storage, accountID string, id string, deadLettered bool) *dal.PendingTransactionDTO {
+		var trxs []dal.PendingTransactionDTO
+		var err error
+		if deadLettered {
+			trxs, err = s.FindDeadLetteredTransactions(context.TODO(), accountID)
+		} else {
+			trxs, err = s.FindNotSyncedTransactions(context.TODO(), accountID)
+		}
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		for _, trx := range trxs {
+			if trx.ID == id {
+				return &trx
+			}
+		}
+		return nil
+	}
+
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "report all transactions", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				trxs := []*dal.PendingTransactionDTO{randTrx(accountID), randTrx(accountID)}
+				if !saveTrxs(t, s, trxs...) {
+					return nil
+				}
+				api := &mockAPI{}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Equal(t, &Report{AccountID: accountID, Synced: 2}, report)
+						assert.Len(t, api.reported, 2)
+						notSynced, err := s.FindNotSyncedTransactions(context.TODO(), accountID)
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Empty(t, notSynced)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "continue past failures and schedule retry", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				failing := randTrx(accountID)
+				failing.SyncAttempts = 1
+				trxs := []*dal.PendingTransactionDTO{failing, randTrx(accountID)}
+				if !saveTrxs(t, s, trxs...) {
+					return nil
+				}
+				reportErr := errors.New(faker.Sentence())
+				api := &mockAPI{failures: map[string]error{failing.ID: reportErr}}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						if !assert.EqualError(t, err, "Failed to sync 1 of 2 transactions") {
+							return
+						}
+						assert.Equal(t, &Report{AccountID: accountID, Synced: 1, Failed: 1}, report)
+						assert.Len(t, api.reported, 1)
+
+						notSynced, err := s.FindNotSyncedTransactions(context.TODO(), accountID)
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Empty(t, notSynced, "failed transaction should not be due yet")
+
+						later, err := dal.NewSQLStorage(dal.WithSQLDb(db), dal.WithNowFn(func() time.Time {
+							return now.Add(2 * backoff)
+						}))
+						if !assert.NoError(t, err) {
+							return
+						}
+						got := findTrx(t, later, accountID, failing.ID, false)
+						if !assert.NotNil(t, got) {
+							return
+						}
+						assert.Equal(t, 2, got.SyncAttempts)
+						assert.Equal(t, reportErr.Error(), got.LastSyncError)
+						assert.Equal(t, now, *got.LastSyncAttemptAt)
+						assert.Equal(t, now.Add(2*backoff), *got.NextSyncAt)
+						assert.Nil(t, got.DeadLetteredAt)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "dead letter after max attempts", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				failing := randTrx(accountID)
+				failing.SyncAttempts = maxAttempts - 1
+				if !saveTrxs(t, s, failing) {
+					return nil
+				}
+				reportErr := errors.New(faker.Sentence())
+				api := &mockAPI{failures: map[string]error{failing.ID: reportErr}}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						if !assert.Error(t, err) {
+							return
+						}
+						assert.Equal(t, &Report{AccountID: accountID, Failed: 1, DeadLettered: 1}, report)
+						got := findTrx(t, s, accountID, failing.ID, true)
+						if !assert.NotNil(t, got) {
+							return
+						}
+						assert.Equal(t, maxAttempts, got.SyncAttempts)
+						assert.Equal(t, reportErr.Error(), got.LastSyncError)
+						assert.Equal(t, now, *got.LastSyncAttemptAt)
+						assert.Equal(t, now, *got.DeadLetteredAt)
+						assert.Nil(t, got.NextSyncAt)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "dead letter rejected transaction right away", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				failing := randTrx(accountID)
+				if !saveTrxs(t, s, failing) {
+					return nil
+				}
+				reportErr := request.Permanent(errors.New(faker.Sentence()))
+				api := &mockAPI{failures: map[string]error{failing.ID: reportErr}}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						if !assert.Error(t, err) {
+							return
+						}
+						assert.Equal(t, &Report{AccountID: accountID, Failed: 1, DeadLettered: 1}, report)
+						got := findTrx(t, s, accountID, failing.ID, true)
+						if !assert.NotNil(t, got) {
+							return
+						}
+						assert.Equal(t, 1, got.SyncAttempts)
+						assert.Equal(t, reportErr.Error(), got.LastSyncError)
+						assert.Equal(t, now, *got.DeadLetteredAt)
+						assert.Nil(t, got.NextSyncAt)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "refuse to report into closed account", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				if !saveTrxs(t, s, randTrx(accountID)) {
+					return nil
+				}
+				accounts := openAccounts(accountID)
+				accounts[0].Closed = true
+				api := &mockAPI{accounts: accounts}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						if !assert.EqualError(t, err, "Refusing to report pending transactions: Ledger account "+accountID+" is closed") {
+							return
+						}
+						assert.True(t, ledger.IsAccountClosed(err))
+						assert.Equal(t, &Report{AccountID: accountID}, report)
+						assert.Empty(t, api.reported)
+						notSynced, err := s.FindNotSyncedTransactions(context.TODO(), accountID)
+						if !assert.NoError(t, err) {
+							return
+						}
+						assert.Len(t, notSynced, 1)
+					},
+				}
+			}
+		},
+		func() (string, tcFn) {
+			return "refuse to report into missing account", func(t *testing.T, db *sql.DB, s dal.Storage, now time.Time) *testCase {
+				accountID := "acc-" + faker.Word()
+				if !saveTrxs(t, s, randTrx(accountID)) {
+					return nil
+				}
+				api := &mockAPI{accounts: openAccounts("other-" + faker.Word())}
+				return &testCase{
+					accountID: accountID,
+					api:       api,
+					assert: func(t *testing.T, report *Report, err error) {
+						assert.EqualError(t, err, "Refusing to report pending transactions: Ledger account "+accountID+" not found")
+						assert.Empty(t, api.reported)
+					},
+				}
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			db, storage := setupStorage(t, now)
+			if db == nil {
+				return
+			}
+			defer db.Close()
+			tt := tt(t, db, storage, now)
+			if tt == nil {
+				return
+			}
+			if tt.api.accounts == nil {
+				tt.api.accounts = openAccounts(tt.accountID)
+			}
+			svc := NewService(
+				WithStorage(storage),
+				WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+				WithLedgerAPI(faker.URL(), func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+					return tt.api, nil
+				}),
+				WithRetries(maxAttempts, backoff),
+			)
+			svc.(*service).nowFn = func() time.Time { return now }
+			report, err := svc.SyncTransactions(context.TODO(), faker.Email(), tt.accountID)
+			tt.assert(t, report, err)
+		})
+	}
+}
+
+func Test_service_SyncTransactions_Locked(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+	accountID := "acc-" + faker.Word()
+	if err := storage.SavePendingTransaction(context.TODO(), randTrx(accountID)); !assert.NoError(t, err) {
+		return
+	}
+	locker := lock.NewStorageLocker(storage)
+	held, err := locker.Acquire(context.TODO(), lock.Key(userID, accountID, lock.OperationSync))
+	if !assert.NoError(t, err) {
+		return
+	}
+	api := &mockAPI{accounts: openAccounts(accountID)}
+	svc := NewService(
+		WithStorage(storage),
+		WithLocker(locker),
+		WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+		WithLedgerAPI(faker.URL(), func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			return api, nil
+		}),
+	)
+
+	report, err := svc.SyncTransactions(context.TODO(), userID, accountID)
+	assert.True(t, lock.IsLocked(err))
+	assert.Equal(t, &Report{AccountID: accountID}, report)
+	assert.Empty(t, api.reported)
+
+	if !assert.NoError(t, held.Release(context.TODO())) {
+		return
+	}
+	report, err = svc.SyncTransactions(context.TODO(), userID, accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, report.Synced)
+}
+
+func Test_service_SyncUserTransactions(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+	account1 := "acc-1-" + faker.Word()
+	account2 := "acc-2-" + faker.Word()
+	lockedAccount := "acc-3-" + faker.Word()
+	withUser := func(trx *dal.PendingTransactionDTO, userID string) *dal.PendingTransactionDTO {
+		trx.UserID = userID
+		return trx
+	}
+	account1Trxs := []*dal.PendingTransactionDTO{withUser(randTrx(account1), userID), withUser(randTrx(account1), userID)}
+	account2Trx := withUser(randTrx(account2), userID)
+	lockedTrx := withUser(randTrx(lockedAccount), userID)
+	otherUserTrx := withUser(randTrx("acc-"+faker.Word()), faker.Email())
+	for _, trx := range append(account1Trxs, account2Trx, lockedTrx, otherUserTrx) {
+		if err := storage.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+	locker := lock.NewStorageLocker(storage)
+	held, err := locker.Acquire(context.TODO(), lock.Key(userID, lockedAccount, lock.OperationSync))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer held.Release(context.TODO())
+
+	reportErr := errors.New(faker.Sentence())
+	api := &mockAPI{
+		failures: map[string]error{account1Trxs[1].ID: reportErr},
+		accounts: openAccounts(account1, account2, lockedAccount),
+	}
+	sessions := 0
+	svc := NewService(
+		WithStorage(storage),
+		WithLocker(locker),
+		WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+		WithLedgerAPI(faker.URL(), func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			sessions++
+			return api, nil
+		}),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	report, err := svc.SyncUserTransactions(context.TODO(), userID)
+	assert.EqualError(t, err, "Failed to sync 1 of 3 transactions")
+	assert.Equal(t, 1, sessions)
+	assert.Equal(t, 1, api.accountLists)
+	assert.Equal(t, 2, api.batches)
+	assert.Equal(t, &UserReport{
+		UserID: userID,
+		Accounts: []*Report{
+			{AccountID: account1, Synced: 1, Failed: 1},
+			{AccountID: account2, Synced: 1},
+		},
+		Locked: []string{lockedAccount},
+		Closed: []string{},
+	}, report)
+	assert.Equal(t, Report{Synced: 2, Failed: 1}, report.Totals())
+	reportedIDs := []string{}
+	for _, trx := range api.reported {
+		reportedIDs = append(reportedIDs, trx.ID)
+	}
+	assert.ElementsMatch(t, []string{account1Trxs[0].ID, account2Trx.ID}, reportedIDs)
+
+	failed, err := storage.GetPendingTransaction(context.TODO(), account1Trxs[1].ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, reportErr.Error(), failed.LastSyncError)
+	assert.Equal(t, userID, failed.UserID)
+
+	t.Run("do not open session if nothing to sync", func(t *testing.T) {
+		sessions = 0
+		report, err := svc.SyncUserTransactions(context.TODO(), faker.Email())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Empty(t, report.Accounts)
+		assert.Equal(t, 0, sessions)
+	})
+}
+
+func Test_service_SyncUserTransactions_ClosedAccount(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+
+	// Accounts are synced in order of their IDs
+	closedAccount := "acc-1-" + faker.Word()
+	missingAccount := "acc-2-" + faker.Word()
+	openAccount := "acc-3-" + faker.Word()
+	trxs := []*dal.PendingTransactionDTO{randTrx(closedAccount), randTrx(missingAccount), randTrx(openAccount)}
+	for _, trx := range trxs {
+		trx.UserID = userID
+		if err := storage.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+	accounts := openAccounts(closedAccount, openAccount)
+	accounts[0].Closed = true
+	api := &mockAPI{accounts: accounts}
+	svc := NewService(
+		WithStorage(storage),
+		WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+		WithLedgerAPI(faker.URL(), func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			return api, nil
+		}),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	report, err := svc.SyncUserTransactions(context.TODO(), userID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &UserReport{
+		UserID:   userID,
+		Accounts: []*Report{{AccountID: openAccount, Synced: 1}},
+		Locked:   []string{},
+		Closed:   []string{closedAccount, missingAccount},
+	}, report)
+	if assert.Len(t, api.reported, 1) {
+		assert.Equal(t, trxs[2].ID, api.reported[0].ID)
+	}
+	for _, trx := range trxs[:2] {
+		got, err := storage.GetPendingTransaction(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		trx.CreatedAt = now
+		assert.Equal(t, trx, got)
+	}
+}
+
+func Test_service_DryRun(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+
+	// Accounts are checked in order of their IDs
+	accountID := "acc-1-" + faker.Word()
+	closedAccountID := "acc-2-" + faker.Word()
+	date := now.Add(-48 * time.Hour)
+	newTrx := func(accountID string, amount string, comment string) *dal.PendingTransactionDTO {
+		trx := randTrx(accountID)
+		trx.UserID = userID
+		trx.Amount = amount
+		trx.Comment = comment
+		trx.Date = date.Format(time.RFC3339)
+		return trx
+	}
+	notSynced := newTrx(accountID, "20", "Taxi")
+	reported := newTrx(accountID, "10.5", "Coffee")
+	entered := newTrx(accountID, "100", "Groceries at the corner shop")
+	refused := newTrx(closedAccountID, "5", "Bus")
+	synced := newTrx(accountID, "1", "Synced")
+	synced.SyncedAt = &now
+	for _, trx := range []*dal.PendingTransactionDTO{notSynced, reported, entered, refused, synced, randTrx("acc-" + faker.Word())} {
+		if err := storage.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+	accounts := openAccounts(accountID, closedAccountID)
+	accounts[1].Closed = true
+	manualID := "manual-" + faker.Word()
+	api := &mockAPI{
+		accounts: accounts,
+		ledgerTrxs: []ledger.TransactionDTO{
+			{ID: reported.ID, Amount: reported.Amount, Date: reported.Date, TypeID: reported.TypeID},
+			{ID: manualID, Amount: "100.00", Date: date.Format("2006-01-02"), Comment: "groceries", TypeID: entered.TypeID},
+		},
+	}
+	apiFactory := func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+		return api, nil
+	}
+	svc := NewService(
+		WithStorage(storage),
+		WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+		WithLedgerAPI(faker.URL(), apiFactory),
+		WithDryRunLedgerAPI(apiFactory),
+		WithDuplicateDetection(24*time.Hour),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	want := map[string]DryRunTransaction{
+		notSynced.ID: newDryRunTransaction(notSynced, DryRunActionReport, ""),
+		reported.ID:  newDryRunTransaction(reported, DryRunActionSkip, "Already in ledger"),
+		entered.ID:   newDryRunTransaction(entered, DryRunActionFlag, "Possible duplicate of ledger transaction "+manualID),
+		refused.ID:   newDryRunTransaction(refused, DryRunActionRefuse, "Ledger account "+closedAccountID+" is closed"),
+	}
+	assertDryRun := func(t *testing.T, got []DryRunTransaction, ids ...string) {
+		wantTrxs := make([]DryRunTransaction, 0, len(ids))
+		for _, id := range ids {
+			wantTrxs = append(wantTrxs, want[id])
+		}
+		assert.ElementsMatch(t, wantTrxs, got)
+	}
+
+	before := dumpStorage(t, db)
+	trxs, err := svc.DryRun(context.TODO(), userID, accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertDryRun(t, trxs, notSynced.ID, reported.ID, entered.ID)
+	assert.Empty(t, api.reported)
+	for _, trx := range []*dal.PendingTransactionDTO{notSynced, reported, entered} {
+		got, err := storage.GetPendingTransaction(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, dal.TransactionStatusNotSynced, got.Status())
+	}
+
+	userTrxs, err := svc.DryRun(context.TODO(), userID, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertDryRun(t, userTrxs, notSynced.ID, reported.ID, entered.ID, refused.ID)
+	assert.Empty(t, api.reported)
+	assert.Equal(t, before, dumpStorage(t, db))
+}
+
+func Test_service_DryRun_LedgerSessions(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	userID := faker.Email()
+	accountID := "acc-" + faker.Word()
+	if err := storage.SavePendingTransaction(context.TODO(), randTrx(accountID)); !assert.NoError(t, err) {
+		return
+	}
+	fakeLedger := ledgertest.NewLedger(ledgertest.WithAccounts(openAccounts(accountID)...))
+	server := httptest.NewServer(fakeLedger)
+	defer server.Close()
+	authSvc := &mockAuthService{token: types.IDToken("idt-" + faker.Word())}
+	svc := NewService(
+		WithStorage(storage),
+		WithAuthService(authSvc),
+		WithLedgerAPI(server.URL, ledger.NewAPIFactory(ledger.WithSessionStorage(storage))),
+		WithDryRunLedgerAPI(ledger.NewAPIFactory(ledger.WithReadOnlySessionStorage(storage))),
+	)
+
+	t.Run("not save started session", func(t *testing.T) {
+		before := dumpStorage(t, db)
+		trxs, err := svc.DryRun(context.TODO(), userID, accountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, trxs, 1)
+		assert.Equal(t, 1, fakeLedger.State().Logins)
+		assert.Equal(t, before, dumpStorage(t, db))
+		assert.Empty(t, before["ledger_sessions"])
+	})
+
+	t.Run("reuse saved session", func(t *testing.T) {
+		_, err := ledger.NewAPIFactory(ledger.WithSessionStorage(storage))(
+			context.TODO(), server.URL, userID, func(ctx context.Context) (types.IDToken, error) {
+				return authSvc.token, nil
+			},
+		)
+		if !assert.NoError(t, err) {
+			return
+		}
+		logins := fakeLedger.State().Logins
+		before := dumpStorage(t, db)
+		trxs, err := svc.DryRun(context.TODO(), userID, accountID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, trxs, 1)
+		assert.Equal(t, logins, fakeLedger.State().Logins)
+		assert.Equal(t, before, dumpStorage(t, db))
+		assert.Len(t, before["ledger_sessions"], 1)
+	})
+}
+
+func Test_service_backoff(t *testing.T) {
+	svc := &service{retryBackoff: 10 * time.Minute}
+	assert.Equal(t, 10*time.Minute, svc.backoff(1))
+	assert.Equal(t, 20*time.Minute, svc.backoff(2))
+	assert.Equal(t, 40*time.Minute, svc.backoff(3))
+	assert.Equal(t, maxRetryBackoff, svc.backoff(100))
+}
+
+func Test_service_SyncTransactions_Duplicates(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	db, storage := setupStorage(t, now)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	accountID := "acc-" + faker.Word()
+	date := now.Add(-48 * time.Hour)
+	newTrx := func(amount string, comment string) *dal.PendingTransactionDTO {
+		trx := randTrx(accountID)
+		trx.Amount = amount
+		trx.Comment = comment
+		trx.Date = date.Format(time.RFC3339)
+		return trx
+	}
+	reportedTrx := newTrx("10.5", "Coffee")
+	enteredTrx := newTrx("100", "Groceries at the corner shop")
+	confirmedTrx := newTrx("55", "Pharmacy")
+	pendingTrx := newTrx("20", "Taxi")
+	newTrxs := []*dal.PendingTransactionDTO{reportedTrx, enteredTrx, confirmedTrx, pendingTrx}
+	for _, trx := range newTrxs {
+		if err := storage.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+			return
+		}
+	}
+	if err := storage.SavePendingTransactionChange(context.TODO(), confirmedTrx, &dal.TransactionChangeDTO{
+		Action: pending.ActionConfirm,
+	}); !assert.NoError(t, err) {
+		return
+	}
+
+	api := &mockAPI{
+		accounts: openAccounts(accountID),
+		ledgerTrxs: []ledger.TransactionDTO{
+			{ID: reportedTrx.ID, Amount: reportedTrx.Amount, Date: reportedTrx.Date, TypeID: reportedTrx.TypeID},
+			{ID: "manual-" + faker.Word(), Amount: "100.00", Date: date.Format("2006-01-02"), Comment: "groceries", TypeID: enteredTrx.TypeID},
+			{ID: "manual-" + faker.Word(), Amount: "55", Date: confirmedTrx.Date, Comment: "pharmacy", TypeID: confirmedTrx.TypeID},
+		},
+	}
+	svc := NewService(
+		WithStorage(storage),
+		WithAuthService(&mockAuthService{token: types.IDToken("idt-" + faker.Word())}),
+		WithLedgerAPI(faker.URL(), func(ctx context.Context, baseURL string, userID string, tokens ledger.TokenSource) (ledger.API, error) {
+			return api, nil
+		}),
+		WithDuplicateDetection(24*time.Hour),
+	)
+	svc.(*service).nowFn = func() time.Time { return now }
+
+	report, err := svc.SyncTransactions(context.TODO(), faker.Email(), accountID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &Report{
+		AccountID: accountID,
+		Synced:    2,
+		Skipped:   1,
+		Flagged:   1,
+		Duplicates: []Duplicate{
+			{TransactionID: reportedTrx.ID, LedgerID: reportedTrx.ID},
+			{TransactionID: enteredTrx.ID, LedgerID: api.ledgerTrxs[1].ID, Fuzzy: true},
+		},
+	}, report)
+	reportedIDs := make([]string, 0, len(api.reported))
+	for _, trx := range api.reported {
+		reportedIDs = append(reportedIDs, trx.ID)
+	}
+	assert.ElementsMatch(t, []string{confirmedTrx.ID, pendingTrx.ID}, reportedIDs)
+
+	for _, trx := range newTrxs {
+		got, err := storage.GetPendingTransaction(context.TODO(), trx.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		want := map[string]string{
+			reportedTrx.ID:  dal.TransactionStatusSynced,
+			enteredTrx.ID:   dal.TransactionStatusNotSynced,
+			confirmedTrx.ID: dal.TransactionStatusSynced,
+			pendingTrx.ID:   dal.TransactionStatusSynced,
+		}[trx.ID]
+		assert.Equal(t, want, got.Status(), trx.Comment)
+	}
+	changes, err := storage.FindTransactionChanges(context.TODO(), enteredTrx.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, changes)
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+// SSMParameterReader reads individual parameters from aws SSM by a full path
+type SSMParameterReader interface {
+	GetParameter(ctx context.Context, path string) (string, error)
+}
+
+type awsSSMParameterReader struct {
+	mux       sync.Mutex
+	ssmClient ssmClient
+}
+
+func (r *awsSSMParameterReader) client() (ssmClient, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.ssmClient == nil {
+		client, err := newSSMClient()
+		if err != nil {
+			return nil, err
+		}
+		r.ssmClient = client
+	}
+	return r.ssmClient, nil
+}
+
+func (r *awsSSMParameterReader) GetParameter(ctx context.Context, path string) (string, error) {
+	client, err := r.client()
+	if err != nil {
+		return "", err
+	}
+	logger.WithData(diag.MsgData{"path": path}).Debug(ctx, "Attempting to get SSM parameter")
+	output, err := client.GetParameters(&ssm.GetParametersInput{
+		Names:          []*string{aws.String(path)},
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, awsParam := range output.Parameters {
+		if *awsParam.Name == path {
+			return *awsParam.Value, nil
+		}
+	}
+	return "", fmt.Errorf("SSM parameter not found: %v", path)
+}
+
+// NewSSMParameterReader creates a reader of aws SSM parameters.
+// The SSM client is created on first use and honors the same
+// endpoint settings as the SSM config source.
+func NewSSMParameterReader() SSMParameterReader {
+	return &awsSSMParameterReader{}
+}
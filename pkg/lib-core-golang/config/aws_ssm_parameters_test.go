@@ -0,0 +1,69 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/bxcodec/faker/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_awsSSMParameterReader_GetParameter(t *testing.T) {
+	type testCase struct {
+		name   string
+		path   string
+		client *mockSSMClient
+		assert func(t *testing.T, value string, err error)
+	}
+	input := func(path string) *ssm.GetParametersInput {
+		return &ssm.GetParametersInput{
+			Names:          []*string{aws.String(path)},
+			WithDecryption: aws.Bool(true),
+		}
+	}
+	tests := []func() testCase{
+		func() testCase {
+			path := "/" + faker.Word() + "/" + faker.Word()
+			value := faker.Password()
+			client := &mockSSMClient{}
+			client.On("GetParameters", input(path)).Return(&ssm.GetParametersOutput{
+				Parameters: []*ssm.Parameter{{Name: aws.String(path), Value: aws.String(value)}},
+			}, nil)
+			return testCase{
+				name:   "get existing parameter",
+				path:   path,
+				client: client,
+				assert: func(t *testing.T, got string, err error) {
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, value, got)
+				},
+			}
+		},
+		func() testCase {
+			path := "/" + faker.Word() + "/" + faker.Word()
+			client := &mockSSMClient{}
+			client.On("GetParameters", input(path)).Return(&ssm.GetParametersOutput{}, nil)
+			return testCase{
+				name:   "fail if parameter is missing",
+				path:   path,
+				client: client,
+				assert: func(t *testing.T, got string, err error) {
+					assert.EqualError(t, err, "SSM parameter not found: "+path)
+				},
+			}
+		},
+	}
+	for _, tt := range tests {
+		tt := tt()
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &awsSSMParameterReader{ssmClient: tt.client}
+			got, err := reader.GetParameter(context.TODO(), tt.path)
+			tt.assert(t, got, err)
+			tt.client.AssertExpectations(t)
+		})
+	}
+}
@@ -176,7 +176,8 @@ func init() {
 		panic("Can not get project root")
 	}
 
-	defaultLoggingSystem.logger = newLogrusLogger(os.Stdout)
+	// Logs go to stderr so stdout is left for command results
+	defaultLoggingSystem.logger = newLogrusLogger(os.Stderr)
 
 	if v := flag.Lookup("test.v"); v == nil {
 		defaultLoggingSystem.SetLogMode("json")
@@ -3,9 +3,90 @@ package request
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorCategory tells whether a failed request may succeed if sent again
+type ErrorCategory string
+
+// Error categories
+const (
+	// ErrorCategoryTransient is a failure that may go away if retried later,
+	// e.g network failure, rate limit or server error
+	ErrorCategoryTransient ErrorCategory = "transient"
+
+	// ErrorCategoryPermanent is a failure that will repeat on each retry,
+	// e.g rejected data or credentials
+	ErrorCategoryPermanent ErrorCategory = "permanent"
 )
 
+// categorized is implemented by errors that know their category
+type categorized interface {
+	Category() ErrorCategory
+}
+
+type categorizedError struct {
+	err      error
+	category ErrorCategory
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Category() ErrorCategory {
+	return e.category
+}
+
+func (e *categorizedError) Cause() error {
+	return e.err
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+// Transient marks the error as transient, nil is returned as is
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{err: err, category: ErrorCategoryTransient}
+}
+
+// Permanent marks the error as permanent, nil is returned as is
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{err: err, category: ErrorCategoryPermanent}
+}
+
+// CategoryOf returns a category of the error or of the closest wrapped error that has it.
+// Errors without a category are considered transient, so they are retried
+func CategoryOf(err error) ErrorCategory {
+	var categorizedErr categorized
+	if errors.As(err, &categorizedErr) {
+		return categorizedErr.Category()
+	}
+	return ErrorCategoryTransient
+}
+
+// IsPermanent returns true if retrying the failed request will not help
+func IsPermanent(err error) bool {
+	return err != nil && CategoryOf(err) == ErrorCategoryPermanent
+}
+
+// IsTransient returns true if the failed request may succeed if retried later
+func IsTransient(err error) bool {
+	return err != nil && CategoryOf(err) == ErrorCategoryTransient
+}
+
 // HTTPError represents a generic http error structure
 type HTTPError struct {
 	StatusCode int    `json:"statusCode"`
@@ -17,6 +98,21 @@ func (e HTTPError) Error() string {
 	return fmt.Sprintf("[%v](%v): %v", e.StatusCode, e.Status, e.Message)
 }
 
+// Category returns permanent for client errors other than
+// timeouts and rate limits, the rest are transient
+func (e HTTPError) Category() ErrorCategory {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout,
+		e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode >= 500:
+		return ErrorCategoryTransient
+	case e.StatusCode >= 400:
+		return ErrorCategoryPermanent
+	default:
+		return ErrorCategoryTransient
+	}
+}
+
 // Send will marshal and send the error response to the client
 // panic if failed to send
 func (e HTTPError) Send(w http.ResponseWriter) {
@@ -40,13 +136,23 @@ func NewHTTPError(statusCode int, message string) error {
 	}
 }
 
-// NewHTTPErrorFromResponse - creates a generic http error
+// maxErrorMessageLength limits how much of an error response body is kept as a message
+const maxErrorMessageLength = 1024
+
+// NewHTTPErrorFromResponse - creates a generic http error, beginning
+// of the response body is used as a message
 func NewHTTPErrorFromResponse(res *http.Response) error {
 	// TODO: Try to deserialize, maybe it's an http error
-	return HTTPError{
+	httpErr := HTTPError{
 		StatusCode: res.StatusCode,
 		Status:     res.Status,
 	}
+	if res.Body != nil {
+		if body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxErrorMessageLength)); err == nil {
+			httpErr.Message = strings.TrimSpace(string(body))
+		}
+	}
+	return httpErr
 }
 
 // ResourceNotFoundError a standard 404 error
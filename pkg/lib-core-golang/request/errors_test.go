@@ -10,6 +10,8 @@ import (
 
 	tst "github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/internal/testing"
 
+	pkgerrors "github.com/pkg/errors"
+
 	"github.com/bxcodec/faker/v3"
 	"github.com/stretchr/testify/assert"
 )
@@ -171,3 +173,98 @@ func TestHTTPError_Send(t *testing.T) {
 		})
 	}
 }
+
+func TestCategoryOf(t *testing.T) {
+	type testCase struct {
+		name string
+		err  error
+		want ErrorCategory
+	}
+	tests := []func() testCase{
+		func() testCase {
+			return testCase{
+				name: "uncategorized error",
+				err:  errors.New(faker.Sentence()),
+				want: ErrorCategoryTransient,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "permanent error",
+				err:  Permanent(errors.New(faker.Sentence())),
+				want: ErrorCategoryPermanent,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "wrapped permanent error",
+				err:  pkgerrors.Wrap(Permanent(errors.New(faker.Sentence())), faker.Sentence()),
+				want: ErrorCategoryPermanent,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "transient error",
+				err:  Transient(BadRequestError(faker.Sentence())),
+				want: ErrorCategoryTransient,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "bad request",
+				err:  BadRequestError(faker.Sentence()),
+				want: ErrorCategoryPermanent,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "unprocessable entity",
+				err:  pkgerrors.Wrap(NewHTTPError(http.StatusUnprocessableEntity, faker.Sentence()), faker.Sentence()),
+				want: ErrorCategoryPermanent,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "too many requests",
+				err:  NewHTTPError(http.StatusTooManyRequests, faker.Sentence()),
+				want: ErrorCategoryTransient,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "request timeout",
+				err:  NewHTTPError(http.StatusRequestTimeout, faker.Sentence()),
+				want: ErrorCategoryTransient,
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "server error",
+				err:  NewHTTPError(500+rand.Intn(10), faker.Sentence()),
+				want: ErrorCategoryTransient,
+			}
+		},
+	}
+	for _, ttFn := range tests {
+		tt := ttFn()
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CategoryOf(tt.err))
+			assert.Equal(t, tt.want == ErrorCategoryPermanent, IsPermanent(tt.err))
+			assert.Equal(t, tt.want == ErrorCategoryTransient, IsTransient(tt.err))
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		assert.Nil(t, Transient(nil))
+		assert.Nil(t, Permanent(nil))
+		assert.False(t, IsPermanent(nil))
+		assert.False(t, IsTransient(nil))
+	})
+
+	t.Run("keep message and cause", func(t *testing.T) {
+		cause := errors.New(faker.Sentence())
+		err := Permanent(cause)
+		assert.Equal(t, cause.Error(), err.Error())
+		assert.Equal(t, cause, pkgerrors.Cause(err))
+	})
+}
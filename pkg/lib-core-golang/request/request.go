@@ -1,6 +1,7 @@
 package request
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -115,10 +116,14 @@ func (f ResFactory) DecodeJSON(receiver interface{}) error {
 }
 
 func newResFactory(res *http.Response, err error) ResFactory {
-	return func() (*http.Response, error) {
-		if res != nil && res.StatusCode >= 300 {
-			return nil, NewHTTPErrorFromResponse(res)
+	if res != nil && res.StatusCode >= 300 {
+		// The body can be read once, so the error is created right away
+		httpErr := NewHTTPErrorFromResponse(res)
+		return func() (*http.Response, error) {
+			return nil, httpErr
 		}
+	}
+	return func() (*http.Response, error) {
 		return res, err
 	}
 }
@@ -129,7 +134,8 @@ func (rl requestLogger) RoundTrip(req *http.Request) (*http.Response, error) {
 	return rl(req)
 }
 
-// Do will send the request. Will fail if response status is other than 2xx
+// Do will send the request. Will fail if response status is other than 2xx.
+// Failures to build the request are permanent and failures to send it are transient
 func Do(ctx context.Context, factory ReqFactory, opts ...SendOpt) ResFactory {
 	// TODO: Include requestID header from context
 
@@ -169,6 +175,9 @@ func Do(ctx context.Context, factory ReqFactory, opts ...SendOpt) ResFactory {
 						cfg.logger.WithError(err).Error(ctx, "Failed to read response body")
 					} else {
 						msgData["body"] = string(body)
+
+						// Keeping the body for the error message
+						res.Body = ioutil.NopCloser(bytes.NewReader(body))
 					}
 
 				}
@@ -181,7 +190,8 @@ func Do(ctx context.Context, factory ReqFactory, opts ...SendOpt) ResFactory {
 	}
 	req, err := factory()
 	if err != nil {
-		return newResFactory(nil, err)
+		return newResFactory(nil, Permanent(err))
 	}
-	return newResFactory(httpClient.Do(req))
+	res, err := httpClient.Do(req)
+	return newResFactory(res, Transient(err))
 }
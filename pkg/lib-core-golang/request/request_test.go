@@ -2,6 +2,7 @@ package request
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -116,6 +117,23 @@ func TestDo(t *testing.T) {
 					return
 				}
 				assert.Equal(t, status, httpErr.StatusCode)
+				assert.Equal(t, expectedBody, httpErr.Message)
+			}
+		},
+
+		func() (string, tcFn) {
+			return "should fail with transient err if not sent", func(t *testing.T) {
+				url := faker.URL()
+
+				gock.New(url).
+					Get("/").
+					ReplyError(errors.New(faker.Sentence()))
+
+				_, err := Do(context.TODO(), Get(url))()
+				if !assert.Error(t, err) {
+					return
+				}
+				assert.True(t, IsTransient(err), "Expected transient err but got:", err)
 			}
 		},
 
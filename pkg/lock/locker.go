@@ -0,0 +1,170 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// Operations that are locked per account
+const (
+	OperationFetch = "fetch"
+	OperationSync  = "sync"
+)
+
+// Key returns a key of a lock of the operation on a user account
+func Key(userID, accountID, operation string) string {
+	return fmt.Sprintf("%v:%v:%v", operation, userID, accountID)
+}
+
+// LockedError is returned if the lock is held by another process
+type LockedError struct {
+	Key       string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("Lock %v is held by another process (%v), lease expires at %v", e.Key, e.Owner, e.ExpiresAt)
+}
+
+// IsLocked returns true if the error is caused by the lock held by another process
+func IsLocked(err error) bool {
+	var lockedErr *LockedError
+	return errors.As(err, &lockedErr)
+}
+
+// Lock is a lock held by the process
+type Lock interface {
+	// Release will stop renewing the lease and free the lock
+	Release(ctx context.Context) error
+}
+
+// Locker prevents concurrent runs of the same operation by different processes
+type Locker interface {
+	// Acquire will take the lock or return LockedError if it is held by another process.
+	// Locks of crashed processes are taken over once their lease expires.
+	// The lease is renewed in background until the lock is released
+	Acquire(ctx context.Context, key string) (Lock, error)
+}
+
+type storageLock struct {
+	storage dal.Storage
+	dto     dal.LockDTO
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func (l *storageLock) Release(ctx context.Context) error {
+	close(l.stop)
+	l.stopped.Wait()
+	if ctx.Err() != nil {
+		// Releasing locks of timed out runs, otherwise they would be held until the lease expires
+		ctx = diag.ContextWithRequestID(context.Background(), diag.RequestIDValue(ctx))
+	}
+	return l.storage.ReleaseLock(ctx, l.dto.Key, l.dto.Owner)
+}
+
+type storageLocker struct {
+	storage     dal.Storage
+	owner       string
+	lease       time.Duration
+	renewPeriod time.Duration
+	nowFn       func() time.Time
+}
+
+func (locker *storageLocker) Acquire(ctx context.Context, key string) (Lock, error) {
+	existing, err := locker.storage.GetLock(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	now := locker.nowFn()
+	if existing != nil && existing.ExpiresAt.Before(now) {
+		logger.Warn(ctx, "Taking over stale lock %v of %v, lease expired at %v", key, existing.Owner, existing.ExpiresAt)
+	}
+	dto := dal.LockDTO{
+		Key:        key,
+		Owner:      fmt.Sprintf("%v/%v", locker.owner, uuid.NewV4()),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(locker.lease),
+	}
+	acquired, err := locker.storage.AcquireLock(ctx, &dto)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		holder, err := locker.storage.GetLock(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		lockedErr := &LockedError{Key: key}
+		if holder != nil {
+			lockedErr.Owner = holder.Owner
+			lockedErr.ExpiresAt = holder.ExpiresAt
+		}
+		return nil, lockedErr
+	}
+	logger.Debug(ctx, "Acquired lock %v", key)
+	lock := &storageLock{storage: locker.storage, dto: dto, stop: make(chan struct{})}
+	lock.stopped.Add(1)
+	go locker.renew(diag.ContextWithRequestID(context.Background(), diag.RequestIDValue(ctx)), lock)
+	return lock, nil
+}
+
+func (locker *storageLocker) renew(ctx context.Context, lock *storageLock) {
+	defer lock.stopped.Done()
+	ticker := time.NewTicker(locker.renewPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			lock.dto.ExpiresAt = locker.nowFn().Add(locker.lease)
+			if err := locker.storage.ExtendLock(ctx, &lock.dto); err != nil {
+				logger.WithError(err).Error(ctx, "Failed to extend lease of lock %v", lock.dto.Key)
+			}
+		}
+	}
+}
+
+// LockerOpt is an option of a storage locker
+type LockerOpt func(*storageLocker)
+
+// WithLease will set how long the lock is held without renewal.
+// The lease is renewed every third of its duration
+func WithLease(lease time.Duration) LockerOpt {
+	return func(locker *storageLocker) {
+		locker.lease = lease
+		locker.renewPeriod = lease / 3
+	}
+}
+
+// NewStorageLocker returns a locker that keeps leases in the storage
+func NewStorageLocker(storage dal.Storage, opts ...LockerOpt) Locker {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	locker := &storageLocker{
+		storage:     storage,
+		owner:       fmt.Sprintf("%v:%v", hostname, os.Getpid()),
+		lease:       2 * time.Minute,
+		renewPeriod: 40 * time.Second,
+		nowFn:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(locker)
+	}
+	return locker
+}
@@ -0,0 +1,108 @@
+package lock
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupStorage(t *testing.T) (dal.Storage, *sql.DB, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+	storage, err := dal.NewSQLStorage(dal.WithSQLDb(db))
+	if !assert.NoError(t, err) {
+		return nil, nil, err
+	}
+	if err := storage.Setup(context.TODO()); !assert.NoError(t, err) {
+		return nil, nil, err
+	}
+	return storage, db, nil
+}
+
+func Test_storageLocker(t *testing.T) {
+	storage, db, err := setupStorage(t)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	randKey := func() string {
+		return Key(faker.Email(), "acc-"+faker.UUIDHyphenated(), OperationFetch)
+	}
+
+	t.Run("acquire and release", func(t *testing.T) {
+		locker := NewStorageLocker(storage)
+		key := randKey()
+		lock, err := locker.Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if err := lock.Release(context.TODO()); !assert.NoError(t, err) {
+			return
+		}
+		lock, err = locker.Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, lock.Release(context.TODO()))
+	})
+
+	t.Run("fail to acquire held lock", func(t *testing.T) {
+		key := randKey()
+		lock, err := NewStorageLocker(storage).Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer lock.Release(context.TODO())
+		_, err = NewStorageLocker(storage).Acquire(context.TODO(), key)
+		assert.True(t, IsLocked(err))
+		assert.True(t, IsLocked(errors.Wrap(err, "Failed to fetch")))
+		var lockedErr *LockedError
+		if assert.True(t, errors.As(err, &lockedErr)) {
+			assert.Equal(t, key, lockedErr.Key)
+			assert.Equal(t, lock.(*storageLock).dto.Owner, lockedErr.Owner)
+		}
+	})
+
+	t.Run("take over stale lock", func(t *testing.T) {
+		key := randKey()
+		now := time.Now()
+		stale := &storageLocker{storage: storage, owner: "stale", lease: time.Minute, renewPeriod: time.Hour, nowFn: func() time.Time {
+			return now.Add(-2 * time.Minute)
+		}}
+		staleLock, err := stale.Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		close(staleLock.(*storageLock).stop)
+
+		lock, err := NewStorageLocker(storage).Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, lock.Release(context.TODO()))
+	})
+
+	t.Run("renew lease while held", func(t *testing.T) {
+		key := randKey()
+		locker := NewStorageLocker(storage, WithLease(30*time.Millisecond))
+		lock, err := locker.Acquire(context.TODO(), key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		time.Sleep(60 * time.Millisecond)
+		_, err = locker.Acquire(context.TODO(), key)
+		assert.True(t, IsLocked(err))
+		assert.NoError(t, lock.Release(context.TODO()))
+	})
+}
@@ -0,0 +1,87 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+)
+
+// FetchRun is an output schema of a fetch run
+type FetchRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	Bank       string    `json:"bank"`
+	UserID     string    `json:"user_id"`
+	AccountID  string    `json:"account_id"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Fetched    int       `json:"fetched"`
+	New        int       `json:"new"`
+	Duplicate  int       `json:"duplicate"`
+	Failed     int       `json:"failed"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+
+	// ErrorCategory is transient or permanent, permanent errors will repeat until the cause is fixed
+	ErrorCategory string `json:"error_category,omitempty"`
+}
+
+// NewFetchRun maps the run to the output schema
+func NewFetchRun(run *dal.FetchRunDTO) FetchRun {
+	return FetchRun{
+		StartedAt:  run.StartedAt,
+		Bank:       run.Bank,
+		UserID:     run.UserID,
+		AccountID:  run.AccountID,
+		From:       run.From,
+		To:         run.To,
+		Fetched:    run.Fetched,
+		New:        run.New,
+		Duplicate:  run.Duplicate,
+		Failed:     run.Failed,
+		DurationMs: run.Duration.Milliseconds(),
+		Error:      run.Error,
+
+		ErrorCategory: run.ErrorCategory,
+	}
+}
+
+// PrintFetchRuns will print fetch runs as a JSON array or a table
+func PrintFetchRuns(format string, runs []dal.FetchRunDTO) error {
+	result := make([]FetchRun, 0, len(runs))
+	for i := range runs {
+		result = append(result, NewFetchRun(&runs[i]))
+	}
+	return Print(format, result, func(w io.Writer) {
+		writeFetchRunsTable(w, runs)
+	})
+}
+
+// PrintFetchRun will print a single fetch run as a JSON object or a table
+func PrintFetchRun(format string, run *dal.FetchRunDTO) error {
+	return Print(format, NewFetchRun(run), func(w io.Writer) {
+		writeFetchRunsTable(w, []dal.FetchRunDTO{*run})
+	})
+}
+
+func writeFetchRunsTable(w io.Writer, runs []dal.FetchRunDTO) {
+	fmt.Fprintln(w, "STARTED\tBANK\tUSER\tACCOUNT\tFROM\tTO\tFETCHED\tNEW\tDUPLICATE\tFAILED\tDURATION\tCATEGORY\tERROR")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			run.StartedAt.Local().Format(time.RFC3339),
+			run.Bank,
+			run.UserID,
+			run.AccountID,
+			run.From.Local().Format(time.RFC3339),
+			run.To.Local().Format(time.RFC3339),
+			run.Fetched,
+			run.New,
+			run.Duplicate,
+			run.Failed,
+			run.Duration,
+			run.ErrorCategory,
+			run.Error,
+		)
+	}
+}
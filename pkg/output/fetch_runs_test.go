@@ -0,0 +1,57 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintFetchRun(t *testing.T) {
+	startedAt := time.Unix(faker.UnixTime(), 0).UTC()
+	run := &dal.FetchRunDTO{
+		Bank:      "bank-" + faker.Word(),
+		UserID:    faker.Email(),
+		AccountID: "acc-" + faker.Word(),
+		From:      startedAt.Add(-48 * time.Hour),
+		To:        startedAt,
+		Fetched:   rand.Intn(100),
+		New:       rand.Intn(100),
+		Duplicate: rand.Intn(100),
+		Failed:    rand.Intn(100),
+		StartedAt: startedAt,
+		Duration:  time.Duration(rand.Intn(10000)) * time.Millisecond,
+		Error:     faker.Sentence(),
+	}
+	var buf bytes.Buffer
+	defer func(stdout io.Writer) { Stdout = stdout }(Stdout)
+	Stdout = &buf
+
+	if !assert.NoError(t, PrintFetchRun(FormatJSON, run)) {
+		return
+	}
+	var got map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal(buf.Bytes(), &got)) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"started_at":  startedAt.Format(time.RFC3339),
+		"bank":        run.Bank,
+		"user_id":     run.UserID,
+		"account_id":  run.AccountID,
+		"from":        run.From.Format(time.RFC3339),
+		"to":          run.To.Format(time.RFC3339),
+		"fetched":     float64(run.Fetched),
+		"new":         float64(run.New),
+		"duplicate":   float64(run.Duplicate),
+		"failed":      float64(run.Failed),
+		"duration_ms": float64(run.Duration.Milliseconds()),
+		"error":       run.Error,
+	}, got)
+}
@@ -0,0 +1,49 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// Formats of command results
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// Stdout is where results are written
+var Stdout io.Writer = os.Stdout
+
+// ValidateFormat returns an error if the format is not supported
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatTable, FormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("Unknown output format: %v", format)
+	}
+}
+
+// Write will write the result as indented JSON or as a table rendered by printTable
+func Write(w io.Writer, format string, result interface{}, printTable func(w io.Writer)) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		printTable(tw)
+		return tw.Flush()
+	default:
+		return ValidateFormat(format)
+	}
+}
+
+// Print will write the result to stdout
+func Print(format string, result interface{}, printTable func(w io.Writer)) error {
+	return Write(Stdout, format, result, printTable)
+}
@@ -0,0 +1,51 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	type row struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	rows := []row{{Name: faker.Word(), Value: faker.Word()}, {Name: faker.Word(), Value: faker.Word()}}
+	printTable := func(w io.Writer) {
+		fmt.Fprintln(w, "NAME\tVALUE")
+		for _, r := range rows {
+			fmt.Fprintf(w, "%v\t%v\n", r.Name, r.Value)
+		}
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if !assert.NoError(t, Write(&buf, FormatJSON, rows, printTable)) {
+			return
+		}
+		assert.JSONEq(t, fmt.Sprintf(`[{"name":%q,"value":%q},{"name":%q,"value":%q}]`,
+			rows[0].Name, rows[0].Value, rows[1].Name, rows[1].Value), buf.String())
+	})
+
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		if !assert.NoError(t, Write(&buf, FormatTable, rows, printTable)) {
+			return
+		}
+		assert.Contains(t, buf.String(), "NAME")
+		assert.Contains(t, buf.String(), rows[0].Name)
+		assert.Contains(t, buf.String(), rows[1].Value)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := Write(&buf, faker.Word(), rows, printTable)
+		assert.Error(t, err)
+		assert.Empty(t, buf.String())
+	})
+}
@@ -0,0 +1,266 @@
+package pending
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// Actions of recorded transaction changes
+const (
+	ActionAdd      = "add"
+	ActionEdit     = "edit"
+	ActionIgnore   = "ignore"
+	ActionUnignore = "unignore"
+	ActionConfirm  = "confirm"
+)
+
+// Edit represents changes of a pending transaction, nil values are left unchanged
+type Edit struct {
+	Amount  *string
+	Comment *string
+	Date    *string
+	TypeID  *uint8
+}
+
+// ManualTransaction represents a transaction that is added manually
+type ManualTransaction struct {
+	// UserID is optional, transactions without a user are synced only per account
+	UserID    string
+	AccountID string
+	Amount    string
+	Comment   string
+	TypeID    uint8
+
+	// Date is optional, now is used if empty
+	Date string
+}
+
+// Service allows manual changes of pending transactions before they are synced.
+// All changes are recorded. Changes of transactions synced meanwhile fail with dal.TransactionSyncedError
+type Service interface {
+	Ignore(ctx context.Context, id string, reason string) error
+	Unignore(ctx context.Context, id string) error
+
+	// Confirm will sync the transaction even if it looks like a duplicate of a ledger transaction
+	Confirm(ctx context.Context, id string) error
+	Edit(ctx context.Context, id string, edit Edit) (*dal.PendingTransactionDTO, error)
+	AddManual(ctx context.Context, trx ManualTransaction) (*dal.PendingTransactionDTO, error)
+}
+
+type service struct {
+	storage  dal.Storage
+	nowFn    func() time.Time
+	location *time.Location
+}
+
+func (svc *service) getNotSynced(ctx context.Context, id string) (*dal.PendingTransactionDTO, error) {
+	trx, err := svc.storage.GetPendingTransaction(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if trx == nil {
+		return nil, fmt.Errorf("Unknown transaction: %v", id)
+	}
+	if trx.SyncedAt != nil {
+		return nil, &dal.TransactionSyncedError{ID: id}
+	}
+	return trx, nil
+}
+
+func (svc *service) Ignore(ctx context.Context, id string, reason string) error {
+	trx, err := svc.getNotSynced(ctx, id)
+	if err != nil {
+		return err
+	}
+	if trx.IgnoredAt != nil {
+		return fmt.Errorf("Transaction %v is already ignored", id)
+	}
+	ignoredAt := svc.nowFn().UTC()
+	trx.IgnoredAt = &ignoredAt
+	logger.Info(ctx, "Ignoring transaction %v", id)
+	return svc.storage.SavePendingTransactionChange(ctx, trx, &dal.TransactionChangeDTO{
+		Action:  ActionIgnore,
+		Details: reason,
+	})
+}
+
+func (svc *service) Unignore(ctx context.Context, id string) error {
+	trx, err := svc.getNotSynced(ctx, id)
+	if err != nil {
+		return err
+	}
+	if trx.IgnoredAt == nil {
+		return fmt.Errorf("Transaction %v is not ignored", id)
+	}
+	trx.IgnoredAt = nil
+	logger.Info(ctx, "Unignoring transaction %v", id)
+	return svc.storage.SavePendingTransactionChange(ctx, trx, &dal.TransactionChangeDTO{
+		Action: ActionUnignore,
+	})
+}
+
+func (svc *service) Confirm(ctx context.Context, id string) error {
+	trx, err := svc.getNotSynced(ctx, id)
+	if err != nil {
+		return err
+	}
+	if trx.IgnoredAt != nil {
+		return fmt.Errorf("Transaction %v is ignored", id)
+	}
+	logger.Info(ctx, "Confirming transaction %v", id)
+	return svc.storage.SavePendingTransactionChange(ctx, trx, &dal.TransactionChangeDTO{
+		Action:  ActionConfirm,
+		Details: "Not a duplicate",
+	})
+}
+
+func (svc *service) Edit(ctx context.Context, id string, edit Edit) (*dal.PendingTransactionDTO, error) {
+	trx, err := svc.getNotSynced(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	details := []string{}
+	if edit.Amount != nil {
+		if err := validateAmount(*edit.Amount); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("amount: %v -> %v", trx.Amount, *edit.Amount))
+		trx.Amount = *edit.Amount
+	}
+	if edit.Date != nil {
+		date, err := svc.normalizeDate(*edit.Date)
+		if err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("date: %v -> %v", trx.Date, date))
+		trx.Date = date
+	}
+	if edit.TypeID != nil {
+		if err := validateTypeID(*edit.TypeID); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("type: %v -> %v", trx.TypeID, *edit.TypeID))
+		trx.TypeID = *edit.TypeID
+	}
+	if edit.Comment != nil {
+		details = append(details, fmt.Sprintf("comment: %q -> %q", trx.Comment, *edit.Comment))
+		trx.Comment = *edit.Comment
+	}
+	if len(details) == 0 {
+		return nil, fmt.Errorf("Nothing to change for transaction %v", id)
+	}
+	logger.Info(ctx, "Editing transaction %v", id)
+	if err := svc.storage.SavePendingTransactionChange(ctx, trx, &dal.TransactionChangeDTO{
+		Action:  ActionEdit,
+		Details: strings.Join(details, "; "),
+	}); err != nil {
+		return nil, err
+	}
+	return trx, nil
+}
+
+func (svc *service) AddManual(ctx context.Context, manualTrx ManualTransaction) (*dal.PendingTransactionDTO, error) {
+	if manualTrx.AccountID == "" {
+		return nil, fmt.Errorf("Account is required")
+	}
+	if err := validateAmount(manualTrx.Amount); err != nil {
+		return nil, err
+	}
+	if err := validateTypeID(manualTrx.TypeID); err != nil {
+		return nil, err
+	}
+	date := svc.nowFn().In(svc.location).Format(time.RFC3339)
+	if manualTrx.Date != "" {
+		var err error
+		if date, err = svc.normalizeDate(manualTrx.Date); err != nil {
+			return nil, err
+		}
+	}
+	trx := &dal.PendingTransactionDTO{
+		ID:        "manual-" + uuid.NewV4().String(),
+		Amount:    manualTrx.Amount,
+		Date:      date,
+		Comment:   manualTrx.Comment,
+		AccountID: manualTrx.AccountID,
+		TypeID:    manualTrx.TypeID,
+		UserID:    manualTrx.UserID,
+	}
+	logger.Info(ctx, "Adding manual transaction %v", trx.ID)
+	if err := svc.storage.SavePendingTransactionChange(ctx, trx, &dal.TransactionChangeDTO{
+		Action: ActionAdd,
+		Details: fmt.Sprintf("amount: %v; date: %v; type: %v; comment: %q",
+			trx.Amount, trx.Date, trx.TypeID, trx.Comment),
+	}); err != nil {
+		return nil, err
+	}
+	return trx, nil
+}
+
+func validateAmount(amount string) error {
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil || value <= 0 {
+		return fmt.Errorf("Amount should be a positive number, got: %v", amount)
+	}
+	return nil
+}
+
+func validateTypeID(typeID uint8) error {
+	if typeID != ledger.TransactionTypeIncome && typeID != ledger.TransactionTypeExpense {
+		return fmt.Errorf("Unexpected transaction type: %v", typeID)
+	}
+	return nil
+}
+
+// normalizeDate accepts RFC3339 or YYYY-MM-DD date and returns it as RFC3339.
+// YYYY-MM-DD is a calendar day in the user time zone, the same as fetchers use
+func (svc *service) normalizeDate(date string) (string, error) {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t.Format(time.RFC3339), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", date, svc.location)
+	if err != nil {
+		return "", fmt.Errorf("Unexpected date format: %v", date)
+	}
+	return t.Format(time.RFC3339), nil
+}
+
+// ServiceOpt is an option for pending transactions service
+type ServiceOpt func(*service)
+
+// WithStorage will init the service with storage
+func WithStorage(storage dal.Storage) ServiceOpt {
+	return func(svc *service) {
+		svc.storage = storage
+	}
+}
+
+// WithTimeZone will set a user time zone, dates without time are calendar days of the zone
+func WithTimeZone(loc *time.Location) ServiceOpt {
+	return func(svc *service) {
+		svc.location = loc
+	}
+}
+
+// NewService returns an instance of a pending transactions service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		nowFn:    time.Now,
+		location: time.Local,
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
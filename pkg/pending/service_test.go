@@ -0,0 +1,298 @@
+package pending
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledger"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupStorage(t *testing.T) (*sql.DB, dal.Storage) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	db.SetMaxOpenConns(1)
+	storage, err := dal.NewSQLStorage(dal.WithSQLDb(db))
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	if err := storage.Setup(context.TODO()); !assert.NoError(t, err) {
+		return nil, nil
+	}
+	return db, storage
+}
+
+// syncingStorage will sync a transaction right after it is read, as if a sync was running concurrently
+type syncingStorage struct {
+	dal.Storage
+	syncedAt time.Time
+}
+
+func (s *syncingStorage) GetPendingTransaction(ctx context.Context, id string) (*dal.PendingTransactionDTO, error) {
+	trx, err := s.Storage.GetPendingTransaction(ctx, id)
+	if err != nil || trx == nil {
+		return trx, err
+	}
+	synced := *trx
+	synced.SyncedAt = &s.syncedAt
+	if err := s.Storage.SaveSyncResults(ctx, []dal.PendingTransactionDTO{synced}); err != nil {
+		return nil, err
+	}
+	return trx, nil
+}
+
+func randTrx() *dal.PendingTransactionDTO {
+	return &dal.PendingTransactionDTO{
+		ID:        gofakeit.UUID(),
+		Amount:    "100.5",
+		Date:      time.Unix(faker.UnixTime(), 0).Format(time.RFC3339),
+		Comment:   faker.Sentence(),
+		AccountID: "acc-" + faker.Word(),
+		TypeID:    ledger.TransactionTypeExpense,
+	}
+}
+
+func Test_service(t *testing.T) {
+	type tcFn func(t *testing.T, s dal.Storage, svc Service, now time.Time)
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "ignore transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				trx := randTrx()
+				if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+					return
+				}
+				reason := faker.Sentence()
+				if err := svc.Ignore(context.TODO(), trx.ID, reason); !assert.NoError(t, err) {
+					return
+				}
+				notSynced, err := s.FindNotSyncedTransactions(context.TODO(), trx.AccountID)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Empty(t, notSynced)
+				changes, err := s.FindTransactionChanges(context.TODO(), trx.ID)
+				if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+					return
+				}
+				assert.Equal(t, ActionIgnore, changes[0].Action)
+				assert.Equal(t, reason, changes[0].Details)
+
+				assert.EqualError(t, svc.Ignore(context.TODO(), trx.ID, reason), "Transaction "+trx.ID+" is already ignored")
+
+				if err := svc.Unignore(context.TODO(), trx.ID); !assert.NoError(t, err) {
+					return
+				}
+				notSynced, err = s.FindNotSyncedTransactions(context.TODO(), trx.AccountID)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Len(t, notSynced, 1)
+			}
+		},
+		func() (string, tcFn) {
+			return "confirm transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				trx := randTrx()
+				if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+					return
+				}
+				if err := svc.Confirm(context.TODO(), trx.ID); !assert.NoError(t, err) {
+					return
+				}
+				changes, err := s.FindTransactionChanges(context.TODO(), trx.ID)
+				if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+					return
+				}
+				assert.Equal(t, ActionConfirm, changes[0].Action)
+				notSynced, err := s.FindNotSyncedTransactions(context.TODO(), trx.AccountID)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Len(t, notSynced, 1)
+
+				if err := svc.Ignore(context.TODO(), trx.ID, ""); !assert.NoError(t, err) {
+					return
+				}
+				assert.EqualError(t, svc.Confirm(context.TODO(), trx.ID), "Transaction "+trx.ID+" is ignored")
+			}
+		},
+		func() (string, tcFn) {
+			return "fail to change synced transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				trx := randTrx()
+				trx.SyncedAt = &now
+				if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+					return
+				}
+				assert.EqualError(t, svc.Ignore(context.TODO(), trx.ID, ""), "Transaction "+trx.ID+" is already synced")
+				comment := faker.Sentence()
+				_, err := svc.Edit(context.TODO(), trx.ID, Edit{Comment: &comment})
+				assert.EqualError(t, err, "Transaction "+trx.ID+" is already synced")
+			}
+		},
+		func() (string, tcFn) {
+			return "fail to change unknown transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				id := "trx-" + faker.Word()
+				assert.EqualError(t, svc.Ignore(context.TODO(), id, ""), "Unknown transaction: "+id)
+			}
+		},
+		func() (string, tcFn) {
+			return "edit transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				trx := randTrx()
+				if err := s.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+					return
+				}
+				amount := "20.3"
+				comment := "new comment"
+				date := "2021-03-04T10:00:00Z"
+				typeID := ledger.TransactionTypeIncome
+				got, err := svc.Edit(context.TODO(), trx.ID, Edit{
+					Amount:  &amount,
+					Comment: &comment,
+					Date:    &date,
+					TypeID:  &typeID,
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, amount, got.Amount)
+				assert.Equal(t, comment, got.Comment)
+				assert.Equal(t, date, got.Date)
+				assert.Equal(t, typeID, got.TypeID)
+
+				stored, err := s.GetPendingTransaction(context.TODO(), trx.ID)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, got, stored)
+
+				changes, err := s.FindTransactionChanges(context.TODO(), trx.ID)
+				if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+					return
+				}
+				assert.Equal(t, ActionEdit, changes[0].Action)
+				assert.Equal(t,
+					"amount: 100.5 -> 20.3; date: "+trx.Date+" -> "+date+"; type: 2 -> 1; comment: \""+trx.Comment+"\" -> \"new comment\"",
+					changes[0].Details)
+
+				invalidAmount := "-" + amount
+				_, err = svc.Edit(context.TODO(), trx.ID, Edit{Amount: &invalidAmount})
+				assert.EqualError(t, err, "Amount should be a positive number, got: "+invalidAmount)
+
+				_, err = svc.Edit(context.TODO(), trx.ID, Edit{})
+				assert.EqualError(t, err, "Nothing to change for transaction "+trx.ID)
+			}
+		},
+		func() (string, tcFn) {
+			return "add manual transaction", func(t *testing.T, s dal.Storage, svc Service, now time.Time) {
+				manualTrx := ManualTransaction{
+					UserID:    faker.Email(),
+					AccountID: "acc-" + faker.Word(),
+					Amount:    "33.5",
+					Comment:   faker.Sentence(),
+					TypeID:    ledger.TransactionTypeExpense,
+				}
+				got, err := svc.AddManual(context.TODO(), manualTrx)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, now.Format(time.RFC3339), got.Date)
+				notSynced, err := s.FindNotSyncedTransactions(context.TODO(), manualTrx.AccountID)
+				if !assert.NoError(t, err) || !assert.Len(t, notSynced, 1) {
+					return
+				}
+				assert.Equal(t, got.ID, notSynced[0].ID)
+				assert.Equal(t, manualTrx.Amount, notSynced[0].Amount)
+				assert.Equal(t, manualTrx.Comment, notSynced[0].Comment)
+				assert.Equal(t, manualTrx.UserID, notSynced[0].UserID)
+				changes, err := s.FindTransactionChanges(context.TODO(), got.ID)
+				if !assert.NoError(t, err) || !assert.Len(t, changes, 1) {
+					return
+				}
+				assert.Equal(t, ActionAdd, changes[0].Action)
+
+				manualTrx.TypeID = 10
+				_, err = svc.AddManual(context.TODO(), manualTrx)
+				assert.EqualError(t, err, "Unexpected transaction type: 10")
+			}
+		},
+	}
+	for _, tt := range tests {
+		name, tt := tt()
+		t.Run(name, func(t *testing.T) {
+			db, storage := setupStorage(t)
+			if db == nil {
+				return
+			}
+			defer db.Close()
+			now := time.Unix(faker.UnixTime(), 0).UTC()
+			svc := NewService(WithStorage(storage), WithTimeZone(time.UTC))
+			svc.(*service).nowFn = func() time.Time { return now }
+			tt(t, storage, svc, now)
+		})
+	}
+}
+
+func Test_service_TimeZone(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	svc := NewService(WithStorage(storage), WithTimeZone(loc))
+
+	got, err := svc.AddManual(context.TODO(), ManualTransaction{
+		AccountID: "acc-" + faker.Word(),
+		Amount:    "10.5",
+		TypeID:    ledger.TransactionTypeExpense,
+		Date:      "2021-01-31",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "2021-01-31T00:00:00+03:00", got.Date)
+
+	date := "2021-02-01"
+	got, err = svc.Edit(context.TODO(), got.ID, Edit{Date: &date})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "2021-02-01T00:00:00+03:00", got.Date)
+}
+
+func Test_service_ConcurrentSync(t *testing.T) {
+	db, storage := setupStorage(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+	svc := NewService(WithStorage(&syncingStorage{Storage: storage, syncedAt: now}), WithTimeZone(time.UTC))
+
+	trx := randTrx()
+	if err := storage.SavePendingTransaction(context.TODO(), trx); !assert.NoError(t, err) {
+		return
+	}
+	comment := faker.Sentence()
+	_, err := svc.Edit(context.TODO(), trx.ID, Edit{Comment: &comment})
+	assert.EqualError(t, err, "Transaction "+trx.ID+" is already synced")
+
+	got, err := storage.GetPendingTransaction(context.TODO(), trx.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, dal.TransactionStatusSynced, got.Status())
+	assert.Equal(t, trx.Comment, got.Comment)
+	changes, err := storage.FindTransactionChanges(context.TODO(), trx.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, changes)
+}
@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"context"
+	"sync"
+)
+
+// Limiter bounds how many accounts are processed concurrently,
+// both overall and per bank
+type Limiter struct {
+	workers   chan struct{}
+	bankLimit int
+
+	mtx   sync.Mutex
+	banks map[string]chan struct{}
+}
+
+func (l *Limiter) bankSemaphore(bank string) chan struct{} {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	sem, ok := l.banks[bank]
+	if !ok {
+		sem = make(chan struct{}, l.bankLimit)
+		l.banks[bank] = sem
+	}
+	return sem
+}
+
+// Acquire will wait for a free worker and a free slot of the bank.
+// The returned release function must be called when processing is done
+func (l *Limiter) Acquire(ctx context.Context, bank string) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var bankSem chan struct{}
+	if l.bankLimit > 0 {
+		bankSem = l.bankSemaphore(bank)
+		select {
+		case bankSem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	releaseBank := func() {
+		if bankSem != nil {
+			<-bankSem
+		}
+	}
+	select {
+	case l.workers <- struct{}{}:
+	case <-ctx.Done():
+		releaseBank()
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-l.workers
+		releaseBank()
+	}, nil
+}
+
+// NewLimiter returns a limiter that allows given number of workers
+// and at most bankLimit of them to process accounts of the same bank.
+// Banks are not limited if bankLimit is zero
+func NewLimiter(workers int, bankLimit int) *Limiter {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Limiter{
+		workers:   make(chan struct{}, workers),
+		bankLimit: bankLimit,
+		banks:     map[string]chan struct{}{},
+	}
+}
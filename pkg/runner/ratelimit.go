@@ -0,0 +1,125 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+)
+
+// RateLimiter spaces fetches of the same account by a minimal interval of its bank.
+// Banks limit requests per merchant (e.g monobank per X-Token), so fetches
+// of different accounts are not spaced. If storage is set the interval is kept there,
+// so fetches of other processes (e.g a one off run next to the daemon) are spaced as well
+type RateLimiter struct {
+	storage   dal.Storage
+	owner     string
+	intervals map[string]time.Duration
+	nowFn     func() time.Time
+
+	mtx    sync.Mutex
+	lastAt map[string]time.Time
+}
+
+func rateLimitKey(bank string, accountID string) string {
+	return "ratelimit:" + bank + ":" + accountID
+}
+
+// Reserve will record a fetch of the account from the bank at now. If the account
+// was fetched more recently than interval of the bank allows then nothing is recorded
+// and the time to wait before the next attempt is returned
+func (l *RateLimiter) Reserve(ctx context.Context, bank string, accountID string, now time.Time) (time.Duration, error) {
+	interval := l.intervals[bank]
+	if interval <= 0 {
+		return 0, nil
+	}
+	key := rateLimitKey(bank, accountID)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if lastAt, ok := l.lastAt[key]; ok && now.Sub(lastAt) < interval {
+		return lastAt.Add(interval).Sub(now), nil
+	}
+	if l.storage != nil {
+		acquired, err := l.storage.AcquireLock(ctx, &dal.LockDTO{
+			Key:        key,
+			Owner:      l.owner,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(interval),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !acquired {
+			holder, err := l.storage.GetLock(ctx, key)
+			if err != nil {
+				return 0, err
+			}
+			if holder == nil || !holder.ExpiresAt.After(now) {
+				// Released or expired meanwhile, retrying right away is fine
+				return time.Millisecond, nil
+			}
+			return holder.ExpiresAt.Sub(now), nil
+		}
+	}
+	l.lastAt[key] = now
+	return 0, nil
+}
+
+// Wait will block until a fetch of the account from the bank is reserved or the context is done
+func (l *RateLimiter) Wait(ctx context.Context, bank string, accountID string) error {
+	for {
+		wait, err := l.Reserve(ctx, bank, accountID, l.nowFn())
+		if err != nil {
+			return err
+		}
+		if wait <= 0 {
+			return nil
+		}
+		logger.Debug(ctx, "Waiting %v for %v rate limit of account %v", wait, bank, accountID)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// RateLimiterOpt is an option of a rate limiter
+type RateLimiterOpt func(*RateLimiter)
+
+// WithBankInterval will set a minimal interval between fetches of an account from a given bank
+func WithBankInterval(bank string, minInterval time.Duration) RateLimiterOpt {
+	return func(l *RateLimiter) {
+		l.intervals[bank] = minInterval
+	}
+}
+
+// WithRateLimitStorage will keep last fetches of accounts in the storage
+func WithRateLimitStorage(storage dal.Storage) RateLimiterOpt {
+	return func(l *RateLimiter) {
+		l.storage = storage
+	}
+}
+
+// NewRateLimiter returns a rate limiter, banks without an interval are not limited
+func NewRateLimiter(opts ...RateLimiterOpt) *RateLimiter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	l := &RateLimiter{
+		owner:     fmt.Sprintf("%v:%v", hostname, os.Getpid()),
+		intervals: map[string]time.Duration{},
+		nowFn:     time.Now,
+		lastAt:    map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(faker.UnixTime(), 0).UTC()
+
+	t.Run("space fetches of the same account", func(t *testing.T) {
+		l := NewRateLimiter(WithBankInterval("bank-1", time.Minute))
+		reserve := func(bank string, accountID string, at time.Time) time.Duration {
+			wait, err := l.Reserve(context.TODO(), bank, accountID, at)
+			assert.NoError(t, err)
+			return wait
+		}
+		assert.Equal(t, time.Duration(0), reserve("bank-1", "acc-1", now))
+		assert.Equal(t, 40*time.Second, reserve("bank-1", "acc-1", now.Add(20*time.Second)))
+		assert.Equal(t, time.Duration(0), reserve("bank-1", "acc-2", now.Add(20*time.Second)))
+		assert.Equal(t, time.Duration(0), reserve("bank-2", "acc-1", now.Add(20*time.Second)))
+		assert.Equal(t, time.Duration(0), reserve("bank-1", "acc-1", now.Add(time.Minute)))
+	})
+
+	t.Run("space fetches of other processes", func(t *testing.T) {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer db.Close()
+		db.SetMaxOpenConns(1)
+		storage, err := dal.NewSQLStorage(dal.WithSQLDb(db))
+		if !assert.NoError(t, err) || !assert.NoError(t, storage.Setup(context.TODO())) {
+			return
+		}
+		daemon := NewRateLimiter(WithRateLimitStorage(storage), WithBankInterval("bank-1", time.Minute))
+		run := NewRateLimiter(WithRateLimitStorage(storage), WithBankInterval("bank-1", time.Minute))
+		run.owner = "other-" + faker.Word()
+
+		wait, err := daemon.Reserve(context.TODO(), "bank-1", "acc-1", now)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, time.Duration(0), wait)
+		wait, err = run.Reserve(context.TODO(), "bank-1", "acc-1", now.Add(15*time.Second))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 45*time.Second, wait)
+		wait, err = run.Reserve(context.TODO(), "bank-1", "acc-1", now.Add(61*time.Second))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, time.Duration(0), wait)
+	})
+
+	t.Run("stop waiting when cancelled", func(t *testing.T) {
+		l := NewRateLimiter(WithBankInterval("bank-1", time.Hour))
+		assert.NoError(t, l.Wait(context.TODO(), "bank-1", "acc-1"))
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, l.Wait(ctx, "bank-1", "acc-1"))
+	})
+}
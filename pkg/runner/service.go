@@ -0,0 +1,241 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+)
+
+var logger = diag.CreateLogger()
+
+// Params represents what to run
+type Params struct {
+	// UserIDs to run for, all configured users if empty
+	UserIDs []string
+}
+
+// AccountResult represents results of fetching and syncing an account
+type AccountResult struct {
+	UserID    string
+	AccountID string
+	Bank      string
+
+	// Fetch is a fetch run, nil if fetching did not start
+	Fetch      *dal.FetchRunDTO
+	FetchError error
+
+	// Sync is a sync report, nil if sync did not start
+	Sync      *ledgersync.Report
+	SyncError error
+}
+
+// Failed returns true if either fetch or sync of the account failed.
+// Accounts locked by another process are not considered failed
+func (r *AccountResult) Failed() bool {
+	return isFailure(r.FetchError) || isFailure(r.SyncError) || (r.Sync != nil && r.Sync.Failed > 0)
+}
+
+// Locked returns true if fetch or sync was skipped since another process was running it
+func (r *AccountResult) Locked() bool {
+	return lock.IsLocked(r.FetchError) || lock.IsLocked(r.SyncError)
+}
+
+func isFailure(err error) bool {
+	return err != nil && !lock.IsLocked(err)
+}
+
+// Service fetches and syncs all configured accounts
+type Service interface {
+	// Run will fetch and then sync every account of configured users.
+	// Accounts are processed concurrently, failure of an account does not stop others,
+	// results are returned for all accounts in the order of users and account ids
+	Run(ctx context.Context, params *Params) ([]AccountResult, error)
+}
+
+type service struct {
+	fetcherConfig banks.FetcherConfig
+	fetchSvc      fetch.Service
+	syncSvc       ledgersync.Service
+
+	limiter        *Limiter
+	rateLimiter    *RateLimiter
+	accountTimeout time.Duration
+}
+
+func (svc *service) Run(ctx context.Context, params *Params) ([]AccountResult, error) {
+	userIDs := params.UserIDs
+	if len(userIDs) == 0 {
+		lister, ok := svc.fetcherConfig.(banks.UserLister)
+		if !ok {
+			return nil, errors.New("Fetcher config can not list users, please provide users to run for")
+		}
+		var err error
+		if userIDs, err = lister.ListUsers(ctx); err != nil {
+			return nil, err
+		}
+	}
+	results := []AccountResult{}
+	for _, userID := range userIDs {
+		userCfg, err := banks.ReadUserConfig(ctx, svc.fetcherConfig, userID)
+		if err != nil {
+			logger.WithError(err).Error(ctx, "Failed to read config of user %v", userID)
+			results = append(results, AccountResult{
+				UserID:     userID,
+				FetchError: fmt.Errorf("Failed to read user config: %v", err),
+			})
+			continue
+		}
+		accountIDs := make([]string, 0, len(userCfg.Accounts))
+		for accountID := range userCfg.Accounts {
+			accountIDs = append(accountIDs, accountID)
+		}
+		sort.Strings(accountIDs)
+		for _, accountID := range accountIDs {
+			results = append(results, AccountResult{
+				UserID:    userID,
+				AccountID: accountID,
+				Bank:      userCfg.Accounts[accountID].Bank,
+			})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].AccountID == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(result *AccountResult) {
+			defer wg.Done()
+			svc.processAccount(ctx, result)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// newAccountContext returns a context to process a single account with, not limited if timeout is zero
+func newAccountContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// processAccount will run the account once the limiter and the bank rate limit allow,
+// each account gets own context so timeout of one account does not affect others
+func (svc *service) processAccount(ctx context.Context, result *AccountResult) {
+	release, err := svc.limiter.Acquire(ctx, result.Bank)
+	if err != nil {
+		result.FetchError = fmt.Errorf("Account was not processed: %v", err)
+		return
+	}
+	defer release()
+	if err := svc.rateLimiter.Wait(ctx, result.Bank, result.AccountID); err != nil {
+		result.FetchError = fmt.Errorf("Account was not processed: %v", err)
+		return
+	}
+
+	accountCtx, cancel := newAccountContext(ctx, svc.accountTimeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(ctx, "Panic while processing account %v: %v", result.AccountID, r)
+			if result.Fetch == nil && result.FetchError == nil {
+				result.FetchError = fmt.Errorf("Panic while fetching: %v", r)
+			} else {
+				result.SyncError = fmt.Errorf("Panic while syncing: %v", r)
+			}
+		}
+	}()
+	svc.runAccount(accountCtx, result)
+}
+
+func (svc *service) runAccount(ctx context.Context, result *AccountResult) {
+	logger.Info(ctx, "Fetching transactions of %v account %v (%v)", result.UserID, result.AccountID, result.Bank)
+	result.Fetch, result.FetchError = svc.fetchSvc.FetchTransactions(ctx, &fetch.Params{
+		UserID:          result.UserID,
+		LedgerAccountID: result.AccountID,
+		Bank:            result.Bank,
+	})
+	if result.FetchError != nil {
+		logger.WithError(result.FetchError).Error(ctx, "Failed to fetch transactions of account %v", result.AccountID)
+	}
+
+	// Previously fetched transactions are synced even if this fetch failed
+	logger.Info(ctx, "Syncing transactions of %v account %v", result.UserID, result.AccountID)
+	result.Sync, result.SyncError = svc.syncSvc.SyncTransactions(ctx, result.UserID, result.AccountID)
+	if result.SyncError != nil {
+		logger.WithError(result.SyncError).Error(ctx, "Failed to sync transactions of account %v", result.AccountID)
+	}
+}
+
+// ServiceOpt is an option for run service
+type ServiceOpt func(*service)
+
+// WithFetcherConfig will init the service with fetcher config to take accounts from
+func WithFetcherConfig(cfg banks.FetcherConfig) ServiceOpt {
+	return func(svc *service) {
+		svc.fetcherConfig = cfg
+	}
+}
+
+// WithFetchService will init the service with fetch service
+func WithFetchService(fetchSvc fetch.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.fetchSvc = fetchSvc
+	}
+}
+
+// WithSyncService will init the service with ledger sync service
+func WithSyncService(syncSvc ledgersync.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.syncSvc = syncSvc
+	}
+}
+
+// WithConcurrency will set how many accounts are processed concurrently
+// and how many of them may belong to the same bank (not limited if zero)
+func WithConcurrency(workers int, bankLimit int) ServiceOpt {
+	return func(svc *service) {
+		svc.limiter = NewLimiter(workers, bankLimit)
+	}
+}
+
+// WithRateLimiter will space fetches from the same bank to respect bank rate limits
+func WithRateLimiter(rateLimiter *RateLimiter) ServiceOpt {
+	return func(svc *service) {
+		svc.rateLimiter = rateLimiter
+	}
+}
+
+// WithAccountTimeout will limit how long fetching and syncing of a single account may take
+func WithAccountTimeout(timeout time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.accountTimeout = timeout
+	}
+}
+
+// NewService returns an instance of a run service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		limiter:     NewLimiter(1, 0),
+		rateLimiter: NewRateLimiter(),
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
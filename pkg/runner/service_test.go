@@ -0,0 +1,247 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lock"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFetchService struct {
+	mtx      sync.Mutex
+	fetched  []fetch.Params
+	failures map[string]error
+}
+
+func (svc *mockFetchService) FetchTransactions(ctx context.Context, params *fetch.Params) (*dal.FetchRunDTO, error) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	svc.fetched = append(svc.fetched, *params)
+	run := &dal.FetchRunDTO{Bank: params.Bank, UserID: params.UserID, AccountID: params.LedgerAccountID, Fetched: 1, New: 1}
+	if err, ok := svc.failures[params.LedgerAccountID]; ok {
+		run.Error = err.Error()
+		return run, err
+	}
+	return run, nil
+}
+
+func (svc *mockFetchService) TestFetch(ctx context.Context, params *fetch.Params, cfg banks.FetcherConfig) (int, error) {
+	return 0, errors.New("Not supported")
+}
+
+func (svc *mockFetchService) DryRun(ctx context.Context, params *fetch.Params) (*fetch.DryRunReport, error) {
+	return nil, errors.New("Not supported")
+}
+
+type mockSyncService struct {
+	mtx      sync.Mutex
+	synced   []string
+	failures map[string]error
+}
+
+func (svc *mockSyncService) SyncTransactions(ctx context.Context, userID string, accountID string) (*ledgersync.Report, error) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	svc.synced = append(svc.synced, userID+"/"+accountID)
+	if err, ok := svc.failures[accountID]; ok {
+		return &ledgersync.Report{AccountID: accountID}, err
+	}
+	return &ledgersync.Report{AccountID: accountID, Synced: 1}, nil
+}
+
+func (svc *mockSyncService) SyncUserTransactions(ctx context.Context, userID string) (*ledgersync.UserReport, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (svc *mockSyncService) DryRun(ctx context.Context, userID string, accountID string) ([]ledgersync.DryRunTransaction, error) {
+	return nil, errors.New("Not supported")
+}
+
+// slowFetchService blocks fetching until proceed is closed or ctx is done
+type slowFetchService struct {
+	mockFetchService
+	started chan string
+	proceed chan struct{}
+}
+
+func (svc *slowFetchService) FetchTransactions(ctx context.Context, params *fetch.Params) (*dal.FetchRunDTO, error) {
+	svc.started <- params.LedgerAccountID
+	select {
+	case <-svc.proceed:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return svc.mockFetchService.FetchTransactions(ctx, params)
+}
+
+func randMerchant(userID string, accountID string) dal.FetcherMerchantDTO {
+	return dal.FetcherMerchantDTO{
+		UserID:    userID,
+		AccountID: accountID,
+		Bank:      "bank-" + faker.Word(),
+		Settings:  map[string]string{"XToken": faker.Word()},
+	}
+}
+
+func Test_service_Run(t *testing.T) {
+	user1 := "user1-" + faker.Email()
+	user2 := "user2-" + faker.Email()
+	merchants := []dal.FetcherMerchantDTO{
+		randMerchant(user1, "acc-2"),
+		randMerchant(user1, "acc-1"),
+		randMerchant(user2, "acc-3"),
+	}
+	cfg := banks.NewMerchantsFetcherConfig(merchants)
+
+	t.Run("fetch and sync all accounts", func(t *testing.T) {
+		fetchSvc := &mockFetchService{}
+		syncSvc := &mockSyncService{}
+		svc := NewService(WithFetcherConfig(cfg), WithFetchService(fetchSvc), WithSyncService(syncSvc))
+		results, err := svc.Run(context.TODO(), &Params{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.ElementsMatch(t, []fetch.Params{
+			{UserID: user1, LedgerAccountID: "acc-1", Bank: merchants[1].Bank},
+			{UserID: user1, LedgerAccountID: "acc-2", Bank: merchants[0].Bank},
+			{UserID: user2, LedgerAccountID: "acc-3", Bank: merchants[2].Bank},
+		}, fetchSvc.fetched)
+		assert.ElementsMatch(t, []string{user1 + "/acc-1", user1 + "/acc-2", user2 + "/acc-3"}, syncSvc.synced)
+		if !assert.Len(t, results, 3) {
+			return
+		}
+		for _, result := range results {
+			assert.False(t, result.Failed())
+			assert.Equal(t, 1, result.Fetch.New)
+			assert.Equal(t, 1, result.Sync.Synced)
+		}
+	})
+
+	t.Run("continue after failures", func(t *testing.T) {
+		fetchErr := errors.New("fetch " + faker.Sentence())
+		syncErr := errors.New("sync " + faker.Sentence())
+		fetchSvc := &mockFetchService{failures: map[string]error{"acc-1": fetchErr}}
+		syncSvc := &mockSyncService{failures: map[string]error{"acc-2": syncErr}}
+		svc := NewService(WithFetcherConfig(cfg), WithFetchService(fetchSvc), WithSyncService(syncSvc))
+		results, err := svc.Run(context.TODO(), &Params{})
+		if !assert.NoError(t, err) || !assert.Len(t, results, 3) {
+			return
+		}
+		assert.Equal(t, fetchErr, results[0].FetchError)
+		assert.NoError(t, results[0].SyncError)
+		assert.True(t, results[0].Failed())
+		assert.NoError(t, results[1].FetchError)
+		assert.Equal(t, syncErr, results[1].SyncError)
+		assert.True(t, results[1].Failed())
+		assert.False(t, results[2].Failed())
+		assert.Len(t, syncSvc.synced, 3)
+	})
+
+	t.Run("do not fail locked accounts", func(t *testing.T) {
+		lockedErr := &lock.LockedError{Key: lock.Key(user1, "acc-1", lock.OperationFetch), Owner: faker.Word()}
+		fetchSvc := &mockFetchService{failures: map[string]error{"acc-1": lockedErr}}
+		syncSvc := &mockSyncService{}
+		svc := NewService(WithFetcherConfig(cfg), WithFetchService(fetchSvc), WithSyncService(syncSvc))
+		results, err := svc.Run(context.TODO(), &Params{UserIDs: []string{user1}})
+		if !assert.NoError(t, err) || !assert.Len(t, results, 2) {
+			return
+		}
+		assert.False(t, results[0].Failed())
+		assert.True(t, results[0].Locked())
+		assert.False(t, results[1].Locked())
+	})
+
+	t.Run("run for given users", func(t *testing.T) {
+		missingUser := faker.Email()
+		fetchSvc := &mockFetchService{}
+		syncSvc := &mockSyncService{}
+		svc := NewService(WithFetcherConfig(cfg), WithFetchService(fetchSvc), WithSyncService(syncSvc))
+		results, err := svc.Run(context.TODO(), &Params{UserIDs: []string{user2, missingUser}})
+		if !assert.NoError(t, err) || !assert.Len(t, results, 2) {
+			return
+		}
+		assert.Equal(t, "acc-3", results[0].AccountID)
+		assert.False(t, results[0].Failed())
+		assert.Equal(t, missingUser, results[1].UserID)
+		assert.EqualError(t, results[1].FetchError, "Failed to read user config: No merchants configured for user: "+missingUser)
+		assert.True(t, results[1].Failed())
+	})
+
+	t.Run("process accounts concurrently within limits", func(t *testing.T) {
+		sameBank := []dal.FetcherMerchantDTO{merchants[0], merchants[1], merchants[2]}
+		sameBank[1].Bank = sameBank[0].Bank
+		fetchSvc := &slowFetchService{started: make(chan string, 3), proceed: make(chan struct{})}
+		syncSvc := &mockSyncService{}
+		svc := NewService(
+			WithFetcherConfig(banks.NewMerchantsFetcherConfig(sameBank)),
+			WithFetchService(fetchSvc),
+			WithSyncService(syncSvc),
+			WithConcurrency(3, 1),
+		)
+		done := make(chan []AccountResult)
+		go func() {
+			results, err := svc.Run(context.TODO(), &Params{})
+			assert.NoError(t, err)
+			done <- results
+		}()
+		started := []string{<-fetchSvc.started, <-fetchSvc.started}
+		assert.Contains(t, started, "acc-3")
+		select {
+		case accountID := <-fetchSvc.started:
+			assert.Fail(t, "Bank limit exceeded", "Unexpected fetch of %v", accountID)
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(fetchSvc.proceed)
+		results := <-done
+		if !assert.Len(t, results, 3) {
+			return
+		}
+		assert.Equal(t, "acc-1", results[0].AccountID)
+		assert.Equal(t, "acc-2", results[1].AccountID)
+		assert.Equal(t, "acc-3", results[2].AccountID)
+		for _, result := range results {
+			assert.False(t, result.Failed())
+		}
+	})
+
+	t.Run("time out slow accounts", func(t *testing.T) {
+		fetchSvc := &slowFetchService{started: make(chan string, 3), proceed: make(chan struct{})}
+		syncSvc := &mockSyncService{}
+		svc := NewService(
+			WithFetcherConfig(cfg),
+			WithFetchService(fetchSvc),
+			WithSyncService(syncSvc),
+			WithConcurrency(3, 0),
+			WithAccountTimeout(time.Millisecond),
+		)
+		results, err := svc.Run(context.TODO(), &Params{UserIDs: []string{user2}})
+		if !assert.NoError(t, err) || !assert.Len(t, results, 1) {
+			return
+		}
+		assert.Equal(t, context.DeadlineExceeded, results[0].FetchError)
+		assert.True(t, results[0].Failed())
+	})
+
+	t.Run("skip accounts when cancelled", func(t *testing.T) {
+		fetchSvc := &mockFetchService{}
+		syncSvc := &mockSyncService{}
+		svc := NewService(WithFetcherConfig(cfg), WithFetchService(fetchSvc), WithSyncService(syncSvc))
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		results, err := svc.Run(ctx, &Params{})
+		if !assert.NoError(t, err) || !assert.Len(t, results, 3) {
+			return
+		}
+		assert.Empty(t, fetchSvc.fetched)
+		assert.EqualError(t, results[0].FetchError, "Account was not processed: context canceled")
+	})
+}
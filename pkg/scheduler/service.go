@@ -0,0 +1,497 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/runner"
+
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/diag"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+)
+
+var logger = diag.CreateLogger()
+
+// maxFetchSuspension is an upper limit of a delay between fetches of a suspended account
+const maxFetchSuspension = 24 * time.Hour
+
+// AccountStatus represents last and next runs of a scheduled account
+type AccountStatus struct {
+	UserID    string
+	AccountID string
+	Bank      string
+
+	LastFetchAt    time.Time
+	LastFetch      *dal.FetchRunDTO
+	LastFetchError string
+	NextFetchAt    time.Time
+
+	// FetchSuspended is set when the last fetch failed permanently (e.g bank rejected credentials).
+	// The account is fetched again at NextFetchAt with a delay growing with each
+	// permanent failure up to a day, or right away when its merchant settings change
+	FetchSuspended bool
+
+	// FetchSuspensions is a number of permanent fetch failures in a row
+	FetchSuspensions int
+
+	LastSyncAt    time.Time
+	LastSync      *ledgersync.Report
+	LastSyncError string
+	NextSyncAt    time.Time
+
+	// settingsHash is a fingerprint of merchant settings of the account
+	settingsHash string
+}
+
+// Service fetches and syncs all configured accounts on schedule
+type Service interface {
+	// Run will fetch and sync accounts when due until ctx is done.
+	// Runs that are in progress when ctx is done are completed before returning
+	Run(ctx context.Context) error
+
+	// Status returns last and next runs of all scheduled accounts
+	Status() []AccountStatus
+}
+
+type accountKey struct {
+	userID    string
+	accountID string
+}
+
+type accountConfig struct {
+	bank         string
+	settingsHash string
+}
+
+// hashSettings returns a fingerprint of merchant settings, so changes
+// can be detected without keeping secrets in memory
+func hashSettings(settings map[string]string) string {
+	// Map keys are sorted when marshaled, marshaling string map never fails
+	data, _ := json.Marshal(settings)
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// detachedContext keeps values of the parent context but is never done,
+// so runs in progress are not interrupted when the scheduler is stopped
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+type service struct {
+	fetcherConfig banks.FetcherConfig
+	fetchSvc      fetch.Service
+	syncSvc       ledgersync.Service
+
+	fetchInterval  time.Duration
+	syncInterval   time.Duration
+	jitter         time.Duration
+	pollInterval   time.Duration
+	rateLimiter    *runner.RateLimiter
+	limiter        *runner.Limiter
+	accountTimeout time.Duration
+
+	now        func() time.Time
+	randInt63n func(n int64) int64
+
+	mtx      sync.Mutex
+	accounts map[accountKey]*AccountStatus
+
+	// inFlight holds accounts dispatched but not yet processed,
+	// so slow accounts are not started again by the next tick
+	inFlight map[accountKey]bool
+	running  sync.WaitGroup
+}
+
+func (svc *service) Run(ctx context.Context) error {
+	if _, ok := svc.fetcherConfig.(banks.UserLister); !ok {
+		return errors.New("Fetcher config can not list users, scheduling is not possible")
+	}
+	logger.Info(ctx, "Scheduler started. Fetch interval: %v, sync interval: %v, jitter: %v", svc.fetchInterval, svc.syncInterval, svc.jitter)
+	ticker := time.NewTicker(svc.pollInterval)
+	defer ticker.Stop()
+	for {
+		svc.tick(ctx)
+		select {
+		case <-ctx.Done():
+			svc.running.Wait()
+			logger.Info(ctx, "Scheduler stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (svc *service) Status() []AccountStatus {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	result := make([]AccountStatus, 0, len(svc.accounts))
+	for _, status := range svc.accounts {
+		result = append(result, *status)
+	}
+	sortStatuses(result)
+	return result
+}
+
+func sortStatuses(statuses []AccountStatus) {
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].UserID != statuses[j].UserID {
+			return statuses[i].UserID < statuses[j].UserID
+		}
+		return statuses[i].AccountID < statuses[j].AccountID
+	})
+}
+
+func (svc *service) withJitter(interval time.Duration) time.Duration {
+	if svc.jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(svc.randInt63n(int64(svc.jitter)))
+}
+
+// tick will dispatch due accounts without waiting for them to be processed,
+// so a slow account does not delay others. Order of runs is up to the limiter
+func (svc *service) tick(ctx context.Context) {
+	if err := svc.refreshAccounts(ctx); err != nil {
+		logger.WithError(err).Error(ctx, "Failed to refresh scheduled accounts")
+	}
+	workCtx := detachedContext{ctx}
+	for _, due := range svc.dueAccounts() {
+		svc.running.Add(1)
+		go func(due AccountStatus) {
+			defer svc.running.Done()
+			defer svc.complete(accountKey{userID: due.UserID, accountID: due.AccountID})
+			svc.processAccount(ctx, workCtx, due)
+		}(due)
+	}
+}
+
+// complete will allow the account to be dispatched again
+func (svc *service) complete(key accountKey) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	delete(svc.inFlight, key)
+}
+
+// processAccount will run the account once the limiter allows unless the scheduler is stopped
+func (svc *service) processAccount(ctx context.Context, workCtx context.Context, due AccountStatus) {
+	release, err := svc.limiter.Acquire(ctx, due.Bank)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	var accountCtx context.Context
+	var cancel context.CancelFunc
+	if svc.accountTimeout > 0 {
+		accountCtx, cancel = context.WithTimeout(workCtx, svc.accountTimeout)
+	} else {
+		accountCtx, cancel = context.WithCancel(workCtx)
+	}
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(ctx, "Panic while processing %v account %v: %v", due.UserID, due.AccountID, r)
+		}
+	}()
+	svc.runAccount(accountCtx, accountKey{userID: due.UserID, accountID: due.AccountID})
+}
+
+// refreshAccounts will schedule newly configured accounts and drop removed ones.
+// Accounts of users with broken configs are kept as is
+func (svc *service) refreshAccounts(ctx context.Context) error {
+	userIDs, err := svc.fetcherConfig.(banks.UserLister).ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	configured := map[accountKey]accountConfig{}
+	failedUsers := map[string]bool{}
+	for _, userID := range userIDs {
+		userCfg, err := banks.ReadUserConfig(ctx, svc.fetcherConfig, userID)
+		if err != nil {
+			logger.WithError(err).Error(ctx, "Failed to read config of user %v", userID)
+			failedUsers[userID] = true
+			continue
+		}
+		for accountID, accountCfg := range userCfg.Accounts {
+			configured[accountKey{userID: userID, accountID: accountID}] = accountConfig{
+				bank:         accountCfg.Bank,
+				settingsHash: hashSettings(accountCfg.Settings),
+			}
+		}
+	}
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	now := svc.now()
+	for key, cfg := range configured {
+		if status, ok := svc.accounts[key]; ok {
+			if status.FetchSuspended && (status.Bank != cfg.bank || status.settingsHash != cfg.settingsHash) {
+				logger.Info(ctx, "Resuming fetch of %v account %v, merchant settings changed", key.userID, key.accountID)
+				status.FetchSuspended = false
+				status.FetchSuspensions = 0
+				status.NextFetchAt = now
+			}
+			status.Bank = cfg.bank
+			status.settingsHash = cfg.settingsHash
+			continue
+		}
+		// Spreading first runs to not hit banks with all accounts at once
+		firstRunAt := now.Add(svc.withJitter(0))
+		svc.accounts[key] = &AccountStatus{
+			UserID:       key.userID,
+			AccountID:    key.accountID,
+			Bank:         cfg.bank,
+			NextFetchAt:  firstRunAt,
+			NextSyncAt:   firstRunAt,
+			settingsHash: cfg.settingsHash,
+		}
+		logger.Info(ctx, "Scheduled %v account %v (%v) at %v", key.userID, key.accountID, cfg.bank, firstRunAt)
+	}
+	for key := range svc.accounts {
+		if _, ok := configured[key]; !ok && !failedUsers[key.userID] {
+			delete(svc.accounts, key)
+			logger.Info(ctx, "Unscheduled %v account %v", key.userID, key.accountID)
+		}
+	}
+	return nil
+}
+
+func (status *AccountStatus) fetchDue(now time.Time) bool {
+	return !now.Before(status.NextFetchAt)
+}
+
+// suspension returns a delay before the next fetch after given number of permanent failures in a row
+func (svc *service) suspension(suspensions int) time.Duration {
+	suspension := svc.fetchInterval
+	for i := 0; i < suspensions && suspension < maxFetchSuspension; i++ {
+		suspension *= 2
+	}
+	if suspension > maxFetchSuspension {
+		return maxFetchSuspension
+	}
+	return suspension
+}
+
+// dueAccounts returns accounts to run and marks them in flight.
+// Accounts that are still in flight are skipped
+func (svc *service) dueAccounts() []AccountStatus {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	now := svc.now()
+	due := []AccountStatus{}
+	for key, status := range svc.accounts {
+		if svc.inFlight[key] {
+			continue
+		}
+		if status.fetchDue(now) || !now.Before(status.NextSyncAt) {
+			svc.inFlight[key] = true
+			due = append(due, *status)
+		}
+	}
+	sortStatuses(due)
+	return due
+}
+
+// acquireFetch returns false if the account was fetched more recently than rate limit of its bank allows
+func (svc *service) acquireFetch(ctx context.Context, key accountKey, bank string) bool {
+	wait, err := svc.rateLimiter.Reserve(ctx, bank, key.accountID, svc.now())
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to check %v rate limit of account %v", bank, key.accountID)
+		return false
+	}
+	return wait == 0
+}
+
+func (svc *service) runAccount(ctx context.Context, key accountKey) {
+	svc.mtx.Lock()
+	status, ok := svc.accounts[key]
+	if !ok {
+		svc.mtx.Unlock()
+		return
+	}
+	now := svc.now()
+	bank := status.Bank
+	fetchDue := status.fetchDue(now)
+	syncDue := !now.Before(status.NextSyncAt)
+	svc.mtx.Unlock()
+
+	if fetchDue {
+		if svc.acquireFetch(ctx, key, bank) {
+			svc.fetchAccount(ctx, key, bank)
+
+			// Syncing right away to report just fetched transactions
+			syncDue = true
+		} else {
+			logger.Debug(ctx, "Postponing fetch of %v account %v due to %v rate limit", key.userID, key.accountID, bank)
+		}
+	}
+	if syncDue {
+		svc.syncAccount(ctx, key)
+	}
+}
+
+func (svc *service) fetchAccount(ctx context.Context, key accountKey, bank string) {
+	logger.Info(ctx, "Fetching transactions of %v account %v (%v)", key.userID, key.accountID, bank)
+	startedAt := svc.now()
+	run, err := svc.fetchSvc.FetchTransactions(ctx, &fetch.Params{
+		UserID:          key.userID,
+		LedgerAccountID: key.accountID,
+		Bank:            bank,
+	})
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to fetch transactions of account %v", key.accountID)
+	}
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	status, ok := svc.accounts[key]
+	if !ok {
+		return
+	}
+	status.LastFetchAt = startedAt
+	status.LastFetch = run
+	status.LastFetchError = ""
+	if err != nil {
+		status.LastFetchError = err.Error()
+	}
+	if request.IsPermanent(err) {
+		status.FetchSuspended = true
+		status.FetchSuspensions++
+		status.NextFetchAt = svc.now().Add(svc.suspension(status.FetchSuspensions))
+		logger.Warn(ctx, "Suspending fetch of %v account %v until %v or its merchant settings change",
+			key.userID, key.accountID, status.NextFetchAt)
+		return
+	}
+	status.FetchSuspended = false
+	status.FetchSuspensions = 0
+	status.NextFetchAt = svc.now().Add(svc.withJitter(svc.fetchInterval))
+}
+
+func (svc *service) syncAccount(ctx context.Context, key accountKey) {
+	logger.Info(ctx, "Syncing transactions of %v account %v", key.userID, key.accountID)
+	startedAt := svc.now()
+	report, err := svc.syncSvc.SyncTransactions(ctx, key.userID, key.accountID)
+	if err != nil {
+		logger.WithError(err).Error(ctx, "Failed to sync transactions of account %v", key.accountID)
+	}
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	status, ok := svc.accounts[key]
+	if !ok {
+		return
+	}
+	status.LastSyncAt = startedAt
+	status.LastSync = report
+	status.LastSyncError = ""
+	if err != nil {
+		status.LastSyncError = err.Error()
+	}
+	status.NextSyncAt = svc.now().Add(svc.withJitter(svc.syncInterval))
+}
+
+// ServiceOpt is an option for scheduler service
+type ServiceOpt func(*service)
+
+// WithFetcherConfig will init the service with fetcher config to take accounts from
+func WithFetcherConfig(cfg banks.FetcherConfig) ServiceOpt {
+	return func(svc *service) {
+		svc.fetcherConfig = cfg
+	}
+}
+
+// WithFetchService will init the service with fetch service
+func WithFetchService(fetchSvc fetch.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.fetchSvc = fetchSvc
+	}
+}
+
+// WithSyncService will init the service with ledger sync service
+func WithSyncService(syncSvc ledgersync.Service) ServiceOpt {
+	return func(svc *service) {
+		svc.syncSvc = syncSvc
+	}
+}
+
+// WithIntervals will set how often accounts are fetched and synced.
+// Sync also happens right after each fetch
+func WithIntervals(fetchInterval time.Duration, syncInterval time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.fetchInterval = fetchInterval
+		svc.syncInterval = syncInterval
+	}
+}
+
+// WithJitter will set max random delay added to each scheduled run
+func WithJitter(jitter time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.jitter = jitter
+	}
+}
+
+// WithPollInterval will set how often the scheduler checks for due runs
+// and picks up config changes
+func WithPollInterval(pollInterval time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.pollInterval = pollInterval
+	}
+}
+
+// WithConcurrency will set how many accounts are processed concurrently
+// and how many of them may belong to the same bank (not limited if zero)
+func WithConcurrency(workers int, bankLimit int) ServiceOpt {
+	return func(svc *service) {
+		svc.limiter = runner.NewLimiter(workers, bankLimit)
+	}
+}
+
+// WithAccountTimeout will limit how long fetching and syncing of a single account may take
+func WithAccountTimeout(timeout time.Duration) ServiceOpt {
+	return func(svc *service) {
+		svc.accountTimeout = timeout
+	}
+}
+
+// WithRateLimiter will space fetches from the same bank to respect bank rate limits
+func WithRateLimiter(rateLimiter *runner.RateLimiter) ServiceOpt {
+	return func(svc *service) {
+		svc.rateLimiter = rateLimiter
+	}
+}
+
+// NewService returns an instance of a scheduler service
+func NewService(opts ...ServiceOpt) Service {
+	svc := &service{
+		fetchInterval: time.Hour,
+		syncInterval:  15 * time.Minute,
+		pollInterval:  10 * time.Second,
+		rateLimiter:   runner.NewRateLimiter(),
+		limiter:       runner.NewLimiter(1, 0),
+		now:           time.Now,
+		randInt63n:    rand.Int63n,
+		accounts:      map[accountKey]*AccountStatus{},
+		inFlight:      map[accountKey]bool{},
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
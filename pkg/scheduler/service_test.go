@@ -0,0 +1,411 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/banks"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/dal"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/fetch"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/ledgersync"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/lib-core-golang/request"
+	"github.com/evgeny-myasishchev/ledger.transactions-fetcher/pkg/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockFetchService struct {
+	mtx      sync.Mutex
+	fetched  []string
+	failures map[string]error
+}
+
+func (svc *mockFetchService) FetchTransactions(ctx context.Context, params *fetch.Params) (*dal.FetchRunDTO, error) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	svc.fetched = append(svc.fetched, params.LedgerAccountID)
+	run := &dal.FetchRunDTO{Bank: params.Bank, UserID: params.UserID, AccountID: params.LedgerAccountID, Fetched: 1, New: 1}
+	if err, ok := svc.failures[params.LedgerAccountID]; ok {
+		run.Error = err.Error()
+		return run, err
+	}
+	return run, nil
+}
+
+func (svc *mockFetchService) TestFetch(ctx context.Context, params *fetch.Params, cfg banks.FetcherConfig) (int, error) {
+	return 0, errors.New("Not supported")
+}
+
+func (svc *mockFetchService) DryRun(ctx context.Context, params *fetch.Params) (*fetch.DryRunReport, error) {
+	return nil, errors.New("Not supported")
+}
+
+type mockSyncService struct {
+	mtx    sync.Mutex
+	synced []string
+}
+
+func (svc *mockSyncService) SyncTransactions(ctx context.Context, userID string, accountID string) (*ledgersync.Report, error) {
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	svc.synced = append(svc.synced, accountID)
+	return &ledgersync.Report{AccountID: accountID, Synced: 1}, nil
+}
+
+func (svc *mockSyncService) SyncUserTransactions(ctx context.Context, userID string) (*ledgersync.UserReport, error) {
+	return nil, errors.New("Not supported")
+}
+
+func (svc *mockSyncService) DryRun(ctx context.Context, userID string, accountID string) ([]ledgersync.DryRunTransaction, error) {
+	return nil, errors.New("Not supported")
+}
+
+type blockingFetchService struct {
+	mockFetchService
+	started chan string
+	proceed chan struct{}
+}
+
+func (svc *blockingFetchService) FetchTransactions(ctx context.Context, params *fetch.Params) (*dal.FetchRunDTO, error) {
+	svc.started <- params.LedgerAccountID
+	<-svc.proceed
+	return svc.mockFetchService.FetchTransactions(ctx, params)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// tickAndWait will dispatch due accounts and wait until they are processed
+func (svc *service) tickAndWait(ctx context.Context) {
+	svc.tick(ctx)
+	svc.running.Wait()
+}
+
+func Test_service(t *testing.T) {
+	userID := faker.Email()
+	merchants := []dal.FetcherMerchantDTO{
+		{UserID: userID, AccountID: "acc-1", Bank: "bank-1"},
+		{UserID: userID, AccountID: "acc-2", Bank: "bank-2"},
+	}
+
+	type testCase struct {
+		name string
+		run  func(t *testing.T)
+	}
+
+	newService := func(
+		clock *fakeClock,
+		fetchSvc *mockFetchService,
+		syncSvc *mockSyncService,
+		merchants []dal.FetcherMerchantDTO,
+		opts ...ServiceOpt,
+	) *service {
+		opts = append([]ServiceOpt{
+			WithFetcherConfig(banks.NewMerchantsFetcherConfig(merchants)),
+			WithFetchService(fetchSvc),
+			WithSyncService(syncSvc),
+			WithIntervals(time.Hour, 10*time.Minute),
+		}, opts...)
+		svc := NewService(opts...).(*service)
+		svc.now = clock.Now
+		svc.randInt63n = func(n int64) int64 { return n / 2 }
+		return svc
+	}
+
+	tests := []func() testCase{
+		func() testCase {
+			return testCase{
+				name: "fetch and sync accounts when due",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchSvc := &mockFetchService{}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants)
+
+					svc.tickAndWait(context.TODO())
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, fetchSvc.fetched)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, syncSvc.synced)
+
+					status := svc.Status()
+					if !assert.Len(t, status, 2) {
+						return
+					}
+					assert.Equal(t, "acc-1", status[0].AccountID)
+					assert.Equal(t, "bank-1", status[0].Bank)
+					assert.Equal(t, clock.now, status[0].LastFetchAt)
+					assert.Equal(t, 1, status[0].LastFetch.New)
+					assert.Equal(t, clock.now.Add(time.Hour), status[0].NextFetchAt)
+					assert.Equal(t, clock.now, status[0].LastSyncAt)
+					assert.Equal(t, 1, status[0].LastSync.Synced)
+					assert.Equal(t, clock.now.Add(10*time.Minute), status[0].NextSyncAt)
+
+					clock.Advance(5 * time.Minute)
+					svc.tickAndWait(context.TODO())
+					assert.Len(t, fetchSvc.fetched, 2)
+					assert.Len(t, syncSvc.synced, 2)
+
+					clock.Advance(5 * time.Minute)
+					svc.tickAndWait(context.TODO())
+					assert.Len(t, fetchSvc.fetched, 2)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-1", "acc-2"}, syncSvc.synced)
+
+					clock.Advance(50 * time.Minute)
+					svc.tickAndWait(context.TODO())
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-1", "acc-2"}, fetchSvc.fetched)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "add jitter to scheduled runs",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchSvc := &mockFetchService{}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants, WithJitter(2*time.Minute))
+
+					startedAt := clock.now
+					svc.tickAndWait(context.TODO())
+					assert.Empty(t, fetchSvc.fetched)
+					status := svc.Status()
+					assert.Equal(t, startedAt.Add(time.Minute), status[0].NextFetchAt)
+
+					clock.Advance(time.Minute)
+					svc.tickAndWait(context.TODO())
+					assert.Len(t, fetchSvc.fetched, 2)
+					status = svc.Status()
+					assert.Equal(t, clock.now.Add(time.Hour+time.Minute), status[0].NextFetchAt)
+					assert.Equal(t, clock.now.Add(11*time.Minute), status[0].NextSyncAt)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "postpone fetch due to bank rate limit",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchSvc := &mockFetchService{}
+					syncSvc := &mockSyncService{}
+					sameBank := []dal.FetcherMerchantDTO{
+						{UserID: userID, AccountID: "acc-1", Bank: "bank-1"},
+						{UserID: userID, AccountID: "acc-2", Bank: "bank-1"},
+					}
+					rateLimiter := runner.NewRateLimiter(runner.WithBankInterval("bank-1", time.Minute))
+					svc := newService(clock, fetchSvc, syncSvc, sameBank, WithRateLimiter(rateLimiter))
+
+					// acc-1 was just fetched by another run, other accounts of the bank are not limited
+					_, err := rateLimiter.Reserve(context.TODO(), "bank-1", "acc-1", clock.now)
+					if !assert.NoError(t, err) {
+						return
+					}
+					svc.tickAndWait(context.TODO())
+					assert.Equal(t, []string{"acc-2"}, fetchSvc.fetched)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, syncSvc.synced)
+
+					clock.Advance(30 * time.Second)
+					svc.tickAndWait(context.TODO())
+					assert.Equal(t, []string{"acc-2"}, fetchSvc.fetched)
+
+					clock.Advance(30 * time.Second)
+					svc.tickAndWait(context.TODO())
+					assert.Equal(t, []string{"acc-2", "acc-1"}, fetchSvc.fetched)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "record fetch errors",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchErr := errors.New(faker.Sentence())
+					fetchSvc := &mockFetchService{failures: map[string]error{"acc-1": fetchErr}}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants)
+
+					svc.tickAndWait(context.TODO())
+					status := svc.Status()
+					assert.Equal(t, fetchErr.Error(), status[0].LastFetchError)
+					assert.Equal(t, clock.now.Add(time.Hour), status[0].NextFetchAt)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, syncSvc.synced)
+					assert.Empty(t, status[1].LastFetchError)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "suspend fetch after permanent error with a growing delay",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchErr := request.Permanent(errors.New(faker.Sentence()))
+					fetchSvc := &mockFetchService{failures: map[string]error{"acc-1": fetchErr}}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants)
+
+					svc.tickAndWait(context.TODO())
+					status := svc.Status()
+					assert.True(t, status[0].FetchSuspended)
+					assert.Equal(t, 1, status[0].FetchSuspensions)
+					assert.Equal(t, clock.now.Add(2*time.Hour), status[0].NextFetchAt)
+					assert.False(t, status[1].FetchSuspended)
+
+					clock.Advance(time.Hour)
+					svc.tickAndWait(context.TODO())
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-2"}, fetchSvc.fetched)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-1", "acc-2"}, syncSvc.synced, "suspended account should still be synced")
+
+					clock.Advance(time.Hour)
+					svc.tickAndWait(context.TODO())
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-2", "acc-1", "acc-2"}, fetchSvc.fetched, "suspended account should be retried")
+					status = svc.Status()
+					assert.Equal(t, 2, status[0].FetchSuspensions)
+					assert.Equal(t, clock.now.Add(4*time.Hour), status[0].NextFetchAt)
+					fetchSvc.fetched = nil
+
+					fixed := append([]dal.FetcherMerchantDTO{}, merchants...)
+					fixed[0].Settings = map[string]string{"XToken": "xt-" + faker.Word()}
+					svc.fetcherConfig = banks.NewMerchantsFetcherConfig(fixed)
+					delete(fetchSvc.failures, "acc-1")
+					svc.tickAndWait(context.TODO())
+					assert.Equal(t, []string{"acc-1"}, fetchSvc.fetched, "settings change should resume fetch")
+					assert.False(t, svc.Status()[0].FetchSuspended)
+					assert.Equal(t, 0, svc.Status()[0].FetchSuspensions)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "unschedule removed accounts",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchSvc := &mockFetchService{}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants)
+					svc.tickAndWait(context.TODO())
+
+					svc.fetcherConfig = banks.NewMerchantsFetcherConfig([]dal.FetcherMerchantDTO{merchants[1]})
+					svc.tickAndWait(context.TODO())
+					status := svc.Status()
+					if !assert.Len(t, status, 1) {
+						return
+					}
+					assert.Equal(t, "acc-2", status[0].AccountID)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "process accounts concurrently",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					blockingFetch := &blockingFetchService{started: make(chan string, 3), proceed: make(chan struct{})}
+					syncSvc := &mockSyncService{}
+					threeAccounts := append([]dal.FetcherMerchantDTO{
+						{UserID: userID, AccountID: "acc-3", Bank: "bank-1"},
+					}, merchants...)
+					svc := newService(clock, nil, syncSvc, threeAccounts, WithConcurrency(3, 1))
+					svc.fetchSvc = blockingFetch
+
+					done := make(chan struct{})
+					go func() {
+						svc.tickAndWait(context.TODO())
+						close(done)
+					}()
+					started := []string{<-blockingFetch.started, <-blockingFetch.started}
+					assert.Contains(t, started, "acc-2")
+					select {
+					case accountID := <-blockingFetch.started:
+						assert.Fail(t, "Bank limit exceeded", "Unexpected fetch of %v", accountID)
+					case <-time.After(10 * time.Millisecond):
+					}
+					close(blockingFetch.proceed)
+					<-done
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-3"}, syncSvc.synced)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "not wait for slow accounts",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					blockingFetch := &blockingFetchService{started: make(chan string, 3), proceed: make(chan struct{})}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, nil, syncSvc, merchants, WithConcurrency(2, 0))
+					svc.fetchSvc = blockingFetch
+
+					svc.tick(context.TODO())
+					started := []string{<-blockingFetch.started, <-blockingFetch.started}
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, started)
+
+					// Accounts in flight are due again but not started twice
+					clock.Advance(2 * time.Hour)
+					svc.tick(context.TODO())
+					select {
+					case accountID := <-blockingFetch.started:
+						assert.Fail(t, "Account started twice", "Unexpected fetch of %v", accountID)
+					case <-time.After(10 * time.Millisecond):
+					}
+
+					close(blockingFetch.proceed)
+					svc.running.Wait()
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, blockingFetch.fetched)
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2"}, syncSvc.synced)
+
+					// Processed accounts are dispatched again
+					clock.Advance(2 * time.Hour)
+					svc.tickAndWait(context.TODO())
+					assert.ElementsMatch(t, []string{"acc-1", "acc-2", "acc-1", "acc-2"}, syncSvc.synced)
+				},
+			}
+		},
+		func() testCase {
+			return testCase{
+				name: "stop when context is done",
+				run: func(t *testing.T) {
+					clock := &fakeClock{now: time.Now()}
+					fetchSvc := &mockFetchService{}
+					syncSvc := &mockSyncService{}
+					svc := newService(clock, fetchSvc, syncSvc, merchants, WithPollInterval(time.Millisecond))
+					ctx, cancel := context.WithCancel(context.TODO())
+					cancel()
+					assert.NoError(t, svc.Run(ctx))
+					assert.Empty(t, fetchSvc.fetched)
+					assert.Len(t, svc.Status(), 2)
+				},
+			}
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt()
+		t.Run(tt.name, tt.run)
+	}
+}
+
+func Test_service_suspension(t *testing.T) {
+	svc := NewService(WithIntervals(time.Hour, 10*time.Minute)).(*service)
+	assert.Equal(t, 2*time.Hour, svc.suspension(1))
+	assert.Equal(t, 8*time.Hour, svc.suspension(3))
+	assert.Equal(t, maxFetchSuspension, svc.suspension(100))
+}
+
+func Test_hashSettings(t *testing.T) {
+	settings := map[string]string{"XToken": "token-" + faker.Word(), "BankAccount": faker.Word()}
+	hash := hashSettings(settings)
+	assert.NotContains(t, hash, settings["XToken"])
+	assert.Equal(t, hash, hashSettings(map[string]string{"BankAccount": settings["BankAccount"], "XToken": settings["XToken"]}))
+	assert.NotEqual(t, hash, hashSettings(map[string]string{"XToken": settings["XToken"]}))
+	assert.NotEqual(t, hashSettings(map[string]string{"a": "b\x00c"}), hashSettings(map[string]string{"a\x00b": "c"}))
+}
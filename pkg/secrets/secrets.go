@@ -0,0 +1,281 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedPrefix marks encrypted values. Encrypted value has a following format:
+// enc:v1:<master key id>:<encrypted data key>:<encrypted data>
+const encryptedPrefix = "enc:v1:"
+
+const masterKeySize = 32
+
+// MasterKey is a key used to encrypt data keys
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// String returns the key in a format accepted by ParseMasterKeys
+func (k MasterKey) String() string {
+	return k.ID + ":" + base64.StdEncoding.EncodeToString(k.Key)
+}
+
+// GenerateMasterKey creates a new random master key
+func GenerateMasterKey(id string) (MasterKey, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return MasterKey{}, errors.Wrap(err, "Failed to generate master key")
+	}
+	return MasterKey{ID: id, Key: key}, nil
+}
+
+// ParseMasterKeys parses comma or new line separated list of keys.
+// Each key has a format <id>:<base64 encoded 32 bytes key>.
+// Empty lines and lines starting with # are ignored
+func ParseMasterKeys(spec string) ([]MasterKey, error) {
+	keys := []MasterKey{}
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Master key should have <id>:<key> format")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode master key %v", parts[0])
+		}
+		if len(key) != masterKeySize {
+			return nil, fmt.Errorf("Master key %v should be %v bytes long, got: %v", parts[0], masterKeySize, len(key))
+		}
+		keys = append(keys, MasterKey{ID: parts[0], Key: key})
+	}
+	return keys, nil
+}
+
+// LoadMasterKeys will parse keys from spec and then from the key file (if provided).
+// First key is a primary key
+func LoadMasterKeys(spec string, keyFile string) ([]MasterKey, error) {
+	keys, err := ParseMasterKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile == "" {
+		return keys, nil
+	}
+	buffer, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read key file")
+	}
+	fileKeys, err := ParseMasterKeys(string(buffer))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse key file %v", keyFile)
+	}
+	return append(keys, fileKeys...), nil
+}
+
+// IsEncrypted returns true if the value has been encrypted with Cipher
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Cipher encrypts secret values using envelope encryption. Each value is
+// encrypted with it's own data key that is encrypted with a primary master key
+type Cipher interface {
+	// Encrypt returns the value as is if there are no master keys
+	Encrypt(plaintext string) (string, error)
+
+	// Decrypt returns not encrypted values as is
+	Decrypt(value string) (string, error)
+
+	// NeedsRotation returns true if value is not encrypted with a primary master key
+	NeedsRotation(value string) bool
+
+	// Rotate will encrypt the value with a primary master key. Only data key
+	// is reencrypted for values that are already encrypted
+	Rotate(value string) (string, error)
+}
+
+type keyring struct {
+	primary *MasterKey
+	keys    map[string]MasterKey
+}
+
+type envelope struct {
+	keyID   string
+	dataKey []byte
+	data    []byte
+}
+
+func (e envelope) String() string {
+	return encryptedPrefix + e.keyID +
+		":" + base64.RawStdEncoding.EncodeToString(e.dataKey) +
+		":" + base64.RawStdEncoding.EncodeToString(e.data)
+}
+
+func parseEnvelope(value string) (*envelope, error) {
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("Unexpected encrypted value format")
+	}
+	dataKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode data key")
+	}
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode data")
+	}
+	return &envelope{keyID: parts[0], dataKey: dataKey, data: data}, nil
+}
+
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func (k *keyring) Encrypt(plaintext string) (string, error) {
+	if k.primary == nil {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, masterKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", errors.Wrap(err, "Failed to generate data key")
+	}
+	data, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encrypt data")
+	}
+	encryptedDataKey, err := seal(k.primary.Key, dataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encrypt data key")
+	}
+	return envelope{keyID: k.primary.ID, dataKey: encryptedDataKey, data: data}.String(), nil
+}
+
+func (k *keyring) openDataKey(env *envelope) ([]byte, error) {
+	masterKey, ok := k.keys[env.keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown master key: %v", env.keyID)
+	}
+	dataKey, err := open(masterKey.Key, env.dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decrypt data key")
+	}
+	return dataKey, nil
+}
+
+func (k *keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	env, err := parseEnvelope(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := k.openDataKey(env)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, env.data)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decrypt data")
+	}
+	return string(plaintext), nil
+}
+
+func (k *keyring) NeedsRotation(value string) bool {
+	if k.primary == nil {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	env, err := parseEnvelope(value)
+	return err != nil || env.keyID != k.primary.ID
+}
+
+func (k *keyring) Rotate(value string) (string, error) {
+	if !k.NeedsRotation(value) {
+		return value, nil
+	}
+	if !IsEncrypted(value) {
+		return k.Encrypt(value)
+	}
+	env, err := parseEnvelope(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := k.openDataKey(env)
+	if err != nil {
+		return "", err
+	}
+	encryptedDataKey, err := seal(k.primary.Key, dataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encrypt data key")
+	}
+	env.keyID = k.primary.ID
+	env.dataKey = encryptedDataKey
+	return env.String(), nil
+}
+
+// NewCipher returns a cipher that uses given master keys. First key is a primary key
+// and used to encrypt values, other keys are used to decrypt values encrypted before key rotation.
+// Values are not encrypted if there are no keys
+func NewCipher(keys ...MasterKey) (Cipher, error) {
+	k := &keyring{keys: make(map[string]MasterKey, len(keys))}
+	for i, key := range keys {
+		if strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("Master key id should not contain ':', got: %v", key.ID)
+		}
+		if len(key.Key) != masterKeySize {
+			return nil, fmt.Errorf("Master key %v should be %v bytes long, got: %v", key.ID, masterKeySize, len(key.Key))
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("Duplicate master key: %v", key.ID)
+		}
+		k.keys[key.ID] = key
+		if i == 0 {
+			k.primary = &keys[0]
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,186 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bxcodec/faker/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func randKey(t *testing.T) MasterKey {
+	key, err := GenerateMasterKey("key-" + faker.Word())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return key
+}
+
+func newCipher(t *testing.T, keys ...MasterKey) Cipher {
+	cipher, err := NewCipher(keys...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return cipher
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	key1 := randKey(t)
+	key2 := randKey(t)
+	type testCase struct {
+		spec    string
+		want    []MasterKey
+		wantErr string
+	}
+	tests := map[string]testCase{
+		"comma separated": {
+			spec: key1.String() + "," + key2.String(),
+			want: []MasterKey{key1, key2},
+		},
+		"new line separated with comments": {
+			spec: "# primary\n" + key1.String() + "\n\n" + key2.String() + "\n",
+			want: []MasterKey{key1, key2},
+		},
+		"empty": {
+			spec: "",
+			want: []MasterKey{},
+		},
+		"invalid format": {
+			spec:    "no-key-id",
+			wantErr: "Master key should have <id>:<key> format",
+		},
+		"invalid key length": {
+			spec:    "k1:YWJj",
+			wantErr: "Master key k1 should be 32 bytes long, got: 3",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseMasterKeys(tt.spec)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCipher(t *testing.T) {
+	type tcFn func(t *testing.T)
+	tests := []func() (string, tcFn){
+		func() (string, tcFn) {
+			return "encrypt and decrypt", func(t *testing.T) {
+				key := randKey(t)
+				cipher := newCipher(t, key)
+				plaintext := faker.Sentence()
+				encrypted, err := cipher.Encrypt(plaintext)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, IsEncrypted(encrypted))
+				assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+key.ID+":"))
+				assert.NotContains(t, encrypted, plaintext)
+				assert.False(t, cipher.NeedsRotation(encrypted))
+
+				decrypted, err := cipher.Decrypt(encrypted)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, plaintext, decrypted)
+			}
+		},
+		func() (string, tcFn) {
+			return "pass plaintext if no keys", func(t *testing.T) {
+				cipher := newCipher(t)
+				plaintext := faker.Sentence()
+				encrypted, err := cipher.Encrypt(plaintext)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, plaintext, encrypted)
+				assert.False(t, cipher.NeedsRotation(plaintext))
+			}
+		},
+		func() (string, tcFn) {
+			return "decrypt plaintext as is", func(t *testing.T) {
+				cipher := newCipher(t, randKey(t))
+				plaintext := faker.Sentence()
+				decrypted, err := cipher.Decrypt(plaintext)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, plaintext, decrypted)
+				assert.True(t, cipher.NeedsRotation(plaintext))
+			}
+		},
+		func() (string, tcFn) {
+			return "rotate to a new primary key", func(t *testing.T) {
+				oldKey := randKey(t)
+				newKey := randKey(t)
+				plaintext := faker.Sentence()
+				encrypted, err := newCipher(t, oldKey).Encrypt(plaintext)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				cipher := newCipher(t, newKey, oldKey)
+				assert.True(t, cipher.NeedsRotation(encrypted))
+				rotated, err := cipher.Rotate(encrypted)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, strings.HasPrefix(rotated, encryptedPrefix+newKey.ID+":"))
+				assert.False(t, cipher.NeedsRotation(rotated))
+
+				decrypted, err := newCipher(t, newKey).Decrypt(rotated)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, plaintext, decrypted)
+
+				rotatedPlaintext, err := cipher.Rotate(plaintext)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, IsEncrypted(rotatedPlaintext))
+			}
+		},
+		func() (string, tcFn) {
+			return "fail to decrypt with unknown key", func(t *testing.T) {
+				key := randKey(t)
+				encrypted, err := newCipher(t, key).Encrypt(faker.Sentence())
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = newCipher(t, randKey(t)).Decrypt(encrypted)
+				assert.EqualError(t, err, "Unknown master key: "+key.ID)
+			}
+		},
+		func() (string, tcFn) {
+			return "fail to decrypt with wrong key", func(t *testing.T) {
+				key := randKey(t)
+				encrypted, err := newCipher(t, key).Encrypt(faker.Sentence())
+				if !assert.NoError(t, err) {
+					return
+				}
+				otherKey := randKey(t)
+				otherKey.ID = key.ID
+				_, err = newCipher(t, otherKey).Decrypt(encrypted)
+				assert.Error(t, err)
+			}
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt())
+	}
+}
+
+func TestNewCipher_DuplicateKeys(t *testing.T) {
+	key := randKey(t)
+	_, err := NewCipher(key, key)
+	assert.EqualError(t, err, "Duplicate master key: "+key.ID)
+}